@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/internal"
 )
 
 // ErrInvalidCredentials is returned by Backend.Login when a username or a
@@ -18,3 +19,128 @@ type Backend interface {
 	// it returns ErrInvalidCredentials.
 	Login(connInfo *imap.ConnInfo, username, password string) (User, error)
 }
+
+// Authenticator checks user credentials independently of the backend storing
+// the users' data.
+type Authenticator interface {
+	// Authenticate checks the password of username. authzid is the identity
+	// the client wants to act as, empty to act as username. Acting as another
+	// user should only be allowed for administrators. It returns the identity
+	// of the user that has been authenticated. If the credentials are
+	// incorrect, it returns ErrInvalidCredentials.
+	Authenticate(connInfo *imap.ConnInfo, authzid, username, password string) (identity string, err error)
+}
+
+// UserBackend is a Backend that can be used with an Authenticator.
+type UserBackend interface {
+	Backend
+
+	// LookupUser returns the user with the provided identity, which has
+	// already been authenticated.
+	LookupUser(connInfo *imap.ConnInfo, identity string) (User, error)
+}
+
+// OAuthBackend is a Backend that supports OAuth 2.0 bearer tokens, used by the
+// OAUTHBEARER (RFC 7628) and XOAUTH2 SASL mechanisms.
+type OAuthBackend interface {
+	Backend
+
+	// LoginOAuth authenticates a user with a bearer token. username is empty if
+	// the client didn't provide one. If the token is rejected, the returned
+	// error can be a *sasl.OAuthBearerError, which is sent to the client.
+	LoginOAuth(connInfo *imap.ConnInfo, username, token string) (User, error)
+}
+
+// ExternalBackend is a Backend that supports the EXTERNAL SASL mechanism with
+// TLS client certificates.
+type ExternalBackend interface {
+	Backend
+
+	// LoginExternal authenticates a user with the verified TLS client
+	// certificate in connInfo.TLS.PeerCertificates[0], for instance by mapping
+	// its subject or its subject alternative names to a user. identity is the
+	// authorization identity requested by the client, empty if the client
+	// wants to act as the identity associated with the certificate.
+	LoginExternal(connInfo *imap.ConnInfo, identity string) (User, error)
+}
+
+// SCRAMCredentials are salted credentials for the SCRAM-SHA-256 SASL
+// mechanism, defined in RFC 5802 and RFC 7677. They allow a server to
+// authenticate a user without knowing the password.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives SCRAM-SHA-256 credentials from a password. The
+// salt should be random and at least 16 bytes long, and iterations should be
+// at least 4096.
+func NewSCRAMCredentials(password string, salt []byte, iterations int) *SCRAMCredentials {
+	saltedPassword := internal.SCRAMSaltedPassword(password, salt, iterations)
+	_, storedKey, serverKey := internal.SCRAMKeys(saltedPassword)
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}
+}
+
+// SCRAMBackend is a Backend that supports the SCRAM-SHA-256 and
+// SCRAM-SHA-256-PLUS SASL mechanisms.
+type SCRAMBackend interface {
+	Backend
+
+	// SCRAMCredentials returns the credentials of a user. If the user doesn't
+	// exist, it returns ErrInvalidCredentials.
+	SCRAMCredentials(connInfo *imap.ConnInfo, username string) (*SCRAMCredentials, error)
+	// LoginSCRAM returns a user whose SCRAM credentials have been verified.
+	LoginSCRAM(connInfo *imap.ConnInfo, username string) (User, error)
+}
+
+// Extension is an IMAP extension that requires support from the backend.
+type Extension string
+
+// Extensions that can be supported by a backend.
+const (
+	// ExtObjectID is the OBJECTID extension defined in RFC 8474. Backends
+	// supporting it must populate MailboxStatus.MailboxId when
+	// imap.StatusMailboxId is requested, Message.EmailId and Message.ThreadId
+	// when imap.FetchEmailId and imap.FetchThreadId are requested, and must
+	// handle SearchCriteria.EmailId and SearchCriteria.ThreadId.
+	ExtObjectID Extension = "OBJECTID"
+	// ExtStatusSize is the STATUS=SIZE extension defined in RFC 8438.
+	// Backends supporting it must populate MailboxStatus.Size when
+	// imap.StatusSize is requested.
+	ExtStatusSize Extension = "STATUS=SIZE"
+	// ExtSaveDate is the SAVEDATE extension defined in RFC 8514. Backends
+	// supporting it must populate Message.SaveDate when imap.FetchSaveDate is
+	// requested and must handle SearchCriteria.SavedSince and
+	// SearchCriteria.SavedBefore.
+	ExtSaveDate Extension = "SAVEDATE"
+	// ExtPreview is the PREVIEW extension defined in RFC 8970. Backends
+	// supporting it must populate Message.Preview when imap.FetchPreview is
+	// requested. backendutil.FetchPreview can be used to generate it.
+	ExtPreview Extension = "PREVIEW"
+	// ExtWithin is the WITHIN extension defined in RFC 5032. Backends
+	// supporting it must handle SearchCriteria.Younger and
+	// SearchCriteria.Older. backendutil.Match does so.
+	ExtWithin Extension = "WITHIN"
+	// ExtSort is the SORT extension defined in RFC 5256. Mailboxes of backends
+	// supporting it must implement SortMailbox. backendutil.Sort can be used
+	// to sort messages.
+	ExtSort Extension = "SORT"
+)
+
+// ExtensionBackend is a Backend that supports IMAP extensions requiring
+// cooperation from the storage layer. The server only advertises such
+// extensions if they are listed by the backend.
+type ExtensionBackend interface {
+	Backend
+
+	// SupportedExtensions returns the list of extensions supported by this
+	// backend.
+	SupportedExtensions() []Extension
+}
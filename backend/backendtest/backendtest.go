@@ -0,0 +1,354 @@
+// Package backendtest provides a conformance test suite for backends.
+//
+// The suite checks the behavior required by RFC 3501 and by the documentation
+// of the backend package. It can be run from a backend's tests:
+//
+//	func TestConformance(t *testing.T) {
+//		backendtest.Run(t, func(t *testing.T) *backendtest.Instance {
+//			return &backendtest.Instance{
+//				Backend:  memory.New(),
+//				Username: "username",
+//				Password: "password",
+//			}
+//		})
+//	}
+package backendtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Instance is a backend created for a single test.
+type Instance struct {
+	// The backend to test. If it implements backend.BackendUpdater, the suite
+	// consumes its updates.
+	Backend backend.Backend
+	// The credentials of a user of the backend. The user's INBOX may contain
+	// messages, other mailboxes are created by the tests. If Password is
+	// empty, the backend must implement backend.UserBackend and the user is
+	// looked up instead of logged in.
+	Username, Password string
+	// Close is called when the test is done, if not nil.
+	Close func()
+}
+
+// Factory creates a new backend for a single test.
+type Factory func(t *testing.T) *Instance
+
+// Run runs the conformance test suite against backends created by newBackend.
+// Each test uses a new backend.
+func Run(t *testing.T, newBackend Factory) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s *session)
+	}{
+		{"ListMailboxes", testListMailboxes},
+		{"GetMailbox", testGetMailbox},
+		{"CreateMailbox", testCreateMailbox},
+		{"DeleteMailbox", testDeleteMailbox},
+		{"DeleteMailbox_uids", testDeleteMailboxUids},
+		{"RenameMailbox", testRenameMailbox},
+		{"RenameMailbox_inbox", testRenameInbox},
+		{"Mailbox_Info", testMailboxInfo},
+		{"Mailbox_Status", testMailboxStatus},
+		{"Mailbox_SetSubscribed", testSetSubscribed},
+		{"Mailbox_CreateMessage", testCreateMessage},
+		{"Mailbox_ListMessages", testListMessages},
+		{"Mailbox_ListMessages_seen", testListMessagesSeen},
+		{"Mailbox_SearchMessages", testSearchMessages},
+		{"Mailbox_UpdateMessagesFlags", testUpdateMessagesFlags},
+		{"Mailbox_CopyMessages", testCopyMessages},
+		{"Mailbox_Expunge", testExpunge},
+		{"Updates", testUpdates},
+		{"SortMailbox", testSortMailbox},
+		{"UidOnlyMailbox", testUidOnlyMailbox},
+		{"SessionMailbox", testSessionMailbox},
+		{"ProgressMailbox", testProgressMailbox},
+		{"ContextMailbox", testContextMailbox},
+		{"Extensions", testExtensions},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := newSession(t, newBackend(t))
+			defer s.close()
+			test.f(t, s)
+		})
+	}
+}
+
+// session is a logged in user, with the backend it belongs to.
+type session struct {
+	t        *testing.T
+	instance *Instance
+	user     backend.User
+
+	// Updates sent by the backend, nil if it doesn't implement
+	// backend.BackendUpdater
+	updates chan backend.Update
+	stop    chan struct{}
+}
+
+func newSession(t *testing.T, instance *Instance) *session {
+	s := &session{t: t, instance: instance, stop: make(chan struct{})}
+
+	if be, ok := instance.Backend.(backend.BackendUpdater); ok {
+		// Acknowledge updates, like a server would. Updates are dropped if
+		// the test doesn't read them.
+		s.updates = make(chan backend.Update, 100)
+		go func() {
+			for {
+				select {
+				case update := <-be.Updates():
+					select {
+					case s.updates <- update:
+					default:
+					}
+					close(update.Done())
+				case <-s.stop:
+					return
+				}
+			}
+		}()
+	}
+
+	s.user = s.login()
+	return s
+}
+
+func (s *session) login() backend.User {
+	if s.instance.Password == "" {
+		be, ok := s.instance.Backend.(backend.UserBackend)
+		if !ok {
+			s.t.Fatal("No password provided and backend doesn't implement UserBackend")
+		}
+		u, err := be.LookupUser(nil, s.instance.Username)
+		if err != nil {
+			s.t.Fatal("LookupUser() =", err)
+		}
+		return u
+	}
+
+	u, err := s.instance.Backend.Login(nil, s.instance.Username, s.instance.Password)
+	if err != nil {
+		s.t.Fatal("Login() =", err)
+	}
+	return u
+}
+
+func (s *session) close() {
+	if err := s.user.Logout(); err != nil {
+		s.t.Error("Logout() =", err)
+	}
+	close(s.stop)
+	if s.instance.Close != nil {
+		s.instance.Close()
+	}
+}
+
+// drainUpdates discards the updates received so far.
+func (s *session) drainUpdates() {
+	for {
+		select {
+		case <-s.updates:
+		default:
+			return
+		}
+	}
+}
+
+func (s *session) mailbox(name string) backend.Mailbox {
+	mbox, err := s.user.GetMailbox(name)
+	if err != nil {
+		s.t.Fatalf("GetMailbox(%q) = %v", name, err)
+	}
+	return mbox
+}
+
+func (s *session) createMailbox(name string) backend.Mailbox {
+	if err := s.user.CreateMailbox(name); err != nil {
+		s.t.Fatalf("CreateMailbox(%q) = %v", name, err)
+	}
+	return s.mailbox(name)
+}
+
+// delimiter returns the hierarchy delimiter of the backend, or an empty
+// string if it doesn't support hierarchies.
+func (s *session) delimiter() string {
+	info, err := s.mailbox("INBOX").Info()
+	if err != nil {
+		s.t.Fatal("Info() =", err)
+	}
+	return info.Delimiter
+}
+
+// inferiorDelimiter returns the hierarchy delimiter of the backend, or an
+// empty string if mbox can't have inferior mailboxes: either the backend
+// doesn't support hierarchies, or mbox has the \Noinferiors attribute.
+func (s *session) inferiorDelimiter(mbox backend.Mailbox) string {
+	info, err := mbox.Info()
+	if err != nil {
+		s.t.Fatal("Info() =", err)
+	}
+	for _, attr := range info.Attributes {
+		if attr == imap.NoInferiorsAttr {
+			return ""
+		}
+	}
+	return info.Delimiter
+}
+
+func (s *session) mailboxNames(subscribed bool) map[string]bool {
+	mailboxes, err := s.user.ListMailboxes(subscribed)
+	if err != nil {
+		s.t.Fatal("ListMailboxes() =", err)
+	}
+	names := make(map[string]bool)
+	for _, mbox := range mailboxes {
+		names[mbox.Name()] = true
+	}
+	return names
+}
+
+func (s *session) status(mbox backend.Mailbox, items ...imap.StatusItem) *imap.MailboxStatus {
+	status, err := mbox.Status(items)
+	if err != nil {
+		s.t.Fatalf("Status() of %q = %v", mbox.Name(), err)
+	}
+	return status
+}
+
+func (s *session) numMessages(mbox backend.Mailbox) uint32 {
+	return s.status(mbox, imap.StatusMessages).Messages
+}
+
+// testMessage returns a message body. Messages with different n have
+// different subjects and bodies.
+func testMessage(n int) string {
+	subject := string(rune('A' + n))
+	return "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+		"To: Taki Tachibana <taki.tachibana@example.org>\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+		"Message-Id: <" + subject + "@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Body " + subject + "\r\n"
+}
+
+var testDate = time.Date(2016, 5, 11, 14, 32, 0, 0, time.UTC)
+
+// appendMessages creates n messages in mbox. Message i has flags[i], if any.
+func (s *session) appendMessages(mbox backend.Mailbox, n int, flags ...[]string) {
+	for i := 0; i < n; i++ {
+		var f []string
+		if i < len(flags) {
+			f = flags[i]
+		}
+		date := testDate.Add(time.Duration(i) * time.Minute)
+		if err := mbox.CreateMessage(f, date, bytes.NewBufferString(testMessage(i))); err != nil {
+			s.t.Fatal("CreateMessage() =", err)
+		}
+	}
+}
+
+func (s *session) listMessages(mbox backend.Mailbox, seqset string, items ...imap.FetchItem) []*imap.Message {
+	set, err := imap.ParseSeqSet(seqset)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return collectMessages(s.t, func(ch chan *imap.Message) error {
+		return mbox.ListMessages(false, set, items, ch)
+	})
+}
+
+func collectMessages(t *testing.T, list func(ch chan *imap.Message) error) []*imap.Message {
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- list(ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("ListMessages() =", err)
+	}
+	return msgs
+}
+
+// uids returns the UIDs of all messages in mbox.
+func (s *session) uids(mbox backend.Mailbox) []uint32 {
+	uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		s.t.Fatal("SearchMessages() =", err)
+	}
+	return uids
+}
+
+func (s *session) search(mbox backend.Mailbox, uid bool, criteria *imap.SearchCriteria) []uint32 {
+	ids, err := mbox.SearchMessages(uid, criteria)
+	if err != nil {
+		s.t.Fatal("SearchMessages() =", err)
+	}
+	return ids
+}
+
+// readBody returns the only body section of msg.
+func readBody(t *testing.T, msg *imap.Message) string {
+	for _, l := range msg.Body {
+		b, err := ioutil.ReadAll(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	t.Fatalf("Message %v has no body section", msg.SeqNum)
+	return ""
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutRecent removes \Recent, which depends on the session, from flags.
+func withoutRecent(flags []string) map[string]bool {
+	m := make(map[string]bool)
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			m[f] = true
+		}
+	}
+	return m
+}
+
+func flagSet(flags ...string) map[string]bool {
+	return withoutRecent(flags)
+}
+
+func hasExtension(be backend.Backend, ext backend.Extension) bool {
+	extBe, ok := be.(backend.ExtensionBackend)
+	if !ok {
+		return false
+	}
+	for _, e := range extBe.SupportedExtensions() {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
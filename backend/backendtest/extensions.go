@@ -0,0 +1,317 @@
+package backendtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// nextUpdate returns the next update sent by the backend.
+func (s *session) nextUpdate() backend.Update {
+	select {
+	case update := <-s.updates:
+		return update
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("Timed out waiting for an update")
+		return nil
+	}
+}
+
+// testUpdates checks that the backend notifies clients of changes, if it
+// implements backend.BackendUpdater.
+func testUpdates(t *testing.T, s *session) {
+	if s.updates == nil {
+		t.Skip("Backend doesn't implement BackendUpdater")
+	}
+
+	mbox := s.createMailbox("Archive")
+	s.drainUpdates()
+
+	checkTarget := func(update backend.Update) {
+		if update.Username() != s.instance.Username || update.Mailbox() != "Archive" {
+			t.Errorf("Update targets user %q and mailbox %q, want %q and Archive", update.Username(), update.Mailbox(), s.instance.Username)
+		}
+	}
+
+	s.appendMessages(mbox, 2)
+	for _, n := range []uint32{1, 2} {
+		update := s.nextUpdate()
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		if !ok {
+			t.Fatalf("Update after CreateMessage() = %T, want *backend.MailboxUpdate", update)
+		}
+		checkTarget(update)
+		if mboxUpdate.Messages != n {
+			t.Errorf("Mailbox update has %v messages, want %v", mboxUpdate.Messages, n)
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	update := s.nextUpdate()
+	msgUpdate, ok := update.(*backend.MessageUpdate)
+	if !ok {
+		t.Fatalf("Update after UpdateMessagesFlags() = %T, want *backend.MessageUpdate", update)
+	}
+	checkTarget(update)
+	if msgUpdate.SeqNum != 2 || !hasFlag(msgUpdate.Flags, imap.DeletedFlag) {
+		t.Errorf("Message update has sequence number %v and flags %v, want 2 and \\Deleted", msgUpdate.SeqNum, msgUpdate.Flags)
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	update = s.nextUpdate()
+	expungeUpdate, ok := update.(*backend.ExpungeUpdate)
+	if !ok {
+		t.Fatalf("Update after Expunge() = %T, want *backend.ExpungeUpdate", update)
+	}
+	checkTarget(update)
+	if expungeUpdate.SeqNum != 2 {
+		t.Errorf("Expunge update has sequence number %v, want 2", expungeUpdate.SeqNum)
+	}
+}
+
+func testSortMailbox(t *testing.T, s *session) {
+	mbox, ok := s.createMailbox("Archive").(backend.SortMailbox)
+	if !ok {
+		t.Skip("Mailbox doesn't implement SortMailbox")
+	}
+	if !hasExtension(s.instance.Backend, backend.ExtSort) {
+		t.Error("Mailbox implements SortMailbox, but backend doesn't list ExtSort")
+	}
+
+	s.appendMessages(mbox, 3)
+	uids := s.uids(mbox)
+
+	sortCriteria := []imap.SortCriterion{{Field: imap.SortSubject, Reverse: true}}
+	seqNums, err := mbox.SortMessages(false, sortCriteria, &imap.SearchCriteria{})
+	if err != nil {
+		t.Fatal("SortMessages() =", err)
+	}
+	if want := []uint32{3, 2, 1}; !equalUids(seqNums, want) {
+		t.Errorf("SortMessages(false) = %v, want %v", seqNums, want)
+	}
+
+	searchCriteria := &imap.SearchCriteria{Not: []*imap.SearchCriteria{{Header: map[string][]string{"Subject": {"B"}}}}}
+	sorted, err := mbox.SortMessages(true, sortCriteria, searchCriteria)
+	if err != nil {
+		t.Fatal("SortMessages() =", err)
+	}
+	if want := []uint32{uids[2], uids[0]}; !equalUids(sorted, want) {
+		t.Errorf("SortMessages(true) = %v, want %v", sorted, want)
+	}
+}
+
+func testUidOnlyMailbox(t *testing.T, s *session) {
+	mbox, ok := s.createMailbox("Archive").(backend.UidOnlyMailbox)
+	if !ok {
+		t.Skip("Mailbox doesn't implement UidOnlyMailbox")
+	}
+	s.createMailbox("Destination")
+
+	s.appendMessages(mbox, 3)
+	uids := s.uids(mbox)
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uids[0], uids[2])
+
+	msgs := collectMessages(t, func(ch chan *imap.Message) error {
+		return mbox.UidListMessages(uidset, []imap.FetchItem{imap.FetchFlags}, ch)
+	})
+	if len(msgs) != 2 || msgs[0].Uid != uids[0] || msgs[1].Uid != uids[2] {
+		t.Errorf("UidListMessages() returned %v, want UIDs %v and %v", msgs, uids[0], uids[2])
+	}
+
+	if err := mbox.UidUpdateMessagesFlags(uidset, imap.AddFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal("UidUpdateMessagesFlags() =", err)
+	}
+	flagged, err := mbox.UidSearchMessages(&imap.SearchCriteria{WithFlags: []string{imap.FlaggedFlag}})
+	if err != nil {
+		t.Fatal("UidSearchMessages() =", err)
+	}
+	if want := []uint32{uids[0], uids[2]}; !equalUids(flagged, want) {
+		t.Errorf("UidSearchMessages() = %v, want %v", flagged, want)
+	}
+
+	if err := mbox.UidCopyMessages(uidset, "Destination"); err != nil {
+		t.Fatal("UidCopyMessages() =", err)
+	}
+	if n := s.numMessages(s.mailbox("Destination")); n != 2 {
+		t.Errorf("Destination has %v messages after UidCopyMessages(), want 2", n)
+	}
+}
+
+// testSessionMailbox checks the per-session \Recent flag, if the mailbox
+// implements backend.SessionMailbox.
+func testSessionMailbox(t *testing.T, s *session) {
+	if _, ok := s.createMailbox("Archive").(backend.SessionMailbox); !ok {
+		t.Skip("Mailbox doesn't implement SessionMailbox")
+	}
+	s.appendMessages(s.mailbox("Archive"), 1)
+
+	selectMailbox := func(u backend.User, readOnly bool) *imap.MailboxStatus {
+		mbox, err := u.GetMailbox("Archive")
+		if err != nil {
+			t.Fatal("GetMailbox() =", err)
+		}
+		status, err := mbox.(backend.SessionMailbox).Select(readOnly, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+		if err != nil {
+			t.Fatal("Select() =", err)
+		}
+		if status.Name != "Archive" || status.Messages != 1 {
+			t.Errorf("Select() = %v, want mailbox Archive with 1 message", status)
+		}
+		return status
+	}
+
+	other := s.login()
+	defer other.Logout()
+
+	if status := selectMailbox(other, true); status.Recent != 1 {
+		t.Errorf("Select(true) has %v recent messages, want 1", status.Recent)
+	}
+	if status := selectMailbox(s.user, false); status.Recent != 1 {
+		t.Errorf("Select(false) has %v recent messages, want 1", status.Recent)
+	}
+
+	// The first session selecting the mailbox read-write claims \Recent
+	if status := selectMailbox(other, false); status.Recent != 0 {
+		t.Errorf("Select(false) from another session has %v recent messages, want 0", status.Recent)
+	}
+}
+
+func testProgressMailbox(t *testing.T, s *session) {
+	mbox, ok := s.createMailbox("Archive").(backend.ProgressMailbox)
+	if !ok {
+		t.Skip("Mailbox doesn't implement ProgressMailbox")
+	}
+	s.appendMessages(mbox, 3, []string{imap.DeletedFlag})
+
+	var last uint32
+	view := mbox.WithProgress(func(count, total uint32) {
+		if count < last {
+			t.Errorf("Progress went from %v to %v", last, count)
+		}
+		if total != 0 && count > total {
+			t.Errorf("Progress %v is more than total %v", count, total)
+		}
+		last = count
+	})
+	if _, ok := mbox.(backend.UidOnlyMailbox); ok {
+		if _, ok := view.(backend.UidOnlyMailbox); !ok {
+			t.Error("WithProgress() view doesn't implement UidOnlyMailbox")
+		}
+	}
+
+	if err := view.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	if n := s.numMessages(mbox); n != 2 {
+		t.Errorf("Mailbox has %v messages after Expunge(), want 2", n)
+	}
+}
+
+func testContextMailbox(t *testing.T, s *session) {
+	mbox, ok := s.createMailbox("Archive").(backend.ContextMailbox)
+	if !ok {
+		t.Skip("Mailbox doesn't implement ContextMailbox")
+	}
+	s.appendMessages(mbox, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	view := mbox.WithContext(ctx)
+	if _, ok := mbox.(backend.UidOnlyMailbox); ok {
+		if _, ok := view.(backend.UidOnlyMailbox); !ok {
+			t.Error("WithContext() view doesn't implement UidOnlyMailbox")
+		}
+	}
+	if ids := s.search(view, false, &imap.SearchCriteria{}); !equalUids(ids, []uint32{1, 2}) {
+		t.Errorf("SearchMessages() before cancellation = %v, want [1 2]", ids)
+	}
+
+	cancel()
+	if _, err := view.SearchMessages(false, &imap.SearchCriteria{}); err != context.Canceled {
+		t.Errorf("SearchMessages() after cancellation = %v, want %v", err, context.Canceled)
+	}
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 2)
+	if err := view.ListMessages(false, seqset, []imap.FetchItem{imap.FetchFlags}, ch); err != context.Canceled {
+		t.Errorf("ListMessages() after cancellation = %v, want %v", err, context.Canceled)
+	}
+
+	// The mailbox itself isn't bound to the context
+	if n := s.numMessages(mbox); n != 2 {
+		t.Errorf("Mailbox has %v messages, want 2", n)
+	}
+}
+
+// testExtensions checks the data required by the extensions listed by the
+// backend.
+func testExtensions(t *testing.T, s *session) {
+	extBe, ok := s.instance.Backend.(backend.ExtensionBackend)
+	if !ok {
+		t.Skip("Backend doesn't implement ExtensionBackend")
+	}
+
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 2)
+	s.createMailbox("Destination")
+
+	for _, ext := range extBe.SupportedExtensions() {
+		switch ext {
+		case backend.ExtObjectID:
+			status := s.status(mbox, imap.StatusMailboxId)
+			if status.MailboxId == "" {
+				t.Error("OBJECTID: Status() has no mailbox ID")
+			}
+			if other := s.status(s.mailbox("Destination"), imap.StatusMailboxId); other.MailboxId == status.MailboxId {
+				t.Errorf("OBJECTID: Mailboxes have the same ID %q", status.MailboxId)
+			}
+
+			msgs := s.listMessages(mbox, "1:*", imap.FetchEmailId, imap.FetchThreadId)
+			if len(msgs) != 2 || msgs[0].EmailId == "" || msgs[0].EmailId == msgs[1].EmailId {
+				t.Fatalf("OBJECTID: Messages have no unique email IDs: %v", msgs)
+			}
+			found := s.search(mbox, false, &imap.SearchCriteria{EmailId: msgs[1].EmailId})
+			if !equalUids(found, []uint32{2}) {
+				t.Errorf("OBJECTID: SearchMessages() of email ID %q = %v, want [2]", msgs[1].EmailId, found)
+			}
+		case backend.ExtStatusSize:
+			status := s.status(mbox, imap.StatusSize)
+			if want := uint64(len(testMessage(0)) + len(testMessage(1))); status.Size != want {
+				t.Errorf("STATUS=SIZE: Status().Size = %v, want %v", status.Size, want)
+			}
+		case backend.ExtSaveDate:
+			msgs := s.listMessages(mbox, "1:*", imap.FetchSaveDate)
+			for _, msg := range msgs {
+				if msg.SaveDate.IsZero() {
+					t.Errorf("SAVEDATE: Message %v has no save date", msg.SeqNum)
+				}
+			}
+		case backend.ExtPreview:
+			msgs := s.listMessages(mbox, "1", imap.FetchPreview)
+			if len(msgs) != 1 || msgs[0].Preview != "Body A" {
+				t.Errorf("PREVIEW: Messages = %v, want preview \"Body A\"", msgs)
+			}
+		case backend.ExtWithin:
+			// Test messages are older than a day
+			older := s.search(mbox, false, &imap.SearchCriteria{Older: 24 * time.Hour})
+			if !equalUids(older, []uint32{1, 2}) {
+				t.Errorf("WITHIN: SearchMessages() with Older = %v, want [1 2]", older)
+			}
+			younger := s.search(mbox, false, &imap.SearchCriteria{Younger: 24 * time.Hour})
+			if len(younger) != 0 {
+				t.Errorf("WITHIN: SearchMessages() with Younger = %v, want none", younger)
+			}
+		case backend.ExtSort:
+			if _, ok := mbox.(backend.SortMailbox); !ok {
+				t.Error("SORT: Mailbox doesn't implement SortMailbox")
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package backendtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func testMailboxInfo(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	info, err := mbox.Info()
+	if err != nil {
+		t.Fatal("Info() =", err)
+	}
+	if info.Name != "Archive" {
+		t.Errorf("Info().Name = %q, want Archive", info.Name)
+	}
+	if len(info.Delimiter) > 1 {
+		t.Errorf("Info().Delimiter = %q, want a single character", info.Delimiter)
+	}
+
+	if err := mbox.Check(); err != nil {
+		t.Error("Check() =", err)
+	}
+}
+
+func testMailboxStatus(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+	before := s.status(mbox, items...)
+	if before.Name != "Archive" {
+		t.Errorf("Status().Name = %q, want Archive", before.Name)
+	}
+	if before.Messages != 0 || before.Unseen != 0 {
+		t.Errorf("Status() of an empty mailbox = %v messages, %v unseen", before.Messages, before.Unseen)
+	}
+	if before.UidValidity == 0 || before.UidNext == 0 {
+		t.Errorf("Status() has UIDVALIDITY %v and UIDNEXT %v, want non-zero values", before.UidValidity, before.UidNext)
+	}
+
+	s.appendMessages(mbox, 3, []string{imap.SeenFlag})
+	after := s.status(mbox, items...)
+	if after.Messages != 3 {
+		t.Errorf("Status().Messages = %v, want 3", after.Messages)
+	}
+	if after.Unseen != 2 {
+		t.Errorf("Status().Unseen = %v, want 2", after.Unseen)
+	}
+	if after.UnseenSeqNum != 2 {
+		t.Errorf("Status().UnseenSeqNum = %v, want 2", after.UnseenSeqNum)
+	}
+	if !hasFlag(after.Flags, imap.SeenFlag) {
+		t.Errorf("Status().Flags = %v, want \\Seen", after.Flags)
+	}
+	if after.UidValidity != before.UidValidity {
+		t.Errorf("UIDVALIDITY changed from %v to %v", before.UidValidity, after.UidValidity)
+	}
+	uids := s.uids(mbox)
+	if after.UidNext <= uids[len(uids)-1] {
+		t.Errorf("Status().UidNext = %v, want more than %v", after.UidNext, uids[len(uids)-1])
+	}
+}
+
+func testSetSubscribed(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal("SetSubscribed(true) =", err)
+	}
+	if names := s.mailboxNames(true); !names["Archive"] {
+		t.Errorf("ListMailboxes(true) = %v, want Archive", names)
+	}
+
+	if err := mbox.SetSubscribed(false); err != nil {
+		t.Fatal("SetSubscribed(false) =", err)
+	}
+	if names := s.mailboxNames(true); names["Archive"] {
+		t.Errorf("ListMailboxes(true) = %v, want no Archive", names)
+	}
+	if names := s.mailboxNames(false); !names["Archive"] {
+		t.Errorf("ListMailboxes(false) = %v, want Archive", names)
+	}
+}
+
+func testCreateMessage(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 2, []string{imap.FlaggedFlag, "$Important"})
+
+	uids := s.uids(mbox)
+	if len(uids) != 2 || uids[0] >= uids[1] {
+		t.Fatalf("UIDs = %v, want 2 strictly ascending UIDs", uids)
+	}
+
+	msgs := s.listMessages(mbox, "1:*", imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, "BODY.PEEK[]")
+	if len(msgs) != 2 {
+		t.Fatalf("ListMessages() returned %v messages, want 2", len(msgs))
+	}
+	for i, msg := range msgs {
+		body := testMessage(i)
+		if got := readBody(t, msg); got != body {
+			t.Errorf("Message %v has body %q, want %q", i+1, got, body)
+		}
+		if msg.Size != uint32(len(body)) {
+			t.Errorf("Message %v has size %v, want %v", i+1, msg.Size, len(body))
+		}
+		if msg.Uid != uids[i] {
+			t.Errorf("Message %v has UID %v, want %v", i+1, msg.Uid, uids[i])
+		}
+		if date := testDate.Add(time.Duration(i) * time.Minute); !msg.InternalDate.Equal(date) {
+			t.Errorf("Message %v has internal date %v, want %v", i+1, msg.InternalDate, date)
+		}
+	}
+
+	if flags := withoutRecent(msgs[0].Flags); !reflect.DeepEqual(flags, flagSet(imap.FlaggedFlag, "$Important")) {
+		t.Errorf("First message has flags %v, want \\Flagged and $Important", msgs[0].Flags)
+	}
+	if flags := withoutRecent(msgs[1].Flags); len(flags) != 0 {
+		t.Errorf("Second message has flags %v, want none", msgs[1].Flags)
+	}
+}
+
+func testListMessages(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 3)
+	uids := s.uids(mbox)
+
+	// Sequence numbers
+	msgs := s.listMessages(mbox, "2:3", imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure)
+	if len(msgs) != 2 {
+		t.Fatalf("ListMessages(false) returned %v messages, want 2", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.SeqNum != uint32(i+2) || msg.Uid != uids[i+1] {
+			t.Errorf("Message has sequence number %v and UID %v, want %v and %v", msg.SeqNum, msg.Uid, i+2, uids[i+1])
+		}
+		subject := string(rune('A' + i + 1))
+		if msg.Envelope == nil || msg.Envelope.Subject != subject {
+			t.Errorf("Message %v has envelope %v, want subject %q", msg.SeqNum, msg.Envelope, subject)
+		}
+		if msg.BodyStructure == nil || msg.BodyStructure.MIMEType != "text" {
+			t.Errorf("Message %v has body structure %v, want a text part", msg.SeqNum, msg.BodyStructure)
+		}
+	}
+
+	// UIDs
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids[0], uids[2])
+	msgs = collectMessages(t, func(ch chan *imap.Message) error {
+		return mbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch)
+	})
+	if len(msgs) != 2 || msgs[0].Uid != uids[0] || msgs[1].Uid != uids[2] {
+		t.Fatalf("ListMessages(true) returned %v messages, want UIDs %v and %v", len(msgs), uids[0], uids[2])
+	}
+	if msgs[0].SeqNum != 1 || msgs[1].SeqNum != 3 {
+		t.Errorf("ListMessages(true) returned sequence numbers %v and %v, want 1 and 3", msgs[0].SeqNum, msgs[1].SeqNum)
+	}
+}
+
+// testListMessagesSeen checks that fetching a body section sets the \Seen flag,
+// unless BODY.PEEK is used or the mailbox has been selected read-only.
+func testListMessagesSeen(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 3)
+	s.drainUpdates()
+
+	msgs := s.listMessages(mbox, "1", imap.FetchUid, "BODY.PEEK[]")
+	if len(msgs) != 1 || hasFlag(msgs[0].Flags, imap.SeenFlag) {
+		t.Fatalf("ListMessages() with BODY.PEEK[] returned %v", msgs)
+	}
+
+	msgs = s.listMessages(mbox, "2", imap.FetchUid, "BODY[]")
+	if len(msgs) != 1 {
+		t.Fatalf("ListMessages() with BODY[] returned %v messages, want 1", len(msgs))
+	}
+	if !hasFlag(msgs[0].Flags, imap.SeenFlag) {
+		t.Errorf("ListMessages() with BODY[] returned flags %v, want \\Seen", msgs[0].Flags)
+	}
+	if readBody(t, msgs[0]) != testMessage(1) {
+		t.Error("ListMessages() with BODY[] returned an invalid body")
+	}
+
+	if s.updates != nil {
+		update := s.nextUpdate()
+		msgUpdate, ok := update.(*backend.MessageUpdate)
+		if !ok {
+			t.Fatalf("Update after ListMessages() with BODY[] = %T, want *backend.MessageUpdate", update)
+		}
+		if msgUpdate.SeqNum != 2 || !hasFlag(msgUpdate.Flags, imap.SeenFlag) {
+			t.Errorf("Message update has sequence number %v and flags %v, want 2 and \\Seen", msgUpdate.SeqNum, msgUpdate.Flags)
+		}
+	}
+
+	if sessionMbox, ok := s.mailbox("Archive").(backend.SessionMailbox); ok {
+		if _, err := sessionMbox.Select(true, nil); err != nil {
+			t.Fatal("Select(true) =", err)
+		}
+		s.listMessages(sessionMbox, "3", "BODY[]")
+		if err := sessionMbox.Unselect(); err != nil {
+			t.Fatal("Unselect() =", err)
+		}
+	}
+
+	msgs = s.listMessages(mbox, "1:*", imap.FetchFlags)
+	var seen []bool
+	for _, msg := range msgs {
+		seen = append(seen, hasFlag(msg.Flags, imap.SeenFlag))
+	}
+	if want := []bool{false, true, false}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("\\Seen flags after ListMessages() = %v, want %v", seen, want)
+	}
+}
+
+func testSearchMessages(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 4, nil, []string{imap.SeenFlag}, []string{imap.SeenFlag, imap.FlaggedFlag})
+	uids := s.uids(mbox)
+	if len(uids) != 4 {
+		t.Fatalf("Mailbox has UIDs %v, want 4 messages", uids)
+	}
+
+	seqset, _ := imap.ParseSeqSet("2:3")
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uids[0], uids[3])
+
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		seqNums  []uint32
+	}{
+		{"all", &imap.SearchCriteria{}, []uint32{1, 2, 3, 4}},
+		{"flag", &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}, []uint32{2, 3}},
+		{"no flag", &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}, []uint32{1, 4}},
+		{"seqset", &imap.SearchCriteria{SeqNum: seqset}, []uint32{2, 3}},
+		{"uidset", &imap.SearchCriteria{Uid: uidset}, []uint32{1, 4}},
+		{"header", &imap.SearchCriteria{Header: map[string][]string{"Subject": {"C"}}}, []uint32{3}},
+		{"body", &imap.SearchCriteria{Body: []string{"Body B"}}, []uint32{2}},
+		{"text", &imap.SearchCriteria{Text: []string{"Mitsuha"}}, []uint32{1, 2, 3, 4}},
+		{"not", &imap.SearchCriteria{Not: []*imap.SearchCriteria{{WithFlags: []string{imap.FlaggedFlag}}}}, []uint32{1, 2, 4}},
+		{"or", &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{
+			{WithFlags: []string{imap.FlaggedFlag}},
+			{WithoutFlags: []string{imap.SeenFlag}},
+		}}}, []uint32{1, 3, 4}},
+	}
+	for _, test := range tests {
+		if got := s.search(mbox, false, test.criteria); !equalUids(got, test.seqNums) {
+			t.Errorf("SearchMessages(false) with %v criteria = %v, want %v", test.name, got, test.seqNums)
+		}
+
+		var want []uint32
+		for _, seqNum := range test.seqNums {
+			want = append(want, uids[seqNum-1])
+		}
+		if got := s.search(mbox, true, test.criteria); !equalUids(got, want) {
+			t.Errorf("SearchMessages(true) with %v criteria = %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func testUpdateMessagesFlags(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 3)
+	uids := s.uids(mbox)
+
+	flagsOf := func() []map[string]bool {
+		msgs := s.listMessages(mbox, "1:*", imap.FetchFlags)
+		flags := make([]map[string]bool, len(msgs))
+		for i, msg := range msgs {
+			flags[i] = withoutRecent(msg.Flags)
+		}
+		return flags
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.SeenFlag, "$Label"}); err != nil {
+		t.Fatal("UpdateMessagesFlags(AddFlags) =", err)
+	}
+	want := []map[string]bool{flagSet(imap.SeenFlag, "$Label"), flagSet(imap.SeenFlag, "$Label"), flagSet()}
+	if got := flagsOf(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags after AddFlags = %v, want %v", got, want)
+	}
+
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uids[1], uids[2])
+	if err := mbox.UpdateMessagesFlags(true, uidset, imap.RemoveFlags, []string{imap.SeenFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags(RemoveFlags) =", err)
+	}
+	want = []map[string]bool{flagSet(imap.SeenFlag, "$Label"), flagSet("$Label"), flagSet()}
+	if got := flagsOf(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags after RemoveFlags = %v, want %v", got, want)
+	}
+
+	seqset, _ = imap.ParseSeqSet("1,3")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.SetFlags, []string{imap.AnsweredFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags(SetFlags) =", err)
+	}
+	want = []map[string]bool{flagSet(imap.AnsweredFlag), flagSet("$Label"), flagSet(imap.AnsweredFlag)}
+	if got := flagsOf(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags after SetFlags = %v, want %v", got, want)
+	}
+}
+
+func testCopyMessages(t *testing.T, s *session) {
+	src := s.createMailbox("Source")
+	dst := s.createMailbox("Destination")
+	s.appendMessages(src, 3, []string{imap.FlaggedFlag})
+	s.appendMessages(dst, 1)
+
+	seqset, _ := imap.ParseSeqSet("1,3")
+	if err := src.CopyMessages(false, seqset, "Missing"); err == nil {
+		t.Error("CopyMessages() to a missing mailbox succeeded")
+	}
+	if err := src.CopyMessages(false, seqset, "Destination"); err != nil {
+		t.Fatal("CopyMessages() =", err)
+	}
+
+	if n := s.numMessages(src); n != 3 {
+		t.Errorf("Source has %v messages after CopyMessages(), want 3", n)
+	}
+	msgs := s.listMessages(dst, "1:*", imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, "BODY.PEEK[]")
+	if len(msgs) != 3 {
+		t.Fatalf("Destination has %v messages after CopyMessages(), want 3", len(msgs))
+	}
+	if msgs[1].Uid <= msgs[0].Uid || msgs[2].Uid <= msgs[1].Uid {
+		t.Errorf("Copied messages have UIDs %v and %v, want more than %v", msgs[1].Uid, msgs[2].Uid, msgs[0].Uid)
+	}
+
+	// Flags and internal dates are preserved
+	for i, n := range []int{0, 2} {
+		msg := msgs[i+1]
+		if got, want := readBody(t, msg), testMessage(n); got != want {
+			t.Errorf("Copied message %v has body %q, want %q", msg.SeqNum, got, want)
+		}
+		if date := testDate.Add(time.Duration(n) * time.Minute); !msg.InternalDate.Equal(date) {
+			t.Errorf("Copied message %v has internal date %v, want %v", msg.SeqNum, msg.InternalDate, date)
+		}
+	}
+	if flags := withoutRecent(msgs[1].Flags); !reflect.DeepEqual(flags, flagSet(imap.FlaggedFlag)) {
+		t.Errorf("Copied message has flags %v, want \\Flagged", msgs[1].Flags)
+	}
+}
+
+// testExpunge checks that only messages with the \Deleted flag are expunged.
+func testExpunge(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	deleted := []string{imap.DeletedFlag}
+	s.appendMessages(mbox, 4, deleted, nil, deleted)
+	uids := s.uids(mbox)
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+
+	if got, want := s.uids(mbox), []uint32{uids[1], uids[3]}; !equalUids(got, want) {
+		t.Errorf("UIDs after Expunge() = %v, want %v", got, want)
+	}
+	msgs := s.listMessages(mbox, "1:*", imap.FetchUid, "BODY.PEEK[]")
+	if len(msgs) != 2 || readBody(t, msgs[0]) != testMessage(1) || readBody(t, msgs[1]) != testMessage(3) {
+		t.Errorf("Remaining messages after Expunge() have the wrong content")
+	}
+
+	// Expunging again doesn't remove anything
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	if n := s.numMessages(mbox); n != 2 {
+		t.Errorf("Mailbox has %v messages after a second Expunge(), want 2", n)
+	}
+}
@@ -0,0 +1,238 @@
+package backendtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+var uidItems = []imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity}
+
+func testListMailboxes(t *testing.T, s *session) {
+	if username := s.user.Username(); username != s.instance.Username {
+		t.Errorf("Username() = %q, want %q", username, s.instance.Username)
+	}
+
+	if names := s.mailboxNames(false); !names["INBOX"] {
+		t.Errorf("ListMailboxes() = %v, want INBOX", names)
+	}
+
+	s.createMailbox("Archive")
+	if names := s.mailboxNames(false); !names["Archive"] {
+		t.Errorf("ListMailboxes() = %v, want Archive", names)
+	}
+}
+
+func testGetMailbox(t *testing.T, s *session) {
+	if _, err := s.user.GetMailbox("Missing"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox() of a missing mailbox = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+
+	// INBOX is case-insensitive
+	mbox, err := s.user.GetMailbox("iNbOx")
+	if err != nil {
+		t.Fatal("GetMailbox(\"iNbOx\") =", err)
+	}
+	if mbox.Name() != "INBOX" {
+		t.Errorf("Name() = %q, want INBOX", mbox.Name())
+	}
+}
+
+func testCreateMailbox(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	if mbox.Name() != "Archive" {
+		t.Errorf("Name() = %q, want Archive", mbox.Name())
+	}
+	if n := s.numMessages(mbox); n != 0 {
+		t.Errorf("New mailbox has %v messages", n)
+	}
+
+	if err := s.user.CreateMailbox("Archive"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("CreateMailbox() of an existing mailbox = %v, want %v", err, backend.ErrMailboxAlreadyExists)
+	}
+	if err := s.user.CreateMailbox("INBOX"); err == nil {
+		t.Error("CreateMailbox(\"INBOX\") succeeded")
+	}
+
+	delim := s.delimiter()
+	if delim == "" {
+		return
+	}
+
+	// Superior mailboxes are created
+	s.createMailbox(strings.Join([]string{"a", "b", "c"}, delim))
+	names := s.mailboxNames(false)
+	for _, name := range []string{"a", "a" + delim + "b", "a" + delim + "b" + delim + "c"} {
+		if !names[name] {
+			t.Errorf("Mailbox %q doesn't exist after CreateMailbox()", name)
+		}
+	}
+
+	// A trailing delimiter declares the intent to create inferior mailboxes
+	if err := s.user.CreateMailbox("d" + delim); err != nil {
+		t.Fatal("CreateMailbox() with a trailing delimiter =", err)
+	}
+	if names := s.mailboxNames(false); !names["d"] {
+		t.Errorf("ListMailboxes() = %v, want d", names)
+	}
+}
+
+func testDeleteMailbox(t *testing.T, s *session) {
+	if err := s.user.DeleteMailbox("Missing"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("DeleteMailbox() of a missing mailbox = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+	if err := s.user.DeleteMailbox("INBOX"); err == nil {
+		t.Error("DeleteMailbox(\"INBOX\") succeeded")
+	}
+
+	s.createMailbox("Archive")
+	if err := s.user.DeleteMailbox("Archive"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	if _, err := s.user.GetMailbox("Archive"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox() of a deleted mailbox = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+	if names := s.mailboxNames(false); names["Archive"] {
+		t.Errorf("ListMailboxes() = %v, want no Archive", names)
+	}
+
+	// Inferior mailboxes are kept
+	delim := s.inferiorDelimiter(s.createMailbox("a"))
+	if delim == "" {
+		return
+	}
+	inferior := "a" + delim + "b"
+	mbox := s.createMailbox(inferior)
+	s.appendMessages(mbox, 1)
+	if err := s.user.DeleteMailbox("a"); err != nil {
+		t.Fatal("DeleteMailbox() of a mailbox with inferiors =", err)
+	}
+	if n := s.numMessages(s.mailbox(inferior)); n != 1 {
+		t.Errorf("Inferior mailbox has %v messages after deleting its parent, want 1", n)
+	}
+}
+
+// testDeleteMailboxUids checks that UIDs aren't re-used after a mailbox has
+// been deleted and re-created.
+func testDeleteMailboxUids(t *testing.T, s *session) {
+	mbox := s.createMailbox("Archive")
+	s.appendMessages(mbox, 3)
+	before := s.status(mbox, uidItems...)
+	uids := s.uids(mbox)
+
+	if err := s.user.DeleteMailbox("Archive"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	mbox = s.createMailbox("Archive")
+	s.appendMessages(mbox, 1)
+	after := s.status(mbox, uidItems...)
+
+	if after.UidValidity != before.UidValidity {
+		return
+	}
+	newUids := s.uids(mbox)
+	if len(newUids) != 1 || len(uids) != 3 || newUids[0] <= uids[2] {
+		t.Errorf("UIDs after re-creation = %v, want more than %v with the same UIDVALIDITY", newUids, uids)
+	}
+	if after.UidNext <= before.UidNext {
+		t.Errorf("UIDNEXT after re-creation = %v, want more than %v with the same UIDVALIDITY", after.UidNext, before.UidNext)
+	}
+}
+
+func testRenameMailbox(t *testing.T, s *session) {
+	if err := s.user.RenameMailbox("Missing", "Other"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("RenameMailbox() of a missing mailbox = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+
+	s.createMailbox("Archive")
+	s.createMailbox("Other")
+	if err := s.user.RenameMailbox("Archive", "Other"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("RenameMailbox() to an existing mailbox = %v, want %v", err, backend.ErrMailboxAlreadyExists)
+	}
+
+	mbox := s.mailbox("Archive")
+	s.appendMessages(mbox, 2)
+	before := s.status(mbox, uidItems...)
+	uids := s.uids(mbox)
+
+	if err := s.user.RenameMailbox("Archive", "Renamed"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+	if _, err := s.user.GetMailbox("Archive"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox() of the old name = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+	renamed := s.mailbox("Renamed")
+	if got := s.uids(renamed); !equalUids(got, uids) {
+		t.Errorf("UIDs after RenameMailbox() = %v, want %v", got, uids)
+	}
+	if after := s.status(renamed, uidItems...); after.UidValidity == before.UidValidity && after.UidNext < before.UidNext {
+		t.Errorf("UIDNEXT after RenameMailbox() = %v, want at least %v", after.UidNext, before.UidNext)
+	}
+
+	delim := s.inferiorDelimiter(renamed)
+	if delim == "" {
+		return
+	}
+
+	// Inferior mailboxes are renamed, superior mailboxes are created
+	inferior := s.createMailbox("Renamed" + delim + "child")
+	s.appendMessages(inferior, 1)
+	to := "x" + delim + "y"
+	if err := s.user.RenameMailbox("Renamed", to); err != nil {
+		t.Fatal("RenameMailbox() with inferiors =", err)
+	}
+	names := s.mailboxNames(false)
+	for _, name := range []string{"x", to, to + delim + "child"} {
+		if !names[name] {
+			t.Errorf("Mailbox %q doesn't exist after RenameMailbox()", name)
+		}
+	}
+	if names["Renamed"+delim+"child"] {
+		t.Error("Inferior mailbox still exists after RenameMailbox()")
+	}
+	if n := s.numMessages(s.mailbox(to + delim + "child")); n != 1 {
+		t.Errorf("Renamed inferior mailbox has %v messages, want 1", n)
+	}
+}
+
+// testRenameInbox checks that renaming INBOX moves its messages to a new
+// mailbox, leaving INBOX empty.
+func testRenameInbox(t *testing.T, s *session) {
+	inbox := s.mailbox("INBOX")
+	s.appendMessages(inbox, 2)
+	n := s.numMessages(inbox)
+
+	if err := s.user.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal("RenameMailbox(\"INBOX\") =", err)
+	}
+
+	if got := s.numMessages(s.mailbox("Old")); got != n {
+		t.Errorf("Renamed INBOX has %v messages, want %v", got, n)
+	}
+	if got := s.numMessages(s.mailbox("INBOX")); got != 0 {
+		t.Errorf("INBOX has %v messages after RenameMailbox(), want 0", got)
+	}
+
+	// INBOX keeps working
+	s.appendMessages(s.mailbox("INBOX"), 1)
+	if got := s.numMessages(s.mailbox("INBOX")); got != 1 {
+		t.Errorf("INBOX has %v messages after CreateMessage(), want 1", got)
+	}
+	if got := s.numMessages(s.mailbox("Old")); got != n {
+		t.Errorf("Renamed INBOX has %v messages after CreateMessage() in INBOX, want %v", got, n)
+	}
+}
+
+func equalUids(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -71,3 +71,31 @@ func UpdateFlags(current []string, op imap.FlagsOp, flags []string) []string {
 	}
 	return newFlags
 }
+
+// SetsSeen checks whether fetching items sets the \Seen flag of messages. As
+// defined in RFC 3501 section 6.4.5, this is the case for body sections
+// fetched without BODY.PEEK, RFC822 and RFC822.TEXT.
+func SetsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchRFC822, imap.FetchRFC822Text:
+			return true
+		}
+		if section, err := imap.ParseBodySectionName(item); err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+// WithFlags returns items with imap.FetchFlags added if it's missing. Messages
+// whose \Seen flag is set by a fetch must include their flags, as defined in
+// RFC 3501 section 6.4.5. items isn't modified.
+func WithFlags(items []imap.FetchItem) []imap.FetchItem {
+	for _, item := range items {
+		if item == imap.FetchFlags {
+			return items
+		}
+	}
+	return append(items[:len(items):len(items)], imap.FetchFlags)
+}
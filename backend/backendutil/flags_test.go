@@ -84,3 +84,37 @@ func TestUpdateFlags_Recent(t *testing.T) {
 		t.Errorf("Expected result to be \n%v\n but got \n%v", res, current)
 	}
 }
+
+func TestSetsSeen(t *testing.T) {
+	tests := []struct {
+		items []imap.FetchItem
+		want  bool
+	}{
+		{[]imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope}, false},
+		{[]imap.FetchItem{"BODY.PEEK[]", imap.FetchRFC822Header}, false},
+		{[]imap.FetchItem{imap.FetchUid, "BODY[]"}, true},
+		{[]imap.FetchItem{"BODY[1.TEXT]"}, true},
+		{[]imap.FetchItem{imap.FetchRFC822}, true},
+		{[]imap.FetchItem{imap.FetchRFC822Text}, true},
+	}
+	for _, test := range tests {
+		if got := SetsSeen(test.items); got != test.want {
+			t.Errorf("SetsSeen(%v) = %v, want %v", test.items, got, test.want)
+		}
+	}
+}
+
+func TestWithFlags(t *testing.T) {
+	items := make([]imap.FetchItem, 1, 2)
+	items[0] = "BODY[]"
+	got := WithFlags(items)
+	if !reflect.DeepEqual(got, []imap.FetchItem{"BODY[]", imap.FetchFlags}) {
+		t.Errorf("WithFlags() = %v", got)
+	}
+	if items[:2][1] != "" {
+		t.Error("WithFlags() modified its argument")
+	}
+	if got := WithFlags(got); len(got) != 2 {
+		t.Errorf("WithFlags() = %v, want no duplicate", got)
+	}
+}
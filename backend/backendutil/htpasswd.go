@@ -0,0 +1,86 @@
+package backendutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against passwords of unknown users, so that they
+// cannot be distinguished from existing users by response time.
+var dummyHash = []byte("$2a$10$g18b/9c8O6e7hib5uXaXGOKJ1TOMyJofFgZDJNt4UyWEQhu5nuQqS")
+
+// HtpasswdAuthenticator is a backend.Authenticator checking passwords against
+// bcrypt hashes read from an htpasswd file, as generated by
+// "htpasswd -B". Other hash formats are rejected.
+type HtpasswdAuthenticator struct {
+	// Master users are allowed to act as any other user, by providing the
+	// other user as the authorization identity.
+	MasterUsers map[string]bool
+
+	hashes map[string][]byte
+}
+
+// ReadHtpasswd reads an htpasswd file.
+func ReadHtpasswd(r io.Reader) (*HtpasswdAuthenticator, error) {
+	hashes := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errors.New("backendutil: malformed htpasswd line")
+		}
+		username, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.New("backendutil: unsupported htpasswd hash for user " + username)
+		}
+		hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &HtpasswdAuthenticator{hashes: hashes}, nil
+}
+
+// OpenHtpasswd reads the htpasswd file at path.
+func OpenHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadHtpasswd(f)
+}
+
+// Authenticate implements backend.Authenticator.
+func (a *HtpasswdAuthenticator) Authenticate(_ *imap.ConnInfo, authzid, username, password string) (string, error) {
+	hash, ok := a.hashes[username]
+	if !ok {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return "", backend.ErrInvalidCredentials
+	}
+
+	if authzid == "" || authzid == username {
+		return username, nil
+	}
+	if !a.MasterUsers[username] {
+		return "", errors.New("Not allowed to act as another user")
+	}
+	return authzid, nil
+}
@@ -0,0 +1,64 @@
+package backendutil
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHtpasswd(t *testing.T) *HtpasswdAuthenticator {
+	var sb strings.Builder
+	sb.WriteString("# Test users\n\n")
+	for _, user := range []string{"alice", "admin"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.WriteString(user + ":" + string(hash) + "\n")
+	}
+
+	a, err := ReadHtpasswd(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("ReadHtpasswd() =", err)
+	}
+	a.MasterUsers = map[string]bool{"admin": true}
+	return a
+}
+
+var htpasswdTests = []struct {
+	authzid, username, password string
+	identity                    string
+	ok                          bool
+}{
+	{username: "alice", password: "alice-password", identity: "alice", ok: true},
+	{authzid: "alice", username: "alice", password: "alice-password", identity: "alice", ok: true},
+	{username: "alice", password: "wrong"},
+	{username: "bob", password: "bob-password"},
+	{authzid: "admin", username: "alice", password: "alice-password"},
+	{authzid: "alice", username: "admin", password: "admin-password", identity: "alice", ok: true},
+	{authzid: "alice", username: "admin", password: "alice-password"},
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	a := testHtpasswd(t)
+
+	for _, test := range htpasswdTests {
+		identity, err := a.Authenticate(nil, test.authzid, test.username, test.password)
+		if test.ok && err != nil {
+			t.Errorf("Authenticate(%q, %q, %q) = %v", test.authzid, test.username, test.password, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Authenticate(%q, %q, %q) succeeded, expected an error", test.authzid, test.username, test.password)
+		} else if identity != test.identity {
+			t.Errorf("Authenticate(%q, %q, %q) returned identity %q, expected %q", test.authzid, test.username, test.password, identity, test.identity)
+		}
+	}
+}
+
+func TestReadHtpasswd_unsupportedHash(t *testing.T) {
+	// MD5 hash generated by "htpasswd -m"
+	r := strings.NewReader("alice:$apr1$1FXrZ0d5$9Jqt5bDcnXsmoPtl3qo3V/\n")
+	if _, err := ReadHtpasswd(r); err == nil {
+		t.Error("Expected an error for an unsupported hash")
+	}
+}
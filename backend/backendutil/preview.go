@@ -0,0 +1,159 @@
+package backendutil
+
+import (
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// previewMaxLen is the maximum length of a preview, in characters. RFC 8970
+// section 3 requires previews to be no longer than 256 characters.
+const previewMaxLen = 200
+
+// previewMaxRead is the maximum number of bytes read from a text part when
+// generating a preview.
+const previewMaxRead = 16 * 1024
+
+// FetchPreview generates a message preview, as defined in RFC 8970. The first
+// text/plain part of the message is used. If there is none, the first
+// text/html part is used instead, with markup stripped. If the message has no
+// text part, an empty string is returned.
+func FetchPreview(header textproto.Header, body io.Reader) (string, error) {
+	e, err := message.New(message.Header{Header: header}, body)
+	if e == nil {
+		return "", err
+	}
+
+	plain, htmlText, err := findPreviewText(e)
+	if err != nil {
+		return "", err
+	}
+
+	text := plain
+	if text == "" && htmlText != "" {
+		text = stripHTML(htmlText)
+	}
+	return formatPreview(text), nil
+}
+
+// findPreviewText walks a MIME entity and returns the contents of the first
+// text/plain and text/html parts. Walking stops as soon as a text/plain part is
+// found.
+func findPreviewText(e *message.Entity) (plain, htmlText string, err error) {
+	if mr := e.MultipartReader(); mr != nil {
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil && !message.IsUnknownCharset(err) {
+				return plain, htmlText, err
+			}
+
+			partPlain, partHTML, err := findPreviewText(p)
+			if err != nil {
+				return plain, htmlText, err
+			}
+			if htmlText == "" {
+				htmlText = partHTML
+			}
+			if partPlain != "" {
+				return partPlain, htmlText, nil
+			}
+		}
+		return plain, htmlText, nil
+	}
+
+	t, _, _ := e.Header.ContentType()
+	if t == "" {
+		t = "text/plain"
+	}
+	if t != "text/plain" && t != "text/html" {
+		return "", "", nil
+	}
+	if disp, _, _ := e.Header.ContentDisposition(); disp == "attachment" {
+		return "", "", nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(e.Body, previewMaxRead))
+	if err != nil {
+		return "", "", err
+	}
+
+	if t == "text/html" {
+		return "", string(b), nil
+	}
+	return string(b), "", nil
+}
+
+// stripHTML removes markup from an HTML document, keeping only its text.
+func stripHTML(s string) string {
+	lower := asciiLower(s)
+
+	var b strings.Builder
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		b.WriteByte(' ')
+		s, lower = s[i:], lower[i:]
+
+		// Skip the contents of elements which don't contain text
+		for _, tag := range []string{"head", "script", "style"} {
+			if isHTMLTag(lower, tag) {
+				if end := strings.Index(lower, "</"+tag); end >= 0 {
+					s, lower = s[end:], lower[end:]
+				}
+				break
+			}
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			break
+		}
+		s, lower = s[end+1:], lower[end+1:]
+	}
+	return html.UnescapeString(b.String())
+}
+
+// asciiLower converts ASCII letters to lower case. Unlike strings.ToLower, the
+// length of the string is preserved.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// isHTMLTag checks whether s starts with an opening tag for the element name.
+func isHTMLTag(s, name string) bool {
+	if !strings.HasPrefix(s, "<"+name) || len(s) == len(name)+1 {
+		return false
+	}
+	c := s[len(name)+1]
+	return c == '>' || c == '/' || c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// formatPreview collapses whitespace and truncates text to previewMaxLen
+// characters.
+func formatPreview(s string) string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+	s = strings.Join(fields, " ")
+
+	if runes := []rune(s); len(runes) > previewMaxLen {
+		s = string(runes[:previewMaxLen])
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package backendutil
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+var previewTests = []struct {
+	name    string
+	mail    string
+	preview string
+}{
+	{
+		name:    "multipart",
+		mail:    testMailString,
+		preview: testTextBodyString,
+	},
+	{
+		name:    "html",
+		mail:    testHTMLString,
+		preview: "What's your name?",
+	},
+	{
+		name: "html-style",
+		mail: "Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<html><HEAD><style>p { color: red; }</style></HEAD>" +
+			"<body><p>Fish &amp; chips</p></body></html>",
+		preview: "Fish & chips",
+	},
+	{
+		name: "quoted-printable",
+		mail: "Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Caf=C3=A9\r\n\r\n   au lait",
+		preview: "Café au lait",
+	},
+	{
+		name:    "attachment",
+		mail:    testAttachmentString,
+		preview: "",
+	},
+	{
+		name: "long",
+		mail: "Content-Type: text/plain\r\n" +
+			"\r\n" +
+			strings.Repeat("a", 300),
+		preview: strings.Repeat("a", previewMaxLen),
+	},
+}
+
+func TestFetchPreview(t *testing.T) {
+	for _, test := range previewTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			bufferedBody := bufio.NewReader(strings.NewReader(test.mail))
+
+			header, err := textproto.ReadHeader(bufferedBody)
+			if err != nil {
+				t.Fatal("Expected no error while reading mail, got:", err)
+			}
+
+			preview, err := FetchPreview(header, bufferedBody)
+			if err != nil {
+				t.Fatal("Expected no error while fetching preview, got:", err)
+			}
+			if preview != test.preview {
+				t.Errorf("Expected preview %q, got %q", test.preview, preview)
+			}
+		})
+	}
+}
@@ -66,9 +66,41 @@ func bodyLen(e *message.Entity) (int, error) {
 	return b.Len() + headerSize.N, nil
 }
 
+// Metadata contains the message metadata which can be matched against search
+// criteria, in addition to the message itself.
+type Metadata struct {
+	// The message sequence number.
+	SeqNum uint32
+	// The message unique identifier.
+	Uid uint32
+	// The message internal date.
+	Date time.Time
+	// The message flags.
+	Flags []string
+	// The message object identifier, as defined in RFC 8474.
+	EmailId string
+	// The thread object identifier, as defined in RFC 8474.
+	ThreadId string
+	// The date the message was saved to its mailbox, as defined in RFC 8514.
+	// Zero if unsupported.
+	SaveDate time.Time
+}
+
 // Match returns true if a message and its metadata matches the provided
 // criteria.
 func Match(e *message.Entity, seqNum, uid uint32, date time.Time, flags []string, c *imap.SearchCriteria) (bool, error) {
+	md := &Metadata{
+		SeqNum: seqNum,
+		Uid:    uid,
+		Date:   date,
+		Flags:  flags,
+	}
+	return MatchMessage(e, md, c)
+}
+
+// MatchMessage is like Match, but accepts additional message metadata required
+// by some IMAP extensions.
+func MatchMessage(e *message.Entity, md *Metadata, c *imap.SearchCriteria) (bool, error) {
 	// TODO: support encoded header fields for Bcc, Cc, From, To
 	// TODO: add header size for Larger and Smaller
 
@@ -147,36 +179,55 @@ func Match(e *message.Entity, seqNum, uid uint32, date time.Time, flags []string
 	}
 
 	if !c.Since.IsZero() || !c.Before.IsZero() {
-		if !matchDate(date, c) {
+		if !matchDate(md.Date, c) {
+			return false, nil
+		}
+	}
+
+	if c.Younger > 0 || c.Older > 0 {
+		if !matchWithin(md.Date, c) {
+			return false, nil
+		}
+	}
+
+	if !c.SavedSince.IsZero() || !c.SavedBefore.IsZero() {
+		if !matchSaveDate(md.SaveDate, c) {
 			return false, nil
 		}
 	}
 
 	if c.WithFlags != nil || c.WithoutFlags != nil {
-		if !matchFlags(flags, c) {
+		if !matchFlags(md.Flags, c) {
 			return false, nil
 		}
 	}
 
 	if c.SeqNum != nil || c.Uid != nil {
-		if !matchSeqNumAndUid(seqNum, uid, c) {
+		if !matchSeqNumAndUid(md.SeqNum, md.Uid, c) {
 			return false, nil
 		}
 	}
 
+	if c.EmailId != "" && c.EmailId != md.EmailId {
+		return false, nil
+	}
+	if c.ThreadId != "" && c.ThreadId != md.ThreadId {
+		return false, nil
+	}
+
 	for _, not := range c.Not {
-		ok, err := Match(e, seqNum, uid, date, flags, not)
+		ok, err := MatchMessage(e, md, not)
 		if err != nil || ok {
 			return false, err
 		}
 	}
 	for _, or := range c.Or {
-		ok1, err := Match(e, seqNum, uid, date, flags, or[0])
+		ok1, err := MatchMessage(e, md, or[0])
 		if err != nil {
 			return ok1, err
 		}
 
-		ok2, err := Match(e, seqNum, uid, date, flags, or[1])
+		ok2, err := MatchMessage(e, md, or[1])
 		if err != nil || (!ok1 && !ok2) {
 			return false, err
 		}
@@ -228,3 +279,33 @@ func matchDate(date time.Time, c *imap.SearchCriteria) bool {
 	}
 	return true
 }
+
+func matchWithin(date time.Time, c *imap.SearchCriteria) bool {
+	// Unlike other date search keys, time and time zone are taken into
+	// account, see RFC 5032 section 3.
+	age := time.Since(date)
+
+	if c.Younger > 0 && age > c.Younger {
+		return false
+	}
+	if c.Older > 0 && age < c.Older {
+		return false
+	}
+	return true
+}
+
+func matchSaveDate(date time.Time, c *imap.SearchCriteria) bool {
+	// Messages without a save date never match, see RFC 8514 section 5.1
+	if date.IsZero() {
+		return false
+	}
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+
+	if !c.SavedSince.IsZero() && date.Before(c.SavedSince) {
+		return false
+	}
+	if !c.SavedBefore.IsZero() && !date.Before(c.SavedBefore) {
+		return false
+	}
+	return true
+}
@@ -290,6 +290,26 @@ var matchTests = []struct {
 		},
 		res: true,
 	},
+	{
+		date:     time.Now().Add(-30 * time.Minute),
+		criteria: &imap.SearchCriteria{Younger: time.Hour},
+		res:      true,
+	},
+	{
+		date:     time.Now().Add(-2 * time.Hour),
+		criteria: &imap.SearchCriteria{Younger: time.Hour},
+		res:      false,
+	},
+	{
+		date:     time.Now().Add(-2 * time.Hour),
+		criteria: &imap.SearchCriteria{Older: time.Hour},
+		res:      true,
+	},
+	{
+		date:     time.Now().Add(-30 * time.Minute),
+		criteria: &imap.SearchCriteria{Older: time.Hour, Younger: 2 * time.Hour},
+		res:      false,
+	},
 }
 
 func TestMatch(t *testing.T) {
@@ -313,6 +333,68 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+var matchMessageTests = []struct {
+	criteria *imap.SearchCriteria
+	md       *Metadata
+	res      bool
+}{
+	{
+		criteria: &imap.SearchCriteria{EmailId: "M42"},
+		md:       &Metadata{EmailId: "M42", ThreadId: "T42"},
+		res:      true,
+	},
+	{
+		criteria: &imap.SearchCriteria{EmailId: "M43"},
+		md:       &Metadata{EmailId: "M42", ThreadId: "T42"},
+		res:      false,
+	},
+	{
+		criteria: &imap.SearchCriteria{ThreadId: "T42"},
+		md:       &Metadata{EmailId: "M42", ThreadId: "T42"},
+		res:      true,
+	},
+	{
+		criteria: &imap.SearchCriteria{
+			Not: []*imap.SearchCriteria{{ThreadId: "T42"}},
+		},
+		md:  &Metadata{EmailId: "M42"},
+		res: true,
+	},
+	{
+		criteria: &imap.SearchCriteria{SavedSince: testDate.Add(-48 * time.Hour)},
+		md:       &Metadata{SaveDate: testDate},
+		res:      true,
+	},
+	{
+		criteria: &imap.SearchCriteria{SavedBefore: testDate.Add(-48 * time.Hour)},
+		md:       &Metadata{SaveDate: testDate},
+		res:      false,
+	},
+	{
+		criteria: &imap.SearchCriteria{SavedSince: testDate.Add(-48 * time.Hour)},
+		md:       &Metadata{},
+		res:      false,
+	},
+}
+
+func TestMatchMessage(t *testing.T) {
+	for i, test := range matchMessageTests {
+		e, err := message.Read(strings.NewReader(testMailString))
+		if err != nil {
+			t.Fatal("Expected no error while reading entity, got:", err)
+		}
+
+		ok, err := MatchMessage(e, test.md, test.criteria)
+		if err != nil {
+			t.Fatal("Expected no error while matching entity, got:", err)
+		}
+
+		if test.res != ok {
+			t.Errorf("Expected #%v to return %v, got %v", i+1, test.res, ok)
+		}
+	}
+}
+
 func TestMatchEncoded(t *testing.T) {
 	encodedTestMsg := `From: "fox.cpp" <foxcpp@foxcpp.dev>
 To: "fox.cpp" <foxcpp@foxcpp.dev>
@@ -0,0 +1,192 @@
+package backendutil
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+)
+
+// NewSearchData computes the ESEARCH data returned for search results, as
+// defined in RFC 4731 and RFC 5267. ids must be ordered: by sequence number for
+// SEARCH and by sort order for SORT. MIN and MAX are the first and last
+// results.
+func NewSearchData(ids []uint32, options *imap.SearchOptions) *imap.SearchData {
+	data := &imap.SearchData{Count: uint32(len(ids))}
+	if len(ids) > 0 {
+		data.Min = ids[0]
+		data.Max = ids[len(ids)-1]
+	}
+
+	if options.ReturnAll {
+		data.All = ids
+	}
+
+	if r := options.ReturnPartial; r != nil {
+		data.Partial = &imap.SearchPartialData{Range: *r}
+		if first := int(r.First) - 1; first < len(ids) {
+			last := int(r.Last)
+			if last > len(ids) {
+				last = len(ids)
+			}
+			data.Partial.Ids = ids[first:last]
+		}
+	}
+
+	return data
+}
+
+// SearchContext keeps track of search results, as defined in RFC 5267 section
+// 4. It computes the ADDTO and REMOVEFROM updates needed to keep a client's
+// view of the results up-to-date.
+//
+// Results are identified by UID, since sequence numbers change when messages
+// are expunged.
+type SearchContext struct {
+	sorted  bool
+	results []uint32
+}
+
+// NewSearchContext creates a new search context from the initial results. If
+// sorted is false, the results are assumed to be ordered by sequence number and
+// updates don't carry positions.
+func NewSearchContext(results []uint32, sorted bool) *SearchContext {
+	return &SearchContext{
+		sorted:  sorted,
+		results: append([]uint32(nil), results...),
+	}
+}
+
+// Results returns the current results.
+func (ctx *SearchContext) Results() []uint32 {
+	return ctx.results
+}
+
+// Forget removes messages from the results without generating updates. It
+// should be used for expunged messages, since EXPUNGE responses already remove
+// them from the client's view.
+func (ctx *SearchContext) Forget(ids []uint32) {
+	forget := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		forget[id] = true
+	}
+
+	results := ctx.results[:0]
+	for _, id := range ctx.results {
+		if !forget[id] {
+			results = append(results, id)
+		}
+	}
+	ctx.results = results
+}
+
+// Update replaces the results with new ones and returns the updates to send to
+// the client. Updates must be applied in order.
+func (ctx *SearchContext) Update(results []uint32) (addTo, removeFrom []imap.SearchContextUpdate) {
+	newPos := make(map[uint32]int, len(results))
+	for i, id := range results {
+		newPos[id] = i
+	}
+
+	// Find the results which stay in place. For unsorted results, that's all
+	// common results. For sorted results, that's the longest subsequence of
+	// common results which keeps the same order.
+	var common []uint32
+	for _, id := range ctx.results {
+		if _, ok := newPos[id]; ok {
+			common = append(common, id)
+		}
+	}
+	kept := make(map[uint32]bool, len(common))
+	if ctx.sorted {
+		for _, id := range longestOrderedSubsequence(common, newPos) {
+			kept[id] = true
+		}
+	} else {
+		for _, id := range common {
+			kept[id] = true
+		}
+	}
+
+	// Remove results from the last one to the first one, so that positions of
+	// the previous ones aren't changed
+	var removed []uint32
+	for i := len(ctx.results) - 1; i >= 0; i-- {
+		id := ctx.results[i]
+		if kept[id] {
+			continue
+		}
+
+		if ctx.sorted {
+			removeFrom = append(removeFrom, imap.SearchContextUpdate{
+				Position: uint32(i + 1),
+				Ids:      []uint32{id},
+			})
+		} else {
+			removed = append(removed, id)
+		}
+	}
+
+	// Add results from the first one to the last one, so that the previous
+	// ones are already at the right position
+	var added []uint32
+	for i, id := range results {
+		if kept[id] {
+			continue
+		}
+
+		if ctx.sorted {
+			addTo = append(addTo, imap.SearchContextUpdate{
+				Position: uint32(i + 1),
+				Ids:      []uint32{id},
+			})
+		} else {
+			added = append(added, id)
+		}
+	}
+
+	if len(removed) > 0 {
+		sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+		removeFrom = []imap.SearchContextUpdate{{Ids: removed}}
+	}
+	if len(added) > 0 {
+		addTo = []imap.SearchContextUpdate{{Ids: added}}
+	}
+
+	ctx.results = append([]uint32(nil), results...)
+	return addTo, removeFrom
+}
+
+// longestOrderedSubsequence returns the longest subsequence of ids whose
+// positions in pos are increasing.
+func longestOrderedSubsequence(ids []uint32, pos map[uint32]int) []uint32 {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// tails[k] is the index in ids of the smallest tail of all increasing
+	// subsequences of length k+1
+	var tails []int
+	prev := make([]int, len(ids))
+	for i, id := range ids {
+		p := pos[id]
+		k := sort.Search(len(tails), func(k int) bool {
+			return pos[ids[tails[k]]] >= p
+		})
+		if k > 0 {
+			prev[i] = tails[k-1]
+		} else {
+			prev[i] = -1
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	seq := make([]uint32, len(tails))
+	for i, k := len(tails)-1, tails[len(tails)-1]; i >= 0; i, k = i-1, prev[k] {
+		seq[i] = ids[k]
+	}
+	return seq
+}
@@ -0,0 +1,124 @@
+package backendutil
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestNewSearchData(t *testing.T) {
+	options := &imap.SearchOptions{
+		ReturnMin:     true,
+		ReturnAll:     true,
+		ReturnPartial: &imap.PartialRange{First: 2, Last: 10},
+	}
+	data := NewSearchData([]uint32{7, 3, 9, 4}, options)
+
+	expected := &imap.SearchData{
+		Min:   7,
+		Max:   4,
+		All:   []uint32{7, 3, 9, 4},
+		Count: 4,
+		Partial: &imap.SearchPartialData{
+			Range: imap.PartialRange{First: 2, Last: 10},
+			Ids:   []uint32{3, 9, 4},
+		},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Invalid search data: got \n%+v\n but expected \n%+v", data, expected)
+	}
+
+	options.ReturnPartial = &imap.PartialRange{First: 5, Last: 10}
+	if data := NewSearchData([]uint32{7, 3, 9, 4}, options); data.Partial.Ids != nil {
+		t.Errorf("Expected an empty partial result, got %v", data.Partial.Ids)
+	}
+}
+
+// applySearchContextUpdates applies updates to a list of results, like a
+// client would.
+func applySearchContextUpdates(results []uint32, sorted bool, addTo, removeFrom []imap.SearchContextUpdate) []uint32 {
+	results = append([]uint32(nil), results...)
+
+	for _, update := range removeFrom {
+		for _, id := range update.Ids {
+			for i, r := range results {
+				if r == id {
+					results = append(results[:i], results[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	for _, update := range addTo {
+		for j, id := range update.Ids {
+			if !sorted {
+				results = append(results, id)
+				continue
+			}
+			i := int(update.Position) - 1 + j
+			results = append(results, 0)
+			copy(results[i+1:], results[i:])
+			results[i] = id
+		}
+	}
+
+	if !sorted {
+		sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	}
+	return results
+}
+
+var searchContextTests = []struct {
+	sorted   bool
+	old, new []uint32
+}{
+	{old: []uint32{1, 2, 3}, new: []uint32{1, 3, 4, 5}},
+	{old: nil, new: []uint32{4}},
+	{old: []uint32{4}, new: nil},
+	{sorted: true, old: []uint32{5, 1, 3}, new: []uint32{5, 1, 3}},
+	{sorted: true, old: []uint32{5, 1, 3}, new: []uint32{1, 6, 3, 5}},
+	{sorted: true, old: []uint32{5, 1, 3, 2}, new: []uint32{2, 3, 7}},
+}
+
+func TestSearchContext_Update(t *testing.T) {
+	for i, test := range searchContextTests {
+		ctx := NewSearchContext(test.old, test.sorted)
+		addTo, removeFrom := ctx.Update(test.new)
+
+		got := applySearchContextUpdates(test.old, test.sorted, addTo, removeFrom)
+		if len(got) == 0 && len(test.new) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.new) {
+			t.Errorf("Invalid results after applying updates for #%v: got %v but expected %v (ADDTO %+v REMOVEFROM %+v)", i+1, got, test.new, addTo, removeFrom)
+		}
+		if !reflect.DeepEqual(ctx.Results(), test.new) {
+			t.Errorf("Invalid context results for #%v: got %v", i+1, ctx.Results())
+		}
+	}
+}
+
+func TestSearchContext_Update_unsorted(t *testing.T) {
+	ctx := NewSearchContext([]uint32{1, 2, 3}, false)
+	addTo, removeFrom := ctx.Update([]uint32{1, 3, 4, 5})
+
+	if expected := []imap.SearchContextUpdate{{Ids: []uint32{4, 5}}}; !reflect.DeepEqual(addTo, expected) {
+		t.Errorf("Invalid ADDTO: got %+v", addTo)
+	}
+	if expected := []imap.SearchContextUpdate{{Ids: []uint32{2}}}; !reflect.DeepEqual(removeFrom, expected) {
+		t.Errorf("Invalid REMOVEFROM: got %+v", removeFrom)
+	}
+}
+
+func TestSearchContext_Forget(t *testing.T) {
+	ctx := NewSearchContext([]uint32{5, 1, 3}, true)
+	ctx.Forget([]uint32{1})
+
+	addTo, removeFrom := ctx.Update([]uint32{5, 3})
+	if len(addTo) != 0 || len(removeFrom) != 0 {
+		t.Errorf("Expected no updates, got ADDTO %+v REMOVEFROM %+v", addTo, removeFrom)
+	}
+}
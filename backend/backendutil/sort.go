@@ -0,0 +1,195 @@
+package backendutil
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// SortMessage contains the message data required to sort messages.
+type SortMessage struct {
+	// The message identifier (either a sequence number or a UID) returned by
+	// Sort.
+	Id uint32
+	// The message header.
+	Header textproto.Header
+	// The message internal date.
+	Date time.Time
+	// The message size.
+	Size uint32
+}
+
+// sortKey is the value of a sort criterion for a message.
+type sortKey struct {
+	s string
+	n int64
+}
+
+func (a sortKey) compare(b sortKey) int {
+	switch {
+	case a.n < b.n:
+		return -1
+	case a.n > b.n:
+		return 1
+	}
+	return strings.Compare(a.s, b.s)
+}
+
+// Sort sorts messages according to criteria, as defined in RFC 5256 section 3.
+// msgs must be ordered by sequence number: messages which compare equal keep
+// their relative order. The sorted list of message identifiers is returned.
+func Sort(msgs []SortMessage, criteria []imap.SortCriterion) []uint32 {
+	keys := make([][]sortKey, len(msgs))
+	for i, msg := range msgs {
+		keys[i] = make([]sortKey, len(criteria))
+		for j, c := range criteria {
+			keys[i][j] = messageSortKey(&msg, c.Field)
+		}
+	}
+
+	indexes := make([]int, len(msgs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := keys[indexes[i]], keys[indexes[j]]
+		for k, c := range criteria {
+			cmp := a[k].compare(b[k])
+			if c.Reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	ids := make([]uint32, len(indexes))
+	for i, index := range indexes {
+		ids[i] = msgs[index].Id
+	}
+	return ids
+}
+
+func messageSortKey(msg *SortMessage, field imap.SortField) sortKey {
+	h := mail.Header{Header: message.Header{Header: msg.Header}}
+
+	switch field {
+	case imap.SortArrival:
+		return sortKey{n: msg.Date.UnixNano()}
+	case imap.SortDate:
+		// RFC 5256 section 2.2: use the internal date if the Date header field
+		// is missing or invalid
+		t, err := h.Date()
+		if err != nil || t.IsZero() {
+			t = msg.Date
+		}
+		return sortKey{n: t.UnixNano()}
+	case imap.SortSize:
+		return sortKey{n: int64(msg.Size)}
+	case imap.SortFrom:
+		return sortKey{s: addrMailbox(h, "From")}
+	case imap.SortTo:
+		return sortKey{s: addrMailbox(h, "To")}
+	case imap.SortCc:
+		return sortKey{s: addrMailbox(h, "Cc")}
+	case imap.SortSubject:
+		subject, _ := h.Subject()
+		return sortKey{s: asciiLower(baseSubject(subject))}
+	}
+	return sortKey{}
+}
+
+// addrMailbox returns the local part of the first address in a header field,
+// as defined in RFC 5256 section 3.
+func addrMailbox(h mail.Header, key string) string {
+	addrs, err := h.AddressList(key)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+
+	addr := addrs[0].Address
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		addr = addr[:i]
+	}
+	return asciiLower(addr)
+}
+
+// baseSubject extracts the base subject from a subject, as defined in RFC 5256
+// section 2.1.
+func baseSubject(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	for {
+		prev := s
+
+		// Remove subj-trailer
+		for {
+			s = strings.TrimRight(s, " ")
+			if !strings.HasSuffix(asciiLower(s), "(fwd)") {
+				break
+			}
+			s = s[:len(s)-len("(fwd)")]
+		}
+
+		// Remove subj-leader
+		for {
+			s = strings.TrimLeft(s, " ")
+			if rest, ok := trimSubjectRefwd(s); ok {
+				s = rest
+			} else if rest, ok := trimSubjectBlob(s); ok && strings.TrimSpace(rest) != "" {
+				s = rest
+			} else {
+				break
+			}
+		}
+
+		// Remove subj-fwd-hdr and subj-fwd-trl
+		if strings.HasPrefix(asciiLower(s), "[fwd:") && strings.HasSuffix(s, "]") {
+			s = s[len("[fwd:") : len(s)-1]
+		}
+
+		if s == prev {
+			return s
+		}
+	}
+}
+
+// trimSubjectRefwd removes a subj-refwd from the beginning of a subject.
+func trimSubjectRefwd(s string) (string, bool) {
+	lower := asciiLower(s)
+	for _, prefix := range []string{"re", "fwd", "fw"} {
+		if !strings.HasPrefix(lower, prefix) {
+			continue
+		}
+
+		rest := strings.TrimLeft(s[len(prefix):], " ")
+		if blobRest, ok := trimSubjectBlob(rest); ok {
+			rest = blobRest
+		}
+		if strings.HasPrefix(rest, ":") {
+			return rest[1:], true
+		}
+	}
+	return s, false
+}
+
+// trimSubjectBlob removes a subj-blob from the beginning of a subject.
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+
+	end := strings.IndexAny(s[1:], "[]")
+	if end < 0 || s[end+1] != ']' {
+		return s, false
+	}
+	return strings.TrimLeft(s[end+2:], " "), true
+}
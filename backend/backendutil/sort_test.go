@@ -0,0 +1,90 @@
+package backendutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+func newSortMessage(id uint32, from, subject, date string, size uint32) SortMessage {
+	var h textproto.Header
+	h.Set("From", from)
+	h.Set("Subject", subject)
+	if date != "" {
+		h.Set("Date", date)
+	}
+	return SortMessage{
+		Id:     id,
+		Header: h,
+		Date:   testDate.Add(time.Duration(id) * time.Hour),
+		Size:   size,
+	}
+}
+
+var sortMessages = []SortMessage{
+	newSortMessage(1, "Taki <taki@example.org>", "Re: [comet] Your name", "Sat, 18 Jun 2016 12:00:00 +0900", 300),
+	newSortMessage(2, "Mitsuha <mitsuha@example.org>", "Kataware-doki", "Fri, 17 Jun 2016 12:00:00 +0900", 100),
+	newSortMessage(3, "Tessie <tessie@example.org>", "your name (fwd)", "", 200),
+	newSortMessage(4, "Mitsuha <mitsuha@example.org>", "[Fwd: Comet]", "Sun, 19 Jun 2016 12:00:00 +0900", 100),
+}
+
+var sortTests = []struct {
+	criteria []imap.SortCriterion
+	ids      []uint32
+}{
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortArrival}},
+		ids:      []uint32{1, 2, 3, 4},
+	},
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortArrival, Reverse: true}},
+		ids:      []uint32{4, 3, 2, 1},
+	},
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortDate}},
+		ids:      []uint32{2, 1, 3, 4},
+	},
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortSize}},
+		ids:      []uint32{2, 4, 3, 1},
+	},
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortFrom}, {Field: imap.SortSize, Reverse: true}},
+		ids:      []uint32{2, 4, 1, 3},
+	},
+	{
+		criteria: []imap.SortCriterion{{Field: imap.SortSubject}, {Field: imap.SortArrival}},
+		ids:      []uint32{4, 2, 1, 3},
+	},
+}
+
+func TestSort(t *testing.T) {
+	for i, test := range sortTests {
+		ids := Sort(sortMessages, test.criteria)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Invalid sort results for #%v: got %v but expected %v", i+1, ids, test.ids)
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	tests := []struct {
+		subject, base string
+	}{
+		{"Your name", "Your name"},
+		{"Re: Your name", "Your name"},
+		{"RE: Fwd:  Re[2]: Your   name", "Your name"},
+		{"[comet] Re: Your name (fwd)", "Your name"},
+		{"[Fwd: Re: Your name]", "Your name"},
+		{"[comet]", "[comet]"},
+	}
+
+	for _, test := range tests {
+		if base := baseSubject(test.subject); base != test.base {
+			t.Errorf("Invalid base subject for %q: got %q but expected %q", test.subject, base, test.base)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package backendutil
+
+import (
+	"os"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// MessageState is the state of a message known to clients, used to compute
+// updates when a mailbox is modified by another process.
+type MessageState struct {
+	Uid   uint32
+	Flags []string
+}
+
+// DiffMessages returns the updates needed to bring clients from the old list
+// of messages of a mailbox to the new one. Both lists must be sorted by UID,
+// and new messages must have greater UIDs than old ones.
+func DiffMessages(username, mailbox string, old, new []MessageState) []backend.Update {
+	var updates []backend.Update
+
+	byUid := make(map[uint32]*MessageState, len(new))
+	for i := range new {
+		byUid[new[i].Uid] = &new[i]
+	}
+
+	// Expunge from the last message to the first one, so that sequence numbers
+	// of the remaining messages don't change
+	remaining := len(old)
+	for i := len(old) - 1; i >= 0; i-- {
+		if _, ok := byUid[old[i].Uid]; ok {
+			continue
+		}
+		updates = append(updates, &backend.ExpungeUpdate{
+			Update: backend.NewUpdate(username, mailbox),
+			SeqNum: uint32(i + 1),
+			Uid:    old[i].Uid,
+		})
+		remaining--
+	}
+
+	oldByUid := make(map[uint32]*MessageState, len(old))
+	for i := range old {
+		oldByUid[old[i].Uid] = &old[i]
+	}
+
+	for i, msg := range new {
+		prev, ok := oldByUid[msg.Uid]
+		if !ok || equalFlags(prev.Flags, msg.Flags) {
+			continue
+		}
+
+		m := imap.NewMessage(uint32(i+1), []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		m.Flags = msg.Flags
+		m.Uid = msg.Uid
+		updates = append(updates, &backend.MessageUpdate{
+			Update:  backend.NewUpdate(username, mailbox),
+			Message: m,
+		})
+	}
+
+	// New messages always have greater UIDs, so they're appended
+	if len(new) > remaining {
+		status := imap.NewMailboxStatus(mailbox, []imap.StatusItem{imap.StatusMessages})
+		status.Messages = uint32(len(new))
+		updates = append(updates, &backend.MailboxUpdate{
+			Update:        backend.NewUpdate(username, mailbox),
+			MailboxStatus: status,
+		})
+	}
+
+	return updates
+}
+
+func equalFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SendUpdates sends updates to a channel returned by
+// backend.BackendUpdater.Updates, waiting for each one to be delivered. It
+// must not be called with locks needed to deliver updates held.
+func SendUpdates(ch chan<- backend.Update, updates []backend.Update) {
+	for _, update := range updates {
+		done := update.Done()
+		ch <- update
+		<-done
+	}
+}
+
+// UpdateQueue sends the updates of modifications serialized by a lock in the
+// order of the modifications, without keeping the lock held while they're
+// delivered. The zero value is an empty queue.
+type UpdateQueue struct {
+	// Closed once the updates of the last modification have been sent
+	sent chan struct{}
+}
+
+// Push reserves a place in the queue for the updates of a modification. It
+// must be called with the lock held. The returned function must be called
+// once the lock is released: it sends the updates to ch after the ones of
+// previous modifications, and waits for them to be delivered.
+func (q *UpdateQueue) Push(ch chan<- backend.Update, updates []backend.Update) (send func()) {
+	if len(updates) == 0 {
+		return func() {}
+	}
+
+	prev := q.sent
+	sent := make(chan struct{})
+	q.sent = sent
+
+	return func() {
+		if prev != nil {
+			<-prev
+		}
+		dones := make([]chan struct{}, len(updates))
+		for i, update := range updates {
+			dones[i] = update.Done()
+			ch <- update
+		}
+		close(sent)
+
+		for _, done := range dones {
+			<-done
+		}
+	}
+}
+
+// Poll synchronizes a mailbox with sync, which is called with l locked, and
+// sends the resulting updates to ch once l is unlocked.
+func Poll(l sync.Locker, sync func() ([]backend.Update, error), ch chan<- backend.Update) error {
+	l.Lock()
+	updates, err := sync()
+	l.Unlock()
+
+	SendUpdates(ch, updates)
+	return err
+}
+
+// WriteFileAtomic replaces the contents of a file, so that concurrent readers
+// never see a partially written file. The data is written to path with a .tmp
+// suffix and flushed to disk, then the file is renamed. Concurrent writers
+// must be excluded by the caller.
+func WriteFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package backendutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestDiffMessages(t *testing.T) {
+	old := []MessageState{
+		{Uid: 1, Flags: []string{imap.SeenFlag}},
+		{Uid: 2},
+		{Uid: 3},
+	}
+	new := []MessageState{
+		{Uid: 1, Flags: []string{imap.SeenFlag}},
+		{Uid: 3, Flags: []string{imap.FlaggedFlag}},
+		{Uid: 4},
+		{Uid: 5},
+	}
+
+	updates := DiffMessages("username", "INBOX", old, new)
+	if len(updates) != 3 {
+		t.Fatalf("Expected 3 updates, got %v", len(updates))
+	}
+
+	expunge, ok := updates[0].(*backend.ExpungeUpdate)
+	if !ok || expunge.SeqNum != 2 || expunge.Uid != 2 {
+		t.Errorf("Invalid expunge update: %#v", updates[0])
+	}
+
+	msg, ok := updates[1].(*backend.MessageUpdate)
+	if !ok {
+		t.Fatalf("Invalid message update: %#v", updates[1])
+	}
+	if msg.SeqNum != 2 || msg.Uid != 3 || !reflect.DeepEqual(msg.Flags, []string{imap.FlaggedFlag}) {
+		t.Errorf("Invalid message update: %#v", msg.Message)
+	}
+
+	mbox, ok := updates[2].(*backend.MailboxUpdate)
+	if !ok || mbox.Messages != 4 {
+		t.Errorf("Invalid mailbox update: %#v", updates[2])
+	}
+
+	for _, update := range updates {
+		if update.Username() != "username" || update.Mailbox() != "INBOX" {
+			t.Errorf("Invalid update target: %v %v", update.Username(), update.Mailbox())
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-backendutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	for _, s := range []string{"hello", "hi"} {
+		if err := WriteFileAtomic(path, []byte(s), 0600); err != nil {
+			t.Fatal("WriteFileAtomic() =", err)
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != s {
+			t.Errorf("Invalid file contents: got %q, %v, want %q", b, err, s)
+		}
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Temporary file not removed:", err)
+	}
+}
@@ -0,0 +1,291 @@
+// Package boltdb implements an IMAP backend storing users, mailboxes and
+// messages in a single bbolt database file.
+//
+// Message bodies are stored separately from their metadata, so that commands
+// which don't need them, such as FETCH FLAGS, don't read them. Copied messages
+// share their body. All modifications are done in transactions: a crash never
+// leaves a partially appended, copied or expunged set of messages.
+package boltdb
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// scramIterations is the number of iterations used to derive SCRAM
+// credentials.
+const scramIterations = 4096
+
+var (
+	// ErrUserAlreadyExists is returned by CreateUser if the user already exists.
+	ErrUserAlreadyExists = errors.New("boltdb: user already exists")
+	// ErrNoSuchUser is returned when a user doesn't exist.
+	ErrNoSuchUser = errors.New("boltdb: no such user")
+)
+
+// Backend is a bbolt backend.
+type Backend struct {
+	db      *bolt.DB
+	updates chan backend.Update
+
+	// Serializes write transactions
+	mutex sync.Mutex
+	// Sends updates in the order of write transactions
+	queue backendutil.UpdateQueue
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+
+	// Protects recent and the sessions which have selected mailboxes
+	sessionsMutex sync.Mutex
+	// Recent messages, indexed by mailbox ID
+	recent map[uint64]*recentState
+}
+
+// New opens a database file, creating it if it doesn't exist. The file is
+// locked while the backend is open, Close must be called to release it.
+func New(path string) (*Backend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, usersBucket, mailboxesBucket, blobsBucket, refsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Backend{
+		db:      db,
+		updates: make(chan backend.Update, 64),
+	}, nil
+}
+
+// Close closes the database file.
+func (be *Backend) Close() error {
+	return be.db.Close()
+}
+
+func validUsername(username string) bool {
+	return username != "" && !strings.ContainsAny(username, "\x00")
+}
+
+// CreateUser creates a new user with an empty INBOX.
+func (be *Backend) CreateUser(username, password string) error {
+	if !validUsername(username) {
+		return errors.New("boltdb: invalid username")
+	}
+
+	creds, err := newCredentials(password)
+	if err != nil {
+		return err
+	}
+
+	return be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		users := tx.Bucket(usersBucket)
+		if users.Bucket([]byte(username)) != nil {
+			return nil, ErrUserAlreadyExists
+		}
+
+		ub, err := users.CreateBucket([]byte(username))
+		if err != nil {
+			return nil, err
+		}
+		if err := putJSON(ub, credentialsKey, creds); err != nil {
+			return nil, err
+		}
+		if _, err := ub.CreateBucket(userMailboxesBucket); err != nil {
+			return nil, err
+		}
+
+		_, err = createMailbox(tx, username, "INBOX")
+		return nil, err
+	})
+}
+
+// SetPassword changes the password of a user.
+func (be *Backend) SetPassword(username, password string) error {
+	creds, err := newCredentials(password)
+	if err != nil {
+		return err
+	}
+
+	return be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		ub := tx.Bucket(usersBucket).Bucket([]byte(username))
+		if ub == nil {
+			return nil, ErrNoSuchUser
+		}
+		return nil, putJSON(ub, credentialsKey, creds)
+	})
+}
+
+// DeleteUser deletes a user and all of its mailboxes.
+func (be *Backend) DeleteUser(username string) error {
+	return be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		users := tx.Bucket(usersBucket)
+		ub := users.Bucket([]byte(username))
+		if ub == nil {
+			return nil, ErrNoSuchUser
+		}
+
+		err := ub.Bucket(userMailboxesBucket).ForEach(func(name, id []byte) error {
+			return deleteMailbox(tx, btoi(id))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, users.DeleteBucket([]byte(username))
+	})
+}
+
+func newCredentials(password string) (*credentials, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &credentials{
+		Password: hash,
+		SCRAM:    backend.NewSCRAMCredentials(password, salt, scramIterations),
+	}, nil
+}
+
+// readCredentials reads the credentials of a user.
+func (be *Backend) readCredentials(username string) (*credentials, error) {
+	var creds credentials
+	err := be.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(usersBucket).Bucket([]byte(username))
+		if ub == nil {
+			return ErrNoSuchUser
+		}
+		return getJSON(ub, credentialsKey, &creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	creds, err := be.readCredentials(username)
+	if err == ErrNoSuchUser {
+		// Check the password anyway, so that the response time doesn't reveal
+		// whether the user exists
+		bcrypt.CompareHashAndPassword(be.dummyPasswordHash(), []byte(password))
+		return nil, backend.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword(creds.Password, []byte(password)) != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &User{be: be, username: username}, nil
+}
+
+// dummyPasswordHash returns a password hash with the same cost as the ones of
+// users, checked when a user doesn't exist.
+func (be *Backend) dummyPasswordHash() []byte {
+	be.dummyHashOnce.Do(func() {
+		be.dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return be.dummyHash
+}
+
+// LookupUser implements backend.UserBackend.
+func (be *Backend) LookupUser(_ *imap.ConnInfo, identity string) (backend.User, error) {
+	err := be.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Bucket([]byte(identity)) == nil {
+			return backend.ErrInvalidCredentials
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &User{be: be, username: identity}, nil
+}
+
+// SCRAMCredentials implements backend.SCRAMBackend.
+func (be *Backend) SCRAMCredentials(_ *imap.ConnInfo, username string) (*backend.SCRAMCredentials, error) {
+	creds, err := be.readCredentials(username)
+	if err == ErrNoSuchUser {
+		return nil, backend.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	return creds.SCRAM, nil
+}
+
+// LoginSCRAM implements backend.SCRAMBackend.
+func (be *Backend) LoginSCRAM(connInfo *imap.ConnInfo, username string) (backend.User, error) {
+	return be.LookupUser(connInfo, username)
+}
+
+// Updates implements backend.BackendUpdater. Updates must be consumed, for
+// instance by a server.Server, otherwise operations on mailboxes block.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *Backend) SupportedExtensions() []backend.Extension {
+	return []backend.Extension{
+		backend.ExtStatusSize,
+		backend.ExtPreview,
+		backend.ExtWithin,
+		backend.ExtSort,
+	}
+}
+
+// update runs f in a write transaction. If the transaction is committed, the
+// updates returned by f are sent to clients. It waits for them to be
+// delivered, so that they're sent before the command's completion response.
+func (be *Backend) update(f func(tx *bolt.Tx) ([]backend.Update, error)) error {
+	be.mutex.Lock()
+
+	var updates []backend.Update
+	err := be.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		updates, err = f(tx)
+		return err
+	})
+	if err != nil {
+		be.mutex.Unlock()
+		return err
+	}
+
+	// Delivering updates may take a while, don't block other transactions
+	send := be.queue.Push(be.updates, updates)
+	be.mutex.Unlock()
+	send()
+	return nil
+}
+
+var (
+	_ backend.UserBackend      = (*Backend)(nil)
+	_ backend.SCRAMBackend     = (*Backend)(nil)
+	_ backend.BackendUpdater   = (*Backend)(nil)
+	_ backend.ExtensionBackend = (*Backend)(nil)
+)
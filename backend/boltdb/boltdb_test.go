@@ -0,0 +1,519 @@
+package boltdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"\r\n" +
+	"Hi there :)\r\n"
+
+func newTestBackend(t *testing.T, path string) (*Backend, <-chan backend.Update) {
+	be, err := New(path)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+
+	// Acknowledge updates, like a server would
+	updates := make(chan backend.Update, 100)
+	go func() {
+		for update := range be.Updates() {
+			updates <- update
+			close(update.Done())
+		}
+	}()
+	return be, updates
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "go-imap-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "imap.db"), func() { os.RemoveAll(dir) }
+}
+
+func testUser(t *testing.T, be *Backend) backend.User {
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	return u
+}
+
+func testMailbox(t *testing.T, u backend.User, name string) backend.Mailbox {
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	return mbox
+}
+
+func listMessages(t *testing.T, mbox backend.Mailbox, items ...imap.FetchItem) []*imap.Message {
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if len(items) == 0 {
+		items = []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, "BODY.PEEK[]"}
+	}
+	if err := mbox.ListMessages(false, seqset, items, ch); err != nil {
+		t.Fatal("ListMessages() =", err)
+	}
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func uids(msgs []*imap.Message) []uint32 {
+	var l []uint32
+	for _, msg := range msgs {
+		l = append(l, msg.Uid)
+	}
+	return l
+}
+
+func status(t *testing.T, mbox backend.Mailbox) *imap.MailboxStatus {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	return status
+}
+
+func TestBackend_users(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, _ := newTestBackend(t, path)
+	defer be.Close()
+
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	if err := be.CreateUser("username", "password"); err != ErrUserAlreadyExists {
+		t.Errorf("CreateUser() = %v, want %v", err, ErrUserAlreadyExists)
+	}
+
+	if _, err := be.Login(nil, "username", "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Login() with a wrong password = %v", err)
+	}
+	if _, err := be.Login(nil, "nobody", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Login() with an unknown user = %v", err)
+	}
+	u := testUser(t, be)
+	testMailbox(t, u, "INBOX")
+
+	if creds, err := be.SCRAMCredentials(nil, "username"); err != nil || creds == nil {
+		t.Errorf("SCRAMCredentials() = %v, %v", creds, err)
+	}
+
+	if err := be.SetPassword("username", "new password"); err != nil {
+		t.Fatal("SetPassword() =", err)
+	}
+	if _, err := be.Login(nil, "username", "new password"); err != nil {
+		t.Errorf("Login() with the new password = %v", err)
+	}
+
+	if err := be.DeleteUser("username"); err != nil {
+		t.Fatal("DeleteUser() =", err)
+	}
+	if _, err := be.LookupUser(nil, "username"); err != backend.ErrInvalidCredentials {
+		t.Errorf("LookupUser() after DeleteUser() = %v", err)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, updates := newTestBackend(t, path)
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	mbox := testMailbox(t, testUser(t, be), "inbox")
+	if mbox.Name() != "INBOX" {
+		t.Errorf("mbox.Name() = %v, want INBOX", mbox.Name())
+	}
+
+	for i := 0; i < 3; i++ {
+		body := bytes.NewBufferString(testMessage)
+		if err := mbox.CreateMessage([]string{"$Important"}, time.Now(), body); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+		update := <-updates
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		if !ok || mboxUpdate.Messages != uint32(i+1) {
+			t.Errorf("Invalid update after CreateMessage(): %#v", update)
+		}
+	}
+
+	msgs := listMessages(t, mbox)
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs: got %v, want %v", uids(msgs), want)
+	}
+	for i, msg := range msgs {
+		if msg.Size != uint32(len(testMessage)) {
+			t.Errorf("Invalid size for message #%v: %v", i+1, msg.Size)
+		}
+		if !reflect.DeepEqual(msg.Flags, []string{"$Important", imap.RecentFlag}) {
+			t.Errorf("Invalid flags for message #%v: %v", i+1, msg.Flags)
+		}
+		for _, l := range msg.Body {
+			if b, _ := ioutil.ReadAll(l); string(b) != testMessage {
+				t.Errorf("Invalid body for message #%v: %q", i+1, b)
+			}
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	update := <-updates
+	if msgUpdate, ok := update.(*backend.MessageUpdate); !ok || msgUpdate.SeqNum != 2 || msgUpdate.Uid != 2 {
+		t.Errorf("Invalid update after UpdateMessagesFlags(): %#v", update)
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	update = <-updates
+	if expungeUpdate, ok := update.(*backend.ExpungeUpdate); !ok || expungeUpdate.SeqNum != 2 {
+		t.Errorf("Invalid update after Expunge(): %#v", update)
+	}
+
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs after expunge: got %v, want %v", uids(msgs), want)
+	}
+
+	before := status(t, mbox)
+	if err := be.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	// Everything is persistent
+	be, _ = newTestBackend(t, path)
+	defer be.Close()
+	mbox = testMailbox(t, testUser(t, be), "INBOX")
+	after := status(t, mbox)
+	if after.UidValidity != before.UidValidity || after.UidNext != 4 || after.Messages != 2 {
+		t.Errorf("Invalid status after restart: UIDVALIDITY %v, UIDNEXT %v, MESSAGES %v", after.UidValidity, after.UidNext, after.Messages)
+	}
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs after restart: got %v, want %v", uids(msgs), want)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$Important"}) {
+		t.Errorf("Invalid flags after restart: %v", msgs[0].Flags)
+	}
+}
+
+func countBlobs(t *testing.T, be *Backend) int {
+	var n int
+	err := be.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(blobsBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMailbox_copy(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, _ := newTestBackend(t, path)
+	defer be.Close()
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	u := testUser(t, be)
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+
+	inbox := testMailbox(t, u, "INBOX")
+	if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+
+	seqset, _ := imap.ParseSeqSet("1")
+	if err := inbox.CopyMessages(false, seqset, "Archive"); err != nil {
+		t.Fatal("CopyMessages() =", err)
+	}
+	if err := inbox.CopyMessages(false, seqset, "Missing"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("CopyMessages() to a missing mailbox = %v", err)
+	}
+
+	// Copies share their body
+	if n := countBlobs(t, be); n != 1 {
+		t.Errorf("Expected 1 body after copy, got %v", n)
+	}
+
+	if err := inbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+
+	archive := testMailbox(t, u, "Archive")
+	msgs := listMessages(t, archive)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message in Archive, got %v", len(msgs))
+	}
+	for _, l := range msgs[0].Body {
+		if b, _ := ioutil.ReadAll(l); string(b) != testMessage {
+			t.Errorf("Invalid body of the copy: %q", b)
+		}
+	}
+
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	if n := countBlobs(t, be); n != 0 {
+		t.Errorf("Expected no body after deleting all messages, got %v", n)
+	}
+}
+
+func TestUser_mailboxes(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, updates := newTestBackend(t, path)
+	defer be.Close()
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	u := testUser(t, be)
+
+	for _, name := range []string{"Archive", "Archive/2020"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatalf("CreateMailbox(%q) = %v", name, err)
+		}
+	}
+	if err := u.CreateMailbox("Archive"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("CreateMailbox() = %v, want %v", err, backend.ErrMailboxAlreadyExists)
+	}
+
+	if err := u.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+	if _, err := u.GetMailbox("Old/2020"); err != nil {
+		t.Errorf("Inferior mailbox wasn't renamed: %v", err)
+	}
+	if _, err := u.GetMailbox("Archive"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox() after rename = %v", err)
+	}
+
+	inbox := testMailbox(t, u, "INBOX")
+	if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	<-updates
+	inboxStatus := status(t, inbox)
+
+	if err := u.RenameMailbox("INBOX", "Moved"); err != nil {
+		t.Fatal("RenameMailbox(INBOX) =", err)
+	}
+	if update, ok := (<-updates).(*backend.ExpungeUpdate); !ok || update.Mailbox() != "INBOX" {
+		t.Errorf("Expected an expunge update for INBOX, got %#v", update)
+	}
+	if s := status(t, inbox); s.Messages != 0 || s.UidValidity != inboxStatus.UidValidity {
+		t.Errorf("Invalid INBOX status after rename: %#v", s)
+	}
+	if msgs := listMessages(t, testMailbox(t, u, "Moved")); len(msgs) != 1 {
+		t.Errorf("Expected 1 message in the renamed INBOX, got %v", len(msgs))
+	}
+
+	if err := u.DeleteMailbox("Old"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	var names []string
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name())
+	}
+	if want := []string{"INBOX", "Moved", "Old/2020"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListMailboxes() = %v, want %v", names, want)
+	}
+
+	// Superior mailboxes are created in the same transaction
+	if err := u.CreateMailbox("a/b/c"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	if err := u.RenameMailbox("a/b/c", "d/e"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+	for _, name := range []string{"a", "a/b", "d", "d/e"} {
+		if _, err := u.GetMailbox(name); err != nil {
+			t.Errorf("GetMailbox(%q) = %v", name, err)
+		}
+	}
+
+	if err := testMailbox(t, u, "Moved").SetSubscribed(true); err != nil {
+		t.Fatal("SetSubscribed() =", err)
+	}
+	if mailboxes, _ := u.ListMailboxes(true); len(mailboxes) != 1 || mailboxes[0].Name() != "Moved" {
+		t.Errorf("Invalid subscribed mailboxes: %v", mailboxes)
+	}
+}
+
+func TestMailbox_recent(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, _ := newTestBackend(t, path)
+	defer be.Close()
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	mbox := testMailbox(t, testUser(t, be), "INBOX")
+	other := testMailbox(t, testUser(t, be), "INBOX")
+
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+
+	items := []imap.StatusItem{imap.StatusRecent}
+	st, err := mbox.(backend.SessionMailbox).Select(false, items)
+	if err != nil {
+		t.Fatal("Select() =", err)
+	}
+	if st.Recent != 1 {
+		t.Errorf("Select(): RECENT = %v, want 1", st.Recent)
+	}
+
+	// The message isn't recent for other sessions anymore
+	st, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if st.Recent != 0 {
+		t.Errorf("Status() for another session: RECENT = %v, want 0", st.Recent)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	seqset, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.(backend.UidOnlyMailbox).UidListMessages(seqset, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal("UidListMessages() =", err)
+	}
+	msg := <-ch
+	if msg == nil || msg.Uid != 1 || !reflect.DeepEqual(msg.Flags, []string{imap.RecentFlag}) {
+		t.Errorf("UidListMessages() = %+v, want UID 1 with \\Recent", msg)
+	}
+
+	// Once the mailbox is unselected, new messages are recent for other
+	// sessions
+	if err := mbox.(backend.SessionMailbox).Unselect(); err != nil {
+		t.Fatal("Unselect() =", err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	st, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if st.Recent != 1 {
+		t.Errorf("Status() after unselect: RECENT = %v, want 1", st.Recent)
+	}
+}
+
+func TestBackend_updatesUnlocked(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	be, err := New(path)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+	defer be.Close()
+
+	if err := be.CreateUser("username", "password"); err != nil {
+		t.Fatal("CreateUser() =", err)
+	}
+	mbox := testMailbox(t, testUser(t, be), "INBOX")
+
+	// Don't acknowledge the update yet, as a server delivering it to a slow
+	// client
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage))
+	}()
+
+	var update backend.Update
+	select {
+	case update = <-be.Updates():
+	case <-time.After(5 * time.Second):
+		t.Fatal("No update sent")
+	}
+
+	// Other write transactions aren't blocked meanwhile
+	created := make(chan error, 1)
+	go func() {
+		created <- be.CreateUser("other", "password")
+	}()
+	select {
+	case err := <-created:
+		if err != nil {
+			t.Fatal("CreateUser() =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CreateUser() blocked while an update is delivered")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatal("CreateMessage() returned before its update was delivered:", err)
+	default:
+	}
+
+	close(update.Done())
+	if err := <-done; err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Instance {
+		path, cleanup := tempPath(t)
+		be, err := New(path)
+		if err != nil {
+			t.Fatal("New() =", err)
+		}
+		if err := be.CreateUser("username", "password"); err != nil {
+			t.Fatal("CreateUser() =", err)
+		}
+		return &backendtest.Instance{
+			Backend:  be,
+			Username: "username",
+			Password: "password",
+			Close: func() {
+				be.Close()
+				cleanup()
+			},
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The database contains the following buckets:
+//
+//	meta                  uidvalidity: last UIDVALIDITY
+//	users/<username>      credentials: JSON credentials
+//	                      mailboxes/<name>: mailbox ID
+//	mailboxes/<id>        uidvalidity, uidnext, subscribed
+//	                      messages/<uid>: JSON message metadata
+//	blobs/<id>            message body
+//	refs/<id>             number of messages sharing the body
+//
+// Integers are encoded in big endian, so that keys are sorted.
+var (
+	metaBucket          = []byte("meta")
+	usersBucket         = []byte("users")
+	userMailboxesBucket = []byte("mailboxes")
+	mailboxesBucket     = []byte("mailboxes")
+	messagesBucket      = []byte("messages")
+	blobsBucket         = []byte("blobs")
+	refsBucket          = []byte("refs")
+
+	credentialsKey = []byte("credentials")
+	uidValidityKey = []byte("uidvalidity")
+	uidNextKey     = []byte("uidnext")
+	subscribedKey  = []byte("subscribed")
+)
+
+var errMissingBody = errors.New("boltdb: missing message body")
+
+type credentials struct {
+	// bcrypt hash
+	Password []byte                    `json:"password"`
+	SCRAM    *backend.SCRAMCredentials `json:"scram"`
+}
+
+// messageMeta is the metadata of a message.
+type messageMeta struct {
+	Date  time.Time `json:"date"`
+	Size  uint32    `json:"size"`
+	Flags []string  `json:"flags"`
+	Blob  uint64    `json:"blob"`
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func uidKey(uid uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uid)
+	return b
+}
+
+func keyUid(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+func putUint32(b *bolt.Bucket, key []byte, v uint32) error {
+	return b.Put(key, uidKey(v))
+}
+
+func getUint32(b *bolt.Bucket, key []byte) uint32 {
+	v := b.Get(key)
+	if len(v) != 4 {
+		return 0
+	}
+	return keyUid(v)
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func getJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	return json.Unmarshal(b.Get(key), v)
+}
+
+// newUidValidity returns a new UIDVALIDITY value. Values are derived from the
+// current time, and are never re-used.
+func newUidValidity(tx *bolt.Tx) (uint32, error) {
+	meta := tx.Bucket(metaBucket)
+	v := uint32(time.Now().Unix())
+	if last := getUint32(meta, uidValidityKey); v <= last {
+		v = last + 1
+	}
+	return v, putUint32(meta, uidValidityKey, v)
+}
+
+// mailboxID returns the ID of a user's mailbox, or zero if it doesn't exist.
+func mailboxID(tx *bolt.Tx, username, name string) uint64 {
+	ub := tx.Bucket(usersBucket).Bucket([]byte(username))
+	if ub == nil {
+		return 0
+	}
+	id := ub.Bucket(userMailboxesBucket).Get([]byte(name))
+	if id == nil {
+		return 0
+	}
+	return btoi(id)
+}
+
+// mailboxBucket returns the bucket of a mailbox.
+func mailboxBucket(tx *bolt.Tx, id uint64) (*bolt.Bucket, error) {
+	mb := tx.Bucket(mailboxesBucket).Bucket(itob(id))
+	if mb == nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mb, nil
+}
+
+// createMailbox creates a new empty mailbox and returns its ID.
+func createMailbox(tx *bolt.Tx, username, name string) (uint64, error) {
+	userMailboxes := tx.Bucket(usersBucket).Bucket([]byte(username)).Bucket(userMailboxesBucket)
+	if userMailboxes.Get([]byte(name)) != nil {
+		return 0, backend.ErrMailboxAlreadyExists
+	}
+
+	mailboxes := tx.Bucket(mailboxesBucket)
+	id, err := mailboxes.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	mb, err := mailboxes.CreateBucket(itob(id))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := mb.CreateBucket(messagesBucket); err != nil {
+		return 0, err
+	}
+
+	uidValidity, err := newUidValidity(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := putUint32(mb, uidValidityKey, uidValidity); err != nil {
+		return 0, err
+	}
+	if err := putUint32(mb, uidNextKey, 1); err != nil {
+		return 0, err
+	}
+
+	return id, userMailboxes.Put([]byte(name), itob(id))
+}
+
+// deleteMailbox deletes a mailbox and releases the bodies of its messages. The
+// mailbox must be removed from the user's mailboxes by the caller.
+func deleteMailbox(tx *bolt.Tx, id uint64) error {
+	mb, err := mailboxBucket(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = mb.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		var meta messageMeta
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return err
+		}
+		return releaseBlob(tx, meta.Blob)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(mailboxesBucket).DeleteBucket(itob(id))
+}
+
+// putBlob stores a message body, referenced once.
+func putBlob(tx *bolt.Tx, body []byte) (uint64, error) {
+	blobs := tx.Bucket(blobsBucket)
+	id, err := blobs.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	if err := blobs.Put(itob(id), body); err != nil {
+		return 0, err
+	}
+	return id, tx.Bucket(refsBucket).Put(itob(id), itob(1))
+}
+
+// retainBlob adds a reference to a message body.
+func retainBlob(tx *bolt.Tx, id uint64) error {
+	refs := tx.Bucket(refsBucket)
+	n := refs.Get(itob(id))
+	if n == nil {
+		return errMissingBody
+	}
+	return refs.Put(itob(id), itob(btoi(n)+1))
+}
+
+// releaseBlob removes a reference to a message body, and deletes it if it's
+// not referenced anymore.
+func releaseBlob(tx *bolt.Tx, id uint64) error {
+	refs := tx.Bucket(refsBucket)
+	n := refs.Get(itob(id))
+	if n != nil && btoi(n) > 1 {
+		return refs.Put(itob(id), itob(btoi(n)-1))
+	}
+
+	if err := refs.Delete(itob(id)); err != nil {
+		return err
+	}
+	return tx.Bucket(blobsBucket).Delete(itob(id))
+}
+
+// readBlob reads a message body.
+func (be *Backend) readBlob(id uint64) ([]byte, error) {
+	var body []byte
+	err := be.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blobsBucket).Get(itob(id))
+		if b == nil {
+			return errMissingBody
+		}
+		// Data is only valid during the transaction
+		body = append([]byte(nil), b...)
+		return nil
+	})
+	return body, err
+}
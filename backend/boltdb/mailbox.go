@@ -0,0 +1,685 @@
+package boltdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Delimiter is the mailbox hierarchy delimiter.
+const Delimiter = "/"
+
+var standardFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+}
+
+// Mailbox is a mailbox stored in the database.
+type Mailbox struct {
+	user *User
+	name string
+	id   uint64
+}
+
+// message is a message's metadata, along with its UID.
+type message struct {
+	uid uint32
+	messageMeta
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	return info, nil
+}
+
+// messages returns the metadata of all messages, sorted by UID. Bodies aren't
+// read.
+func (mbox *Mailbox) messages() (uidValidity, uidNext uint32, msgs []message, err error) {
+	err = mbox.user.be.db.View(func(tx *bolt.Tx) error {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return err
+		}
+		uidValidity = getUint32(mb, uidValidityKey)
+		uidNext = getUint32(mb, uidNextKey)
+
+		return mb.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			msg := message{uid: keyUid(k)}
+			if err := json.Unmarshal(v, &msg.messageMeta); err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+	return
+}
+
+// selectMessages returns the messages whose sequence number or UID is in
+// seqset, along with their sequence numbers. \Recent is included in the flags
+// if the message is recent for the session.
+func (mbox *Mailbox) selectMessages(uid bool, seqset *imap.SeqSet) (msgs []message, seqNums []uint32, err error) {
+	_, _, all, err := mbox.messages()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recent := mbox.user.be.recentUids(mbox.id, mbox.user)
+	for i, msg := range all {
+		seqNum := uint32(i + 1)
+		msg.Flags = withRecent(msg.Flags, recent[msg.uid])
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqset != nil && !seqset.Contains(id) {
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		seqNums = append(seqNums, seqNum)
+	}
+	return msgs, seqNums, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	uidValidity, uidNext, msgs, err := mbox.messages()
+	if err != nil {
+		return nil, err
+	}
+	recentUids := mbox.user.be.recentUids(mbox.id, mbox.user)
+
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = mailboxFlags(msgs)
+	status.PermanentFlags = append(append([]string(nil), status.Flags...), "\\*")
+
+	var recent, unseen uint32
+	for i, msg := range msgs {
+		if recentUids[msg.uid] {
+			recent++
+		}
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(msgs))
+		case imap.StatusUidNext:
+			status.UidNext = uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = uidValidity
+		case imap.StatusRecent:
+			status.Recent = recent
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusSize:
+			var size uint64
+			for _, msg := range msgs {
+				size += uint64(msg.Size)
+			}
+			status.Size = size
+		}
+	}
+
+	return status, nil
+}
+
+// mailboxFlags returns the standard flags and the keywords used in a mailbox.
+func mailboxFlags(msgs []message) []string {
+	flags := append([]string(nil), standardFlags...)
+
+	keywords := make(map[string]bool)
+	for _, msg := range msgs {
+		for _, flag := range msg.Flags {
+			if !hasFlag(standardFlags, flag) && !keywords[flag] {
+				keywords[flag] = true
+				flags = append(flags, flag)
+			}
+		}
+	}
+	sort.Strings(flags[len(standardFlags):])
+	return flags
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Select implements backend.SessionMailbox. Unless readOnly is set, the session
+// claims the messages which aren't recent for any other session yet, and
+// messages arriving while the mailbox is selected are recent for this session.
+func (mbox *Mailbox) Select(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	be := mbox.user.be
+	be.sessionsMutex.Lock()
+	mbox.user.unselect()
+	if readOnly {
+		mbox.user.examined = mbox.id
+	} else {
+		st := be.recentState(mbox.id)
+		for uid, owner := range st.recent {
+			if owner == nil {
+				st.recent[uid] = mbox.user
+			}
+		}
+		st.sessions = append(st.sessions, mbox.user)
+		mbox.user.selected = mbox.id
+	}
+	be.sessionsMutex.Unlock()
+
+	return mbox.Status(items)
+}
+
+// Unselect implements backend.SessionMailbox. Messages arriving in the mailbox
+// aren't recent for the session anymore.
+func (mbox *Mailbox) Unselect() error {
+	be := mbox.user.be
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	if mbox.user.selected == mbox.id || mbox.user.examined == mbox.id {
+		mbox.user.unselect()
+	}
+	return nil
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return nil, err
+		}
+		if subscribed {
+			return nil, mb.Put(subscribedKey, []byte{1})
+		}
+		return nil, mb.Delete(subscribedKey)
+	})
+}
+
+func (mbox *Mailbox) Check() error {
+	return nil
+}
+
+func headerAndBody(b []byte) (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(b))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+// needsBody checks whether the message body must be read to fetch items.
+func needsBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) fetch(msg *message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var b []byte
+	if needsBody(items) {
+		var err error
+		if b, err = mbox.user.be.readBlob(msg.Blob); err != nil {
+			return nil, err
+		}
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, _ := headerAndBody(b)
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, _ := headerAndBody(b)
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = msg.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Date
+		case imap.FetchRFC822Size:
+			fetched.Size = msg.Size
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		case imap.FetchPreview:
+			hdr, body, _ := headerAndBody(b)
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody(b)
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (mbox *Mailbox) match(msg *message, seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+	b, err := mbox.user.be.readBlob(msg.Blob)
+	if err != nil {
+		return false, err
+	}
+	e, err := gomessage.Read(bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+
+	md := &backendutil.Metadata{
+		SeqNum: seqNum,
+		Uid:    msg.uid,
+		Date:   msg.Date,
+		Flags:  msg.Flags,
+	}
+	return backendutil.MatchMessage(e, md, c)
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(uid, false, seqset, items, ch)
+}
+
+// listMessages implements ListMessages and UidListMessages. If uidOnly is set,
+// seqset contains UIDs, and messages have their UID populated but not their
+// sequence number.
+func (mbox *Mailbox) listMessages(uid, uidOnly bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	msgs, seqNums, err := mbox.selectMessages(uid || uidOnly, seqset)
+	if err != nil {
+		close(ch)
+		return err
+	}
+
+	setSeen := backendutil.SetsSeen(items) && !mbox.isReadOnly()
+	if setSeen {
+		items = backendutil.WithFlags(items)
+	}
+
+	var seen []uint32
+	for i := range msgs {
+		msg := &msgs[i]
+		if setSeen && !hasFlag(msg.Flags, imap.SeenFlag) {
+			msg.Flags = append(append([]string(nil), msg.Flags...), imap.SeenFlag)
+			seen = append(seen, msg.uid)
+		}
+
+		seqNum := seqNums[i]
+		if uidOnly {
+			seqNum = 0
+		}
+		m, err := mbox.fetch(msg, seqNum, items)
+		if err != nil {
+			// The message has been expunged in the meantime
+			continue
+		}
+		if uidOnly {
+			m.Uid = msg.uid
+		}
+
+		ch <- m
+	}
+
+	// The server can't deliver updates until all messages have been sent
+	close(ch)
+	if len(seen) == 0 {
+		return nil
+	}
+	uids := new(imap.SeqSet)
+	uids.AddNum(seen...)
+	return mbox.UpdateMessagesFlags(true, uids, imap.AddFlags, []string{imap.SeenFlag})
+}
+
+// isReadOnly checks whether the session has selected the mailbox read-only.
+func (mbox *Mailbox) isReadOnly() bool {
+	be := mbox.user.be
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	return mbox.user.examined == mbox.id
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, seqNums, err := mbox.selectMessages(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i := range msgs {
+		ok, err := mbox.match(&msgs[i], seqNums[i], criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := seqNums[i]
+		if uid {
+			id = msgs[i].uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) SortMessages(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, seqNums, err := mbox.selectMessages(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var sortMsgs []backendutil.SortMessage
+	for i, msg := range msgs {
+		ok, err := mbox.match(&msgs[i], seqNums[i], searchCriteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		b, err := mbox.user.be.readBlob(msg.Blob)
+		if err != nil {
+			continue
+		}
+		hdr, _, err := headerAndBody(b)
+		if err != nil {
+			continue
+		}
+
+		sm := backendutil.SortMessage{
+			Id:     seqNums[i],
+			Header: hdr,
+			Date:   msg.Date,
+			Size:   msg.Size,
+		}
+		if uid {
+			sm.Id = msg.uid
+		}
+		sortMsgs = append(sortMsgs, sm)
+	}
+	return backendutil.Sort(sortMsgs, sortCriteria), nil
+}
+
+// appendMessage adds a message to a mailbox and returns its UID.
+func appendMessage(mb *bolt.Bucket, meta []byte) (uint32, error) {
+	uid := getUint32(mb, uidNextKey)
+	if err := mb.Bucket(messagesBucket).Put(uidKey(uid), meta); err != nil {
+		return 0, err
+	}
+	return uid, putUint32(mb, uidNextKey, uid+1)
+}
+
+// existsUpdate returns an update with the number of messages in a mailbox.
+func existsUpdate(username, name string, mb *bolt.Bucket) backend.Update {
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages})
+	c := mb.Bucket(messagesBucket).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		status.Messages++
+	}
+	return &backend.MailboxUpdate{
+		Update:        backend.NewUpdate(username, name),
+		MailboxStatus: status,
+	}
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return mbox.user.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return nil, err
+		}
+
+		blob, err := putBlob(tx, b)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := json.Marshal(&messageMeta{
+			Date:  date,
+			Size:  uint32(len(b)),
+			Flags: withoutRecent(flags),
+			Blob:  blob,
+		})
+		if err != nil {
+			return nil, err
+		}
+		uid, err := appendMessage(mb, meta)
+		if err != nil {
+			return nil, err
+		}
+		mbox.user.be.addRecent(mbox.id, []uint32{uid})
+
+		return []backend.Update{existsUpdate(mbox.user.username, mbox.name, mb)}, nil
+	})
+}
+
+// forEachMessage calls f for each message whose sequence number or UID is in
+// seqset.
+func forEachMessage(mb *bolt.Bucket, uid bool, seqset *imap.SeqSet, f func(seqNum uint32, msg *message) error) error {
+	var seqNum uint32
+	return mb.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		seqNum++
+		msg := &message{uid: keyUid(k)}
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !seqset.Contains(id) {
+			return nil
+		}
+
+		if err := json.Unmarshal(v, &msg.messageMeta); err != nil {
+			return err
+		}
+		return f(seqNum, msg)
+	})
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.user.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return nil, err
+		}
+
+		var updated []*message
+		var updates []backend.Update
+		err = forEachMessage(mb, uid, seqset, func(seqNum uint32, msg *message) error {
+			msg.Flags = backendutil.UpdateFlags(msg.Flags, op, withoutRecent(flags))
+			updated = append(updated, msg)
+
+			m := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+			m.Flags = msg.Flags
+			m.Uid = msg.uid
+			updates = append(updates, &backend.MessageUpdate{
+				Update:  backend.NewUpdate(mbox.user.username, mbox.name),
+				Message: m,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Buckets can't be modified while iterating
+		for _, msg := range updated {
+			if err := putJSON(mb.Bucket(messagesBucket), uidKey(msg.uid), &msg.messageMeta); err != nil {
+				return nil, err
+			}
+		}
+		return updates, nil
+	})
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	destName = canonicalName(destName)
+
+	return mbox.user.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return nil, err
+		}
+		destID := mailboxID(tx, mbox.user.username, destName)
+		if destID == 0 {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		dest, err := mailboxBucket(tx, destID)
+		if err != nil {
+			return nil, err
+		}
+
+		var copied []*message
+		err = forEachMessage(mb, uid, seqset, func(seqNum uint32, msg *message) error {
+			copied = append(copied, msg)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(copied) == 0 {
+			return nil, nil
+		}
+
+		// Bodies are shared with the copies
+		var uids []uint32
+		for _, msg := range copied {
+			if err := retainBlob(tx, msg.Blob); err != nil {
+				return nil, err
+			}
+			meta, err := json.Marshal(&msg.messageMeta)
+			if err != nil {
+				return nil, err
+			}
+			uid, err := appendMessage(dest, meta)
+			if err != nil {
+				return nil, err
+			}
+			uids = append(uids, uid)
+		}
+		mbox.user.be.addRecent(destID, uids)
+
+		return []backend.Update{existsUpdate(mbox.user.username, destName, dest)}, nil
+	})
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.user.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		mb, err := mailboxBucket(tx, mbox.id)
+		if err != nil {
+			return nil, err
+		}
+
+		var expunged []*message
+		var seqNums []uint32
+		err = mb.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			msg := &message{uid: keyUid(k)}
+			if err := json.Unmarshal(v, &msg.messageMeta); err != nil {
+				return err
+			}
+			seqNums = append(seqNums, 0)
+			if hasFlag(msg.Flags, imap.DeletedFlag) {
+				seqNums[len(seqNums)-1] = uint32(len(seqNums))
+				expunged = append(expunged, msg)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Expunge from the last message to the first one, so that sequence
+		// numbers of the remaining messages don't change
+		var updates []backend.Update
+		for i := len(seqNums) - 1; i >= 0; i-- {
+			if seqNums[i] == 0 {
+				continue
+			}
+			msg := expunged[len(expunged)-1]
+			expunged = expunged[:len(expunged)-1]
+
+			if err := mb.Bucket(messagesBucket).Delete(uidKey(msg.uid)); err != nil {
+				return nil, err
+			}
+			if err := releaseBlob(tx, msg.Blob); err != nil {
+				return nil, err
+			}
+
+			mbox.user.be.removeRecent(mbox.id, []uint32{msg.uid})
+
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: backend.NewUpdate(mbox.user.username, mbox.name),
+				SeqNum: seqNums[i],
+				Uid:    msg.uid,
+			})
+		}
+		return updates, nil
+	})
+}
+
+func (mbox *Mailbox) UidListMessages(uids *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(true, true, uids, items, ch)
+}
+
+func (mbox *Mailbox) UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessages(true, criteria)
+}
+
+func (mbox *Mailbox) UidUpdateMessagesFlags(uids *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlags(true, uids, op, flags)
+}
+
+func (mbox *Mailbox) UidCopyMessages(uids *imap.SeqSet, destName string) error {
+	return mbox.CopyMessages(true, uids, destName)
+}
+
+var (
+	_ backend.SortMailbox    = (*Mailbox)(nil)
+	_ backend.UidOnlyMailbox = (*Mailbox)(nil)
+	_ backend.SessionMailbox = (*Mailbox)(nil)
+)
@@ -0,0 +1,122 @@
+package boltdb
+
+import (
+	"github.com/emersion/go-imap"
+)
+
+// recentState keeps track of the \Recent flag of a mailbox's messages. It
+// isn't stored in the database: messages aren't recent anymore when the
+// backend is re-opened, which RFC 3501 allows.
+type recentState struct {
+	// UIDs of messages with the \Recent flag, mapped to the session they're
+	// recent for. Messages which arrived when no session had selected the
+	// mailbox are mapped to nil, until a session selects it.
+	recent map[uint32]*User
+	// Sessions which have selected the mailbox read-write, in order
+	sessions []*User
+}
+
+// recentState returns the state of a mailbox, creating it if needed.
+// Backend.sessionsMutex must be locked.
+func (be *Backend) recentState(id uint64) *recentState {
+	if be.recent == nil {
+		be.recent = make(map[uint64]*recentState)
+	}
+	st, ok := be.recent[id]
+	if !ok {
+		st = &recentState{recent: make(map[uint32]*User)}
+		be.recent[id] = st
+	}
+	return st
+}
+
+// addRecent marks messages which have been added to a mailbox as recent for
+// the first session which has selected it read-write, if any.
+func (be *Backend) addRecent(id uint64, uids []uint32) {
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	st := be.recentState(id)
+	var owner *User
+	if len(st.sessions) > 0 {
+		owner = st.sessions[0]
+	}
+	for _, uid := range uids {
+		st.recent[uid] = owner
+	}
+}
+
+// removeRecent forgets expunged messages.
+func (be *Backend) removeRecent(id uint64, uids []uint32) {
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	if st, ok := be.recent[id]; ok {
+		for _, uid := range uids {
+			delete(st.recent, uid)
+		}
+	}
+}
+
+// forgetRecent forgets a deleted mailbox. Mailbox IDs are never re-used.
+func (be *Backend) forgetRecent(id uint64) {
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	delete(be.recent, id)
+}
+
+// recentUids returns the UIDs of the messages of a mailbox which are recent for
+// a session.
+func (be *Backend) recentUids(id uint64, u *User) map[uint32]bool {
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	uids := make(map[uint32]bool)
+	if st, ok := be.recent[id]; ok {
+		for uid, owner := range st.recent {
+			if owner == nil || owner == u {
+				uids[uid] = true
+			}
+		}
+	}
+	return uids
+}
+
+// withRecent returns the flags of a message, including \Recent if recent is
+// set.
+func withRecent(flags []string, recent bool) []string {
+	if !recent {
+		return flags
+	}
+	return append(append([]string(nil), flags...), imap.RecentFlag)
+}
+
+// withoutRecent returns flags without \Recent, which isn't stored.
+func withoutRecent(flags []string) []string {
+	var l []string
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	return l
+}
+
+// unselect removes the session from the sessions of its selected mailbox.
+// Backend.sessionsMutex must be locked.
+func (u *User) unselect() {
+	u.examined = 0
+	if u.selected == 0 {
+		return
+	}
+	if st, ok := u.be.recent[u.selected]; ok {
+		for i, s := range st.sessions {
+			if s == u {
+				st.sessions = append(st.sessions[:i:i], st.sessions[i+1:]...)
+				break
+			}
+		}
+	}
+	u.selected = 0
+}
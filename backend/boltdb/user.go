@@ -0,0 +1,250 @@
+package boltdb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+// User is a user stored in the database.
+type User struct {
+	be       *Backend
+	username string
+
+	// The IDs of the mailboxes selected read-write and read-only by this
+	// session, or zero. Protected by Backend.sessionsMutex.
+	selected, examined uint64
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// canonicalName returns the canonical name of a mailbox. INBOX is
+// case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+// userMailboxes returns the bucket mapping the names of the user's mailboxes
+// to their IDs.
+func (u *User) userMailboxes(tx *bolt.Tx) (*bolt.Bucket, error) {
+	ub := tx.Bucket(usersBucket).Bucket([]byte(u.username))
+	if ub == nil {
+		return nil, ErrNoSuchUser
+	}
+	return ub.Bucket(userMailboxesBucket), nil
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	var mailboxes []backend.Mailbox
+	err := u.be.db.View(func(tx *bolt.Tx) error {
+		userMailboxes, err := u.userMailboxes(tx)
+		if err != nil {
+			return err
+		}
+
+		return userMailboxes.ForEach(func(name, id []byte) error {
+			mb, err := mailboxBucket(tx, btoi(id))
+			if err != nil {
+				return err
+			}
+			if subscribed && mb.Get(subscribedKey) == nil {
+				return nil
+			}
+
+			mailboxes = append(mailboxes, &Mailbox{user: u, name: string(name), id: btoi(id)})
+			return nil
+		})
+	})
+	return mailboxes, err
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.getMailbox(name)
+}
+
+func (u *User) getMailbox(name string) (*Mailbox, error) {
+	name = canonicalName(name)
+
+	var id uint64
+	err := u.be.db.View(func(tx *bolt.Tx) error {
+		if id = mailboxID(tx, u.username, name); id == 0 {
+			return backend.ErrNoSuchMailbox
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mailbox{user: u, name: name, id: id}, nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = canonicalName(strings.TrimSuffix(name, Delimiter))
+	if name == "" {
+		return errors.New("Invalid mailbox name")
+	}
+
+	return u.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		if _, err := createMailbox(tx, u.username, name); err != nil {
+			return nil, err
+		}
+		return nil, createParents(tx, u.username, name)
+	})
+}
+
+// createParents creates the missing superior mailboxes of name.
+func createParents(tx *bolt.Tx, username, name string) error {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], Delimiter)
+		if parent == "" || mailboxID(tx, username, parent) != 0 {
+			continue
+		}
+		if _, err := createMailbox(tx, username, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	name = canonicalName(name)
+	if name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	return u.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		userMailboxes, err := u.userMailboxes(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		id := userMailboxes.Get([]byte(name))
+		if id == nil {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		if err := deleteMailbox(tx, btoi(id)); err != nil {
+			return nil, err
+		}
+		u.be.forgetRecent(btoi(id))
+		return nil, userMailboxes.Delete([]byte(name))
+	})
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingName = canonicalName(existingName)
+	newName = canonicalName(strings.TrimSuffix(newName, Delimiter))
+	if newName == "" {
+		return errors.New("Invalid mailbox name")
+	}
+
+	return u.be.update(func(tx *bolt.Tx) ([]backend.Update, error) {
+		userMailboxes, err := u.userMailboxes(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		id := userMailboxes.Get([]byte(existingName))
+		if id == nil {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		if userMailboxes.Get([]byte(newName)) != nil {
+			return nil, backend.ErrMailboxAlreadyExists
+		}
+
+		if existingName == "INBOX" {
+			return u.renameInbox(tx, btoi(id), newName)
+		}
+
+		// Inferior mailboxes are renamed too
+		renames := map[string]string{existingName: newName}
+		prefix := existingName + Delimiter
+		c := userMailboxes.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			renames[string(k)] = newName + Delimiter + strings.TrimPrefix(string(k), prefix)
+		}
+
+		for from, to := range renames {
+			if userMailboxes.Get([]byte(to)) != nil {
+				return nil, backend.ErrMailboxAlreadyExists
+			}
+			id := append([]byte(nil), userMailboxes.Get([]byte(from))...)
+			if err := userMailboxes.Delete([]byte(from)); err != nil {
+				return nil, err
+			}
+			if err := userMailboxes.Put([]byte(to), id); err != nil {
+				return nil, err
+			}
+		}
+		return nil, createParents(tx, u.username, newName)
+	})
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty.
+func (u *User) renameInbox(tx *bolt.Tx, inboxID uint64, newName string) ([]backend.Update, error) {
+	id, err := createMailbox(tx, u.username, newName)
+	if err != nil {
+		return nil, err
+	}
+	if err := createParents(tx, u.username, newName); err != nil {
+		return nil, err
+	}
+
+	inbox, err := mailboxBucket(tx, inboxID)
+	if err != nil {
+		return nil, err
+	}
+	mb, err := mailboxBucket(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids, newUids []uint32
+	err = inbox.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		uids = append(uids, keyUid(k))
+		uid, err := appendMessage(mb, v)
+		newUids = append(newUids, uid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.be.removeRecent(inboxID, uids)
+	u.be.addRecent(id, newUids)
+
+	// Expunge from the last message to the first one
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+
+	var updates []backend.Update
+	for i, uid := range uids {
+		if err := inbox.Bucket(messagesBucket).Delete(uidKey(uid)); err != nil {
+			return nil, err
+		}
+		updates = append(updates, &backend.ExpungeUpdate{
+			Update: backend.NewUpdate(u.username, "INBOX"),
+			SeqNum: uint32(len(uids) - i),
+			Uid:    uid,
+		})
+	}
+	return updates, nil
+}
+
+// Logout ends the session. Messages arriving in the mailbox it had selected
+// aren't recent for this session anymore.
+func (u *User) Logout() error {
+	u.be.sessionsMutex.Lock()
+	defer u.be.sessionsMutex.Unlock()
+
+	u.unselect()
+	return nil
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+)
+
+// UserWithContext binds the operations of u to ctx if u implements
+// ContextUser. Otherwise, u is returned unchanged.
+func UserWithContext(ctx context.Context, u User) User {
+	if u, ok := u.(ContextUser); ok && ctx != nil {
+		return u.WithContext(ctx)
+	}
+	return u
+}
+
+// MailboxWithContext binds the operations of mbox to ctx if mbox implements
+// ContextMailbox. Otherwise, mbox is returned unchanged.
+func MailboxWithContext(ctx context.Context, mbox Mailbox) Mailbox {
+	if mbox, ok := mbox.(ContextMailbox); ok && ctx != nil {
+		return mbox.WithContext(ctx)
+	}
+	return mbox
+}
+
+type contextKey int
+
+const (
+	connInfoContextKey contextKey = iota
+	tagContextKey
+)
+
+// ContextWithConnInfo returns a copy of ctx carrying the information about a
+// client connection.
+func ContextWithConnInfo(ctx context.Context, connInfo *imap.ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoContextKey, connInfo)
+}
+
+// ConnInfoFromContext returns the information about the client connection
+// carried by ctx, or nil if there is none.
+func ConnInfoFromContext(ctx context.Context) *imap.ConnInfo {
+	connInfo, _ := ctx.Value(connInfoContextKey).(*imap.ConnInfo)
+	return connInfo
+}
+
+// ContextWithTag returns a copy of ctx carrying the tag of the command being
+// handled.
+func ContextWithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagContextKey, tag)
+}
+
+// TagFromContext returns the tag of the command carried by ctx, or an empty
+// string if there is none.
+func TagFromContext(ctx context.Context) string {
+	tag, _ := ctx.Value(tagContextKey).(string)
+	return tag
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -37,6 +38,11 @@ type Mailbox interface {
 	// if uid is set to true and as message sequence numbers otherwise. See RFC
 	// 3501 section 6.4.5 for a list of items that can be requested.
 	//
+	// Fetching a body section without BODY.PEEK, RFC822 or RFC822.TEXT sets the
+	// \Seen flag of messages, unless the mailbox has been selected read-only
+	// with SessionMailbox.Select. Messages must include their flags then. See
+	// backendutil.SetsSeen.
+	//
 	// Messages must be sent to ch. When the function returns, ch must be closed.
 	ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error
 
@@ -48,6 +54,10 @@ type Mailbox interface {
 	// be added no matter flags is empty or not. If date is nil, the current time
 	// will be used.
 	//
+	// body may be read directly from the client connection: it must not be
+	// used after CreateMessage returns. Backends which need random access to
+	// the message can use imap.BufferLiteral.
+	//
 	// If the Backend implements Updater, it must notify the client immediately
 	// via a mailbox update.
 	CreateMessage(flags []string, date time.Time, body imap.Literal) error
@@ -76,3 +86,84 @@ type Mailbox interface {
 	// via an expunge update.
 	Expunge() error
 }
+
+// SortMailbox is a mailbox that supports sorting messages, as defined in RFC
+// 5256. Backends must list ExtSort in their supported extensions for the SORT
+// command to be advertised.
+type SortMailbox interface {
+	Mailbox
+
+	// SortMessages searches messages and sorts the results. The returned list
+	// must contain UIDs if uid is set to true, or sequence numbers otherwise.
+	// Messages which compare equal must be ordered by sequence number.
+	SortMessages(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error)
+}
+
+// UidOnlyMailbox is a mailbox that can be accessed with UIDs only. It's used
+// instead of the Mailbox methods when the client has enabled the UIDONLY
+// extension, defined in RFC 9586, so that the backend doesn't need to keep
+// track of message sequence numbers.
+type UidOnlyMailbox interface {
+	Mailbox
+
+	// UidListMessages is identical to ListMessages with uid set to true, except
+	// that messages don't need to have their sequence number populated. The
+	// UID must always be populated.
+	UidListMessages(uids *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error
+
+	// UidSearchMessages is identical to SearchMessages with uid set to true.
+	// criteria never contains sequence numbers.
+	UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error)
+
+	// UidUpdateMessagesFlags is identical to UpdateMessagesFlags with uid set
+	// to true.
+	UidUpdateMessagesFlags(uids *imap.SeqSet, operation imap.FlagsOp, flags []string) error
+
+	// UidCopyMessages is identical to CopyMessages with uid set to true.
+	UidCopyMessages(uids *imap.SeqSet, dest string) error
+}
+
+// SessionMailbox is a mailbox that keeps track of per-session state, such as
+// the \Recent flag. The server calls Select instead of Status when the mailbox
+// is selected.
+type SessionMailbox interface {
+	Mailbox
+
+	// Select returns the mailbox status, like Status. It's called when the
+	// mailbox is selected with SELECT, or with EXAMINE if readOnly is set. As
+	// defined in RFC 3501 section 2.3.2, a session selecting the mailbox
+	// read-write removes the \Recent flag from messages for other sessions.
+	Select(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, error)
+
+	// Unselect is called when the mailbox stops being selected, e.g. with
+	// CLOSE or UNSELECT, or before another mailbox is selected.
+	Unselect() error
+}
+
+// ProgressFunc reports the progress of a long-running operation: count items
+// out of total have been processed. total is zero if unknown.
+type ProgressFunc func(count, total uint32)
+
+// ProgressMailbox is a mailbox that reports the progress of long-running
+// operations. The server forwards it to the client with INPROGRESS responses,
+// as defined in RFC 9585.
+type ProgressMailbox interface {
+	Mailbox
+
+	// WithProgress returns a view of this mailbox whose SearchMessages,
+	// CopyMessages and Expunge methods call progress while they run. The view
+	// is only used for a single operation. If the mailbox implements
+	// UidOnlyMailbox, the view must implement it too.
+	WithProgress(progress ProgressFunc) Mailbox
+}
+
+// ContextMailbox is a mailbox whose operations can be cancelled.
+type ContextMailbox interface {
+	Mailbox
+
+	// WithContext returns a view of this mailbox whose operations are bound to
+	// ctx: they should stop and return ctx.Err() when ctx is cancelled. The
+	// view is only used for a single command. It must implement the same
+	// optional interfaces as the mailbox, such as UidOnlyMailbox.
+	WithContext(ctx context.Context) Mailbox
+}
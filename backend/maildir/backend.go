@@ -0,0 +1,201 @@
+// Package maildir implements an IMAP backend storing messages in Maildir++
+// directories.
+//
+// Each user has a Maildir++ directory in the backend root directory, named
+// after the username. Message flags are stored in Maildir file names, with
+// keywords mapped to the letters a to z. UIDs are stored in an imap-uidlist
+// file in each mailbox directory, and keywords in an imap-keywords file. Both
+// are protected by a lock file, so that several processes can access the same
+// directories. Messages can be delivered to the new directory by other
+// processes at any time, clients are notified of changes.
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Backend is a Maildir backend.
+//
+// Maildir directories don't contain passwords: Login always fails, the
+// backend must be used with a backend.Authenticator (see
+// server.Server.Authenticator).
+type Backend struct {
+	root    string
+	updates chan backend.Update
+	watcher *fsnotify.Watcher
+
+	mutex           sync.Mutex
+	states          map[string]*mailboxState
+	lastUidValidity uint32
+}
+
+// New creates a new Maildir backend storing users' Maildir directories in
+// root. The backend watches the directories for changes, Close must be called
+// to stop it.
+func New(root string) (*Backend, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	be := &Backend{
+		root:    root,
+		updates: make(chan backend.Update, 64),
+		watcher: watcher,
+		states:  make(map[string]*mailboxState),
+	}
+	go be.watch()
+	return be, nil
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	return nil, backend.ErrInvalidCredentials
+}
+
+// LookupUser implements backend.UserBackend. The user's Maildir directory is
+// created if it doesn't exist.
+func (be *Backend) LookupUser(_ *imap.ConnInfo, identity string) (backend.User, error) {
+	if identity == "" || identity == "." || identity == ".." || strings.ContainsAny(identity, "/\\\x00") {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	dir := filepath.Join(be.root, identity)
+	if err := createMaildir(dir); err != nil {
+		return nil, err
+	}
+
+	return &User{be: be, username: identity, dir: dir}, nil
+}
+
+// Updates implements backend.BackendUpdater. Updates must be consumed, for
+// instance by a server.Server, otherwise operations on mailboxes block.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *Backend) SupportedExtensions() []backend.Extension {
+	return []backend.Extension{
+		backend.ExtStatusSize,
+		backend.ExtPreview,
+		backend.ExtWithin,
+		backend.ExtSort,
+	}
+}
+
+// Close stops watching Maildir directories.
+func (be *Backend) Close() error {
+	return be.watcher.Close()
+}
+
+// sendUpdates sends updates to clients, and waits for them to be delivered so
+// that they're sent in order and before the command's completion response.
+func (be *Backend) sendUpdates(updates []backend.Update) {
+	backendutil.SendUpdates(be.updates, updates)
+}
+
+// newUidValidity returns a new UIDVALIDITY value. Values are derived from the
+// current time, and are never re-used.
+func (be *Backend) newUidValidity() uint32 {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	v := uint32(time.Now().Unix())
+	if v <= be.lastUidValidity {
+		v = be.lastUidValidity + 1
+	}
+	be.lastUidValidity = v
+	return v
+}
+
+// state returns the shared state of a mailbox directory, loading it if
+// necessary.
+func (be *Backend) state(dir, username, name string) (*mailboxState, error) {
+	be.mutex.Lock()
+	st, ok := be.states[dir]
+	if !ok {
+		st = &mailboxState{be: be, dir: dir, username: username, name: name}
+		be.states[dir] = st
+	}
+	be.mutex.Unlock()
+
+	st.Lock()
+	defer st.Unlock()
+
+	if st.loaded {
+		return st, nil
+	}
+	if _, err := st.sync(); err != nil {
+		return nil, err
+	}
+
+	for _, sub := range []string{"new", "cur"} {
+		if err := be.watcher.Add(filepath.Join(dir, sub)); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// forgetState drops the state of a mailbox directory which is about to be
+// removed or renamed.
+func (be *Backend) forgetState(dir string) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	if _, ok := be.states[dir]; !ok {
+		return
+	}
+	delete(be.states, dir)
+	for _, sub := range []string{"new", "cur"} {
+		be.watcher.Remove(filepath.Join(dir, sub))
+	}
+}
+
+// watch synchronizes mailboxes when their Maildir directory changes.
+func (be *Backend) watch() {
+	pending := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-be.watcher.Events:
+			if !ok {
+				return
+			}
+			// Events are reported for files in the new and cur directories
+			pending[filepath.Dir(filepath.Dir(ev.Name))] = true
+			if timer == nil {
+				timer = time.After(watchDelay)
+			}
+		case _, ok := <-be.watcher.Errors:
+			if !ok {
+				return
+			}
+		case <-timer:
+			timer = nil
+			for dir := range pending {
+				delete(pending, dir)
+
+				be.mutex.Lock()
+				st := be.states[dir]
+				be.mutex.Unlock()
+
+				if st != nil {
+					st.poll()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Delimiter is the mailbox hierarchy delimiter. It's the same as the one used
+// in Maildir++ directory names.
+const Delimiter = "."
+
+var standardFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+}
+
+// Mailbox is a Maildir mailbox.
+type Mailbox struct {
+	user *User
+	name string
+	dir  string
+	st   *mailboxState
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	// Pick up changes made by other processes
+	if err := mbox.st.poll(); err != nil {
+		return nil, err
+	}
+
+	mbox.st.Lock()
+	defer mbox.st.Unlock()
+
+	return mbox.status(items), nil
+}
+
+// status returns the mailbox status. The state must be locked.
+func (mbox *Mailbox) status(items []imap.StatusItem) *imap.MailboxStatus {
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = append(append([]string(nil), standardFlags...), mbox.st.keywords...)
+	status.PermanentFlags = append([]string(nil), status.Flags...)
+	if len(mbox.st.keywords) < maxKeywords {
+		status.PermanentFlags = append(status.PermanentFlags, "\\*")
+	}
+
+	var recent, unseen uint32
+	for i, msg := range mbox.st.messages {
+		if mbox.st.isRecent(msg.uid, mbox.user) {
+			recent++
+		}
+		if !hasFlag(msg.flags, imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mbox.st.messages))
+		case imap.StatusUidNext:
+			status.UidNext = mbox.st.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.st.uidValidity
+		case imap.StatusRecent:
+			status.Recent = recent
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusSize:
+			// Message files aren't read with the state locked: if the
+			// size isn't part of the file name, the file size is used
+			var size uint64
+			for _, msg := range mbox.st.messages {
+				if msg.size != 0 {
+					size += uint64(msg.size)
+				} else {
+					size += uint64(msg.fileSize)
+				}
+			}
+			status.Size = size
+		}
+	}
+
+	return status
+}
+
+// Select implements backend.SessionMailbox. Unless readOnly is set, the session
+// claims the messages which aren't recent for any other session yet, and
+// messages arriving while the mailbox is selected are recent for this session.
+func (mbox *Mailbox) Select(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if err := mbox.st.poll(); err != nil {
+		return nil, err
+	}
+
+	u := mbox.user
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.unselect()
+
+	st := mbox.st
+	st.Lock()
+	defer st.Unlock()
+
+	if readOnly {
+		u.examined = st
+	} else {
+		for uid, owner := range st.recent {
+			if owner == nil {
+				st.recent[uid] = u
+			}
+		}
+		st.sessions = append(st.sessions, u)
+		u.selected = st
+	}
+
+	return mbox.status(items), nil
+}
+
+// Unselect implements backend.SessionMailbox. Messages arriving in the mailbox
+// aren't recent for the session anymore.
+func (mbox *Mailbox) Unselect() error {
+	u := mbox.user
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.selected == mbox.st || u.examined == mbox.st {
+		u.unselect()
+	}
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *Mailbox) Check() error {
+	return mbox.st.poll()
+}
+
+// Poll implements backend.MailboxPoller.
+func (mbox *Mailbox) Poll() error {
+	return mbox.st.poll()
+}
+
+// selectMessages returns a snapshot of the messages whose sequence number or
+// UID is in seqset, along with their sequence numbers.
+func (mbox *Mailbox) selectMessages(uid bool, seqset *imap.SeqSet) (msgs []message, seqNums []uint32) {
+	mbox.st.Lock()
+	all := mbox.st.snapshot(mbox.user)
+	mbox.st.Unlock()
+
+	for i, msg := range all {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqset != nil && !seqset.Contains(id) {
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		seqNums = append(seqNums, seqNum)
+	}
+	return msgs, seqNums
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(uid, false, seqset, items, ch)
+}
+
+// listMessages implements ListMessages and UidListMessages. If uidOnly is set,
+// seqset contains UIDs, and messages have their UID populated but not their
+// sequence number.
+func (mbox *Mailbox) listMessages(uid, uidOnly bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	setSeen := backendutil.SetsSeen(items) && !mbox.isReadOnly()
+	if setSeen {
+		items = backendutil.WithFlags(items)
+	}
+
+	var seen []uint32
+	msgs, seqNums := mbox.selectMessages(uid || uidOnly, seqset)
+	for i, msg := range msgs {
+		if setSeen && !hasFlag(msg.flags, imap.SeenFlag) {
+			msg.flags = append(append([]string(nil), msg.flags...), imap.SeenFlag)
+			seen = append(seen, msg.uid)
+		}
+
+		seqNum := seqNums[i]
+		if uidOnly {
+			seqNum = 0
+		}
+		m, err := msg.fetch(mbox.dir, seqNum, items)
+		if err != nil {
+			// The message has been removed in the meantime
+			continue
+		}
+		if uidOnly {
+			m.Uid = msg.uid
+		}
+
+		ch <- m
+	}
+
+	// The server can't deliver updates until all messages have been sent
+	close(ch)
+	if len(seen) == 0 {
+		return nil
+	}
+	uids := new(imap.SeqSet)
+	uids.AddNum(seen...)
+	return mbox.UpdateMessagesFlags(true, uids, imap.AddFlags, []string{imap.SeenFlag})
+}
+
+// isReadOnly checks whether the session has selected the mailbox read-only.
+func (mbox *Mailbox) isReadOnly() bool {
+	mbox.user.mutex.Lock()
+	defer mbox.user.mutex.Unlock()
+
+	return mbox.user.examined == mbox.st
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, seqNums := mbox.selectMessages(false, nil)
+
+	var ids []uint32
+	for i, msg := range msgs {
+		ok, err := msg.match(mbox.dir, seqNums[i], criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := seqNums[i]
+		if uid {
+			id = msg.uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) SortMessages(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, seqNums := mbox.selectMessages(false, nil)
+
+	var sortMsgs []backendutil.SortMessage
+	for i, msg := range msgs {
+		ok, err := msg.match(mbox.dir, seqNums[i], searchCriteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		b, err := msg.readBody(mbox.dir)
+		if err != nil {
+			continue
+		}
+		hdr, _, err := headerAndBody(b)
+		if err != nil {
+			continue
+		}
+
+		sm := backendutil.SortMessage{
+			Id:     seqNums[i],
+			Header: hdr,
+			Date:   msg.date,
+			Size:   uint32(len(b)),
+		}
+		if uid {
+			sm.Id = msg.uid
+		}
+		sortMsgs = append(sortMsgs, sm)
+	}
+	return backendutil.Sort(sortMsgs, sortCriteria), nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return mbox.st.createMessage(b, flags, date)
+}
+
+// createMessage delivers a message to the mailbox and notifies clients.
+func (st *mailboxState) createMessage(b []byte, flags []string, date time.Time) error {
+	st.Lock()
+	updates, err := st.withDirLock(func(keywords *[]string) error {
+		info, err := formatInfo(flags, keywords)
+		if err != nil {
+			return err
+		}
+		_, err = deliver(st.dir, b, info, date)
+		return err
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	st := mbox.st
+
+	st.Lock()
+	updates, err := st.withDirLock(func(keywords *[]string) error {
+		for i, msg := range st.messages {
+			id := uint32(i + 1)
+			if uid {
+				id = msg.uid
+			}
+			if !seqset.Contains(id) {
+				continue
+			}
+
+			newFlags := backendutil.UpdateFlags(append([]string(nil), msg.flags...), op, flags)
+			info, err := formatInfo(newFlags, keywords)
+			if err != nil {
+				return err
+			}
+
+			if err := renameMessage(st.dir, msg, msg.key+":2,"+info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+// renameMessage renames a message file in the cur directory. Messages removed
+// by someone else are ignored.
+func renameMessage(dir string, msg *message, name string) error {
+	if msg.name == name {
+		return nil
+	}
+
+	err := os.Rename(filepath.Join(dir, "cur", msg.name), filepath.Join(dir, "cur", name))
+	if os.IsNotExist(err) {
+		if msg.name, err = resolveName(dir, msg.key); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(dir, "cur", msg.name), filepath.Join(dir, "cur", name))
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest, err := mbox.user.getMailbox(destName)
+	if err != nil {
+		return err
+	}
+
+	// All messages are delivered before synchronizing the destination
+	msgs, _ := mbox.selectMessages(uid, seqset)
+	st := dest.st
+	st.Lock()
+	updates, err := st.withDirLock(func(keywords *[]string) error {
+		for _, msg := range msgs {
+			b, err := msg.readBody(mbox.dir)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			info, err := formatInfo(msg.flags, keywords)
+			if err != nil {
+				return err
+			}
+			if _, err := deliver(st.dir, b, info, msg.date); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (mbox *Mailbox) Expunge() error {
+	st := mbox.st
+
+	st.Lock()
+	updates, err := st.withDirLock(func(keywords *[]string) error {
+		for _, msg := range st.messages {
+			if !hasFlag(msg.flags, imap.DeletedFlag) {
+				continue
+			}
+
+			err := os.Remove(filepath.Join(st.dir, "cur", msg.name))
+			if os.IsNotExist(err) {
+				// The flags may have been changed by someone else
+				var name string
+				if name, err = resolveName(st.dir, msg.key); err == nil {
+					_, info := splitFilename(name)
+					if hasFlag(parseInfo(info, *keywords), imap.DeletedFlag) {
+						err = os.Remove(filepath.Join(st.dir, "cur", name))
+					}
+				}
+			}
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (mbox *Mailbox) UidListMessages(uids *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(true, true, uids, items, ch)
+}
+
+func (mbox *Mailbox) UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessages(true, criteria)
+}
+
+func (mbox *Mailbox) UidUpdateMessagesFlags(uids *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlags(true, uids, op, flags)
+}
+
+func (mbox *Mailbox) UidCopyMessages(uids *imap.SeqSet, destName string) error {
+	return mbox.CopyMessages(true, uids, destName)
+}
+
+var (
+	_ backend.MailboxPoller  = (*Mailbox)(nil)
+	_ backend.SortMailbox    = (*Mailbox)(nil)
+	_ backend.UidOnlyMailbox = (*Mailbox)(nil)
+	_ backend.SessionMailbox = (*Mailbox)(nil)
+)
@@ -0,0 +1,357 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Files stored in each mailbox directory, in addition to the Maildir cur, new
+// and tmp sub-directories.
+const (
+	uidListFile  = "imap-uidlist"
+	keywordsFile = "imap-keywords"
+	lockFile     = "imap-uidlist.lock"
+	folderFile   = "maildirfolder"
+)
+
+// Maildir info flags, as defined in https://cr.yp.to/proto/maildir.html.
+var infoFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+// maxKeywords is the number of keywords that can be stored in a file name,
+// with the letters a to z.
+const maxKeywords = 26
+
+var errTooManyKeywords = errors.New("maildir: too many keywords")
+
+// splitFilename splits a Maildir file name into its unique key and its info
+// flags.
+func splitFilename(name string) (key, info string) {
+	i := strings.Index(name, ":2,")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+len(":2,"):]
+}
+
+// parseInfo converts Maildir info flags to IMAP flags.
+func parseInfo(info string, keywords []string) []string {
+	var flags []string
+	for i := 0; i < len(info); i++ {
+		c := info[i]
+		if c >= 'a' && c <= 'z' {
+			if j := int(c - 'a'); j < len(keywords) {
+				flags = append(flags, keywords[j])
+			}
+			continue
+		}
+		for _, f := range infoFlags {
+			if f.letter == c {
+				flags = append(flags, f.flag)
+			}
+		}
+	}
+	return flags
+}
+
+// formatInfo converts IMAP flags to Maildir info flags. Keywords which don't
+// have a letter yet are added to keywords. The \Recent flag is ignored.
+func formatInfo(flags []string, keywords *[]string) (string, error) {
+	var letters []byte
+	for _, flag := range flags {
+		if flag == imap.RecentFlag {
+			continue
+		}
+
+		found := false
+		for _, f := range infoFlags {
+			if strings.EqualFold(f.flag, flag) {
+				letters = append(letters, f.letter)
+				found = true
+			}
+		}
+		if found || strings.HasPrefix(flag, "\\") {
+			continue
+		}
+
+		i := -1
+		for j, kw := range *keywords {
+			if strings.EqualFold(kw, flag) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			if len(*keywords) >= maxKeywords {
+				return "", errTooManyKeywords
+			}
+			i = len(*keywords)
+			*keywords = append(*keywords, flag)
+		}
+		letters = append(letters, byte('a'+i))
+	}
+
+	// Flags must be in ASCII order, without duplicates
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	var info []byte
+	for i, c := range letters {
+		if i == 0 || letters[i-1] != c {
+			info = append(info, c)
+		}
+	}
+	return string(info), nil
+}
+
+// parseSize extracts the size of a message from a file name with a ,S= or
+// ,W= field.
+func parseSize(key, field string) (uint32, bool) {
+	i := strings.Index(key, ","+field+"=")
+	if i < 0 {
+		return 0, false
+	}
+	s := key[i+len(field)+2:]
+	if j := strings.IndexByte(s, ','); j >= 0 {
+		s = s[:j]
+	}
+	size, err := strconv.ParseUint(s, 10, 32)
+	return uint32(size), err == nil
+}
+
+var deliveryCounter uint32
+
+// newKey generates a unique key for a new message, as described in
+// https://cr.yp.to/proto/maildir.html.
+func newKey(size int) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	// Slashes and colons are not allowed in file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	now := time.Now()
+	n := atomic.AddUint32(&deliveryCounter, 1)
+	return fmt.Sprintf("%v.M%vP%vQ%v.%v,S=%v,W=%v", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, hostname, size, size)
+}
+
+// deliver writes a message to a Maildir directory, with the provided info
+// flags and modification time. It returns the file name in the cur
+// directory.
+func deliver(dir string, body []byte, info string, date time.Time) (string, error) {
+	key := newKey(len(body))
+	tmpPath := filepath.Join(dir, "tmp", key)
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := os.Chtimes(tmpPath, date, date); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	name := key + ":2," + info
+	if err := os.Rename(tmpPath, filepath.Join(dir, "cur", name)); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return name, nil
+}
+
+// createMaildir creates the cur, new and tmp directories of a Maildir.
+func createMaildir(dir string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMaildir checks whether a directory is a Maildir.
+func isMaildir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && fi.IsDir()
+}
+
+// uidList is the list of UIDs assigned to the messages of a mailbox, stored in
+// the imap-uidlist file. The first line contains a version number, the
+// UIDVALIDITY and the next UID. Each following line contains a UID and the key
+// of the message it's assigned to.
+type uidList struct {
+	uidValidity uint32
+	uidNext     uint32
+	uids        map[string]uint32
+}
+
+func readUidList(dir string) (*uidList, error) {
+	l := &uidList{uids: make(map[string]uint32)}
+
+	f, err := os.Open(filepath.Join(dir, uidListFile))
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return l, scanner.Err()
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &version, &l.uidValidity, &l.uidNext); err != nil {
+		return nil, fmt.Errorf("maildir: malformed %v header: %v", uidListFile, err)
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("maildir: unsupported %v version %v", uidListFile, version)
+	}
+
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("maildir: malformed %v line", uidListFile)
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: malformed %v UID: %v", uidListFile, err)
+		}
+		l.uids[fields[1]] = uint32(uid)
+	}
+	return l, scanner.Err()
+}
+
+func (l *uidList) write(dir string) error {
+	keys := make([]string, 0, len(l.uids))
+	for key := range l.uids {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return l.uids[keys[i]] < l.uids[keys[j]] })
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "1 %v %v\n", l.uidValidity, l.uidNext)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%v %v\n", l.uids[key], key)
+	}
+	return backendutil.WriteFileAtomic(filepath.Join(dir, uidListFile), b.Bytes(), 0600)
+}
+
+// readKeywords reads the keywords of a mailbox. The nth keyword is stored with
+// the nth letter in file names.
+func readKeywords(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, keywordsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keywords []string
+	for _, kw := range strings.Split(string(b), "\n") {
+		if kw != "" {
+			keywords = append(keywords, kw)
+		}
+	}
+	return keywords, nil
+}
+
+func writeKeywords(dir string, keywords []string) error {
+	var b bytes.Buffer
+	for _, kw := range keywords {
+		b.WriteString(kw + "\n")
+	}
+	return backendutil.WriteFileAtomic(filepath.Join(dir, keywordsFile), b.Bytes(), 0600)
+}
+
+const (
+	lockTimeout = 30 * time.Second
+	lockStale   = 2 * time.Minute
+)
+
+// lock acquires the lock of a mailbox directory. It's a dot-lock file, so that
+// it also works across processes and on network file systems.
+func lock(dir string) (unlock func(), err error) {
+	path := filepath.Join(dir, lockFile)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%v\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Break stale locks left by crashed processes
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("maildir: timeout while waiting for mailbox lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// normalizeNewlines converts bare LF line endings, commonly used by local
+// delivery agents, to CRLF, as required by IMAP.
+func normalizeNewlines(b []byte) []byte {
+	n := 0
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			n++
+		}
+	}
+	if n == 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b)+n)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
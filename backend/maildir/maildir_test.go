@@ -0,0 +1,452 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"\r\n" +
+	"Hi there :)\r\n"
+
+func TestFormatInfo(t *testing.T) {
+	var keywords []string
+	info, err := formatInfo([]string{imap.SeenFlag, "$Forwarded", imap.RecentFlag, imap.FlaggedFlag, "$Junk"}, &keywords)
+	if err != nil {
+		t.Fatal("formatInfo() =", err)
+	}
+	if info != "FSab" {
+		t.Errorf("formatInfo() = %q, want %q", info, "FSab")
+	}
+	if want := []string{"$Forwarded", "$Junk"}; !reflect.DeepEqual(keywords, want) {
+		t.Errorf("keywords = %v, want %v", keywords, want)
+	}
+
+	flags := parseInfo(info, keywords)
+	want := []string{imap.FlaggedFlag, imap.SeenFlag, "$Forwarded", "$Junk"}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("parseInfo() = %v, want %v", flags, want)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	got := normalizeNewlines([]byte("a\nb\r\nc\n"))
+	if want := []byte("a\r\nb\r\nc\r\n"); !bytes.Equal(got, want) {
+		t.Errorf("normalizeNewlines() = %q, want %q", got, want)
+	}
+}
+
+func newTestBackend(t *testing.T, root string) (*Backend, <-chan backend.Update) {
+	be, err := New(root)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+
+	// Acknowledge updates, like a server would
+	updates := make(chan backend.Update, 100)
+	go func() {
+		for update := range be.Updates() {
+			updates <- update
+			close(update.Done())
+		}
+	}()
+	return be, updates
+}
+
+func testUser(t *testing.T, be *Backend) *User {
+	u, err := be.LookupUser(nil, "username")
+	if err != nil {
+		t.Fatal("LookupUser() =", err)
+	}
+	return u.(*User)
+}
+
+func listMessages(t *testing.T, mbox backend.Mailbox) []*imap.Message {
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size}
+	if err := mbox.ListMessages(false, seqset, items, ch); err != nil {
+		t.Fatal("ListMessages() =", err)
+	}
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestMailbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, _ := newTestBackend(t, root)
+	u := testUser(t, be)
+
+	mbox, err := u.GetMailbox("inbox")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if mbox.Name() != "INBOX" {
+		t.Errorf("mbox.Name() = %v, want INBOX", mbox.Name())
+	}
+
+	for i := 0; i < 3; i++ {
+		body := bytes.NewBufferString(testMessage)
+		if err := mbox.CreateMessage([]string{"$Important"}, time.Now(), body); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+
+	msgs := listMessages(t, mbox)
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.SeqNum != uint32(i+1) || msg.Uid != uint32(i+1) {
+			t.Errorf("Invalid message #%v: seq %v, UID %v", i+1, msg.SeqNum, msg.Uid)
+		}
+		if msg.Size != uint32(len(testMessage)) {
+			t.Errorf("Invalid size for message #%v: %v", i+1, msg.Size)
+		}
+		if !reflect.DeepEqual(msg.Flags, []string{"$Important", imap.RecentFlag}) {
+			t.Errorf("Invalid flags for message #%v: %v", i+1, msg.Flags)
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(root, "username", "cur"))
+	deleted := 0
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ":2,Ta") {
+			deleted++
+		}
+	}
+	if deleted != 1 {
+		t.Errorf("Expected a file name with the T flag, got %v", entries)
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	msgs = listMessages(t, mbox)
+	if len(msgs) != 2 || msgs[0].Uid != 1 || msgs[1].Uid != 3 {
+		t.Fatalf("Invalid messages after expunge: %v", msgs)
+	}
+
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	be.Close()
+
+	// UIDs are persistent
+	be, _ = newTestBackend(t, root)
+	defer be.Close()
+	mbox, err = testUser(t, be).GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+
+	newStatus, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if newStatus.UidValidity != status.UidValidity || newStatus.UidNext != 4 {
+		t.Errorf("Invalid status after restart: UIDVALIDITY %v, UIDNEXT %v", newStatus.UidValidity, newStatus.UidNext)
+	}
+	msgs = listMessages(t, mbox)
+	if len(msgs) != 2 || msgs[0].Uid != 1 || msgs[1].Uid != 3 {
+		t.Fatalf("Invalid messages after restart: %v", msgs)
+	}
+}
+
+func TestMailbox_externalDelivery(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, updates := newTestBackend(t, root)
+	defer be.Close()
+	mbox, err := testUser(t, be).GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+
+	// Deliver a message with LF line endings, like a local delivery agent
+	body := strings.Replace(testMessage, "\r\n", "\n", -1)
+	tmpPath := filepath.Join(root, "username", "tmp", "1234.delivery")
+	if err := ioutil.WriteFile(tmpPath, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(root, "username", "new", "1234.delivery")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case update := <-updates:
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		if !ok || mboxUpdate.Messages != 1 || update.Username() != "username" || update.Mailbox() != "INBOX" {
+			t.Errorf("Invalid update: %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout while waiting for an update")
+	}
+
+	msgs := listMessages(t, mbox)
+	if len(msgs) != 1 || msgs[0].Uid != 1 {
+		t.Fatalf("Invalid messages: %v", msgs)
+	}
+	if msgs[0].Size != uint32(len(testMessage)) {
+		t.Errorf("Invalid size: got %v, want %v", msgs[0].Size, len(testMessage))
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "username", "cur", "1234.delivery:2,")); err != nil {
+		t.Errorf("Message hasn't been moved to cur: %v", err)
+	}
+}
+
+func TestMailbox_copy(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, updates := newTestBackend(t, root)
+	defer be.Close()
+	u := testUser(t, be)
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	for i := 0; i < 3; i++ {
+		body := bytes.NewBufferString(testMessage)
+		if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), body); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+	for len(updates) > 0 {
+		<-updates
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.CopyMessages(false, seqset, "Archive"); err != nil {
+		t.Fatal("CopyMessages() =", err)
+	}
+
+	// The destination is synchronized once
+	if len(updates) != 1 {
+		t.Fatalf("Expected a single update, got %v", len(updates))
+	}
+	update, ok := (<-updates).(*backend.MailboxUpdate)
+	if !ok || update.Mailbox() != "Archive" || update.Messages != 3 {
+		t.Errorf("Invalid update: %+v", update)
+	}
+
+	dest, err := u.GetMailbox("Archive")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	msgs := listMessages(t, dest)
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(msgs))
+	}
+	for i, msg := range msgs {
+		if !reflect.DeepEqual(msg.Flags, []string{imap.SeenFlag, imap.RecentFlag}) {
+			t.Errorf("Invalid flags for message #%v: %v", i+1, msg.Flags)
+		}
+	}
+
+	status, err := dest.Status([]imap.StatusItem{imap.StatusSize})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if want := uint64(3 * len(testMessage)); status.Size != want {
+		t.Errorf("Status(): SIZE = %v, want %v", status.Size, want)
+	}
+}
+
+func TestMailbox_recent(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A message delivered before the server starts is recent too
+	be, _ := newTestBackend(t, root)
+	testUser(t, be)
+	be.Close()
+	if err := ioutil.WriteFile(filepath.Join(root, "username", "new", "1234.delivery"), []byte(testMessage), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be, _ = newTestBackend(t, root)
+	defer be.Close()
+	mbox, err := testUser(t, be).GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	other, err := testUser(t, be).GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+
+	items := []imap.StatusItem{imap.StatusRecent}
+	status, err := mbox.(backend.SessionMailbox).Select(false, items)
+	if err != nil {
+		t.Fatal("Select() =", err)
+	}
+	if status.Recent != 1 {
+		t.Errorf("Select(): RECENT = %v, want 1", status.Recent)
+	}
+
+	// The message isn't recent for other sessions anymore
+	status, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if status.Recent != 0 {
+		t.Errorf("Status() for another session: RECENT = %v, want 0", status.Recent)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	uids, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.(backend.UidOnlyMailbox).UidListMessages(uids, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal("UidListMessages() =", err)
+	}
+	msg := <-ch
+	if msg == nil || msg.Uid != 1 || !reflect.DeepEqual(msg.Flags, []string{imap.RecentFlag}) {
+		t.Errorf("UidListMessages() = %+v, want UID 1 with \\Recent", msg)
+	}
+
+	ids, err := mbox.SearchMessages(false, &imap.SearchCriteria{WithFlags: []string{imap.RecentFlag}})
+	if err != nil {
+		t.Fatal("SearchMessages() =", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{1}) {
+		t.Errorf("SearchMessages(RECENT) = %v, want [1]", ids)
+	}
+
+	// Once the mailbox is unselected, new messages are recent for other
+	// sessions
+	if err := mbox.(backend.SessionMailbox).Unselect(); err != nil {
+		t.Fatal("Unselect() =", err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	status, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if status.Recent != 1 {
+		t.Errorf("Status() after unselect: RECENT = %v, want 1", status.Recent)
+	}
+}
+
+func TestUser_mailboxes(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, _ := newTestBackend(t, root)
+	defer be.Close()
+	u := testUser(t, be)
+
+	if err := u.CreateMailbox("Archive.2020"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	if err := u.CreateMailbox("Archive"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("CreateMailbox() = %v, want %v", err, backend.ErrMailboxAlreadyExists)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", ".Archive.2020", folderFile)); err != nil {
+		t.Errorf("Missing Maildir++ folder: %v", err)
+	}
+
+	if err := u.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+	if err := u.DeleteMailbox("Old"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+
+	mbox, err := u.GetMailbox("Old.2020")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal("SetSubscribed() =", err)
+	}
+
+	var names []string
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name())
+	}
+	if want := []string{"INBOX", "Old.2020"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListMailboxes(false) = %v, want %v", names, want)
+	}
+
+	mailboxes, err = u.ListMailboxes(true)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Name() != "Old.2020" {
+		t.Errorf("ListMailboxes(true) = %v", mailboxes)
+	}
+
+	if _, err := u.GetMailbox("../other"); err == nil {
+		t.Error("Expected an error for an invalid mailbox name")
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Instance {
+		root, err := ioutil.TempDir("", "go-imap-maildir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		be, err := New(root)
+		if err != nil {
+			t.Fatal("New() =", err)
+		}
+		return &backendtest.Instance{
+			Backend:  be,
+			Username: "username",
+			Close: func() {
+				be.Close()
+				os.RemoveAll(root)
+			},
+		}
+	})
+}
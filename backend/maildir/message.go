@@ -0,0 +1,139 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+type message struct {
+	uid uint32
+	// The unique part of the file name, which doesn't change with flags
+	key string
+	// The file name in the cur directory
+	name  string
+	flags []string
+	date  time.Time
+	// Zero if unknown
+	size uint32
+	// The size of the file, which differs from size if the file has LF line
+	// endings
+	fileSize int64
+}
+
+// readBody reads the message from the Maildir directory.
+func (m *message) readBody(dir string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cur", m.name))
+	if os.IsNotExist(err) {
+		// The flags have been changed by someone else in the meantime
+		if m.name, err = resolveName(dir, m.key); err != nil {
+			return nil, err
+		}
+		b, err = ioutil.ReadFile(filepath.Join(dir, "cur", m.name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeNewlines(b), nil
+}
+
+func headerAndBody(b []byte) (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(b))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+// needsBody checks whether the message file must be read to fetch items.
+func (m *message) needsBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchUid:
+		case imap.FetchRFC822Size:
+			if m.size == 0 {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (m *message) fetch(dir string, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var b []byte
+	if m.needsBody(items) {
+		var err error
+		if b, err = m.readBody(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, _ := headerAndBody(b)
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, _ := headerAndBody(b)
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.date
+		case imap.FetchRFC822Size:
+			fetched.Size = m.size
+			if b != nil {
+				fetched.Size = uint32(len(b))
+			}
+		case imap.FetchUid:
+			fetched.Uid = m.uid
+		case imap.FetchPreview:
+			hdr, body, _ := headerAndBody(b)
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody(b)
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (m *message) match(dir string, seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+	b, err := m.readBody(dir)
+	if err != nil {
+		return false, err
+	}
+	e, err := gomessage.Read(bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+
+	md := &backendutil.Metadata{
+		SeqNum: seqNum,
+		Uid:    m.uid,
+		Date:   m.date,
+		Flags:  m.flags,
+	}
+	return backendutil.MatchMessage(e, md, c)
+}
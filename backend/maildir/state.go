@@ -0,0 +1,296 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// mailboxState is the state of a mailbox, shared by all connections which
+// access it so that they agree on message sequence numbers. It's kept in sync
+// with the Maildir directory, which can be modified by other processes.
+type mailboxState struct {
+	sync.Mutex
+
+	be       *Backend
+	dir      string
+	username string
+	name     string
+
+	loaded      bool
+	uidValidity uint32
+	uidNext     uint32
+	keywords    []string
+	// Sorted by UID
+	messages []*message
+
+	// UIDs of messages with the \Recent flag, mapped to the session they're
+	// recent for. Messages which arrived when no session had selected the
+	// mailbox are mapped to nil, until a session selects it.
+	recent map[uint32]*User
+	// Sessions which have selected the mailbox read-write, in order
+	sessions []*User
+}
+
+// snapshot returns a copy of the messages, which can be accessed without
+// holding the lock. The \Recent flag is added to the messages which are recent
+// for the session.
+func (st *mailboxState) snapshot(u *User) []message {
+	msgs := make([]message, len(st.messages))
+	for i, msg := range st.messages {
+		msgs[i] = *msg
+		if st.isRecent(msg.uid, u) {
+			msgs[i].flags = append(append([]string(nil), msg.flags...), imap.RecentFlag)
+		}
+	}
+	return msgs
+}
+
+// isRecent checks whether a message is recent for the session.
+func (st *mailboxState) isRecent(uid uint32, u *User) bool {
+	owner, ok := st.recent[uid]
+	return ok && (owner == nil || owner == u)
+}
+
+// recentOwner returns the session new messages are recent for: the first one
+// which has selected the mailbox read-write, if any.
+func (st *mailboxState) recentOwner() *User {
+	if len(st.sessions) > 0 {
+		return st.sessions[0]
+	}
+	return nil
+}
+
+// removeSession removes a session from the sessions which have selected the
+// mailbox.
+func (st *mailboxState) removeSession(u *User) {
+	for i, s := range st.sessions {
+		if s == u {
+			st.sessions = append(st.sessions[:i:i], st.sessions[i+1:]...)
+			break
+		}
+	}
+}
+
+// sync updates the state from the Maildir directory, assigns UIDs to new
+// messages and returns updates describing the changes. It must be called with
+// the state locked.
+func (st *mailboxState) sync() ([]backend.Update, error) {
+	unlock, err := lock(st.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	list, err := readUidList(st.dir)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := readKeywords(st.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	if list.uidValidity == 0 {
+		list.uidValidity = st.be.newUidValidity()
+		list.uidNext = 1
+		changed = true
+	}
+
+	// Move new messages to cur, they're now known to an IMAP server
+	newEntries, err := ioutil.ReadDir(filepath.Join(st.dir, "new"))
+	if err != nil {
+		return nil, err
+	}
+	fromNew := make(map[string]bool, len(newEntries))
+	for _, fi := range newEntries {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		key, info := splitFilename(fi.Name())
+		err := os.Rename(filepath.Join(st.dir, "new", fi.Name()), filepath.Join(st.dir, "cur", key+":2,"+info))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		fromNew[key] = true
+	}
+
+	curEntries, err := ioutil.ReadDir(filepath.Join(st.dir, "cur"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]os.FileInfo, len(curEntries))
+	var unknown []os.FileInfo
+	for _, fi := range curEntries {
+		if strings.HasPrefix(fi.Name(), ".") || fi.IsDir() {
+			continue
+		}
+		key, _ := splitFilename(fi.Name())
+		files[key] = fi
+		if _, ok := list.uids[key]; !ok {
+			unknown = append(unknown, fi)
+		}
+	}
+
+	for key := range list.uids {
+		if _, ok := files[key]; !ok {
+			delete(list.uids, key)
+			changed = true
+		}
+	}
+
+	// Assign UIDs to new messages, in delivery order
+	sort.Slice(unknown, func(i, j int) bool {
+		if !unknown[i].ModTime().Equal(unknown[j].ModTime()) {
+			return unknown[i].ModTime().Before(unknown[j].ModTime())
+		}
+		return unknown[i].Name() < unknown[j].Name()
+	})
+	reset := !st.loaded || st.uidValidity != list.uidValidity
+	if reset {
+		st.recent = make(map[uint32]*User)
+	}
+	for _, fi := range unknown {
+		key, _ := splitFilename(fi.Name())
+		list.uids[key] = list.uidNext
+		// Messages taken from new are recent. Once the mailbox is loaded,
+		// messages delivered directly to cur, e.g. by APPEND, are recent too.
+		if fromNew[key] || !reset {
+			st.recent[list.uidNext] = st.recentOwner()
+		}
+		list.uidNext++
+		changed = true
+	}
+
+	if changed {
+		if err := list.write(st.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	msgs := make([]*message, 0, len(files))
+	for key, fi := range files {
+		_, info := splitFilename(fi.Name())
+		msg := &message{
+			uid:      list.uids[key],
+			key:      key,
+			name:     fi.Name(),
+			flags:    parseInfo(info, keywords),
+			date:     fi.ModTime(),
+			fileSize: fi.Size(),
+		}
+		if size, ok := parseSize(key, "W"); ok {
+			msg.size = size
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+
+	// Expunged messages aren't recent anymore
+	present := make(map[uint32]bool, len(msgs))
+	for _, msg := range msgs {
+		present[msg.uid] = true
+	}
+	for uid := range st.recent {
+		if !present[uid] {
+			delete(st.recent, uid)
+		}
+	}
+
+	var updates []backend.Update
+	if st.loaded && st.uidValidity == list.uidValidity {
+		updates = backendutil.DiffMessages(st.username, st.name, messageStates(st.messages), messageStates(msgs))
+	} else if st.loaded {
+		// The mailbox has been re-created, clients need to re-synchronize
+		updates = append(updates, &backend.StatusUpdate{
+			Update: backend.NewUpdate(st.username, st.name),
+			StatusResp: &imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: "UIDVALIDITY changed",
+			},
+		})
+	}
+
+	st.loaded = true
+	st.uidValidity = list.uidValidity
+	st.uidNext = list.uidNext
+	st.keywords = keywords
+	st.messages = msgs
+	return updates, nil
+}
+
+// poll synchronizes the state with the Maildir directory and notifies
+// clients.
+func (st *mailboxState) poll() error {
+	return backendutil.Poll(st, st.sync, st.be.updates)
+}
+
+// messageStates returns the states of messages known to clients.
+func messageStates(msgs []*message) []backendutil.MessageState {
+	states := make([]backendutil.MessageState, len(msgs))
+	for i, msg := range msgs {
+		states[i] = backendutil.MessageState{Uid: msg.uid, Flags: msg.flags}
+	}
+	return states
+}
+
+// withDirLock runs f with the Maildir directory locked and the keywords
+// loaded, then synchronizes the state. It must be called with the state
+// locked.
+func (st *mailboxState) withDirLock(f func(keywords *[]string) error) ([]backend.Update, error) {
+	unlock, err := lock(st.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keywords, err := readKeywords(st.dir)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	n := len(keywords)
+
+	err = f(&keywords)
+	if len(keywords) != n {
+		if kwErr := writeKeywords(st.dir, keywords); err == nil {
+			err = kwErr
+		}
+	}
+	unlock()
+
+	updates, syncErr := st.sync()
+	if err == nil {
+		err = syncErr
+	}
+	return updates, err
+}
+
+// resolveName finds the current file name of a message in the cur directory.
+// The file name changes when the flags are updated, possibly by another
+// process.
+func resolveName(dir, key string) (string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return "", err
+	}
+	for _, fi := range entries {
+		if k, _ := splitFilename(fi.Name()); k == key {
+			return fi.Name(), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// watchDelay is the time to wait after a change in a Maildir directory before
+// synchronizing the mailbox, so that bursts of changes are processed at once.
+const watchDelay = 50 * time.Millisecond
@@ -0,0 +1,337 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// subscriptionsFile contains the names of the subscribed mailboxes, one per
+// line.
+const subscriptionsFile = "subscriptions"
+
+var errInvalidMailboxName = errors.New("Invalid mailbox name")
+
+// User is a user whose mailboxes are stored in a Maildir++ directory: INBOX is
+// the directory itself, other mailboxes are sub-directories whose name is the
+// mailbox name prefixed with a dot.
+type User struct {
+	be       *Backend
+	username string
+	dir      string
+
+	// Protects selected and examined
+	mutex sync.Mutex
+	// The mailbox selected read-write by this session, if any
+	selected *mailboxState
+	// The mailbox selected read-only by this session, if any
+	examined *mailboxState
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// mailboxDir returns the directory of a mailbox.
+func (u *User) mailboxDir(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") {
+		return u.dir, nil
+	}
+
+	if name == "" || strings.ContainsAny(name, "/\x00") {
+		return "", errInvalidMailboxName
+	}
+	for _, part := range strings.Split(name, Delimiter) {
+		if part == "" {
+			return "", errInvalidMailboxName
+		}
+	}
+	return filepath.Join(u.dir, "."+name), nil
+}
+
+// canonicalName returns the canonical name of a mailbox. INBOX is
+// case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	names := []string{"INBOX"}
+
+	entries, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if !isMaildir(filepath.Join(u.dir, name)) {
+			continue
+		}
+		names = append(names, name[1:])
+	}
+
+	if subscribed {
+		subscriptions, err := u.subscriptions()
+		if err != nil {
+			return nil, err
+		}
+
+		var l []string
+		for _, name := range names {
+			if subscriptions[name] {
+				l = append(l, name)
+			}
+		}
+		names = l
+	}
+
+	var mailboxes []backend.Mailbox
+	for _, name := range names {
+		mbox, err := u.getMailbox(name)
+		if err != nil {
+			continue
+		}
+		mailboxes = append(mailboxes, mbox)
+	}
+	return mailboxes, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.getMailbox(name)
+}
+
+func (u *User) getMailbox(name string) (*Mailbox, error) {
+	dir, err := u.mailboxDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isMaildir(dir) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	name = canonicalName(name)
+	st, err := u.be.state(dir, u.username, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mailbox{user: u, name: name, dir: dir, st: st}, nil
+}
+
+// createFolder creates a Maildir++ folder, and its parents if they don't
+// exist.
+func (u *User) createFolder(name string) error {
+	parts := strings.Split(name, Delimiter)
+	for i := range parts {
+		dir, err := u.mailboxDir(strings.Join(parts[:i+1], Delimiter))
+		if err != nil {
+			return err
+		}
+		if isMaildir(dir) {
+			continue
+		}
+
+		if err := createMaildir(dir); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, folderFile), nil, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+
+	dir, err := u.mailboxDir(name)
+	if err != nil {
+		return err
+	}
+	if isMaildir(dir) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	return u.createFolder(name)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if strings.EqualFold(name, "INBOX") {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	dir, err := u.mailboxDir(name)
+	if err != nil {
+		return err
+	}
+	if !isMaildir(dir) {
+		return backend.ErrNoSuchMailbox
+	}
+
+	// Inferior mailboxes are sibling directories, they're kept
+	u.be.forgetState(dir)
+	return os.RemoveAll(dir)
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingDir, err := u.mailboxDir(existingName)
+	if err != nil {
+		return err
+	}
+	if !isMaildir(existingDir) {
+		return backend.ErrNoSuchMailbox
+	}
+	newDir, err := u.mailboxDir(newName)
+	if err != nil {
+		return err
+	}
+	if isMaildir(newDir) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if strings.EqualFold(existingName, "INBOX") {
+		return u.renameInbox(newName)
+	}
+
+	// Create parents, then replace the leaf with the renamed directory
+	if err := u.createFolder(newName); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+
+	// Inferior mailboxes are renamed too
+	entries, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return err
+	}
+	renames := map[string]string{existingDir: newDir}
+	prefix := "." + existingName + Delimiter
+	for _, fi := range entries {
+		if strings.HasPrefix(fi.Name(), prefix) {
+			to := "." + newName + Delimiter + strings.TrimPrefix(fi.Name(), prefix)
+			renames[filepath.Join(u.dir, fi.Name())] = filepath.Join(u.dir, to)
+		}
+	}
+
+	for from, to := range renames {
+		u.be.forgetState(from)
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty.
+func (u *User) renameInbox(newName string) error {
+	if err := u.createFolder(newName); err != nil {
+		return err
+	}
+	newDir, err := u.mailboxDir(newName)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(u.dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, fi := range entries {
+			err := os.Rename(filepath.Join(u.dir, sub, fi.Name()), filepath.Join(newDir, sub, fi.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// Notify clients which have selected INBOX
+	inbox, err := u.getMailbox("INBOX")
+	if err != nil {
+		return err
+	}
+	return inbox.st.poll()
+}
+
+func (u *User) subscriptions() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(u.dir, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make(map[string]bool)
+	for _, name := range strings.Split(string(b), "\n") {
+		if name != "" {
+			subscriptions[name] = true
+		}
+	}
+	return subscriptions, nil
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.be.mutex.Lock()
+	defer u.be.mutex.Unlock()
+
+	subscriptions, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		subscriptions[name] = true
+	} else {
+		delete(subscriptions, name)
+	}
+
+	names := make([]string, 0, len(subscriptions))
+	for name := range subscriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	return backendutil.WriteFileAtomic(filepath.Join(u.dir, subscriptionsFile), []byte(b.String()), 0600)
+}
+
+// Logout ends the session. Messages arriving in the mailbox it had selected
+// aren't recent for this session anymore.
+func (u *User) Logout() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.unselect()
+	return nil
+}
+
+// unselect removes the session from the sessions of its selected mailbox.
+// u.mutex must be locked.
+func (u *User) unselect() {
+	u.examined = nil
+	if u.selected == nil {
+		return
+	}
+	u.selected.Lock()
+	u.selected.removeSession(u)
+	u.selected.Unlock()
+	u.selected = nil
+}
@@ -0,0 +1,148 @@
+// Package mbox implements an IMAP backend storing messages in mbox files.
+//
+// Each user has a directory in the backend root directory, named after the
+// username. INBOX is the INBOX file in this directory, other mailboxes are
+// files whose path is the mailbox name. Directories are mailboxes which can't
+// be selected but can have inferiors.
+//
+// As a consequence, a mailbox can't both contain messages and have inferiors:
+// mailboxes which contain messages have the \Noinferiors attribute, and
+// creating an inferior of such a mailbox fails. Mailboxes created with a
+// trailing hierarchy delimiter, and superior mailboxes created implicitly, are
+// directories.
+//
+// Both the mboxrd and mboxcl2 formats can be read, new messages are written in
+// the mboxrd format. UIDs, flags and message locations are stored in a hidden
+// index file next to each mbox file. mbox files are protected by dot-lock
+// files, so that they can be modified by other processes such as mail delivery
+// agents. External modifications are detected: if the index can't be
+// reconciled with the mbox file, UIDVALIDITY is changed.
+package mbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Backend is an mbox backend.
+//
+// mbox files don't contain passwords: Login always fails, the backend must be
+// used with a backend.Authenticator (see server.Server.Authenticator).
+type Backend struct {
+	root    string
+	updates chan backend.Update
+
+	mutex           sync.Mutex
+	states          map[string]*mailboxState
+	lastUidValidity uint32
+}
+
+// New creates a new mbox backend storing users' mailboxes in root.
+func New(root string) (*Backend, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		root:    root,
+		updates: make(chan backend.Update, 64),
+		states:  make(map[string]*mailboxState),
+	}, nil
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	return nil, backend.ErrInvalidCredentials
+}
+
+// LookupUser implements backend.UserBackend. The user's directory is created
+// if it doesn't exist.
+func (be *Backend) LookupUser(_ *imap.ConnInfo, identity string) (backend.User, error) {
+	if identity == "" || identity == "." || identity == ".." || strings.ContainsAny(identity, "/\\\x00") {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	dir := filepath.Join(be.root, identity)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &User{be: be, username: identity, dir: dir}, nil
+}
+
+// Updates implements backend.BackendUpdater. Updates must be consumed, for
+// instance by a server.Server, otherwise operations on mailboxes block.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *Backend) SupportedExtensions() []backend.Extension {
+	return []backend.Extension{
+		backend.ExtStatusSize,
+		backend.ExtPreview,
+		backend.ExtWithin,
+		backend.ExtSort,
+	}
+}
+
+// sendUpdates sends updates to clients, and waits for them to be delivered so
+// that they're sent in order and before the command's completion response.
+func (be *Backend) sendUpdates(updates []backend.Update) {
+	backendutil.SendUpdates(be.updates, updates)
+}
+
+// newUidValidity returns a new UIDVALIDITY value. Values are derived from the
+// current time, and are never re-used.
+func (be *Backend) newUidValidity() uint32 {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	v := uint32(time.Now().Unix())
+	if v <= be.lastUidValidity {
+		v = be.lastUidValidity + 1
+	}
+	be.lastUidValidity = v
+	return v
+}
+
+// state returns the shared state of an mbox file, loading it if necessary.
+func (be *Backend) state(path, username, name string) (*mailboxState, error) {
+	be.mutex.Lock()
+	st, ok := be.states[path]
+	if !ok {
+		st = &mailboxState{be: be, path: path, username: username, name: name}
+		be.states[path] = st
+	}
+	be.mutex.Unlock()
+
+	st.Lock()
+	defer st.Unlock()
+
+	if st.loaded {
+		return st, nil
+	}
+	if _, err := st.sync(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// forgetStates drops the states of an mbox file, or of all mbox files in a
+// directory, which is about to be removed or renamed.
+func (be *Backend) forgetStates(path string) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for p := range be.states {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(be.states, p)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+const indexVersion = 1
+
+// index is the sidecar file of an mbox file. It contains the UIDs, flags and
+// locations of messages, along with the size and modification time of the
+// mbox file when it was last indexed so that external modifications can be
+// detected.
+//
+// The first line contains the version, UIDVALIDITY, UIDNEXT, size and
+// modification time. Each following line describes a message: UID, offset,
+// length, size, checksum, internal date and flags.
+type index struct {
+	uidValidity uint32
+	uidNext     uint32
+	size        int64
+	modTime     time.Time
+	// Sorted by UID, which is also the order of messages in the mbox file
+	messages []*message
+}
+
+// indexPath returns the path of the index of an mbox file. It's a hidden file
+// in the same directory.
+func indexPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".index")
+}
+
+func readIndex(path string) (*index, error) {
+	idx := &index{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() {
+		return idx, scanner.Err()
+	}
+
+	var version int
+	var modTime int64
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d %d %d", &version, &idx.uidValidity, &idx.uidNext, &idx.size, &modTime); err != nil {
+		return nil, fmt.Errorf("mbox: malformed index header: %v", err)
+	}
+	if version != indexVersion {
+		return nil, fmt.Errorf("mbox: unsupported index version %v", version)
+	}
+	idx.modTime = time.Unix(0, modTime)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("mbox: malformed index line")
+		}
+
+		var values [6]uint64
+		for i, s := range fields[:6] {
+			base := 10
+			if i == 4 {
+				base = 16
+			}
+			if values[i], err = strconv.ParseUint(s, base, 64); err != nil {
+				return nil, fmt.Errorf("mbox: malformed index line: %v", err)
+			}
+		}
+
+		idx.messages = append(idx.messages, &message{
+			uid:    uint32(values[0]),
+			offset: int64(values[1]),
+			length: int64(values[2]),
+			size:   uint32(values[3]),
+			crc:    uint32(values[4]),
+			date:   time.Unix(int64(values[5]), 0),
+			flags:  fields[6:],
+		})
+	}
+	return idx, scanner.Err()
+}
+
+func (idx *index) write(path string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%v %v %v %v %v\n", indexVersion, idx.uidValidity, idx.uidNext, idx.size, idx.modTime.UnixNano())
+	for _, msg := range idx.messages {
+		fmt.Fprintf(&b, "%v %v %v %v %08x %v", msg.uid, msg.offset, msg.length, msg.size, msg.crc, msg.date.Unix())
+		for _, flag := range msg.flags {
+			b.WriteString(" " + flag)
+		}
+		b.WriteString("\n")
+	}
+	return backendutil.WriteFileAtomic(path, b.Bytes(), 0600)
+}
+
+// clone returns a copy of the index, whose messages can be modified.
+func (idx *index) clone() *index {
+	c := *idx
+	c.messages = make([]*message, len(idx.messages))
+	for i, msg := range idx.messages {
+		m := *msg
+		c.messages[i] = &m
+	}
+	return &c
+}
+
+// assignUids assigns UIDs to new messages, which have a zero UID.
+func (idx *index) assignUids() {
+	for _, msg := range idx.messages {
+		if msg.uid == 0 {
+			msg.uid = idx.uidNext
+			idx.uidNext++
+		}
+	}
+}
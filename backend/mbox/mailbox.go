@@ -0,0 +1,501 @@
+package mbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Delimiter is the mailbox hierarchy delimiter.
+const Delimiter = "/"
+
+var errNoSelect = errors.New("Mailbox cannot be selected")
+
+var standardFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+}
+
+// Mailbox is an mbox mailbox. Mailboxes which are directories can't be
+// selected.
+type Mailbox struct {
+	user *User
+	name string
+	path string
+	// Nil if the mailbox is a directory
+	st *mailboxState
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	if mbox.st == nil {
+		info.Attributes = append(info.Attributes, imap.NoSelectAttr)
+	} else {
+		info.Attributes = append(info.Attributes, imap.NoInferiorsAttr)
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if mbox.st == nil {
+		return nil, errNoSelect
+	}
+
+	// Pick up changes made by other processes
+	if err := mbox.st.poll(); err != nil {
+		return nil, err
+	}
+
+	mbox.st.Lock()
+	defer mbox.st.Unlock()
+
+	return mbox.status(items), nil
+}
+
+// status returns the mailbox status. The state must be locked.
+func (mbox *Mailbox) status(items []imap.StatusItem) *imap.MailboxStatus {
+	msgs := mbox.st.idx.messages
+
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = mailboxFlags(msgs)
+	status.PermanentFlags = append(append([]string(nil), status.Flags...), "\\*")
+
+	var recent, unseen uint32
+	for i, msg := range msgs {
+		if mbox.st.isRecent(msg.uid, mbox.user) {
+			recent++
+		}
+		if !hasFlag(msg.flags, imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(msgs))
+		case imap.StatusUidNext:
+			status.UidNext = mbox.st.idx.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.st.idx.uidValidity
+		case imap.StatusRecent:
+			status.Recent = recent
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusSize:
+			var size uint64
+			for _, msg := range msgs {
+				size += uint64(msg.size)
+			}
+			status.Size = size
+		}
+	}
+
+	return status
+}
+
+// Select implements backend.SessionMailbox. Unless readOnly is set, the session
+// claims the messages which aren't recent for any other session yet, and
+// messages arriving while the mailbox is selected are recent for this session.
+func (mbox *Mailbox) Select(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if mbox.st == nil {
+		return nil, errNoSelect
+	}
+	if err := mbox.st.poll(); err != nil {
+		return nil, err
+	}
+
+	u := mbox.user
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.unselect()
+
+	st := mbox.st
+	st.Lock()
+	defer st.Unlock()
+
+	if readOnly {
+		u.examined = st
+	} else {
+		for uid, owner := range st.recent {
+			if owner == nil {
+				st.recent[uid] = u
+			}
+		}
+		st.sessions = append(st.sessions, u)
+		u.selected = st
+	}
+
+	return mbox.status(items), nil
+}
+
+// Unselect implements backend.SessionMailbox. Messages arriving in the mailbox
+// aren't recent for the session anymore.
+func (mbox *Mailbox) Unselect() error {
+	u := mbox.user
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if mbox.st != nil && (u.selected == mbox.st || u.examined == mbox.st) {
+		u.unselect()
+	}
+	return nil
+}
+
+// mailboxFlags returns the standard flags and the keywords used in a mailbox.
+func mailboxFlags(msgs []*message) []string {
+	flags := append([]string(nil), standardFlags...)
+
+	keywords := make(map[string]bool)
+	for _, msg := range msgs {
+		for _, flag := range msg.flags {
+			if !hasFlag(standardFlags, flag) && !keywords[flag] {
+				keywords[flag] = true
+				flags = append(flags, flag)
+			}
+		}
+	}
+	sort.Strings(flags[len(standardFlags):])
+	return flags
+}
+
+// withoutRecent returns flags without \Recent, which isn't stored.
+func withoutRecent(flags []string) []string {
+	var l []string
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	return l
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *Mailbox) Check() error {
+	return mbox.st.poll()
+}
+
+// Poll implements backend.MailboxPoller.
+func (mbox *Mailbox) Poll() error {
+	return mbox.st.poll()
+}
+
+// selectMessages returns a snapshot of the messages whose sequence number or
+// UID is in seqset, along with their sequence numbers.
+func (mbox *Mailbox) selectMessages(uid bool, seqset *imap.SeqSet) (msgs []message, seqNums []uint32) {
+	mbox.st.Lock()
+	all := mbox.st.snapshot(mbox.user)
+	mbox.st.Unlock()
+
+	for i, msg := range all {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqset != nil && !seqset.Contains(id) {
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		seqNums = append(seqNums, seqNum)
+	}
+	return msgs, seqNums
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(uid, false, seqset, items, ch)
+}
+
+// listMessages implements ListMessages and UidListMessages. If uidOnly is set,
+// seqset contains UIDs, and messages have their UID populated but not their
+// sequence number.
+func (mbox *Mailbox) listMessages(uid, uidOnly bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	f, err := os.Open(mbox.path)
+	if os.IsNotExist(err) {
+		close(ch)
+		return nil
+	} else if err != nil {
+		close(ch)
+		return err
+	}
+	defer f.Close()
+
+	setSeen := backendutil.SetsSeen(items) && !mbox.isReadOnly()
+	if setSeen {
+		items = backendutil.WithFlags(items)
+	}
+
+	var seen []uint32
+	msgs, seqNums := mbox.selectMessages(uid || uidOnly, seqset)
+	for i, msg := range msgs {
+		if setSeen && !hasFlag(msg.flags, imap.SeenFlag) {
+			msg.flags = append(append([]string(nil), msg.flags...), imap.SeenFlag)
+			seen = append(seen, msg.uid)
+		}
+
+		seqNum := seqNums[i]
+		if uidOnly {
+			seqNum = 0
+		}
+		m, err := msg.fetch(f, seqNum, items)
+		if err != nil {
+			// The message has been removed in the meantime
+			continue
+		}
+		if uidOnly {
+			m.Uid = msg.uid
+		}
+
+		ch <- m
+	}
+
+	// The server can't deliver updates until all messages have been sent
+	close(ch)
+	if len(seen) == 0 {
+		return nil
+	}
+	uids := new(imap.SeqSet)
+	uids.AddNum(seen...)
+	return mbox.UpdateMessagesFlags(true, uids, imap.AddFlags, []string{imap.SeenFlag})
+}
+
+// isReadOnly checks whether the session has selected the mailbox read-only.
+func (mbox *Mailbox) isReadOnly() bool {
+	mbox.user.mutex.Lock()
+	defer mbox.user.mutex.Unlock()
+
+	return mbox.st != nil && mbox.user.examined == mbox.st
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	f, err := os.Open(mbox.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msgs, seqNums := mbox.selectMessages(false, nil)
+
+	var ids []uint32
+	for i, msg := range msgs {
+		ok, err := msg.match(f, seqNums[i], criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := seqNums[i]
+		if uid {
+			id = msg.uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) SortMessages(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	f, err := os.Open(mbox.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msgs, seqNums := mbox.selectMessages(false, nil)
+
+	var sortMsgs []backendutil.SortMessage
+	for i, msg := range msgs {
+		ok, err := msg.match(f, seqNums[i], searchCriteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		b, err := msg.readBody(f)
+		if err != nil {
+			continue
+		}
+		hdr, _, err := headerAndBody(b)
+		if err != nil {
+			continue
+		}
+
+		sm := backendutil.SortMessage{
+			Id:     seqNums[i],
+			Header: hdr,
+			Date:   msg.date,
+			Size:   msg.size,
+		}
+		if uid {
+			sm.Id = msg.uid
+		}
+		sortMsgs = append(sortMsgs, sm)
+	}
+	return backendutil.Sort(sortMsgs, sortCriteria), nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if mbox.st == nil {
+		return errNoSelect
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return mbox.st.createMessages([]pendingMessage{{body: b, flags: flags, date: date}})
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	st := mbox.st
+
+	st.Lock()
+	updates, err := st.withLock(func(idx *index) (*index, error) {
+		for i, msg := range idx.messages {
+			id := uint32(i + 1)
+			if uid {
+				id = msg.uid
+			}
+			if seqset.Contains(id) {
+				msg.flags = backendutil.UpdateFlags(append([]string(nil), msg.flags...), op, withoutRecent(flags))
+			}
+		}
+		return idx, nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest, err := mbox.user.getMailbox(destName)
+	if err != nil {
+		return err
+	}
+	if dest.st == nil {
+		return errNoSelect
+	}
+
+	f, err := os.Open(mbox.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pending []pendingMessage
+	msgs, _ := mbox.selectMessages(uid, seqset)
+	for _, msg := range msgs {
+		b, err := msg.readBody(f)
+		if err == errMessageChanged {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		pending = append(pending, pendingMessage{body: b, flags: msg.flags, date: msg.date})
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return dest.st.createMessages(pending)
+}
+
+func (mbox *Mailbox) Expunge() error {
+	st := mbox.st
+
+	st.Lock()
+	updates, err := st.withLock(func(idx *index) (*index, error) {
+		var kept []*message
+		for _, msg := range idx.messages {
+			if !hasFlag(msg.flags, imap.DeletedFlag) {
+				kept = append(kept, msg)
+			}
+		}
+		if len(kept) == len(idx.messages) {
+			return idx, nil
+		}
+
+		if err := rewrite(st.path, kept); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(st.path)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.messages = kept
+		idx.size = fi.Size()
+		idx.modTime = fi.ModTime()
+		return idx, nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (mbox *Mailbox) UidListMessages(uids *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(true, true, uids, items, ch)
+}
+
+func (mbox *Mailbox) UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessages(true, criteria)
+}
+
+func (mbox *Mailbox) UidUpdateMessagesFlags(uids *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlags(true, uids, op, flags)
+}
+
+func (mbox *Mailbox) UidCopyMessages(uids *imap.SeqSet, destName string) error {
+	return mbox.CopyMessages(true, uids, destName)
+}
+
+var (
+	_ backend.MailboxPoller  = (*Mailbox)(nil)
+	_ backend.SortMailbox    = (*Mailbox)(nil)
+	_ backend.UidOnlyMailbox = (*Mailbox)(nil)
+	_ backend.SessionMailbox = (*Mailbox)(nil)
+)
@@ -0,0 +1,384 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+var fromPrefix = []byte("From ")
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, fromPrefix)
+}
+
+// isQuotedFromLine checks whether a line matches ^>*From , ie. whether it
+// needs to be quoted in mboxrd.
+func isQuotedFromLine(line []byte) bool {
+	return isFromLine(bytes.TrimLeft(line, ">"))
+}
+
+func isBlankLine(line []byte) bool {
+	return string(line) == "\n" || string(line) == "\r\n"
+}
+
+// readLine reads a whole line, including its line ending.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+
+	buf := append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		line, err = br.ReadSlice('\n')
+		buf = append(buf, line...)
+	}
+	return buf, err
+}
+
+const contentLengthPrefix = "Content-Length:"
+
+func parseContentLength(line []byte) (int64, bool) {
+	if len(line) < len(contentLengthPrefix) || !strings.EqualFold(string(line[:len(contentLengthPrefix)]), contentLengthPrefix) {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(bytes.TrimSpace(line[len(contentLengthPrefix):])), 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// isMessageBoundary checks whether a message can end at offset pos: it must be
+// followed by a From line, possibly after a blank line, or by the end of the
+// file.
+func isMessageBoundary(r io.ReaderAt, pos, end int64) bool {
+	if pos > end {
+		return false
+	}
+
+	buf := make([]byte, 7)
+	if n := end - pos; n < int64(len(buf)) {
+		buf = buf[:n]
+	}
+	if _, err := r.ReadAt(buf, pos); err != nil && err != io.EOF {
+		return false
+	}
+
+	rest := bytes.TrimLeft(buf, "\r\n")
+	if len(rest) == 0 {
+		return pos+int64(len(buf)) == end
+	}
+	return len(buf)-len(rest) <= 2 && isFromLine(rest)
+}
+
+// readMessages reads the entries of an mbox file between offsets start and
+// end, which must be the beginning of an entry. f is called with the offset
+// and the raw contents of each entry, including its From line and the blank
+// line separating it from the next one.
+//
+// Both mboxrd and mboxcl2 are supported: an entry starts with a From line
+// preceded by a blank line, unless its header contains a Content-Length field
+// which matches the position of the next entry.
+func readMessages(r io.ReaderAt, start, end int64, f func(offset int64, raw []byte) error) error {
+	br := bufio.NewReaderSize(io.NewSectionReader(r, start, end-start), 64*1024)
+
+	var (
+		cur           []byte
+		curOffset     int64
+		inHeader      bool
+		contentLength int64
+	)
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		err := f(curOffset, cur)
+		cur = nil
+		return err
+	}
+
+	offset := start
+	prevBlank := true
+	for {
+		line, err := readLine(br)
+		if len(line) > 0 {
+			next := offset + int64(len(line))
+			blank := isBlankLine(line)
+			skippedBody := false
+
+			if prevBlank && isFromLine(line) {
+				if err := flush(); err != nil {
+					return err
+				}
+				cur = append([]byte(nil), line...)
+				curOffset = offset
+				inHeader = true
+				contentLength = -1
+			} else if cur != nil {
+				cur = append(cur, line...)
+
+				if inHeader && blank {
+					inHeader = false
+
+					// mboxcl2 bodies aren't quoted, skip them
+					if contentLength >= 0 && isMessageBoundary(r, next+contentLength, end) {
+						body := make([]byte, contentLength)
+						if _, err := io.ReadFull(br, body); err != nil {
+							return err
+						}
+						cur = append(cur, body...)
+						next += contentLength
+						skippedBody = true
+					}
+				} else if inHeader {
+					if v, ok := parseContentLength(line); ok {
+						contentLength = v
+					}
+				}
+			}
+			// Garbage before the first From line is ignored
+
+			offset = next
+			prevBlank = blank || skippedBody
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return flush()
+}
+
+// decodeMessage extracts a message from a raw mbox entry: the From line and
+// the separator are stripped, mboxrd quoting is removed and line endings are
+// converted to CRLF.
+func decodeMessage(raw []byte) []byte {
+	b := raw
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	} else {
+		b = nil
+	}
+
+	if body, ok := contentLengthBody(b); ok {
+		return normalizeNewlines(body)
+	}
+
+	if bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		b = b[:len(b)-2]
+	} else if bytes.HasSuffix(b, []byte("\n\n")) {
+		b = b[:len(b)-1]
+	}
+	return normalizeNewlines(unquote(b))
+}
+
+// contentLengthBody checks whether a message has a Content-Length header field
+// matching its body, in which case its body isn't quoted. The message without
+// the separator is returned.
+func contentLengthBody(b []byte) ([]byte, bool) {
+	contentLength := int64(-1)
+	for i := 0; i < len(b); {
+		n := bytes.IndexByte(b[i:], '\n')
+		if n < 0 {
+			return nil, false
+		}
+		line := b[i : i+n+1]
+		i += n + 1
+
+		if isBlankLine(line) {
+			if contentLength < 0 || contentLength > int64(len(b)-i) {
+				return nil, false
+			}
+			end := i + int(contentLength)
+			if len(b)-end > 2 || len(bytes.Trim(b[end:], "\r\n")) > 0 {
+				return nil, false
+			}
+			return b[:end], true
+		} else if v, ok := parseContentLength(line); ok {
+			contentLength = v
+		}
+	}
+	return nil, false
+}
+
+// unquote removes mboxrd quoting.
+func unquote(b []byte) []byte {
+	var out []byte
+	for i := 0; i < len(b); {
+		line := b[i:]
+		if n := bytes.IndexByte(line, '\n'); n >= 0 {
+			line = line[:n+1]
+		}
+		start := i
+		i += len(line)
+
+		if line[0] == '>' && isQuotedFromLine(line) {
+			if out == nil {
+				out = append(make([]byte, 0, len(b)), b[:start]...)
+			}
+			line = line[1:]
+		}
+		if out != nil {
+			out = append(out, line...)
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
+
+// writeMessage writes an mboxrd entry, with LF line endings.
+func writeMessage(w *bytes.Buffer, body []byte, date time.Time) {
+	fmt.Fprintf(w, "From MAILER-DAEMON %v\n", date.UTC().Format(time.ANSIC))
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			body = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if isQuotedFromLine(line) {
+			w.WriteByte('>')
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+}
+
+// separator returns the line endings to append to an mbox file ending with
+// tail so that the next entry is preceded by a blank line.
+func separator(tail []byte) string {
+	switch {
+	case len(tail) == 0:
+		return ""
+	case bytes.HasSuffix(tail, []byte("\n\n")), bytes.HasSuffix(tail, []byte("\r\n\r\n")):
+		return ""
+	case bytes.HasSuffix(tail, []byte("\n")):
+		return "\n"
+	default:
+		return "\n\n"
+	}
+}
+
+var fromDateLayouts = []string{
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+}
+
+// parseFromLine parses the date of a From line, "From sender date".
+func parseFromLine(line []byte) (time.Time, bool) {
+	fields := strings.Fields(string(line))
+	for _, layout := range fromDateLayouts {
+		n := len(strings.Fields(layout))
+		if len(fields) < n+1 {
+			continue
+		}
+		t, err := time.Parse(layout, strings.Join(fields[len(fields)-n:], " "))
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// headerFlags returns the flags stored in the Status, X-Status and X-Keywords
+// header fields by mail user agents.
+func headerFlags(hdr textproto.Header) []string {
+	var flags []string
+	if strings.Contains(hdr.Get("X-Status"), "A") {
+		flags = append(flags, imap.AnsweredFlag)
+	}
+	if strings.Contains(hdr.Get("X-Status"), "F") {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if strings.Contains(hdr.Get("X-Status"), "D") {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	if strings.Contains(hdr.Get("Status"), "R") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if strings.Contains(hdr.Get("X-Status"), "T") {
+		flags = append(flags, imap.DraftFlag)
+	}
+
+	keywords := strings.FieldsFunc(hdr.Get("X-Keywords"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	return append(flags, keywords...)
+}
+
+const (
+	lockTimeout = 30 * time.Second
+	lockStale   = 2 * time.Minute
+)
+
+// lock acquires the dot-lock of an mbox file, which is also used by mail
+// delivery agents.
+func lock(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%v\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Break stale locks left by crashed processes
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("mbox: timeout while waiting for mailbox lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// normalizeNewlines converts bare LF line endings, used in mbox files, to
+// CRLF, as required by IMAP.
+func normalizeNewlines(b []byte) []byte {
+	n := 0
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			n++
+		}
+	}
+	if n == 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b)+n)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
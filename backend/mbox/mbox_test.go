@@ -0,0 +1,535 @@
+package mbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"\r\n" +
+	"Hi there :)\r\n" +
+	"From now on, lines starting with From are quoted.\r\n" +
+	">From here too.\r\n"
+
+func readAll(t *testing.T, mbox string) [][]byte {
+	var msgs [][]byte
+	r := strings.NewReader(mbox)
+	err := readMessages(r, 0, r.Size(), func(offset int64, raw []byte) error {
+		if !strings.HasPrefix(mbox[offset:], "From ") {
+			t.Errorf("Invalid offset %v", offset)
+		}
+		msgs = append(msgs, decodeMessage(raw))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("readMessages() =", err)
+	}
+	return msgs
+}
+
+func TestReadMessages_mboxrd(t *testing.T) {
+	mbox := "From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n" +
+		"Subject: 1\n" +
+		"\n" +
+		">From the start\n" +
+		">>From a quote\n" +
+		"\n" +
+		"From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n" +
+		"Subject: 2\n" +
+		"\n" +
+		"Hi\n" +
+		"From inside a paragraph isn't a separator\n" +
+		"\n"
+
+	msgs := readAll(t, mbox)
+	want := []string{
+		"Subject: 1\r\n\r\nFrom the start\r\n>From a quote\r\n",
+		"Subject: 2\r\n\r\nHi\r\nFrom inside a paragraph isn't a separator\r\n",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("Expected %v messages, got %v", len(want), len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg) != want[i] {
+			t.Errorf("Invalid message #%v: got %q, want %q", i+1, msg, want[i])
+		}
+	}
+}
+
+func TestReadMessages_mboxcl2(t *testing.T) {
+	body := "From the start\n\nFrom a new paragraph\n"
+	mbox := "From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n" +
+		"Subject: 1\n" +
+		"Content-Length: 37\n" +
+		"\n" +
+		body +
+		"\n" +
+		"From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n" +
+		"Subject: 2\n" +
+		"\n" +
+		"Hi\n"
+
+	msgs := readAll(t, mbox)
+	want := []string{
+		"Subject: 1\r\nContent-Length: 37\r\n\r\nFrom the start\r\n\r\nFrom a new paragraph\r\n",
+		"Subject: 2\r\n\r\nHi\r\n",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("Expected %v messages, got %v", len(want), len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg) != want[i] {
+			t.Errorf("Invalid message #%v: got %q, want %q", i+1, msg, want[i])
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	date := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+	var b bytes.Buffer
+	writeMessage(&b, []byte(testMessage), date)
+
+	s := b.String()
+	if !strings.HasPrefix(s, "From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n") {
+		t.Errorf("Invalid From line: %q", s)
+	}
+	if !strings.Contains(s, "\n>From now on") || !strings.Contains(s, "\n>>From here") {
+		t.Errorf("From lines aren't quoted: %q", s)
+	}
+
+	msgs := readAll(t, s)
+	if len(msgs) != 1 || string(msgs[0]) != testMessage {
+		t.Errorf("Invalid round-trip: %q", msgs)
+	}
+
+	if d, ok := parseFromLine([]byte(strings.SplitN(s, "\n", 2)[0])); !ok || !d.Equal(date) {
+		t.Errorf("parseFromLine() = %v, %v, want %v", d, ok, date)
+	}
+}
+
+func newTestBackend(t *testing.T, root string) (*Backend, <-chan backend.Update) {
+	be, err := New(root)
+	if err != nil {
+		t.Fatal("New() =", err)
+	}
+
+	// Acknowledge updates, like a server would
+	updates := make(chan backend.Update, 100)
+	go func() {
+		for update := range be.Updates() {
+			updates <- update
+			close(update.Done())
+		}
+	}()
+	return be, updates
+}
+
+func testMailbox(t *testing.T, be *Backend, name string) backend.Mailbox {
+	u, err := be.LookupUser(nil, "username")
+	if err != nil {
+		t.Fatal("LookupUser() =", err)
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	return mbox
+}
+
+func listMessages(t *testing.T, mbox backend.Mailbox) []*imap.Message {
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, "BODY.PEEK[]"}
+	if err := mbox.ListMessages(false, seqset, items, ch); err != nil {
+		t.Fatal("ListMessages() =", err)
+	}
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func uids(msgs []*imap.Message) []uint32 {
+	var l []uint32
+	for _, msg := range msgs {
+		l = append(l, msg.Uid)
+	}
+	return l
+}
+
+func status(t *testing.T, mbox backend.Mailbox) *imap.MailboxStatus {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	return status
+}
+
+func TestMailbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, _ := newTestBackend(t, root)
+	mbox := testMailbox(t, be, "inbox")
+	if mbox.Name() != "INBOX" {
+		t.Errorf("mbox.Name() = %v, want INBOX", mbox.Name())
+	}
+
+	for i := 0; i < 3; i++ {
+		body := bytes.NewBufferString(testMessage)
+		if err := mbox.CreateMessage([]string{"$Important"}, time.Now(), body); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+
+	msgs := listMessages(t, mbox)
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs: got %v, want %v", uids(msgs), want)
+	}
+	for i, msg := range msgs {
+		if msg.Size != uint32(len(testMessage)) {
+			t.Errorf("Invalid size for message #%v: %v", i+1, msg.Size)
+		}
+		if !reflect.DeepEqual(msg.Flags, []string{"$Important", imap.RecentFlag}) {
+			t.Errorf("Invalid flags for message #%v: %v", i+1, msg.Flags)
+		}
+		for _, l := range msg.Body {
+			if b, _ := ioutil.ReadAll(l); string(b) != testMessage {
+				t.Errorf("Invalid body for message #%v: %q", i+1, b)
+			}
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs after expunge: got %v, want %v", uids(msgs), want)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "username", "INBOX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\nFrom MAILER-DAEMON"); n != 1 {
+		t.Errorf("Expected 2 messages in the mbox file, got %v", n+1)
+	}
+
+	before := status(t, mbox)
+
+	// UIDs are persistent
+	be, _ = newTestBackend(t, root)
+	mbox = testMailbox(t, be, "INBOX")
+	after := status(t, mbox)
+	if after.UidValidity != before.UidValidity || after.UidNext != 4 {
+		t.Errorf("Invalid status after restart: UIDVALIDITY %v, UIDNEXT %v", after.UidValidity, after.UidNext)
+	}
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs after restart: got %v, want %v", uids(msgs), want)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$Important"}) {
+		t.Errorf("Invalid flags after restart: %v", msgs[0].Flags)
+	}
+}
+
+func TestMailbox_externalModification(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "username", "INBOX")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(subject string) string {
+		return "From sender@example.org Mon Jan  2 15:04:05 2006\n" +
+			"Subject: " + subject + "\n" +
+			"Status: RO\n" +
+			"\n" +
+			"Hi\n" +
+			"\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(entry("1")+entry("2")+entry("3")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be, updates := newTestBackend(t, root)
+	mbox := testMailbox(t, be, "INBOX")
+	msgs := listMessages(t, mbox)
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs: got %v, want %v", uids(msgs), want)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{imap.SeenFlag}) {
+		t.Errorf("Flags haven't been read from the header: %v", msgs[0].Flags)
+	}
+	uidValidity := status(t, mbox).UidValidity
+
+	// A message is delivered, another one is removed by a mail user agent
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte(entry("1")+entry("3")+entry("4")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Poll() =", err)
+	}
+
+	var got []string
+	for len(updates) > 0 {
+		switch update := (<-updates).(type) {
+		case *backend.ExpungeUpdate:
+			got = append(got, "EXPUNGE")
+			if update.SeqNum != 2 {
+				t.Errorf("Invalid expunged sequence number: %v", update.SeqNum)
+			}
+		case *backend.MailboxUpdate:
+			got = append(got, "EXISTS")
+			if update.Messages != 3 {
+				t.Errorf("Invalid number of messages: %v", update.Messages)
+			}
+		}
+	}
+	if want := []string{"EXPUNGE", "EXISTS"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalid updates: got %v, want %v", got, want)
+	}
+
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 3, 4}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs: got %v, want %v", uids(msgs), want)
+	}
+	if status(t, mbox).UidValidity != uidValidity {
+		t.Errorf("UIDVALIDITY has changed")
+	}
+
+	// Messages are re-ordered, the index can't be reconciled
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte(entry("4")+entry("1")+entry("3")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if newUidValidity := status(t, mbox).UidValidity; newUidValidity <= uidValidity {
+		t.Errorf("UIDVALIDITY hasn't been bumped: got %v, was %v", newUidValidity, uidValidity)
+	}
+	msgs = listMessages(t, mbox)
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("Invalid UIDs: got %v, want %v", uids(msgs), want)
+	}
+}
+
+func TestMailbox_recent(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "username", "INBOX")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first message has been seen by a mail user agent, the second one
+	// hasn't
+	entries := "From sender@example.org Mon Jan  2 15:04:05 2006\n" +
+		"Subject: Old\n" +
+		"Status: O\n" +
+		"\n" +
+		"Hi\n" +
+		"\n" +
+		"From sender@example.org Mon Jan  2 15:04:05 2006\n" +
+		"Subject: New\n" +
+		"\n" +
+		"Hi\n" +
+		"\n"
+	if err := ioutil.WriteFile(path, []byte(entries), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be, _ := newTestBackend(t, root)
+	mbox := testMailbox(t, be, "INBOX")
+	other := testMailbox(t, be, "INBOX")
+
+	items := []imap.StatusItem{imap.StatusRecent}
+	st, err := mbox.(backend.SessionMailbox).Select(false, items)
+	if err != nil {
+		t.Fatal("Select() =", err)
+	}
+	if st.Recent != 1 {
+		t.Errorf("Select(): RECENT = %v, want 1", st.Recent)
+	}
+
+	// The message isn't recent for other sessions anymore
+	st, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if st.Recent != 0 {
+		t.Errorf("Status() for another session: RECENT = %v, want 0", st.Recent)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	seqset, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.(backend.UidOnlyMailbox).UidListMessages(seqset, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal("UidListMessages() =", err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if want := []uint32{1, 2}; !reflect.DeepEqual(uids(msgs), want) {
+		t.Fatalf("UidListMessages(): got UIDs %v, want %v", uids(msgs), want)
+	}
+	if len(msgs[0].Flags) != 0 || !reflect.DeepEqual(msgs[1].Flags, []string{imap.RecentFlag}) {
+		t.Errorf("UidListMessages(): got flags %v and %v, want only \\Recent for the second message", msgs[0].Flags, msgs[1].Flags)
+	}
+
+	// Once the mailbox is unselected, new messages are recent for other
+	// sessions
+	if err := mbox.(backend.SessionMailbox).Unselect(); err != nil {
+		t.Fatal("Unselect() =", err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	st, err = other.Status(items)
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if st.Recent != 1 {
+		t.Errorf("Status() after unselect: RECENT = %v, want 1", st.Recent)
+	}
+}
+
+func TestUser_mailboxes(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be, _ := newTestBackend(t, root)
+	u, err := be.LookupUser(nil, "username")
+	if err != nil {
+		t.Fatal("LookupUser() =", err)
+	}
+
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	if err := u.CreateMailbox("Archive"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("CreateMailbox() = %v, want %v", err, backend.ErrMailboxAlreadyExists)
+	}
+	if err := u.CreateMailbox("Archive/2020/01"); err != errNoInferiors {
+		t.Errorf("CreateMailbox() = %v, want %v", err, errNoInferiors)
+	}
+
+	mbox, err := u.GetMailbox("Archive")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if info, _ := mbox.Info(); !reflect.DeepEqual(info.Attributes, []string{imap.NoSelectAttr}) {
+		t.Errorf("Invalid attributes: %v", info.Attributes)
+	}
+	if _, err := mbox.Status([]imap.StatusItem{imap.StatusMessages}); err == nil {
+		t.Error("Expected an error when selecting a directory")
+	}
+
+	mbox, err = u.GetMailbox("Archive/2020")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+
+	if err := u.DeleteMailbox("Archive"); err != errHasInferiors {
+		t.Errorf("DeleteMailbox() = %v, want %v", err, errHasInferiors)
+	}
+	if err := u.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+
+	mbox, err = u.GetMailbox("Old/2020")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if msgs := listMessages(t, mbox); len(msgs) != 1 || msgs[0].Uid != 1 {
+		t.Errorf("Invalid messages after rename: %v", msgs)
+	}
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal("SetSubscribed() =", err)
+	}
+
+	var names []string
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name())
+	}
+	if want := []string{"INBOX", "Old", "Old/2020"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListMailboxes(false) = %v, want %v", names, want)
+	}
+
+	mailboxes, err = u.ListMailboxes(true)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Name() != "Old/2020" {
+		t.Errorf("ListMailboxes(true) = %v", mailboxes)
+	}
+
+	if err := u.RenameMailbox("INBOX", "Old/Inbox"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+	if _, err := u.GetMailbox("Old/Inbox"); err != nil {
+		t.Errorf("GetMailbox() = %v", err)
+	}
+	if _, err := u.GetMailbox("../other"); err == nil {
+		t.Error("Expected an error for an invalid mailbox name")
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Instance {
+		root, err := ioutil.TempDir("", "go-imap-mbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		be, err := New(root)
+		if err != nil {
+			t.Fatal("New() =", err)
+		}
+		return &backendtest.Instance{
+			Backend:  be,
+			Username: "username",
+			Close:    func() { os.RemoveAll(root) },
+		}
+	})
+}
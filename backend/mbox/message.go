@@ -0,0 +1,174 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+var errMessageChanged = errors.New("mbox: message has been modified")
+
+type message struct {
+	uid uint32
+	// Location of the entry in the mbox file, including the From line and the
+	// separator
+	offset int64
+	length int64
+	// Size of the message, with CRLF line endings
+	size uint32
+	// Checksum of the message, used to recognize it when the mbox file is
+	// modified by someone else
+	crc   uint32
+	date  time.Time
+	flags []string
+	// Set if a mail user agent has marked the message as old with the Status
+	// header field. It's only known for messages which have just been parsed,
+	// and isn't stored in the index.
+	old bool
+}
+
+// checksum computes the checksum of a message. Trailing line endings are
+// ignored, since they may be added to separate the message from the next one.
+func checksum(b []byte) uint32 {
+	return crc32.ChecksumIEEE(bytes.TrimRight(b, "\r\n"))
+}
+
+// parseMessage creates a message from a raw mbox entry. The date and the flags
+// are read from the From line and the header.
+func parseMessage(offset int64, raw []byte) *message {
+	b := decodeMessage(raw)
+	msg := &message{
+		offset: offset,
+		length: int64(len(raw)),
+		size:   uint32(len(b)),
+		crc:    checksum(b),
+	}
+
+	fromLine := raw
+	if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+		fromLine = raw[:i]
+	}
+	date, ok := parseFromLine(fromLine)
+
+	hdr, _, err := headerAndBody(b)
+	if err == nil {
+		msg.flags = headerFlags(hdr)
+		msg.old = strings.Contains(hdr.Get("Status"), "O")
+		if !ok {
+			h := mail.Header{Header: gomessage.Header{Header: hdr}}
+			date, err = h.Date()
+			ok = err == nil
+		}
+	}
+	if ok {
+		msg.date = date
+	} else {
+		msg.date = time.Now()
+	}
+
+	return msg
+}
+
+// readBody reads the message from the mbox file.
+func (m *message) readBody(r io.ReaderAt) ([]byte, error) {
+	raw := make([]byte, m.length)
+	if _, err := r.ReadAt(raw, m.offset); err != nil {
+		return nil, err
+	}
+
+	b := decodeMessage(raw)
+	if checksum(b) != m.crc {
+		// The mbox file has been rewritten by someone else in the meantime
+		return nil, errMessageChanged
+	}
+	return b, nil
+}
+
+func headerAndBody(b []byte) (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(b))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+func (m *message) fetch(r io.ReaderAt, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var b []byte
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid:
+		default:
+			if b == nil {
+				var err error
+				if b, err = m.readBody(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, _ := headerAndBody(b)
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, _ := headerAndBody(b)
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.date
+		case imap.FetchRFC822Size:
+			fetched.Size = m.size
+		case imap.FetchUid:
+			fetched.Uid = m.uid
+		case imap.FetchPreview:
+			hdr, body, _ := headerAndBody(b)
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody(b)
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (m *message) match(r io.ReaderAt, seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+	b, err := m.readBody(r)
+	if err != nil {
+		return false, err
+	}
+	e, err := gomessage.Read(bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+
+	md := &backendutil.Metadata{
+		SeqNum: seqNum,
+		Uid:    m.uid,
+		Date:   m.date,
+		Flags:  m.flags,
+	}
+	return backendutil.MatchMessage(e, md, c)
+}
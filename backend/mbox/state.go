@@ -0,0 +1,494 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// mailboxState is the state of a mailbox, shared by all connections which
+// access it so that they agree on message sequence numbers. It's kept in sync
+// with the mbox file, which can be modified by other processes.
+type mailboxState struct {
+	sync.Mutex
+
+	be       *Backend
+	path     string
+	username string
+	name     string
+
+	loaded bool
+	idx    *index
+
+	// UIDs of messages with the \Recent flag, mapped to the session they're
+	// recent for. Messages which arrived when no session had selected the
+	// mailbox are mapped to nil, until a session selects it.
+	recent map[uint32]*User
+	// Sessions which have selected the mailbox read-write, in order
+	sessions []*User
+}
+
+// snapshot returns a copy of the messages, which can be accessed without
+// holding the lock. The \Recent flag is added to the messages which are recent
+// for the session.
+func (st *mailboxState) snapshot(u *User) []message {
+	msgs := make([]message, len(st.idx.messages))
+	for i, msg := range st.idx.messages {
+		msgs[i] = *msg
+		if st.isRecent(msg.uid, u) {
+			msgs[i].flags = append(append([]string(nil), msg.flags...), imap.RecentFlag)
+		}
+	}
+	return msgs
+}
+
+// isRecent checks whether a message is recent for the session.
+func (st *mailboxState) isRecent(uid uint32, u *User) bool {
+	owner, ok := st.recent[uid]
+	return ok && (owner == nil || owner == u)
+}
+
+// recentOwner returns the session new messages are recent for: the first one
+// which has selected the mailbox read-write, if any.
+func (st *mailboxState) recentOwner() *User {
+	if len(st.sessions) > 0 {
+		return st.sessions[0]
+	}
+	return nil
+}
+
+// removeSession removes a session from the sessions which have selected the
+// mailbox.
+func (st *mailboxState) removeSession(u *User) {
+	for i, s := range st.sessions {
+		if s == u {
+			st.sessions = append(st.sessions[:i:i], st.sessions[i+1:]...)
+			break
+		}
+	}
+}
+
+// markRecent updates the recent messages after the index has changed from old
+// to idx. Messages which have been assigned a UID since old was written are
+// recent, or all messages if the index has just been created, unless a mail
+// user agent has marked them as old.
+func (st *mailboxState) markRecent(old, idx *index) {
+	if st.recent == nil || old.uidValidity != idx.uidValidity {
+		st.recent = make(map[uint32]*User)
+	}
+
+	present := make(map[uint32]bool, len(idx.messages))
+	for _, msg := range idx.messages {
+		present[msg.uid] = true
+		if msg.old {
+			continue
+		}
+		if old.uidValidity == 0 || (old.uidValidity == idx.uidValidity && msg.uid >= old.uidNext) {
+			if _, ok := st.recent[msg.uid]; !ok {
+				st.recent[msg.uid] = st.recentOwner()
+			}
+		}
+	}
+
+	// Expunged messages aren't recent anymore
+	for uid := range st.recent {
+		if !present[uid] {
+			delete(st.recent, uid)
+		}
+	}
+}
+
+// load reads the index and reconciles it with the mbox file. It must be called
+// with the mbox file locked.
+func (st *mailboxState) load() (*index, error) {
+	idx, err := readIndex(indexPath(st.path))
+	if err != nil {
+		// The index is corrupted, rebuild it
+		idx = &index{}
+	}
+
+	newIdx, err := st.reconcile(idx)
+	if err == nil && !st.loaded {
+		// Messages appended since the index was written are recent
+		st.markRecent(idx, newIdx)
+	}
+	return newIdx, err
+}
+
+// reconcile updates an index after the mbox file has been modified, and writes
+// it. It must be called with the mbox file locked.
+func (st *mailboxState) reconcile(idx *index) (*index, error) {
+	var size int64
+	var modTime time.Time
+	if fi, err := os.Stat(st.path); err == nil {
+		size, modTime = fi.Size(), fi.ModTime()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if idx.uidValidity != 0 && idx.size == size && idx.modTime.Equal(modTime) {
+		return idx, nil
+	}
+
+	var newIdx *index
+	var err error
+	if idx.uidValidity != 0 && size > idx.size {
+		// Most of the time, messages have been appended
+		newIdx, err = st.reconcileAppended(idx, size)
+	}
+	if newIdx == nil && err == nil {
+		newIdx, err = st.rebuild(idx, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	newIdx.size = size
+	newIdx.modTime = modTime
+	return newIdx, newIdx.write(indexPath(st.path))
+}
+
+// parseMessages parses the messages of the mbox file between two offsets.
+func (st *mailboxState) parseMessages(start, end int64) ([]*message, error) {
+	f, err := os.Open(st.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []*message
+	err = readMessages(f, start, end, func(offset int64, raw []byte) error {
+		msgs = append(msgs, parseMessage(offset, raw))
+		return nil
+	})
+	return msgs, err
+}
+
+// reconcileAppended updates an index after messages have been appended to the
+// mbox file. The last indexed message is parsed again, since a separator may
+// have been appended to it. If it doesn't match, nil is returned.
+func (st *mailboxState) reconcileAppended(idx *index, size int64) (*index, error) {
+	var start int64
+	n := len(idx.messages)
+	if n > 0 {
+		start = idx.messages[n-1].offset
+	} else if idx.size > 0 {
+		return nil, nil
+	}
+
+	msgs, err := st.parseMessages(start, size)
+	if err != nil {
+		return nil, err
+	}
+
+	newIdx := idx.clone()
+	if n > 0 {
+		last := newIdx.messages[n-1]
+		if len(msgs) == 0 || msgs[0].offset != last.offset || msgs[0].crc != last.crc {
+			return nil, nil
+		}
+		last.length = msgs[0].length
+		msgs = msgs[1:]
+	}
+
+	newIdx.messages = append(newIdx.messages, msgs...)
+	newIdx.assignUids()
+	return newIdx, nil
+}
+
+type messageKey struct {
+	crc  uint32
+	size uint32
+}
+
+// rebuild parses the whole mbox file and matches its messages with the index.
+// If indexed messages have only been removed and new messages have only been
+// appended, UIDs are kept. Otherwise, UIDVALIDITY is changed and UIDs are
+// re-assigned.
+func (st *mailboxState) rebuild(idx *index, size int64) (*index, error) {
+	msgs, err := st.parseMessages(0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[messageKey][]int)
+	for i, msg := range idx.messages {
+		k := messageKey{msg.crc, msg.size}
+		positions[k] = append(positions[k], i)
+	}
+
+	reconciled := idx.uidValidity != 0
+	next := 0
+	sawNew := false
+	for _, msg := range msgs {
+		k := messageKey{msg.crc, msg.size}
+		pos := positions[k]
+		if len(pos) == 0 {
+			sawNew = true
+			continue
+		}
+		positions[k] = pos[1:]
+
+		// Indexed messages must appear in the same order, before new ones
+		if sawNew || pos[0] < next {
+			reconciled = false
+		}
+		next = pos[0] + 1
+
+		old := idx.messages[pos[0]]
+		msg.uid = old.uid
+		msg.date = old.date
+		msg.flags = old.flags
+	}
+
+	newIdx := &index{
+		uidValidity: idx.uidValidity,
+		uidNext:     idx.uidNext,
+		messages:    msgs,
+	}
+	if !reconciled {
+		newIdx.uidValidity = st.be.newUidValidity()
+		if newIdx.uidValidity <= idx.uidValidity {
+			newIdx.uidValidity = idx.uidValidity + 1
+		}
+		newIdx.uidNext = 1
+		for _, msg := range msgs {
+			msg.uid = 0
+		}
+	}
+	newIdx.assignUids()
+	return newIdx, nil
+}
+
+// sync updates the state from the mbox file and returns updates describing
+// the changes. It must be called with the state locked.
+func (st *mailboxState) sync() ([]backend.Update, error) {
+	unlock, err := lock(st.path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+	return st.apply(idx), nil
+}
+
+// apply replaces the state with a new index and returns updates describing
+// the changes. It must be called with the state locked.
+func (st *mailboxState) apply(idx *index) []backend.Update {
+	var updates []backend.Update
+	if st.loaded {
+		st.markRecent(st.idx, idx)
+	}
+	if st.loaded && st.idx.uidValidity == idx.uidValidity {
+		updates = backendutil.DiffMessages(st.username, st.name, messageStates(st.idx.messages), messageStates(idx.messages))
+	} else if st.loaded {
+		// The mbox file couldn't be reconciled, clients need to re-synchronize
+		updates = append(updates, &backend.StatusUpdate{
+			Update: backend.NewUpdate(st.username, st.name),
+			StatusResp: &imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: "UIDVALIDITY changed",
+			},
+		})
+	}
+
+	st.loaded = true
+	st.idx = idx
+	return updates
+}
+
+// poll synchronizes the state with the mbox file and notifies clients.
+func (st *mailboxState) poll() error {
+	return backendutil.Poll(st, st.sync, st.be.updates)
+}
+
+// messageStates returns the states of messages known to clients.
+func messageStates(msgs []*message) []backendutil.MessageState {
+	states := make([]backendutil.MessageState, len(msgs))
+	for i, msg := range msgs {
+		states[i] = backendutil.MessageState{Uid: msg.uid, Flags: msg.flags}
+	}
+	return states
+}
+
+// withLock runs f with the mbox file locked and a synchronized copy of the
+// index, which f can modify. The index is then written and the state updated.
+// It must be called with the state locked.
+func (st *mailboxState) withLock(f func(idx *index) (*index, error)) ([]backend.Update, error) {
+	unlock, err := lock(st.path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+
+	newIdx, err := f(idx.clone())
+	if err == nil {
+		err = newIdx.write(indexPath(st.path))
+	}
+	if err != nil {
+		// Changes may have been partially applied
+		if idx, loadErr := st.load(); loadErr == nil {
+			return st.apply(idx), err
+		}
+		return nil, err
+	}
+	return st.apply(newIdx), nil
+}
+
+type pendingMessage struct {
+	body  []byte
+	flags []string
+	date  time.Time
+}
+
+// createMessages appends messages to the mailbox and notifies clients.
+func (st *mailboxState) createMessages(pending []pendingMessage) error {
+	st.Lock()
+	updates, err := st.withLock(func(idx *index) (*index, error) {
+		start := idx.size
+
+		if err := appendMessages(st.path, pending); err != nil {
+			return nil, err
+		}
+
+		newIdx, err := st.reconcile(idx)
+		if err != nil {
+			return nil, err
+		}
+
+		i := 0
+		for _, msg := range newIdx.messages {
+			if msg.offset >= start && i < len(pending) {
+				msg.flags = withoutRecent(pending[i].flags)
+				msg.date = pending[i].date
+				// A copied message may have a Status header field, but
+				// it's new to this mailbox
+				msg.old = false
+				i++
+			}
+		}
+		return newIdx, nil
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+// appendMessages appends messages to an mbox file, which is created if it
+// doesn't exist.
+func appendMessages(path string, pending []pendingMessage) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	tail := make([]byte, 4)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(separator(tail))
+	for _, msg := range pending {
+		writeMessage(&b, msg.body, msg.date)
+	}
+
+	if _, err := f.Write(b.Bytes()); err != nil {
+		// Don't leave a partially written message
+		f.Truncate(size)
+		return err
+	}
+	return f.Sync()
+}
+
+// rewrite replaces the mbox file with a new one containing only the given
+// messages. The new file is written next to the old one, then renamed. The
+// locations of the messages are updated.
+func rewrite(path string, msgs []*message) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	err = copyMessages(dst, src, msgs)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func copyMessages(w io.Writer, r io.ReaderAt, msgs []*message) error {
+	bw := bufio.NewWriter(w)
+	var offset int64
+	for _, msg := range msgs {
+		raw := make([]byte, msg.length)
+		if _, err := r.ReadAt(raw, msg.offset); err != nil {
+			return err
+		}
+		if !isFromLine(raw) {
+			return errors.New("mbox: index doesn't match mbox file")
+		}
+
+		sep := separator(raw)
+		bw.Write(raw)
+		bw.WriteString(sep)
+
+		msg.offset = offset
+		msg.length = int64(len(raw) + len(sep))
+		offset += msg.length
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,404 @@
+package mbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// subscriptionsFile contains the names of the subscribed mailboxes, one per
+// line.
+const subscriptionsFile = ".subscriptions"
+
+var (
+	errInvalidMailboxName = errors.New("Invalid mailbox name")
+	errNoInferiors        = errors.New("Mailbox cannot have inferiors")
+	errHasInferiors       = errors.New("Mailbox has inferiors")
+)
+
+// User is a user whose mailboxes are stored in a directory.
+type User struct {
+	be       *Backend
+	username string
+	dir      string
+
+	// Protects selected and examined
+	mutex sync.Mutex
+	// The mailbox selected read-write by this session, if any
+	selected *mailboxState
+	// The mailbox selected read-only by this session, if any
+	examined *mailboxState
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// mailboxPath returns the path of the mbox file or directory of a mailbox.
+func (u *User) mailboxPath(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") {
+		return filepath.Join(u.dir, "INBOX"), nil
+	}
+
+	parts := strings.Split(name, Delimiter)
+	if strings.EqualFold(parts[0], "INBOX") {
+		return "", errNoInferiors
+	}
+	for _, part := range parts {
+		// Hidden files are indexes and lock files
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") || strings.ContainsAny(part, "\\\x00") {
+			return "", errInvalidMailboxName
+		}
+	}
+	return filepath.Join(u.dir, filepath.FromSlash(name)), nil
+}
+
+// canonicalName returns the canonical name of a mailbox. INBOX is
+// case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	names := []string{"INBOX"}
+
+	err := filepath.Walk(u.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == u.dir {
+			return nil
+		}
+
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".lock") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(u.dir, path)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); rel != "INBOX" {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if subscribed {
+		subscriptions, err := u.subscriptions()
+		if err != nil {
+			return nil, err
+		}
+
+		var l []string
+		for _, name := range names {
+			if subscriptions[name] {
+				l = append(l, name)
+			}
+		}
+		names = l
+	}
+
+	var mailboxes []backend.Mailbox
+	for _, name := range names {
+		mbox, err := u.getMailbox(name)
+		if err != nil {
+			continue
+		}
+		mailboxes = append(mailboxes, mbox)
+	}
+	return mailboxes, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.getMailbox(name)
+}
+
+func (u *User) getMailbox(name string) (*Mailbox, error) {
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+	name = canonicalName(name)
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) && name == "INBOX" {
+		// INBOX is created on the first delivery
+	} else if os.IsNotExist(err) {
+		return nil, backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return &Mailbox{user: u, name: name, path: path}, nil
+	}
+
+	st, err := u.be.state(path, u.username, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mailbox{user: u, name: name, path: path, st: st}, nil
+}
+
+// createParents creates the directories of the parents of a mailbox.
+func (u *User) createParents(name string) error {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		path, err := u.mailboxPath(strings.Join(parts[:i], Delimiter))
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(path, 0700); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return errNoInferiors
+		}
+	}
+	return nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	// A trailing delimiter indicates that the mailbox will have inferiors
+	isDir := strings.HasSuffix(name, Delimiter)
+	name = strings.TrimSuffix(name, Delimiter)
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if _, err := os.Stat(path); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if err := u.createParents(name); err != nil {
+		return err
+	}
+
+	if isDir {
+		return os.Mkdir(path, 0700)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return backend.ErrMailboxAlreadyExists
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if strings.EqualFold(name, "INBOX") {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), ".") {
+				return errHasInferiors
+			}
+		}
+		return os.RemoveAll(path)
+	}
+
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	u.be.forgetStates(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingPath, err := u.mailboxPath(existingName)
+	if err != nil {
+		return err
+	}
+	newPath, err := u.mailboxPath(newName)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(newName, "INBOX") {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if strings.EqualFold(existingName, "INBOX") {
+		return u.renameInbox(newName, newPath)
+	}
+
+	if _, err := os.Stat(existingPath); os.IsNotExist(err) {
+		return backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return err
+	}
+	if err := u.createParents(newName); err != nil {
+		return err
+	}
+
+	// Inferior mailboxes are in the directory, they're renamed too
+	u.be.forgetStates(existingPath)
+	if err := os.Rename(existingPath, newPath); err != nil {
+		return err
+	}
+	err = os.Rename(indexPath(existingPath), indexPath(newPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty.
+func (u *User) renameInbox(newName, newPath string) error {
+	if err := u.createParents(newName); err != nil {
+		return err
+	}
+
+	inbox, err := u.getMailbox("INBOX")
+	if err != nil {
+		return err
+	}
+	st := inbox.st
+
+	st.Lock()
+	updates, err := st.withLock(func(idx *index) (*index, error) {
+		if idx.size == 0 {
+			return idx, ioutil.WriteFile(newPath, nil, 0600)
+		}
+
+		if err := os.Rename(st.path, newPath); err != nil {
+			return nil, err
+		}
+		if err := idx.write(indexPath(newPath)); err != nil {
+			return nil, err
+		}
+
+		// INBOX keeps its UIDVALIDITY, messages are expunged
+		return st.reconcile(&index{
+			uidValidity: idx.uidValidity,
+			uidNext:     idx.uidNext,
+		})
+	})
+	st.Unlock()
+
+	st.be.sendUpdates(updates)
+	return err
+}
+
+func (u *User) subscriptions() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(u.dir, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make(map[string]bool)
+	for _, name := range strings.Split(string(b), "\n") {
+		if name != "" {
+			subscriptions[name] = true
+		}
+	}
+	return subscriptions, nil
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.be.mutex.Lock()
+	defer u.be.mutex.Unlock()
+
+	subscriptions, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		subscriptions[name] = true
+	} else {
+		delete(subscriptions, name)
+	}
+
+	names := make([]string, 0, len(subscriptions))
+	for name := range subscriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	return backendutil.WriteFileAtomic(filepath.Join(u.dir, subscriptionsFile), []byte(b.String()), 0600)
+}
+
+// Logout ends the session. Messages arriving in the mailbox it had selected
+// aren't recent for this session anymore.
+func (u *User) Logout() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.unselect()
+	return nil
+}
+
+// unselect removes the session from the sessions of its selected mailbox.
+// u.mutex must be locked.
+func (u *User) unselect() {
+	u.examined = nil
+	if u.selected == nil {
+		return
+	}
+	u.selected.Lock()
+	u.selected.removeSession(u)
+	u.selected.Unlock()
+	u.selected = nil
+}
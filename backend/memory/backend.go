@@ -1,29 +1,172 @@
-// A memory backend.
+// Package memory implements an in-memory IMAP backend.
+//
+// It's meant to be a reference implementation of the backend interfaces: it's
+// safe for concurrent use, keeps track of the \Recent flag for each session
+// and notifies other sessions of changes.
 package memory
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 )
 
+// Backend is an in-memory backend.
+//
+// Updates must be consumed, for instance by a server.Server, otherwise
+// operations modifying mailboxes block.
 type Backend struct {
-	users map[string]*User
+	updates chan backend.Update
+
+	// Protects users, mailboxes and messages
+	mutex           sync.RWMutex
+	users           map[string]*userState
+	lastUidValidity uint32
+	// Sends updates in the order of the modifications
+	queue backendutil.UpdateQueue
+
+	// Protects the sessions which have selected mailboxes. It's never kept
+	// locked while waiting, so that sessions can log out while updates are
+	// delivered.
+	sessionsMutex sync.Mutex
 }
 
 func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	be.mutex.RLock()
+	defer be.mutex.RUnlock()
+
 	user, ok := be.users[username]
 	if ok && user.password == password {
-		return user, nil
+		return &User{be: be, state: user}, nil
+	}
+
+	return nil, backend.ErrInvalidCredentials
+}
+
+func (be *Backend) LookupUser(_ *imap.ConnInfo, identity string) (backend.User, error) {
+	be.mutex.RLock()
+	defer be.mutex.RUnlock()
+
+	user, ok := be.users[identity]
+	if !ok {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &User{be: be, state: user}, nil
+}
+
+func (be *Backend) SCRAMCredentials(_ *imap.ConnInfo, username string) (*backend.SCRAMCredentials, error) {
+	be.mutex.RLock()
+	defer be.mutex.RUnlock()
+
+	user, ok := be.users[username]
+	if !ok {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return user.scram, nil
+}
+
+func (be *Backend) LoginSCRAM(connInfo *imap.ConnInfo, username string) (backend.User, error) {
+	return be.LookupUser(connInfo, username)
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *Backend) SupportedExtensions() []backend.Extension {
+	return []backend.Extension{
+		backend.ExtObjectID,
+		backend.ExtStatusSize,
+		backend.ExtSaveDate,
+		backend.ExtPreview,
+		backend.ExtWithin,
+		backend.ExtSort,
 	}
+}
 
-	return nil, errors.New("Bad username or password")
+// unlockAndSendUpdates unlocks the backend, then sends updates to clients and
+// waits for them to be delivered, so that they're sent before the command's
+// completion response. The backend must be locked for writing.
+func (be *Backend) unlockAndSendUpdates(updates []backend.Update) {
+	send := be.queue.Push(be.updates, updates)
+	be.mutex.Unlock()
+	send()
 }
 
+// recentOwner returns the session new messages of a mailbox are recent for:
+// the first one which has selected it read-write, if any.
+func (be *Backend) recentOwner(st *mailboxState) *User {
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	if len(st.sessions) > 0 {
+		return st.sessions[0]
+	}
+	return nil
+}
+
+// newUidValidity returns a new UIDVALIDITY value. The backend must be locked.
+func (be *Backend) newUidValidity() uint32 {
+	be.lastUidValidity++
+	return be.lastUidValidity
+}
+
+// newObjectId generates a new random object identifier, as defined in RFC
+// 8474.
+func newObjectId(prefix string) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+func newBackend() *Backend {
+	return &Backend{
+		updates: make(chan backend.Update, 64),
+		users:   make(map[string]*userState),
+	}
+}
+
+// newUserState creates a user with an empty INBOX. The backend must be locked.
+func (be *Backend) newUserState(username, password string) *userState {
+	user := &userState{username: username, password: password}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	user.scram = backend.NewSCRAMCredentials(user.password, salt, 4096)
+
+	inbox := be.newMailboxState("INBOX")
+	user.mailboxes = map[string]*mailboxState{inbox.name: inbox}
+	return user
+}
+
+// AddUser adds a user with an empty INBOX.
+func (be *Backend) AddUser(username, password string) error {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	if _, ok := be.users[username]; ok {
+		return errors.New("User already exists")
+	}
+	be.users[username] = be.newUserState(username, password)
+	return nil
+}
+
+// New creates a new memory backend, with a user named "username" whose
+// password is "password". Its INBOX contains a single message.
 func New() *Backend {
-	user := &User{username: "username", password: "password"}
+	be := newBackend()
+	user := be.newUserState("username", "password")
 
 	body := "From: contact@example.org\r\n" +
 		"To: contact@example.org\r\n" +
@@ -34,23 +177,30 @@ func New() *Backend {
 		"\r\n" +
 		"Hi there :)"
 
-	user.mailboxes = map[string]*Mailbox{
-		"INBOX": {
-			name: "INBOX",
-			user: user,
-			Messages: []*Message{
-				{
-					Uid:   6,
-					Date:  time.Now(),
-					Flags: []string{"\\Seen"},
-					Size:  uint32(len(body)),
-					Body:  []byte(body),
-				},
-			},
+	now := time.Now()
+	emailId := newObjectId("M")
+	inbox := user.mailboxes["INBOX"]
+	inbox.messages = []*Message{
+		{
+			Uid:      6,
+			Date:     now,
+			Flags:    []string{"\\Seen"},
+			Size:     uint32(len(body)),
+			Body:     []byte(body),
+			EmailId:  emailId,
+			ThreadId: "T" + emailId[1:],
+			SaveDate: now,
 		},
 	}
+	inbox.uidNext = 7
 
-	return &Backend{
-		users: map[string]*User{user.username: user},
-	}
+	be.users[user.username] = user
+	return be
 }
+
+var (
+	_ backend.UserBackend      = (*Backend)(nil)
+	_ backend.SCRAMBackend     = (*Backend)(nil)
+	_ backend.BackendUpdater   = (*Backend)(nil)
+	_ backend.ExtensionBackend = (*Backend)(nil)
+)
@@ -1,7 +1,10 @@
 package memory
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
+	"sort"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -11,12 +14,89 @@ import (
 
 var Delimiter = "/"
 
-type Mailbox struct {
-	Subscribed bool
-	Messages   []*Message
+var errNoSelect = errors.New("Mailbox cannot be selected")
+
+// mailboxState is the data of a mailbox, shared by all sessions.
+type mailboxState struct {
+	name        string
+	id          string
+	uidValidity uint32
+	uidNext     uint32
+	subscribed  bool
+	messages    []*Message
+	deleted     bool
+	// Set if the mailbox was deleted while it had inferior mailboxes, as
+	// defined in RFC 3501 section 6.3.4
+	noselect bool
+
+	// UIDs of messages with the \Recent flag, mapped to the session they're
+	// recent for. Messages which arrived when no session had selected the
+	// mailbox are mapped to nil, until a session selects it.
+	recent map[uint32]*User
+	// Sessions which have selected the mailbox read-write, in order. Protected
+	// by Backend.sessionsMutex.
+	sessions []*User
+}
+
+// newMailboxState creates an empty mailbox. The backend must be locked.
+func (be *Backend) newMailboxState(name string) *mailboxState {
+	return &mailboxState{
+		name:        name,
+		id:          newObjectId("F"),
+		uidValidity: be.newUidValidity(),
+		uidNext:     1,
+		recent:      make(map[uint32]*User),
+	}
+}
+
+// appendMessage adds a message to the mailbox, assigns it a UID and marks it
+// as recent for owner, as returned by Backend.recentOwner.
+func (st *mailboxState) appendMessage(msg *Message, owner *User) {
+	msg.Uid = st.uidNext
+	st.uidNext++
+	st.messages = append(st.messages, msg)
+	st.recent[msg.Uid] = owner
+}
 
+// check returns an error if the mailbox has been deleted or can't be
+// selected. The backend must be locked.
+func (st *mailboxState) check() error {
+	if st.deleted {
+		return backend.ErrNoSuchMailbox
+	}
+	if st.noselect {
+		return errNoSelect
+	}
+	return nil
+}
+
+// existsUpdate returns an update with the number of messages.
+func (st *mailboxState) existsUpdate(username string) backend.Update {
+	status := imap.NewMailboxStatus(st.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(st.messages))
+	return &backend.MailboxUpdate{
+		Update:        backend.NewUpdate(username, st.name),
+		MailboxStatus: status,
+	}
+}
+
+func (st *mailboxState) expungeUpdate(username string, seqNum, uid uint32) backend.Update {
+	return &backend.ExpungeUpdate{
+		Update: backend.NewUpdate(username, st.name),
+		SeqNum: seqNum,
+		Uid:    uid,
+	}
+}
+
+// Mailbox is a mailbox opened by a user session.
+type Mailbox struct {
+	user  *User
+	state *mailboxState
+	// The name of the mailbox when it was opened. It isn't protected by the
+	// backend lock, because the server reads it while updates are delivered.
 	name string
-	user *User
+	// The context operations are bound to, nil if none
+	ctx context.Context
 }
 
 func (mbox *Mailbox) Name() string {
@@ -26,29 +106,65 @@ func (mbox *Mailbox) Name() string {
 func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
 	info := &imap.MailboxInfo{
 		Delimiter: Delimiter,
-		Name:      mbox.name,
+		Name:      mbox.Name(),
 	}
+
+	mbox.user.be.mutex.RLock()
+	if mbox.state.noselect {
+		info.Attributes = append(info.Attributes, imap.NoSelectAttr)
+	}
+	mbox.user.be.mutex.RUnlock()
 	return info, nil
 }
 
-func (mbox *Mailbox) uidNext() uint32 {
-	var uid uint32
-	for _, msg := range mbox.Messages {
-		if msg.Uid > uid {
-			uid = msg.Uid
-		}
+// isRecent checks whether a message is recent for the session. The backend
+// must be locked.
+func (mbox *Mailbox) isRecent(uid uint32) bool {
+	owner, ok := mbox.state.recent[uid]
+	return ok && (owner == nil || owner == mbox.user)
+}
+
+// flags returns the flags of a message, including \Recent. The backend must be
+// locked.
+func (mbox *Mailbox) flags(msg *Message) []string {
+	flags := append([]string(nil), msg.Flags...)
+	if mbox.isRecent(msg.Uid) {
+		flags = append(flags, imap.RecentFlag)
+	}
+	return flags
+}
+
+// snapshot returns a copy of the messages of the mailbox, so that they can be
+// read without keeping the backend locked. Bodies are shared, since they are
+// never modified.
+func (mbox *Mailbox) snapshot() ([]*Message, error) {
+	if err := mbox.ctxErr(); err != nil {
+		return nil, err
+	}
+
+	mbox.user.be.mutex.RLock()
+	defer mbox.user.be.mutex.RUnlock()
+
+	if err := mbox.state.check(); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*Message, len(mbox.state.messages))
+	for i, msg := range mbox.state.messages {
+		msgCopy := *msg
+		msgCopy.Flags = mbox.flags(msg)
+		msgs[i] = &msgCopy
 	}
-	uid++
-	return uid
+	return msgs, nil
 }
 
-func (mbox *Mailbox) flags() []string {
+// mailboxFlags returns the flags used in a mailbox, sorted. The backend must be
+// locked.
+func (mbox *Mailbox) mailboxFlags() []string {
 	flagsMap := make(map[string]bool)
-	for _, msg := range mbox.Messages {
+	for _, msg := range mbox.state.messages {
 		for _, f := range msg.Flags {
-			if !flagsMap[f] {
-				flagsMap[f] = true
-			}
+			flagsMap[f] = true
 		}
 	}
 
@@ -56,54 +172,128 @@ func (mbox *Mailbox) flags() []string {
 	for f := range flagsMap {
 		flags = append(flags, f)
 	}
+	sort.Strings(flags)
 	return flags
 }
 
-func (mbox *Mailbox) unseenSeqNum() uint32 {
-	for i, msg := range mbox.Messages {
-		seqNum := uint32(i + 1)
+// status returns the mailbox status. The backend must be locked.
+func (mbox *Mailbox) status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	st := mbox.state
+	if err := st.check(); err != nil {
+		return nil, err
+	}
 
-		seen := false
-		for _, flag := range msg.Flags {
-			if flag == imap.SeenFlag {
-				seen = true
-				break
-			}
-		}
+	status := imap.NewMailboxStatus(st.name, items)
+	status.Flags = mbox.mailboxFlags()
+	status.PermanentFlags = []string{"\\*"}
 
-		if !seen {
-			return seqNum
+	var recent, unseen uint32
+	for i, msg := range st.messages {
+		if mbox.isRecent(msg.Uid) {
+			recent++
+		}
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
 		}
 	}
-	return 0
-}
-
-func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	status := imap.NewMailboxStatus(mbox.name, items)
-	status.Flags = mbox.flags()
-	status.PermanentFlags = []string{"\\*"}
-	status.UnseenSeqNum = mbox.unseenSeqNum()
 
 	for _, name := range items {
 		switch name {
 		case imap.StatusMessages:
-			status.Messages = uint32(len(mbox.Messages))
+			status.Messages = uint32(len(st.messages))
 		case imap.StatusUidNext:
-			status.UidNext = mbox.uidNext()
+			status.UidNext = st.uidNext
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			status.UidValidity = st.uidValidity
 		case imap.StatusRecent:
-			status.Recent = 0 // TODO
+			status.Recent = recent
 		case imap.StatusUnseen:
-			status.Unseen = 0 // TODO
+			status.Unseen = unseen
+		case imap.StatusMailboxId:
+			status.MailboxId = st.id
+		case imap.StatusSize:
+			var size uint64
+			for _, msg := range st.messages {
+				size += uint64(msg.Size)
+			}
+			status.Size = size
 		}
 	}
 
 	return status, nil
 }
 
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.user.be.mutex.RLock()
+	defer mbox.user.be.mutex.RUnlock()
+
+	return mbox.status(items)
+}
+
+// Select implements backend.SessionMailbox. Unless readOnly is set, the session
+// claims the messages which aren't recent for any other session yet, and
+// messages arriving while the mailbox is selected are recent for this session.
+func (mbox *Mailbox) Select(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	be := mbox.user.be
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+
+	be.sessionsMutex.Lock()
+	mbox.user.unselect()
+	if readOnly {
+		mbox.user.examined = st
+	} else {
+		for uid, owner := range st.recent {
+			if owner == nil {
+				st.recent[uid] = mbox.user
+			}
+		}
+		st.sessions = append(st.sessions, mbox.user)
+		mbox.user.selected = st
+	}
+	be.sessionsMutex.Unlock()
+
+	return mbox.status(items)
+}
+
+// Unselect implements backend.SessionMailbox. Messages arriving in the mailbox
+// aren't recent for the session anymore.
+func (mbox *Mailbox) Unselect() error {
+	be := mbox.user.be
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	if mbox.user.selected == mbox.state || mbox.user.examined == mbox.state {
+		mbox.user.unselect()
+	}
+	return nil
+}
+
+// isReadOnly checks whether the session has selected the mailbox read-only.
+func (mbox *Mailbox) isReadOnly() bool {
+	be := mbox.user.be
+	be.sessionsMutex.Lock()
+	defer be.sessionsMutex.Unlock()
+
+	return mbox.user.examined == mbox.state
+}
+
 func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
-	mbox.Subscribed = subscribed
+	mbox.user.be.mutex.Lock()
+	defer mbox.user.be.mutex.Unlock()
+
+	if mbox.state.deleted {
+		return backend.ErrNoSuchMailbox
+	}
+	mbox.state.subscribed = subscribed
 	return nil
 }
 
@@ -111,14 +301,35 @@ func (mbox *Mailbox) Check() error {
 	return nil
 }
 
+// ListMessages implements backend.Mailbox. Unless the session has selected the
+// mailbox read-only, fetching a message's body sets its \Seen flag.
 func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
-	defer close(ch)
+	return mbox.listMessages(uid, false, seqSet, items, ch)
+}
 
-	for i, msg := range mbox.Messages {
+// listMessages sends the messages in seqSet to ch, and closes it. If uidOnly
+// is set, seqSet contains UIDs and sequence numbers aren't populated.
+func (mbox *Mailbox) listMessages(uid, uidOnly bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	msgs, err := mbox.snapshot()
+	if err != nil {
+		close(ch)
+		return err
+	}
+
+	setSeen := backendutil.SetsSeen(items) && !mbox.isReadOnly()
+	if setSeen {
+		items = backendutil.WithFlags(items)
+	}
+
+	var seen []uint32
+	for i, msg := range msgs {
+		if err = mbox.ctxErr(); err != nil {
+			break
+		}
 		seqNum := uint32(i + 1)
 
 		var id uint32
-		if uid {
+		if uid || uidOnly {
 			id = msg.Uid
 		} else {
 			id = seqNum
@@ -127,21 +338,98 @@ func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 			continue
 		}
 
-		m, err := msg.Fetch(seqNum, items)
-		if err != nil {
+		if setSeen && !hasFlag(msg.Flags, imap.SeenFlag) {
+			msg.Flags = append(msg.Flags, imap.SeenFlag)
+			seen = append(seen, msg.Uid)
+		}
+
+		if uidOnly {
+			seqNum = 0
+		}
+		m, fetchErr := msg.Fetch(seqNum, items)
+		if fetchErr != nil {
 			continue
 		}
+		if uidOnly {
+			m.Uid = msg.Uid
+		}
 
 		ch <- m
 	}
 
-	return nil
+	// The server can't deliver updates until all messages have been sent
+	close(ch)
+	mbox.setSeen(seen)
+	return err
+}
+
+// setSeen sets the \Seen flag of messages which have been fetched.
+func (mbox *Mailbox) setSeen(uids []uint32) {
+	if len(uids) == 0 {
+		return
+	}
+	seen := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		seen[uid] = true
+	}
+
+	be := mbox.user.be
+	be.mutex.Lock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		be.mutex.Unlock()
+		return
+	}
+
+	var updates []backend.Update
+	for i, msg := range st.messages {
+		if !seen[msg.Uid] || hasFlag(msg.Flags, imap.SeenFlag) {
+			continue
+		}
+		msg.Flags = append(msg.Flags, imap.SeenFlag)
+		updates = append(updates, mbox.flagsUpdate(uint32(i+1), msg, true))
+	}
+
+	be.unlockAndSendUpdates(updates)
+}
+
+// flagsUpdate returns an update with the flags of a message, and its UID if
+// uid is set. The backend must be locked.
+func (mbox *Mailbox) flagsUpdate(seqNum uint32, msg *Message, uid bool) backend.Update {
+	items := []imap.FetchItem{imap.FetchFlags}
+	if uid {
+		items = append(items, imap.FetchUid)
+	}
+
+	m := imap.NewMessage(seqNum, items)
+	m.Flags = mbox.flags(msg)
+	m.Uid = msg.Uid
+	return &backend.MessageUpdate{
+		Update:  backend.NewUpdate(mbox.user.Username(), mbox.state.name),
+		Message: m,
+	}
 }
 
 func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.searchMessages(uid, criteria, nil)
+}
+
+func (mbox *Mailbox) searchMessages(uid bool, criteria *imap.SearchCriteria, progress backend.ProgressFunc) ([]uint32, error) {
+	msgs, err := mbox.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
 	var ids []uint32
-	for i, msg := range mbox.Messages {
+	for i, msg := range msgs {
+		if err := mbox.ctxErr(); err != nil {
+			return nil, err
+		}
 		seqNum := uint32(i + 1)
+		if progress != nil {
+			progress(seqNum, uint32(len(msgs)))
+		}
 
 		ok, err := msg.Match(seqNum, criteria)
 		if err != nil || !ok {
@@ -159,6 +447,61 @@ func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]
 	return ids, nil
 }
 
+func (mbox *Mailbox) SortMessages(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	all, err := mbox.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []backendutil.SortMessage
+	for i, msg := range all {
+		seqNum := uint32(i + 1)
+
+		ok, err := msg.Match(seqNum, searchCriteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		hdr, _, err := msg.headerAndBody()
+		if err != nil {
+			continue
+		}
+
+		sm := backendutil.SortMessage{
+			Id:     seqNum,
+			Header: hdr,
+			Date:   msg.Date,
+			Size:   msg.Size,
+		}
+		if uid {
+			sm.Id = msg.Uid
+		}
+		msgs = append(msgs, sm)
+	}
+	return backendutil.Sort(msgs, sortCriteria), nil
+}
+
+// withoutRecent returns flags without \Recent, which can't be altered by
+// clients.
+func withoutRecent(flags []string) []string {
+	var l []string
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	return l
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
 	if date.IsZero() {
 		date = time.Now()
@@ -169,75 +512,260 @@ func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Lit
 		return err
 	}
 
-	mbox.Messages = append(mbox.Messages, &Message{
-		Uid:   mbox.uidNext(),
-		Date:  date,
-		Size:  uint32(len(b)),
-		Flags: flags,
-		Body:  b,
-	})
+	be := mbox.user.be
+	be.mutex.Lock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		be.mutex.Unlock()
+		return err
+	}
+
+	emailId := newObjectId("M")
+	st.appendMessage(&Message{
+		Date:     date,
+		Size:     uint32(len(b)),
+		Flags:    withoutRecent(flags),
+		Body:     b,
+		EmailId:  emailId,
+		ThreadId: mbox.user.threadId(b, emailId),
+		SaveDate: time.Now(),
+	}, be.recentOwner(st))
+
+	be.unlockAndSendUpdates([]backend.Update{st.existsUpdate(mbox.user.Username())})
 	return nil
 }
 
+// UpdateMessagesFlags implements backend.Mailbox. Message updates contain the
+// UID of the messages, which is only included in the FETCH responses if uid is
+// set. \Recent is included in the flags if the message is recent for the
+// session making the change.
 func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
-	for i, msg := range mbox.Messages {
+	flags = withoutRecent(flags)
+
+	be := mbox.user.be
+	be.mutex.Lock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		be.mutex.Unlock()
+		return err
+	}
+
+	var updates []backend.Update
+	for i, msg := range st.messages {
+		seqNum := uint32(i + 1)
+
 		var id uint32
 		if uid {
 			id = msg.Uid
 		} else {
-			id = uint32(i + 1)
+			id = seqNum
 		}
 		if !seqset.Contains(id) {
 			continue
 		}
 
 		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
+		updates = append(updates, mbox.flagsUpdate(seqNum, msg, uid))
 	}
 
+	be.unlockAndSendUpdates(updates)
 	return nil
 }
 
 func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
-	dest, ok := mbox.user.mailboxes[destName]
-	if !ok {
-		return backend.ErrNoSuchMailbox
+	return mbox.copyMessages(uid, seqset, destName, nil)
+}
+
+func (mbox *Mailbox) copyMessages(uid bool, seqset *imap.SeqSet, destName string, progress backend.ProgressFunc) error {
+	msgs, err := mbox.snapshot()
+	if err != nil {
+		return err
 	}
 
-	for i, msg := range mbox.Messages {
+	// Reporting progress may block, find the messages to copy without keeping
+	// the backend locked
+	uids := make(map[uint32]bool)
+	for i, msg := range msgs {
+		if progress != nil {
+			progress(uint32(i+1), uint32(len(msgs)))
+		}
+
 		var id uint32
 		if uid {
 			id = msg.Uid
 		} else {
 			id = uint32(i + 1)
 		}
-		if !seqset.Contains(id) {
+		if seqset.Contains(id) {
+			uids[msg.Uid] = true
+		}
+	}
+
+	be := mbox.user.be
+	be.mutex.Lock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		be.mutex.Unlock()
+		return err
+	}
+	dest, ok := mbox.user.state.mailboxes[canonicalName(destName)]
+	if !ok {
+		be.mutex.Unlock()
+		return backend.ErrNoSuchMailbox
+	} else if dest.noselect {
+		be.mutex.Unlock()
+		return errNoSelect
+	}
+
+	// Copying a mailbox to itself appends messages to it. Messages expunged
+	// meanwhile aren't copied.
+	owner := be.recentOwner(dest)
+	var updates []backend.Update
+	for _, msg := range append([]*Message(nil), st.messages...) {
+		if !uids[msg.Uid] {
 			continue
 		}
 
 		msgCopy := *msg
-		msgCopy.Uid = dest.uidNext()
-		dest.Messages = append(dest.Messages, &msgCopy)
+		msgCopy.Flags = append([]string(nil), msg.Flags...)
+		msgCopy.SaveDate = time.Now()
+		dest.appendMessage(&msgCopy, owner)
+		updates = []backend.Update{dest.existsUpdate(mbox.user.Username())}
 	}
 
+	be.unlockAndSendUpdates(updates)
 	return nil
 }
 
+func (mbox *Mailbox) UidListMessages(uids *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(true, true, uids, items, ch)
+}
+
+func (mbox *Mailbox) UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessages(true, criteria)
+}
+
+func (mbox *Mailbox) UidUpdateMessagesFlags(uids *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlags(true, uids, op, flags)
+}
+
+func (mbox *Mailbox) UidCopyMessages(uids *imap.SeqSet, destName string) error {
+	return mbox.CopyMessages(true, uids, destName)
+}
+
 func (mbox *Mailbox) Expunge() error {
-	for i := len(mbox.Messages) - 1; i >= 0; i-- {
-		msg := mbox.Messages[i]
-
-		deleted := false
-		for _, flag := range msg.Flags {
-			if flag == imap.DeletedFlag {
-				deleted = true
-				break
-			}
+	return mbox.expunge(nil)
+}
+
+func (mbox *Mailbox) expunge(progress backend.ProgressFunc) error {
+	msgs, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+
+	// Reporting progress may block, find the messages to expunge without
+	// keeping the backend locked
+	deleted := make(map[uint32]bool)
+	total := uint32(len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if progress != nil {
+			progress(total-uint32(i), total)
+		}
+		if hasFlag(msgs[i].Flags, imap.DeletedFlag) {
+			deleted[msgs[i].Uid] = true
 		}
+	}
 
-		if deleted {
-			mbox.Messages = append(mbox.Messages[:i], mbox.Messages[i+1:]...)
+	be := mbox.user.be
+	be.mutex.Lock()
+
+	st := mbox.state
+	if err := st.check(); err != nil {
+		be.mutex.Unlock()
+		return err
+	}
+
+	// Expunge from the last message to the first one, so that sequence numbers
+	// in updates are valid when they're received. Messages whose \Deleted flag
+	// has been removed meanwhile are kept.
+	var updates []backend.Update
+	for i := len(st.messages) - 1; i >= 0; i-- {
+		msg := st.messages[i]
+		if !deleted[msg.Uid] || !hasFlag(msg.Flags, imap.DeletedFlag) {
+			continue
 		}
+
+		st.messages = append(st.messages[:i], st.messages[i+1:]...)
+		delete(st.recent, msg.Uid)
+		updates = append(updates, st.expungeUpdate(mbox.user.Username(), uint32(i+1), msg.Uid))
 	}
 
+	be.unlockAndSendUpdates(updates)
 	return nil
 }
+
+func (mbox *Mailbox) WithProgress(progress backend.ProgressFunc) backend.Mailbox {
+	return &progressMailbox{Mailbox: mbox, progress: progress}
+}
+
+// WithContext implements backend.ContextMailbox. Long-running operations of
+// the returned view stop when ctx is cancelled. Operations which modify the
+// mailbox are atomic: they're only cancelled before they start.
+func (mbox *Mailbox) WithContext(ctx context.Context) backend.Mailbox {
+	view := *mbox
+	view.ctx = ctx
+	return &view
+}
+
+// ctxErr returns the error of the context the mailbox is bound to, if any.
+func (mbox *Mailbox) ctxErr() error {
+	if mbox.ctx == nil {
+		return nil
+	}
+	return mbox.ctx.Err()
+}
+
+// progressMailbox is a mailbox reporting the progress of long-running
+// operations.
+type progressMailbox struct {
+	*Mailbox
+	progress backend.ProgressFunc
+}
+
+// WithContext implements backend.ContextMailbox. The returned view still
+// reports progress.
+func (mbox *progressMailbox) WithContext(ctx context.Context) backend.Mailbox {
+	view := mbox.Mailbox.WithContext(ctx).(*Mailbox)
+	return &progressMailbox{Mailbox: view, progress: mbox.progress}
+}
+
+func (mbox *progressMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.searchMessages(uid, criteria, mbox.progress)
+}
+
+func (mbox *progressMailbox) UidSearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.searchMessages(true, criteria, mbox.progress)
+}
+
+func (mbox *progressMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	return mbox.copyMessages(uid, seqset, destName, mbox.progress)
+}
+
+func (mbox *progressMailbox) UidCopyMessages(uids *imap.SeqSet, destName string) error {
+	return mbox.copyMessages(true, uids, destName, mbox.progress)
+}
+
+func (mbox *progressMailbox) Expunge() error {
+	return mbox.expunge(mbox.progress)
+}
+
+var (
+	_ backend.SortMailbox     = (*Mailbox)(nil)
+	_ backend.UidOnlyMailbox  = (*Mailbox)(nil)
+	_ backend.ProgressMailbox = (*Mailbox)(nil)
+	_ backend.SessionMailbox  = (*Mailbox)(nil)
+	_ backend.ContextMailbox  = (*Mailbox)(nil)
+)
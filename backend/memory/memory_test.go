@@ -0,0 +1,648 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"\r\n" +
+	"Hi there :)\r\n"
+
+func newTestBackend() (*Backend, <-chan backend.Update) {
+	be := New()
+
+	// Acknowledge updates, like a server would
+	updates := make(chan backend.Update, 100)
+	go func() {
+		for update := range be.Updates() {
+			select {
+			case updates <- update:
+			default:
+			}
+			close(update.Done())
+		}
+	}()
+	return be, updates
+}
+
+func login(t *testing.T, be *Backend) backend.User {
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	return u
+}
+
+func getMailbox(t *testing.T, u backend.User, name string) backend.Mailbox {
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	return mbox
+}
+
+func recentUids(t *testing.T, mbox backend.Mailbox) []uint32 {
+	uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.RecentFlag}})
+	if err != nil {
+		t.Fatal("SearchMessages() =", err)
+	}
+	return uids
+}
+
+func TestMailbox_recent(t *testing.T) {
+	be, _ := newTestBackend()
+	items := []imap.StatusItem{imap.StatusRecent}
+
+	// A message arrives while no session has selected INBOX
+	inbox := getMailbox(t, login(t, be), "INBOX")
+	if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	if status, _ := inbox.Status(items); status.Recent != 1 {
+		t.Errorf("Status().Recent = %v, want 1", status.Recent)
+	}
+
+	// EXAMINE doesn't claim recent messages
+	examined := getMailbox(t, login(t, be), "INBOX").(backend.SessionMailbox)
+	if status, err := examined.Select(true, items); err != nil || status.Recent != 1 {
+		t.Errorf("Select(true) = %v, %v, want 1 recent message", status, err)
+	}
+
+	first := getMailbox(t, login(t, be), "INBOX").(backend.SessionMailbox)
+	if status, err := first.Select(false, items); err != nil || status.Recent != 1 {
+		t.Errorf("Select(false) = %v, %v, want 1 recent message", status, err)
+	}
+	if uids := recentUids(t, first); !reflect.DeepEqual(uids, []uint32{7}) {
+		t.Errorf("Recent messages of the first session = %v", uids)
+	}
+
+	// The message isn't recent anymore for other sessions
+	second := getMailbox(t, login(t, be), "INBOX").(backend.SessionMailbox)
+	if status, err := second.Select(false, items); err != nil || status.Recent != 0 {
+		t.Errorf("Select(false) = %v, %v, want no recent message", status, err)
+	}
+
+	// New messages are recent for the first session which selected INBOX
+	if err := second.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	if uids := recentUids(t, first); !reflect.DeepEqual(uids, []uint32{7, 8}) {
+		t.Errorf("Recent messages of the first session = %v", uids)
+	}
+	if uids := recentUids(t, second); len(uids) != 0 {
+		t.Errorf("Recent messages of the second session = %v", uids)
+	}
+
+	// \Recent can't be stored
+	seqset, _ := imap.ParseSeqSet("1")
+	if err := second.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.RecentFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	if uids := recentUids(t, second); len(uids) != 0 {
+		t.Errorf("Recent messages after storing \\Recent = %v", uids)
+	}
+}
+
+func TestMailbox_threadId(t *testing.T) {
+	be, _ := newTestBackend()
+	inbox := getMailbox(t, login(t, be), "INBOX")
+
+	// Replies to the initial message, then to the reply
+	bodies := []string{
+		"Message-ID: <1@example.org>\r\nIn-Reply-To: <0000000@localhost/>\r\n\r\nReply",
+		"Message-ID: <2@example.org>\r\nReferences: <0000000@localhost/> <1@example.org>\r\n\r\nReply",
+		"Message-ID: <3@example.org>\r\n\r\nAnother thread",
+	}
+	for _, body := range bodies {
+		if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := inbox.ListMessages(false, seqset, []imap.FetchItem{imap.FetchThreadId}, ch); err != nil {
+		t.Fatal("ListMessages() =", err)
+	}
+	var threads []string
+	for msg := range ch {
+		threads = append(threads, msg.ThreadId)
+	}
+
+	if len(threads) != 4 {
+		t.Fatalf("Got %v messages, want 4", len(threads))
+	}
+	for i := 1; i < 3; i++ {
+		if threads[i] != threads[0] {
+			t.Errorf("Message %v is in thread %v, want %v", i+1, threads[i], threads[0])
+		}
+	}
+	if threads[3] == threads[0] {
+		t.Errorf("Unrelated message is in thread %v", threads[3])
+	}
+}
+
+func TestUser_uidValidity(t *testing.T) {
+	be, _ := newTestBackend()
+	u := login(t, be)
+
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	mbox := getMailbox(t, u, "Archive")
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext}
+	before, _ := mbox.Status(items)
+
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	if _, err := mbox.Status(items); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Status() of a deleted mailbox = %v", err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+
+	after, _ := getMailbox(t, u, "Archive").Status(items)
+	if after.UidValidity <= before.UidValidity {
+		t.Errorf("UIDVALIDITY after re-creation = %v, want more than %v", after.UidValidity, before.UidValidity)
+	}
+}
+
+func TestUser_hierarchy(t *testing.T) {
+	be, _ := newTestBackend()
+	u := login(t, be)
+
+	if err := u.CreateMailbox("foo/bar/baz"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	if err := u.CreateMailbox("foo/bar/"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("CreateMailbox() of a parent = %v", err)
+	}
+
+	if err := u.RenameMailbox("foo", "qux/quux"); err != nil {
+		t.Fatal("RenameMailbox() =", err)
+	}
+
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal("ListMailboxes() =", err)
+	}
+	var names []string
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name())
+	}
+	want := []string{"INBOX", "qux", "qux/quux", "qux/quux/bar", "qux/quux/bar/baz"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ListMailboxes() = %v, want %v", names, want)
+	}
+}
+
+func TestUser_deleteWithInferiors(t *testing.T) {
+	be, _ := newTestBackend()
+	u := login(t, be)
+
+	if err := u.CreateMailbox("foo/bar"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	foo := getMailbox(t, u, "foo")
+	if err := foo.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+
+	// The mailbox is kept with the \Noselect attribute, its messages are
+	// removed
+	if err := u.DeleteMailbox("foo"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	if _, err := foo.Status([]imap.StatusItem{imap.StatusMessages}); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Status() of the deleted mailbox = %v", err)
+	}
+	foo = getMailbox(t, u, "foo")
+	info, err := foo.Info()
+	if err != nil {
+		t.Fatal("Info() =", err)
+	}
+	if !reflect.DeepEqual(info.Attributes, []string{imap.NoSelectAttr}) {
+		t.Errorf("Invalid attributes: %v", info.Attributes)
+	}
+	if _, err := foo.Status([]imap.StatusItem{imap.StatusMessages}); err == nil {
+		t.Error("Status() of a \\Noselect mailbox succeeded")
+	}
+	getMailbox(t, u, "foo/bar")
+
+	// A \Noselect mailbox with inferiors can't be deleted
+	if err := u.DeleteMailbox("foo"); err == nil {
+		t.Error("DeleteMailbox() of a \\Noselect mailbox with inferiors succeeded")
+	}
+
+	// It can be created again
+	if err := u.CreateMailbox("foo"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	status, err := getMailbox(t, u, "foo").Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if status.Messages != 0 {
+		t.Errorf("Re-created mailbox has %v messages", status.Messages)
+	}
+
+	// Without inferiors, the mailbox is removed
+	if err := u.DeleteMailbox("foo/bar"); err != nil {
+		t.Fatal("DeleteMailbox() =", err)
+	}
+	if _, err := u.GetMailbox("foo/bar"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox() after DeleteMailbox() = %v", err)
+	}
+}
+
+func TestMailbox_updates(t *testing.T) {
+	be, updates := newTestBackend()
+	mbox := getMailbox(t, login(t, be), "INBOX")
+
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	if update, ok := (<-updates).(*backend.MailboxUpdate); !ok || update.Messages != 2 {
+		t.Errorf("Invalid update after CreateMessage(): %#v", update)
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	for _, seqNum := range []uint32{1, 2} {
+		if update, ok := (<-updates).(*backend.MessageUpdate); !ok || update.SeqNum != seqNum {
+			t.Errorf("Invalid update after UpdateMessagesFlags(): %#v", update)
+		}
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	for _, seqNum := range []uint32{2, 1} {
+		if update, ok := (<-updates).(*backend.ExpungeUpdate); !ok || update.SeqNum != seqNum {
+			t.Errorf("Invalid update after Expunge(): %#v", update)
+		}
+	}
+}
+
+func TestMailbox_fetchSeen(t *testing.T) {
+	be, updates := newTestBackend()
+	u := login(t, be)
+
+	mbox := getMailbox(t, u, "INBOX")
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	<-updates
+
+	fetch := func(mbox backend.Mailbox, item imap.FetchItem) *imap.Message {
+		seqset, _ := imap.ParseSeqSet("2")
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(false, seqset, []imap.FetchItem{item}, ch); err != nil {
+			t.Fatal("ListMessages() =", err)
+		}
+		return <-ch
+	}
+
+	// Messages aren't marked as seen in read-only mailboxes
+	examined := getMailbox(t, u, "INBOX")
+	if _, err := examined.(backend.SessionMailbox).Select(true, nil); err != nil {
+		t.Fatal("Select() =", err)
+	}
+	if msg := fetch(examined, "BODY[]"); hasFlag(msg.Flags, imap.SeenFlag) {
+		t.Error("\\Seen set by a fetch in a read-only mailbox")
+	}
+
+	if _, err := mbox.(backend.SessionMailbox).Select(false, nil); err != nil {
+		t.Fatal("Select() =", err)
+	}
+	if msg := fetch(mbox, "BODY.PEEK[]"); hasFlag(msg.Flags, imap.SeenFlag) {
+		t.Error("\\Seen set by BODY.PEEK[]")
+	}
+
+	msg := fetch(mbox, "BODY[]")
+	if !hasFlag(msg.Flags, imap.SeenFlag) {
+		t.Errorf("Flags of a message fetched with BODY[] = %v, want \\Seen", msg.Flags)
+	}
+	update, ok := (<-updates).(*backend.MessageUpdate)
+	if !ok || update.SeqNum != 2 || update.Uid == 0 || !hasFlag(update.Flags, imap.SeenFlag) {
+		t.Errorf("Invalid update after fetching BODY[]: %#v", update)
+	}
+}
+
+func TestMailbox_updatesUnlocked(t *testing.T) {
+	be := New()
+	u := login(t, be)
+	mbox := getMailbox(t, u, "INBOX")
+	if _, err := mbox.(backend.SessionMailbox).Select(false, nil); err != nil {
+		t.Fatal("Select() =", err)
+	}
+
+	// Don't acknowledge the update yet, as a server delivering it to a slow
+	// client
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage))
+	}()
+	update := <-be.Updates()
+
+	// Other operations aren't blocked meanwhile, including the logout of the
+	// session the update is delivered to
+	blocked := make(chan error, 1)
+	go func() {
+		if _, err := mbox.Status([]imap.StatusItem{imap.StatusMessages}); err != nil {
+			blocked <- err
+			return
+		}
+		if err := u.CreateMailbox("Other"); err != nil {
+			blocked <- err
+			return
+		}
+		blocked <- u.Logout()
+	}()
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend blocked while an update is delivered")
+	}
+
+	close(update.Done())
+	if err := <-done; err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+}
+
+func TestMailbox_progressUnlocked(t *testing.T) {
+	be, _ := newTestBackend()
+	mbox := getMailbox(t, login(t, be), "INBOX")
+
+	// The progress callback may block, for instance to write a response: it
+	// must be called without keeping the backend locked
+	var calls int
+	progress := mbox.(backend.ProgressMailbox).WithProgress(func(count, total uint32) {
+		calls++
+		if _, err := mbox.Status([]imap.StatusItem{imap.StatusMessages}); err != nil {
+			t.Error("Status() =", err)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seqset, _ := imap.ParseSeqSet("1:*")
+		if err := progress.CopyMessages(false, seqset, "INBOX"); err != nil {
+			t.Error("CopyMessages() =", err)
+		}
+		if err := progress.Expunge(); err != nil {
+			t.Error("Expunge() =", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Progress reported with the backend locked")
+	}
+
+	if calls != 3 {
+		t.Errorf("Progress reported %v times, want 3", calls)
+	}
+}
+
+func TestMailbox_progressWithContext(t *testing.T) {
+	be, _ := newTestBackend()
+	mbox := getMailbox(t, login(t, be), "INBOX")
+
+	var calls int
+	progress := mbox.(backend.ProgressMailbox).WithProgress(func(count, total uint32) {
+		calls++
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	view := progress.(backend.ContextMailbox).WithContext(ctx)
+
+	seqset, _ := imap.ParseSeqSet("1:*")
+	if err := view.CopyMessages(false, seqset, "INBOX"); err != nil {
+		t.Fatal("CopyMessages() =", err)
+	}
+	if calls == 0 {
+		t.Error("Progress not reported by a mailbox bound to a context")
+	}
+
+	cancel()
+	if _, err := view.SearchMessages(false, &imap.SearchCriteria{}); err != context.Canceled {
+		t.Errorf("SearchMessages() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMailbox_concurrent(t *testing.T) {
+	be, _ := newTestBackend()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mbox := getMailbox(t, login(t, be), "INBOX")
+			for j := 0; j < 10; j++ {
+				mbox.CreateMessage([]string{imap.DeletedFlag}, time.Now(), bytes.NewBufferString(testMessage))
+				mbox.Expunge()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			mbox := getMailbox(t, login(t, be), "INBOX")
+			seqset, _ := imap.ParseSeqSet("1:*")
+			for j := 0; j < 10; j++ {
+				ch := make(chan *imap.Message, 10)
+				go func() {
+					for range ch {
+					}
+				}()
+				mbox.ListMessages(false, seqset, []imap.FetchItem{imap.FetchFlags, "BODY[]"}, ch)
+				mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.SeenFlag})
+			}
+		}()
+	}
+	wg.Wait()
+
+	status, err := getMailbox(t, login(t, be), "INBOX").Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if status.Messages != 1 || status.UidNext != 47 {
+		t.Errorf("Invalid status: %v messages, UIDNEXT %v", status.Messages, status.UidNext)
+	}
+}
+
+// testState returns a summary of the backend's content, for comparison.
+func testState(t *testing.T, be *Backend) map[string]interface{} {
+	state := make(map[string]interface{})
+	for _, username := range be.usernames() {
+		u, err := be.Login(nil, username, be.users[username].password)
+		if err != nil {
+			t.Fatal("Login() =", err)
+		}
+
+		mailboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			t.Fatal("ListMailboxes() =", err)
+		}
+		for _, mbox := range mailboxes {
+			items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMailboxId}
+			status, err := mbox.Status(items)
+			if err != nil {
+				t.Fatal("Status() =", err)
+			}
+
+			seqset, _ := imap.ParseSeqSet("1:*")
+			ch := make(chan *imap.Message, 10)
+			fetchItems := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchEmailId, "BODY[]"}
+			go mbox.ListMessages(false, seqset, fetchItems, ch)
+
+			var msgs []string
+			for msg := range ch {
+				var body []byte
+				for _, l := range msg.Body {
+					body, _ = ioutil.ReadAll(l)
+				}
+				// \Recent is specific to sessions, it isn't persisted
+				msgs = append(msgs, fmt.Sprintf("%v %v %v %v %q", msg.Uid, withoutRecent(msg.Flags), msg.InternalDate.UTC(), msg.EmailId, body))
+			}
+
+			key := username + " " + mbox.Name()
+			state[key] = fmt.Sprintf("%v %v %v %v", status.UidValidity, status.UidNext, status.MailboxId, msgs)
+		}
+	}
+	return state
+}
+
+func TestSnapshot(t *testing.T) {
+	be, _ := newTestBackend()
+	u := login(t, be)
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("CreateMailbox() =", err)
+	}
+	if err := be.AddUser("other", "secret"); err != nil {
+		t.Fatal("AddUser() =", err)
+	}
+	mbox := getMailbox(t, u, "Archive/2020")
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage([]string{"$Important"}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+	want := testState(t, be)
+
+	var buf bytes.Buffer
+	if err := be.WriteSnapshot(&buf); err != nil {
+		t.Fatal("WriteSnapshot() =", err)
+	}
+	restored, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal("ReadSnapshot() =", err)
+	}
+	if got := testState(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored snapshot = \n%v\n want \n%v", got, want)
+	}
+
+	dir, err := ioutil.TempDir("", "go-imap-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := be.DumpDir(dir); err != nil {
+		t.Fatal("DumpDir() =", err)
+	}
+	loaded, err := LoadDir(dir)
+	if err != nil {
+		t.Fatal("LoadDir() =", err)
+	}
+	if got := testState(t, loaded); !reflect.DeepEqual(got, want) {
+		t.Errorf("Loaded directory = \n%v\n want \n%v", got, want)
+	}
+
+	// New mailboxes don't re-use UIDVALIDITY values
+	if err := loaded.AddUser("new", "password"); err != nil {
+		t.Fatal("AddUser() =", err)
+	}
+	if uidValidity := loaded.users["new"].mailboxes["INBOX"].uidValidity; uidValidity <= be.lastUidValidity {
+		t.Errorf("UIDVALIDITY of a new mailbox = %v, want more than %v", uidValidity, be.lastUidValidity)
+	}
+}
+
+func TestLoadDir_fixture(t *testing.T) {
+	be, err := LoadDir("testdata/fixture")
+	if err != nil {
+		t.Fatal("LoadDir() =", err)
+	}
+
+	mbox := getMailbox(t, login(t, be), "INBOX")
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity})
+	if err != nil {
+		t.Fatal("Status() =", err)
+	}
+	if status.Messages != 1 || status.UidNext != 7 || status.UidValidity != 1 {
+		t.Errorf("Invalid status: %v messages, UIDNEXT %v, UIDVALIDITY %v", status.Messages, status.UidNext, status.UidValidity)
+	}
+
+	// Messages without metadata are added after the others
+	dir, err := ioutil.TempDir("", "go-imap-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := be.DumpDir(dir); err != nil {
+		t.Fatal("DumpDir() =", err)
+	}
+	path := filepath.Join(dir, "username", "INBOX", "new.eml")
+	if err := ioutil.WriteFile(path, []byte("Subject: New\n\nHi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	be, err = LoadDir(dir)
+	if err != nil {
+		t.Fatal("LoadDir() =", err)
+	}
+	mbox = getMailbox(t, login(t, be), "INBOX")
+	uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		t.Fatal("SearchMessages() =", err)
+	}
+	if want := []uint32{6, 7}; !reflect.DeepEqual(uids, want) {
+		t.Errorf("UIDs = %v, want %v", uids, want)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Instance {
+		return &backendtest.Instance{
+			Backend:  New(),
+			Username: "username",
+			Password: "password",
+		}
+	})
+}
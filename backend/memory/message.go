@@ -18,6 +18,10 @@ type Message struct {
 	Size  uint32
 	Flags []string
 	Body  []byte
+
+	EmailId  string
+	ThreadId string
+	SaveDate time.Time
 }
 
 func (m *Message) entity() (*message.Entity, error) {
@@ -48,6 +52,15 @@ func (m *Message) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, e
 			fetched.Size = m.Size
 		case imap.FetchUid:
 			fetched.Uid = m.Uid
+		case imap.FetchEmailId:
+			fetched.EmailId = m.EmailId
+		case imap.FetchThreadId:
+			fetched.ThreadId = m.ThreadId
+		case imap.FetchSaveDate:
+			fetched.SaveDate = m.SaveDate
+		case imap.FetchPreview:
+			hdr, body, _ := m.headerAndBody()
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
 		default:
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
@@ -69,6 +82,18 @@ func (m *Message) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, e
 }
 
 func (m *Message) Match(seqNum uint32, c *imap.SearchCriteria) (bool, error) {
-	e, _ := m.entity()
-	return backendutil.Match(e, seqNum, m.Uid, m.Date, m.Flags, c)
+	e, err := m.entity()
+	if err != nil {
+		return false, err
+	}
+	md := &backendutil.Metadata{
+		SeqNum:   seqNum,
+		Uid:      m.Uid,
+		Date:     m.Date,
+		Flags:    m.Flags,
+		EmailId:  m.EmailId,
+		ThreadId: m.ThreadId,
+		SaveDate: m.SaveDate,
+	}
+	return backendutil.MatchMessage(e, md, c)
 }
@@ -0,0 +1,417 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshots contain users, mailboxes and messages. Session state, such as the
+// \Recent flag, isn't saved.
+
+type snapshot struct {
+	LastUidValidity uint32         `json:"lastuidvalidity"`
+	Users           []snapshotUser `json:"users"`
+}
+
+type snapshotUser struct {
+	Username  string            `json:"username"`
+	Password  string            `json:"password"`
+	Mailboxes []snapshotMailbox `json:"mailboxes"`
+}
+
+type snapshotMailbox struct {
+	// Empty in directory metadata files, the name is the directory path
+	Name        string            `json:"name,omitempty"`
+	ID          string            `json:"id"`
+	UidValidity uint32            `json:"uidvalidity"`
+	UidNext     uint32            `json:"uidnext"`
+	Subscribed  bool              `json:"subscribed,omitempty"`
+	NoSelect    bool              `json:"noselect,omitempty"`
+	Messages    []snapshotMessage `json:"messages"`
+}
+
+type snapshotMessage struct {
+	Uid      uint32    `json:"uid"`
+	Date     time.Time `json:"date"`
+	Flags    []string  `json:"flags"`
+	EmailId  string    `json:"emailid"`
+	ThreadId string    `json:"threadid"`
+	SaveDate time.Time `json:"savedate"`
+	// Empty in directory metadata files, the body is stored in an .eml file
+	Body []byte `json:"body,omitempty"`
+}
+
+func (st *mailboxState) snapshot(withBodies bool) snapshotMailbox {
+	mbox := snapshotMailbox{
+		Name:        st.name,
+		ID:          st.id,
+		UidValidity: st.uidValidity,
+		UidNext:     st.uidNext,
+		Subscribed:  st.subscribed,
+		NoSelect:    st.noselect,
+	}
+	for _, msg := range st.messages {
+		m := snapshotMessage{
+			Uid:      msg.Uid,
+			Date:     msg.Date,
+			Flags:    msg.Flags,
+			EmailId:  msg.EmailId,
+			ThreadId: msg.ThreadId,
+			SaveDate: msg.SaveDate,
+		}
+		if withBodies {
+			m.Body = msg.Body
+		}
+		mbox.Messages = append(mbox.Messages, m)
+	}
+	return mbox
+}
+
+// restore replaces the mailbox's data with a snapshot. bodies maps UIDs to
+// message bodies, if they aren't in the snapshot. The backend must be locked.
+func (st *mailboxState) restore(be *Backend, mbox *snapshotMailbox, bodies map[uint32][]byte) {
+	if mbox.ID != "" {
+		st.id = mbox.ID
+	}
+	if mbox.UidValidity != 0 {
+		st.uidValidity = mbox.UidValidity
+		if st.uidValidity > be.lastUidValidity {
+			be.lastUidValidity = st.uidValidity
+		}
+	}
+	st.subscribed = mbox.Subscribed
+	st.noselect = mbox.NoSelect
+
+	st.messages = nil
+	for _, m := range mbox.Messages {
+		body := m.Body
+		if body == nil {
+			body = bodies[m.Uid]
+		}
+		if body == nil {
+			continue
+		}
+
+		emailId := m.EmailId
+		if emailId == "" {
+			emailId = newObjectId("M")
+		}
+		threadId := m.ThreadId
+		if threadId == "" {
+			threadId = "T" + strings.TrimPrefix(emailId, "M")
+		}
+
+		st.messages = append(st.messages, &Message{
+			Uid:      m.Uid,
+			Date:     m.Date,
+			Size:     uint32(len(body)),
+			Flags:    withoutRecent(m.Flags),
+			Body:     body,
+			EmailId:  emailId,
+			ThreadId: threadId,
+			SaveDate: m.SaveDate,
+		})
+	}
+	sort.Slice(st.messages, func(i, j int) bool {
+		return st.messages[i].Uid < st.messages[j].Uid
+	})
+
+	st.uidNext = mbox.UidNext
+	if n := len(st.messages); n > 0 && st.messages[n-1].Uid >= st.uidNext {
+		st.uidNext = st.messages[n-1].Uid + 1
+	}
+	if st.uidNext == 0 {
+		st.uidNext = 1
+	}
+}
+
+// mailbox returns a user's mailbox, creating it and its parents if needed. The
+// backend must be locked.
+func (u *userState) mailbox(be *Backend, name string) *mailboxState {
+	name = canonicalName(name)
+	if st, ok := u.mailboxes[name]; ok {
+		return st
+	}
+	(&User{be: be, state: u}).createParents(name)
+	st := be.newMailboxState(name)
+	u.mailboxes[name] = st
+	return st
+}
+
+// WriteSnapshot writes a JSON snapshot of all users, mailboxes and messages to
+// w. It can be loaded with ReadSnapshot.
+func (be *Backend) WriteSnapshot(w io.Writer) error {
+	be.mutex.RLock()
+	defer be.mutex.RUnlock()
+
+	s := snapshot{LastUidValidity: be.lastUidValidity}
+	for _, username := range be.usernames() {
+		user := be.users[username]
+		u := snapshotUser{Username: user.username, Password: user.password}
+		for _, name := range user.mailboxNames() {
+			u.Mailboxes = append(u.Mailboxes, user.mailboxes[name].snapshot(true))
+		}
+		s.Users = append(s.Users, u)
+	}
+
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// ReadSnapshot creates a backend from a snapshot written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*Backend, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+
+	be := newBackend()
+	be.lastUidValidity = s.LastUidValidity
+	for _, u := range s.Users {
+		if _, ok := be.users[u.Username]; ok {
+			return nil, fmt.Errorf("memory: duplicate user %q in snapshot", u.Username)
+		}
+		user := be.newUserState(u.Username, u.Password)
+		for i := range u.Mailboxes {
+			mbox := &u.Mailboxes[i]
+			user.mailbox(be, mbox.Name).restore(be, mbox, nil)
+		}
+		be.users[user.username] = user
+	}
+	return be, nil
+}
+
+// Directories contain a directory for each user, named after the username. A
+// user directory contains an optional .password file, and a directory for each
+// mailbox. Inferior mailboxes are sub-directories. Messages are stored in
+// <uid>.eml files. Files with names which aren't a UID are assigned a new one.
+// An optional .mailbox.json file contains the mailbox's metadata, and the
+// date and flags of its messages.
+const (
+	passwordFile = ".password"
+	metadataFile = ".mailbox.json"
+)
+
+// LoadDir creates a backend from a directory of .eml files, such as one written
+// by DumpDir. Messages without metadata get their date from the file
+// modification time.
+func LoadDir(dir string) (*Backend, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	be := newBackend()
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		username := entry.Name()
+		userDir := filepath.Join(dir, username)
+
+		password, err := ioutil.ReadFile(filepath.Join(userDir, passwordFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		user := be.newUserState(username, strings.TrimRight(string(password), "\r\n"))
+		if err := loadUserDir(be, user, userDir, ""); err != nil {
+			return nil, err
+		}
+		be.users[username] = user
+	}
+	return be, nil
+}
+
+// loadUserDir loads the mailboxes in a directory, and its sub-directories.
+func loadUserDir(be *Backend, user *userState, dir, prefix string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		name := prefix + entry.Name()
+		mboxDir := filepath.Join(dir, entry.Name())
+		if err := loadMailboxDir(be, user.mailbox(be, name), mboxDir); err != nil {
+			return err
+		}
+		if err := loadUserDir(be, user, mboxDir, name+Delimiter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMailboxDir loads the messages of a mailbox directory.
+func loadMailboxDir(be *Backend, st *mailboxState, dir string) error {
+	var mbox snapshotMailbox
+	if b, err := ioutil.ReadFile(filepath.Join(dir, metadataFile)); err == nil {
+		if err := json.Unmarshal(b, &mbox); err != nil {
+			return fmt.Errorf("memory: invalid %v: %v", filepath.Join(dir, metadataFile), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[uint32]bool)
+	for _, m := range mbox.Messages {
+		known[m.Uid] = true
+	}
+
+	bodies := make(map[uint32][]byte)
+	var maxUid uint32
+	var unnamed []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".eml") {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".eml"), 10, 32)
+		if err != nil || uid == 0 {
+			unnamed = append(unnamed, entry)
+			continue
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		bodies[uint32(uid)] = normalizeNewlines(body)
+		if uint32(uid) > maxUid {
+			maxUid = uint32(uid)
+		}
+		if !known[uint32(uid)] {
+			mbox.Messages = append(mbox.Messages, snapshotMessage{
+				Uid:  uint32(uid),
+				Date: entry.ModTime(),
+			})
+		}
+	}
+
+	// Files which aren't named after a UID are added after the others
+	if mbox.UidNext > maxUid {
+		maxUid = mbox.UidNext - 1
+	}
+	for _, entry := range unnamed {
+		body, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		maxUid++
+		bodies[maxUid] = normalizeNewlines(body)
+		mbox.Messages = append(mbox.Messages, snapshotMessage{
+			Uid:  maxUid,
+			Date: entry.ModTime(),
+		})
+	}
+
+	st.restore(be, &mbox, bodies)
+	return nil
+}
+
+// normalizeNewlines converts LF line endings to CRLF, since .eml files are
+// often written with the local line ending.
+func normalizeNewlines(b []byte) []byte {
+	s := strings.Replace(string(b), "\r\n", "\n", -1)
+	return []byte(strings.Replace(s, "\n", "\r\n", -1))
+}
+
+// DumpDir writes all users, mailboxes and messages to a directory, which can
+// be loaded with LoadDir. The directory is created if it doesn't exist.
+func (be *Backend) DumpDir(dir string) error {
+	be.mutex.RLock()
+	defer be.mutex.RUnlock()
+
+	for _, username := range be.usernames() {
+		user := be.users[username]
+		if !validPathElement(username) {
+			return fmt.Errorf("memory: cannot dump user %q to a directory", username)
+		}
+		userDir := filepath.Join(dir, username)
+		if err := os.MkdirAll(userDir, 0700); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(userDir, passwordFile), []byte(user.password+"\n"), 0600); err != nil {
+			return err
+		}
+
+		for _, name := range user.mailboxNames() {
+			if err := dumpMailboxDir(user.mailboxes[name], userDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dumpMailboxDir(st *mailboxState, userDir string) error {
+	for _, elem := range strings.Split(st.name, Delimiter) {
+		if !validPathElement(elem) {
+			return fmt.Errorf("memory: cannot dump mailbox %q to a directory", st.name)
+		}
+	}
+
+	dir := filepath.Join(userDir, filepath.FromSlash(st.name))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for _, msg := range st.messages {
+		path := filepath.Join(dir, strconv.FormatUint(uint64(msg.Uid), 10)+".eml")
+		if err := ioutil.WriteFile(path, msg.Body, 0600); err != nil {
+			return err
+		}
+	}
+
+	mbox := st.snapshot(false)
+	mbox.Name = ""
+	b, err := json.MarshalIndent(&mbox, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, metadataFile), b, 0600)
+}
+
+func validPathElement(s string) bool {
+	return s != "" && !strings.HasPrefix(s, ".") && !strings.ContainsAny(s, "/\\\x00")
+}
+
+// usernames returns the sorted list of usernames. The backend must be locked.
+func (be *Backend) usernames() []string {
+	var l []string
+	for username := range be.users {
+		l = append(l, username)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// mailboxNames returns the sorted list of mailbox names. The backend must be
+// locked.
+func (u *userState) mailboxNames() []string {
+	var l []string
+	for name := range u.mailboxes {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
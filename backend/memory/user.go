@@ -1,82 +1,342 @@
 package memory
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"sort"
+	"strings"
 
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
 )
 
-type User struct {
+// userState is the data of a user, shared by all of its sessions.
+type userState struct {
 	username  string
 	password  string
-	mailboxes map[string]*Mailbox
+	scram     *backend.SCRAMCredentials
+	mailboxes map[string]*mailboxState
+	// Maps message identifiers to thread identifiers, built on first use
+	threads map[string]string
+}
+
+// User is a user session. A new session is created for each login.
+type User struct {
+	be    *Backend
+	state *userState
+
+	// The mailbox selected read-write by this session, if any. Protected by
+	// Backend.sessionsMutex.
+	selected *mailboxState
+	// The mailbox selected read-only by this session, if any. Protected by
+	// Backend.sessionsMutex.
+	examined *mailboxState
 }
 
 func (u *User) Username() string {
-	return u.username
+	return u.state.username
 }
 
-func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
-	for _, mailbox := range u.mailboxes {
-		if subscribed && !mailbox.Subscribed {
+// canonicalName returns the canonical name of a mailbox. INBOX is
+// case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.be.mutex.RLock()
+	defer u.be.mutex.RUnlock()
+
+	var names []string
+	for name, mbox := range u.state.mailboxes {
+		if subscribed && !mbox.subscribed {
 			continue
 		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		mailboxes = append(mailboxes, mailbox)
+	mailboxes := make([]backend.Mailbox, len(names))
+	for i, name := range names {
+		mailboxes[i] = &Mailbox{user: u, state: u.state.mailboxes[name], name: name}
 	}
-	return
+	return mailboxes, nil
 }
 
-func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
-	mailbox, ok := u.mailboxes[name]
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	u.be.mutex.RLock()
+	defer u.be.mutex.RUnlock()
+
+	mbox, ok := u.state.mailboxes[canonicalName(name)]
 	if !ok {
-		err = errors.New("No such mailbox")
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &Mailbox{user: u, state: mbox, name: mbox.name}, nil
+}
+
+// createParents creates the missing superior mailboxes of name. The backend
+// must be locked.
+func (u *User) createParents(name string) {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], Delimiter)
+		if parent == "" {
+			continue
+		}
+		if _, ok := u.state.mailboxes[parent]; !ok {
+			u.state.mailboxes[parent] = u.be.newMailboxState(parent)
+		}
 	}
-	return
 }
 
 func (u *User) CreateMailbox(name string) error {
-	if _, ok := u.mailboxes[name]; ok {
-		return errors.New("Mailbox already exists")
+	name = canonicalName(strings.TrimSuffix(name, Delimiter))
+	if name == "" {
+		return errors.New("Invalid mailbox name")
 	}
 
-	u.mailboxes[name] = &Mailbox{name: name, user: u}
+	u.be.mutex.Lock()
+	defer u.be.mutex.Unlock()
+
+	var subscribed bool
+	if mbox, ok := u.state.mailboxes[name]; ok && !mbox.noselect {
+		return backend.ErrMailboxAlreadyExists
+	} else if ok {
+		// The mailbox was deleted while it had inferiors, make it
+		// selectable again
+		mbox.deleted = true
+		subscribed = mbox.subscribed
+	}
+
+	u.createParents(name)
+	mbox := u.be.newMailboxState(name)
+	mbox.subscribed = subscribed
+	u.state.mailboxes[name] = mbox
 	return nil
 }
 
 func (u *User) DeleteMailbox(name string) error {
+	name = canonicalName(name)
 	if name == "INBOX" {
 		return errors.New("Cannot delete INBOX")
 	}
-	if _, ok := u.mailboxes[name]; !ok {
-		return errors.New("No such mailbox")
+
+	u.be.mutex.Lock()
+	defer u.be.mutex.Unlock()
+
+	mbox, ok := u.state.mailboxes[name]
+	if !ok {
+		return backend.ErrNoSuchMailbox
 	}
 
-	delete(u.mailboxes, name)
+	if u.hasInferiors(name) {
+		// RFC 3501 section 6.3.4: inferior mailboxes are kept, and the mailbox
+		// is replaced with an empty one with the \Noselect attribute
+		if mbox.noselect {
+			return errors.New("Mailbox has inferior hierarchical names")
+		}
+		noselect := u.be.newMailboxState(name)
+		noselect.noselect = true
+		noselect.subscribed = mbox.subscribed
+		u.state.mailboxes[name] = noselect
+	} else {
+		delete(u.state.mailboxes, name)
+	}
+
+	// The mailbox is re-created with a new UIDVALIDITY if needed
+	mbox.deleted = true
 	return nil
 }
 
+// hasInferiors checks whether a mailbox has inferior mailboxes. The backend
+// must be locked.
+func (u *User) hasInferiors(name string) bool {
+	prefix := name + Delimiter
+	for other := range u.state.mailboxes {
+		if strings.HasPrefix(other, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) RenameMailbox(existingName, newName string) error {
-	mbox, ok := u.mailboxes[existingName]
+	existingName = canonicalName(existingName)
+	newName = canonicalName(strings.TrimSuffix(newName, Delimiter))
+	if newName == "" {
+		return errors.New("Invalid mailbox name")
+	}
+
+	u.be.mutex.Lock()
+	updates, err := u.renameMailbox(existingName, newName)
+	u.be.unlockAndSendUpdates(updates)
+	return err
+}
+
+// renameMailbox renames a mailbox and returns the resulting updates. The
+// backend must be locked.
+func (u *User) renameMailbox(existingName, newName string) ([]backend.Update, error) {
+	mbox, ok := u.state.mailboxes[existingName]
 	if !ok {
-		return errors.New("No such mailbox")
+		return nil, backend.ErrNoSuchMailbox
+	}
+	if _, ok := u.state.mailboxes[newName]; ok {
+		return nil, backend.ErrMailboxAlreadyExists
 	}
 
-	u.mailboxes[newName] = &Mailbox{
-		name:     newName,
-		Messages: mbox.Messages,
-		user:     u,
+	if existingName == "INBOX" {
+		return u.renameInbox(mbox, newName), nil
 	}
 
-	mbox.Messages = nil
+	// Inferior mailboxes are renamed too
+	renamed := map[string]*mailboxState{newName: mbox}
+	prefix := existingName + Delimiter
+	for name, inferior := range u.state.mailboxes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		to := newName + Delimiter + strings.TrimPrefix(name, prefix)
+		if _, ok := u.state.mailboxes[to]; ok {
+			return nil, backend.ErrMailboxAlreadyExists
+		}
+		renamed[to] = inferior
+	}
 
-	if existingName != "INBOX" {
-		delete(u.mailboxes, existingName)
+	for to, mbox := range renamed {
+		delete(u.state.mailboxes, mbox.name)
+		mbox.name = to
+	}
+	for to, mbox := range renamed {
+		u.state.mailboxes[to] = mbox
 	}
+	u.createParents(newName)
+	return nil, nil
+}
 
-	return nil
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty, and returns the resulting updates. The backend must be locked.
+func (u *User) renameInbox(inbox *mailboxState, newName string) []backend.Update {
+	mbox := u.be.newMailboxState(newName)
+	mbox.messages = inbox.messages
+	mbox.recent = inbox.recent
+	mbox.uidNext = inbox.uidNext
+
+	u.createParents(newName)
+	u.state.mailboxes[newName] = mbox
+
+	var updates []backend.Update
+	for i := len(inbox.messages) - 1; i >= 0; i-- {
+		updates = append(updates, inbox.expungeUpdate(u.state.username, uint32(i+1), inbox.messages[i].Uid))
+	}
+	inbox.messages = nil
+	inbox.recent = make(map[uint32]*User)
+	return updates
+}
+
+// threadId returns the thread identifier of a new message. If the message
+// replies to an existing message, the thread identifier of the existing message
+// is re-used. Otherwise, a new thread identifier derived from the message
+// identifier is returned. The backend must be locked.
+func (u *User) threadId(body []byte, emailId string) string {
+	threadId := "T" + strings.TrimPrefix(emailId, "M")
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return threadId
+	}
+
+	threads := u.state.threadIndex()
+
+	parents := parseMsgIds(hdr.Get("References"))
+	parents = append(parents, parseMsgIds(hdr.Get("In-Reply-To"))...)
+	for _, parent := range parents {
+		if id, ok := threads[parent]; ok {
+			threadId = id
+			break
+		}
+	}
+
+	for _, id := range parseMsgIds(hdr.Get("Message-Id")) {
+		if _, ok := threads[id]; !ok {
+			threads[id] = threadId
+		}
+	}
+	return threadId
+}
+
+// threadIndex returns the thread identifiers of the user's messages, indexed by
+// message identifier. The index is built when first needed, and then kept up
+// to date as messages are added. The backend must be locked.
+func (u *userState) threadIndex() map[string]string {
+	if u.threads != nil {
+		return u.threads
+	}
+
+	u.threads = make(map[string]string)
+	for _, mbox := range u.mailboxes {
+		for _, msg := range mbox.messages {
+			if msg.ThreadId == "" {
+				continue
+			}
+			hdr, _, err := msg.headerAndBody()
+			if err != nil {
+				continue
+			}
+			for _, id := range parseMsgIds(hdr.Get("Message-Id")) {
+				if _, ok := u.threads[id]; !ok {
+					u.threads[id] = msg.ThreadId
+				}
+			}
+		}
+	}
+	return u.threads
+}
+
+// parseMsgIds extracts message identifiers from a header field value such as
+// References or In-Reply-To.
+func parseMsgIds(s string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			return ids
+		}
+		ids = append(ids, s[start+1:start+end])
+		s = s[start+end+1:]
+	}
 }
 
+// Logout ends the session. Messages arriving in the mailbox it had selected
+// aren't recent for this session anymore.
 func (u *User) Logout() error {
+	u.be.sessionsMutex.Lock()
+	defer u.be.sessionsMutex.Unlock()
+
+	u.unselect()
 	return nil
 }
+
+// unselect removes the session from the sessions of its selected mailbox.
+// Backend.sessionsMutex must be locked.
+func (u *User) unselect() {
+	u.examined = nil
+	if u.selected == nil {
+		return
+	}
+	sessions := u.selected.sessions
+	for i, s := range sessions {
+		if s == u {
+			u.selected.sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	u.selected = nil
+}
@@ -66,7 +66,8 @@ type MailboxInfoUpdate struct {
 	*imap.MailboxInfo
 }
 
-// MessageUpdate is a message update.
+// MessageUpdate is a message update. The server translates the message's
+// sequence number to the client's view of the mailbox using its UID, if set.
 type MessageUpdate struct {
 	Update
 	*imap.Message
@@ -75,7 +76,13 @@ type MessageUpdate struct {
 // ExpungeUpdate is an expunge update.
 type ExpungeUpdate struct {
 	Update
+	// The sequence number of the expunged message in the backend's view of
+	// the mailbox. The server translates it to each client's view.
 	SeqNum uint32
+	// The UID of the expunged message. Clients which have enabled UIDONLY are
+	// only notified if it's set. The server uses it to find the message in
+	// the client's view, backends should set it.
+	Uid uint32
 }
 
 // BackendUpdater is a Backend that implements Updater is able to send
@@ -1,6 +1,9 @@
 package backend
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var (
 	// ErrNoSuchMailbox is returned by User.GetMailbox, User.DeleteMailbox and
@@ -90,3 +93,14 @@ type User interface {
 	// client closed the connection.
 	Logout() error
 }
+
+// ContextUser is a user whose operations can be cancelled.
+type ContextUser interface {
+	User
+
+	// WithContext returns a view of this user whose operations are bound to
+	// ctx: they should stop and return ctx.Err() when ctx is cancelled. The
+	// view is only used for a single command, mailboxes it returns may be
+	// bound to ctx too.
+	WithContext(ctx context.Context) User
+}
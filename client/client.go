@@ -61,6 +61,22 @@ type MessageUpdate struct {
 
 func (u *MessageUpdate) update() {}
 
+// VanishedUpdate is delivered when messages are deleted and UIDONLY is
+// enabled. See RFC 9586 section 3.4.
+type VanishedUpdate struct {
+	Uids *imap.SeqSet
+}
+
+func (u *VanishedUpdate) update() {}
+
+// SearchUpdate is delivered when the results of a search context change. See
+// RFC 5267 section 4.
+type SearchUpdate struct {
+	Data *imap.SearchData
+}
+
+func (u *SearchUpdate) update() {}
+
 // Client is an IMAP client.
 type Client struct {
 	conn       *imap.Conn
@@ -86,9 +102,9 @@ type Client struct {
 
 	// A channel to which unilateral updates from the server will be sent. An
 	// update can be one of: *StatusUpdate, *MailboxUpdate, *MessageUpdate,
-	// *ExpungeUpdate. Note that blocking this channel blocks the whole client,
-	// so it's recommended to use a separate goroutine and a buffered channel to
-	// prevent deadlocks.
+	// *ExpungeUpdate, *VanishedUpdate, *SearchUpdate. Note that blocking this
+	// channel blocks the whole client, so it's recommended to use a separate
+	// goroutine and a buffered channel to prevent deadlocks.
 	Updates chan<- Update
 
 	// ErrorLog specifies an optional logger for errors accepting connections and
@@ -97,12 +113,31 @@ type Client struct {
 	// simultaneously from multiple goroutines.
 	ErrorLog imap.Logger
 
-	// Timeout specifies a maximum amount of time to wait on a command.
+	// Timeout specifies a maximum amount of time to wait on a command. The
+	// deadline is extended each time the server reports the progress of the
+	// command with an INPROGRESS response, as defined in RFC 9585.
 	//
 	// A Timeout of zero means no timeout. This is the default.
 	Timeout time.Duration
 }
 
+// ProgressFunc is called when the server reports the progress of a
+// long-running command, as defined in RFC 9585.
+type ProgressFunc func(p *imap.InProgress)
+
+// progressCommander is a command whose progress is reported.
+type progressCommander struct {
+	imap.Commander
+	progress ProgressFunc
+}
+
+// WithProgress returns a command which calls progress each time the server
+// reports the progress of cmdr, when executed with Client.Execute. Note that
+// blocking in progress blocks the whole client.
+func WithProgress(cmdr imap.Commander, progress ProgressFunc) imap.Commander {
+	return &progressCommander{cmdr, progress}
+}
+
 func (c *Client) registerHandler(h responses.Handler) {
 	if h == nil {
 		return
@@ -189,6 +224,11 @@ func (c *Client) execute(cmdr imap.Commander, h responses.Handler) (*imap.Status
 	cmd := cmdr.Command()
 	cmd.Tag = generateTag()
 
+	var progress ProgressFunc
+	if pc, ok := cmdr.(*progressCommander); ok {
+		progress = pc.progress
+	}
+
 	var replies <-chan []byte
 	if replier, ok := h.(responses.Replier); ok {
 		replies = replier.Replies()
@@ -240,6 +280,19 @@ func (c *Client) execute(cmdr imap.Commander, h responses.Handler) (*imap.Status
 			return errUnregisterHandler
 		}
 
+		if s, ok := resp.(*imap.StatusResp); ok && s.Code == imap.CodeInProgress {
+			if p, err := imap.ParseInProgress(s.Arguments); err == nil && p.Tag == cmd.Tag {
+				// The server is still working on the command, give it more time
+				if c.Timeout > 0 {
+					c.conn.SetDeadline(time.Now().Add(c.Timeout))
+				}
+				if progress != nil {
+					progress(p)
+				}
+				return nil
+			}
+		}
+
 		if h != nil {
 			// Pass the response to the response handler
 			if err := h.Handle(resp); err != nil && err != responses.ErrUnhandled {
@@ -335,7 +388,8 @@ func (c *Client) SetState(state imap.ConnState, mailbox *imap.MailboxStatus) {
 // indicates a network error.
 //
 // This function should not be called directly, it must only be used by
-// libraries implementing extensions of the IMAP protocol.
+// libraries implementing extensions of the IMAP protocol, or to report the
+// progress of a command with WithProgress.
 func (c *Client) Execute(cmdr imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
 	return c.execute(cmdr, h)
 }
@@ -444,18 +498,43 @@ func (c *Client) handleUnilateral() {
 				if c.Updates != nil {
 					c.Updates <- &ExpungeUpdate{seqNum}
 				}
-			case "FETCH":
-				seqNum, _ := imap.ParseNumber(fields[0])
+			case "FETCH", "UIDFETCH":
+				id, _ := imap.ParseNumber(fields[0])
 				fields, _ := fields[1].([]interface{})
 
-				msg := &imap.Message{SeqNum: seqNum}
+				msg := &imap.Message{SeqNum: id}
 				if err := msg.Parse(fields); err != nil {
 					break
 				}
+				if name == "UIDFETCH" {
+					msg.SeqNum = 0
+					msg.Uid = id
+				}
 
 				if c.Updates != nil {
 					c.Updates <- &MessageUpdate{msg}
 				}
+			case "VANISHED":
+				res := new(responses.Vanished)
+				if err := res.Handle(resp); err != nil {
+					break
+				}
+
+				if c.Updates != nil {
+					c.Updates <- &VanishedUpdate{res.Uids}
+				}
+			case "ESEARCH":
+				data := new(imap.SearchData)
+				if err := data.Parse(fields); err != nil {
+					break
+				}
+				if len(data.AddTo) == 0 && len(data.RemoveFrom) == 0 {
+					return responses.ErrUnhandled
+				}
+
+				if c.Updates != nil {
+					c.Updates <- &SearchUpdate{data}
+				}
 			default:
 				return responses.ErrUnhandled
 			}
@@ -549,6 +628,11 @@ func (c *Client) IsTLS() bool {
 	return c.isTLS
 }
 
+// TLSState returns the TLS connection state if TLS is enabled, nil otherwise.
+func (c *Client) TLSState() *tls.ConnectionState {
+	return c.conn.Info().TLS
+}
+
 // LoggedOut returns a channel which is closed when the connection to the server
 // is closed.
 func (c *Client) LoggedOut() <-chan struct{} {
@@ -557,6 +641,9 @@ func (c *Client) LoggedOut() <-chan struct{} {
 
 // SetDebug defines an io.Writer to which all network activity will be logged.
 // If nil is provided, network activity will not be logged.
+//
+// Raw network activity contains credentials. To redact them, use a writer
+// returned by imap.DebugLogger.ClientWriter.
 func (c *Client) SetDebug(w io.Writer) {
 	// Need to send a command to unblock the reader goroutine.
 	cmd := new(commands.Noop)
@@ -581,6 +668,35 @@ func (c *Client) SetDebug(w io.Writer) {
 
 }
 
+// SetLiteralSpill defines how large literals sent by the server, e.g. bodies
+// of messages fetched with FETCH BODY[], are stored. Literals larger than
+// maxMemory bytes are written to a temporary file in dir instead of being kept
+// in memory. If dir is empty, os.TempDir is used. If maxMemory is zero,
+// literals are kept in memory (this is the default).
+//
+// Literals stored in temporary files are *imap.BufferedLiteral values, which
+// should be closed once they aren't needed anymore.
+func (c *Client) SetLiteralSpill(maxMemory uint32, dir string) error {
+	// Need to send a command to unblock the reader goroutine.
+	cmd := new(commands.Noop)
+	return c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		// Flag connection as in upgrading
+		c.upgrading = true
+		if status, err := c.execute(cmd, nil); err != nil {
+			return nil, err
+		} else if err := status.Err(); err != nil {
+			return nil, err
+		}
+
+		// Wait for reader to block.
+		c.conn.WaitReady()
+
+		c.conn.MaxMemoryLiteralSize = maxMemory
+		c.conn.LiteralTempDir = dir
+		return conn, nil
+	})
+}
+
 // New creates a new client from an existing connection.
 func New(conn net.Conn) (*Client, error) {
 	continues := make(chan bool)
@@ -141,6 +141,48 @@ func TestClient_SetDebug(t *testing.T) {
 	}
 }
 
+func TestClient_SetDebug_logger(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	var b bytes.Buffer
+	logger := &imap.DebugLogger{Output: &b}
+	done := make(chan error)
+
+	go func() {
+		c.SetDebug(logger.ClientWriter("1"))
+		done <- nil
+	}()
+	if tag, cmd := s.ScanCmd(); cmd != "NOOP" {
+		t.Fatal("Bad command:", cmd)
+	} else {
+		s.WriteString(tag + " OK NOOP completed.\r\n")
+	}
+	<-done
+
+	go func() {
+		done <- c.Login("username", "password")
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "LOGIN \"username\" \"password\"" {
+		t.Fatal("Bad command:", cmd)
+	}
+	s.WriteString(tag + " OK LOGIN completed.\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatal("c.Login() =", err)
+	}
+
+	want := "1 C: " + tag + " LOGIN [redacted]\n1 S: " + tag + " OK LOGIN completed.\n"
+	if !strings.HasSuffix(b.String(), want) {
+		t.Errorf("Invalid debug log: got %q, want suffix %q", b.String(), want)
+	}
+	if strings.Contains(b.String(), "password") {
+		t.Error("Debug log contains the password")
+	}
+}
+
 func TestClient_unilateral(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
@@ -170,6 +212,21 @@ func TestClient_unilateral(t *testing.T) {
 		t.Errorf("Invalid expunged sequence number: expected %v but got %v", 431, update.Message.SeqNum)
 	}
 
+	s.WriteString("* 17 UIDFETCH (FLAGS (\\Seen))\r\n")
+	if update, ok := (<-updates).(*MessageUpdate); !ok || update.Message.Uid != 17 || update.Message.SeqNum != 0 {
+		t.Errorf("Invalid UIDFETCH message: got %+v", update.Message)
+	}
+
+	s.WriteString("* VANISHED 3:5\r\n")
+	if update, ok := (<-updates).(*VanishedUpdate); !ok || update.Uids.String() != "3:5" {
+		t.Errorf("Invalid vanished UIDs: got %v", update.Uids)
+	}
+
+	s.WriteString("* ESEARCH (TAG \"a42\") UID ADDTO (0 17)\r\n")
+	if update, ok := (<-updates).(*SearchUpdate); !ok || update.Data.Tag != "a42" || len(update.Data.AddTo) != 1 {
+		t.Errorf("Invalid search update: got %+v", update.Data)
+	}
+
 	s.WriteString("* OK Reticulating splines...\r\n")
 	if update, ok := (<-updates).(*StatusUpdate); !ok || update.Status.Info != "Reticulating splines..." {
 		t.Errorf("Invalid info: got %v", update.Status.Info)
@@ -21,6 +21,28 @@ func (c *Client) ensureAuthenticated() error {
 	return nil
 }
 
+// Enable enables server capabilities, as defined in RFC 5161. It must be called
+// before selecting a mailbox. The capabilities actually enabled by the server
+// are returned.
+//
+// When UIDONLY is enabled, message sequence numbers can't be used anymore:
+// fetched messages only have their UID populated and expunged messages are
+// delivered as VanishedUpdate values. See RFC 9586.
+func (c *Client) Enable(caps []string) ([]string, error) {
+	if err := c.ensureAuthenticated(); err != nil {
+		return nil, err
+	}
+
+	cmd := &commands.Enable{Caps: caps}
+	res := new(responses.Enabled)
+
+	status, err := c.execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Caps, status.Err()
+}
+
 // Select selects a mailbox so that messages in the mailbox can be accessed. Any
 // currently selected mailbox is deselected before attempting the new selection.
 // Even if the readOnly parameter is set to false, the server can decide to open
@@ -36,6 +36,7 @@ func TestClient_Select(t *testing.T) {
 	s.WriteString("* OK [UIDNEXT 4392] Predicted next UID\r\n")
 	s.WriteString("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n")
 	s.WriteString("* OK [PERMANENTFLAGS (\\Deleted \\Seen \\*)] Limited\r\n")
+	s.WriteString("* OK [MAILBOXID (F2212ea87-6097-4256-9d51-71338625)] Ok\r\n")
 	s.WriteString(tag + " OK SELECT completed\r\n")
 
 	if err := <-done; err != nil {
@@ -52,6 +53,7 @@ func TestClient_Select(t *testing.T) {
 		Recent:         1,
 		UidNext:        4392,
 		UidValidity:    3857529045,
+		MailboxId:      "F2212ea87-6097-4256-9d51-71338625",
 	}
 	mbox.Items = nil
 	if !reflect.DeepEqual(mbox, want) {
@@ -89,6 +91,36 @@ func TestClient_Select_ReadOnly(t *testing.T) {
 	}
 }
 
+func TestClient_Enable(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+
+	done := make(chan error, 1)
+	var enabled []string
+	go func() {
+		var err error
+		enabled, err = c.Enable([]string{"UIDONLY", "X-UNKNOWN"})
+		done <- err
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "ENABLE UIDONLY X-UNKNOWN" {
+		t.Fatalf("client sent command %v, want %v", cmd, "ENABLE UIDONLY X-UNKNOWN")
+	}
+
+	s.WriteString("* ENABLED UIDONLY\r\n")
+	s.WriteString(tag + " OK ENABLE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Enable() = %v", err)
+	}
+	if !reflect.DeepEqual(enabled, []string{"UIDONLY"}) {
+		t.Errorf("c.Enable() = %v, want %v", enabled, []string{"UIDONLY"})
+	}
+}
+
 func TestClient_Create(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
@@ -22,6 +22,10 @@ var (
 	// server has disabled authentication. Most of the time, calling enabling TLS
 	// solves the problem.
 	ErrLoginDisabled = errors.New("Login is disabled in current state")
+	// ErrExternalNotSupported is returned by AuthenticateExternal if TLS isn't
+	// enabled or if the server doesn't support EXTERNAL authentication, for
+	// instance because no client certificate has been presented.
+	ErrExternalNotSupported = errors.New("EXTERNAL authentication not supported")
 )
 
 // SupportStartTLS checks if the server supports STARTTLS.
@@ -135,6 +139,25 @@ func (c *Client) Authenticate(auth sasl.Client) error {
 	return nil
 }
 
+// AuthenticateExternal authenticates the client with the EXTERNAL mechanism,
+// using the TLS client certificate of the connection. The certificate can be
+// set in the tls.Config passed to DialTLS or StartTLS. identity is the
+// authorization identity, it can be left empty to act as the identity
+// associated with the certificate.
+func (c *Client) AuthenticateExternal(identity string) error {
+	if !c.IsTLS() {
+		return ErrExternalNotSupported
+	}
+
+	if ok, err := c.SupportAuth(sasl.External); err != nil {
+		return err
+	} else if !ok {
+		return ErrExternalNotSupported
+	}
+
+	return c.Authenticate(sasl.NewExternalClient(identity))
+}
+
 // Login identifies the client to the server and carries the plaintext password
 // authenticating this user.
 func (c *Client) Login(username, password string) error {
@@ -2,6 +2,7 @@ package client
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"testing"
 
@@ -297,3 +298,94 @@ func TestClient_Login_State_Allowed(t *testing.T) {
 		t.Errorf("Client is logout, login must not give %v", ErrAlreadyLoggedIn)
 	}
 }
+
+func TestClient_AuthenticateOAuth_refresh(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=OAUTHBEARER] Server ready.\r\n")
+	defer s.Close()
+
+	var refreshed bool
+	token := func(refresh bool) (string, error) {
+		if refresh {
+			refreshed = true
+			return "new", nil
+		}
+		return "old", nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.AuthenticateOAuth("username", token)
+	}()
+
+	ir := base64.StdEncoding.EncodeToString([]byte("n,a=username,\x01auth=Bearer old\x01\x01"))
+	tag, cmd := s.ScanCmd()
+	if cmd != "AUTHENTICATE OAUTHBEARER "+ir {
+		t.Fatalf("client sent command %v, want AUTHENTICATE OAUTHBEARER %v", cmd, ir)
+	}
+
+	challenge := base64.StdEncoding.EncodeToString([]byte(`{"status":"invalid_token","schemes":"bearer"}`))
+	s.WriteString("+ " + challenge + "\r\n")
+
+	if line := s.ScanLine(); line != "AQ==" {
+		t.Fatalf("client sent %v, want AQ==", line)
+	}
+	s.WriteString(tag + " NO Invalid token\r\n")
+
+	ir = base64.StdEncoding.EncodeToString([]byte("n,a=username,\x01auth=Bearer new\x01\x01"))
+	tag, cmd = s.ScanCmd()
+	if cmd != "AUTHENTICATE OAUTHBEARER "+ir {
+		t.Fatalf("client sent command %v, want AUTHENTICATE OAUTHBEARER %v", cmd, ir)
+	}
+	s.WriteString(tag + " OK AUTHENTICATE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.AuthenticateOAuth() = %v", err)
+	}
+	if !refreshed {
+		t.Error("Expected token to be refreshed")
+	}
+	if state := c.State(); state != imap.AuthenticatedState {
+		t.Errorf("c.State() = %v, want %v", state, imap.AuthenticatedState)
+	}
+}
+
+func TestClient_AuthenticateOAuth_xoauth2(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=XOAUTH2] Server ready.\r\n")
+	defer s.Close()
+
+	token := func(refresh bool) (string, error) {
+		return "token", nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.AuthenticateOAuth("username", token)
+	}()
+
+	ir := base64.StdEncoding.EncodeToString([]byte("user=username\x01auth=Bearer token\x01\x01"))
+	tag, cmd := s.ScanCmd()
+	if cmd != "AUTHENTICATE XOAUTH2 "+ir {
+		t.Fatalf("client sent command %v, want AUTHENTICATE XOAUTH2 %v", cmd, ir)
+	}
+
+	challenge := base64.StdEncoding.EncodeToString([]byte(`{"status":"400","schemes":"bearer"}`))
+	s.WriteString("+ " + challenge + "\r\n")
+
+	if line := s.ScanLine(); line != "" {
+		t.Fatalf("client sent %q, want an empty line", line)
+	}
+	s.WriteString(tag + " NO Invalid request\r\n")
+
+	if err := <-done; err == nil {
+		t.Fatal("c.AuthenticateOAuth() = nil, want an error")
+	}
+}
+
+func TestClient_AuthenticateExternal_NoTLS(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 AUTH=EXTERNAL] Server ready.\r\n")
+	defer s.Close()
+
+	if err := c.AuthenticateExternal(""); err != ErrExternalNotSupported {
+		t.Errorf("c.AuthenticateExternal() = %v, want %v", err, ErrExternalNotSupported)
+	}
+}
@@ -137,6 +137,132 @@ func (c *Client) UidSearch(criteria *imap.SearchCriteria) (uids []uint32, err er
 	return c.search(true, criteria)
 }
 
+func (c *Client) executeESearch(uid bool, cmd imap.Commander) (*imap.SearchData, error) {
+	if c.State() != imap.SelectedState {
+		return nil, ErrNoMailboxSelected
+	}
+
+	if uid {
+		cmd = &commands.Uid{Cmd: cmd}
+	}
+
+	res := new(responses.ESearch)
+
+	status, err := c.execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	if res.Data == nil {
+		return &imap.SearchData{Uid: uid}, nil
+	}
+	return res.Data, nil
+}
+
+// ESearch is identical to Search, but only returns the results requested in
+// opts. The server must support the ESEARCH extension, defined in RFC 4731.
+//
+// If opts.ReturnUpdate is set and the server supports the CONTEXT=SEARCH
+// extension, defined in RFC 5267, changes to the results are delivered as
+// SearchUpdate values until CancelUpdate is called with the returned tag.
+func (c *Client) ESearch(criteria *imap.SearchCriteria, opts *imap.SearchOptions) (*imap.SearchData, error) {
+	return c.executeESearch(false, &commands.Search{
+		Charset:  "UTF-8",
+		Criteria: criteria,
+		Options:  opts,
+	})
+}
+
+// UidESearch is identical to ESearch, but UIDs are returned instead of message
+// sequence numbers.
+func (c *Client) UidESearch(criteria *imap.SearchCriteria, opts *imap.SearchOptions) (*imap.SearchData, error) {
+	return c.executeESearch(true, &commands.Search{
+		Charset:  "UTF-8",
+		Criteria: criteria,
+		Options:  opts,
+	})
+}
+
+func (c *Client) sort(uid bool, sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	if c.State() != imap.SelectedState {
+		return nil, ErrNoMailboxSelected
+	}
+
+	var cmd imap.Commander = &commands.Sort{
+		SortCriteria:   sortCriteria,
+		SearchCriteria: searchCriteria,
+	}
+	if uid {
+		cmd = &commands.Uid{Cmd: cmd}
+	}
+
+	res := new(responses.Sort)
+
+	status, err := c.execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Ids, status.Err()
+}
+
+// Sort searches the mailbox for messages that match the given searching
+// criteria and returns their sequence numbers sorted according to the given
+// sort criteria. The server must support the SORT extension, defined in RFC
+// 5256.
+func (c *Client) Sort(sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) (seqNums []uint32, err error) {
+	return c.sort(false, sortCriteria, searchCriteria)
+}
+
+// UidSort is identical to Sort, but UIDs are returned instead of message
+// sequence numbers.
+func (c *Client) UidSort(sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria) (uids []uint32, err error) {
+	return c.sort(true, sortCriteria, searchCriteria)
+}
+
+// ESort is identical to Sort, but only returns the results requested in opts.
+// MIN and MAX are the first and last results in sort order. The server must
+// support the ESORT extension, defined in RFC 5267.
+//
+// If opts.ReturnUpdate is set and the server supports the CONTEXT=SORT
+// extension, changes to the results are delivered as SearchUpdate values until
+// CancelUpdate is called with the returned tag.
+func (c *Client) ESort(sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria, opts *imap.SearchOptions) (*imap.SearchData, error) {
+	return c.executeESearch(false, &commands.Sort{
+		SortCriteria:   sortCriteria,
+		SearchCriteria: searchCriteria,
+		Options:        opts,
+	})
+}
+
+// UidESort is identical to ESort, but UIDs are returned instead of message
+// sequence numbers.
+func (c *Client) UidESort(sortCriteria []imap.SortCriterion, searchCriteria *imap.SearchCriteria, opts *imap.SearchOptions) (*imap.SearchData, error) {
+	return c.executeESearch(true, &commands.Sort{
+		SortCriteria:   sortCriteria,
+		SearchCriteria: searchCriteria,
+		Options:        opts,
+	})
+}
+
+// CancelUpdate stops updates for the search contexts created by the commands
+// with the given tags. See RFC 5267 section 4.2.
+func (c *Client) CancelUpdate(tags ...string) error {
+	if c.State() != imap.SelectedState {
+		return ErrNoMailboxSelected
+	}
+
+	cmd := &commands.CancelUpdate{Tags: tags}
+
+	status, err := c.execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
 func (c *Client) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
 	defer close(ch)
 
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
 )
 
 func TestClient_Check(t *testing.T) {
@@ -181,6 +183,138 @@ func TestClient_Search_Uid(t *testing.T) {
 	}
 }
 
+func TestClient_Search_progress(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.SelectedState, nil)
+
+	progress := make(chan *imap.InProgress, 2)
+	cmd := &commands.Search{Criteria: &imap.SearchCriteria{}}
+	res := new(responses.Search)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Execute(WithProgress(cmd, func(p *imap.InProgress) {
+			progress <- p
+		}), res)
+		done <- err
+	}()
+
+	tag, _ := s.ScanCmd()
+	// The progress of other commands isn't reported
+	s.WriteString("* OK [INPROGRESS (\"other\" 1 2)] Searching\r\n")
+	s.WriteString("* OK [INPROGRESS (\"" + tag + "\" 500 1000)] Searching\r\n")
+
+	p := <-progress
+	if p.Tag != tag || p.Count != 500 || p.Total != 1000 {
+		t.Errorf("Invalid progress: got %+v", p)
+	}
+
+	s.WriteString("* SEARCH 1\r\n")
+	s.WriteString(tag + " OK SEARCH completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Execute() = %v", err)
+	}
+	if len(progress) != 0 {
+		t.Errorf("Unexpected progress: %+v", <-progress)
+	}
+	if len(res.Ids) != 1 || res.Ids[0] != 1 {
+		t.Errorf("Invalid search results: got %v", res.Ids)
+	}
+}
+
+func TestClient_ESearch(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.SelectedState, nil)
+
+	criteria := &imap.SearchCriteria{
+		WithoutFlags: []string{imap.SeenFlag},
+	}
+	opts := &imap.SearchOptions{
+		ReturnCount:   true,
+		ReturnPartial: &imap.PartialRange{First: 1, Last: 50},
+	}
+
+	done := make(chan error, 1)
+	var data *imap.SearchData
+	go func() {
+		var err error
+		data, err = c.UidESearch(criteria, opts)
+		done <- err
+	}()
+
+	wantCmd := "UID SEARCH RETURN (COUNT PARTIAL 1:50) CHARSET UTF-8 UNSEEN"
+	tag, cmd := s.ScanCmd()
+	if cmd != wantCmd {
+		t.Fatalf("client sent command %v, want %v", cmd, wantCmd)
+	}
+
+	s.WriteString("* ESEARCH (TAG \"" + tag + "\") UID COUNT 3 PARTIAL (1:50 12:13,20)\r\n")
+	s.WriteString(tag + " OK UID SEARCH completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.UidESearch() = %v", err)
+	}
+
+	want := &imap.SearchData{
+		Tag:   tag,
+		Uid:   true,
+		Count: 3,
+		Partial: &imap.SearchPartialData{
+			Range: imap.PartialRange{First: 1, Last: 50},
+			Ids:   []uint32{12, 13, 20},
+		},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("c.UidESearch() = %+v, want %+v", data, want)
+	}
+}
+
+func TestClient_Sort(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.SelectedState, nil)
+
+	sortCriteria := []imap.SortCriterion{
+		{Field: imap.SortDate, Reverse: true},
+		{Field: imap.SortSubject},
+	}
+	searchCriteria := &imap.SearchCriteria{
+		WithoutFlags: []string{imap.DeletedFlag},
+	}
+
+	done := make(chan error, 1)
+	var results []uint32
+	go func() {
+		var err error
+		results, err = c.Sort(sortCriteria, searchCriteria)
+		done <- err
+	}()
+
+	wantCmd := "SORT (REVERSE DATE SUBJECT) UTF-8 UNDELETED"
+	tag, cmd := s.ScanCmd()
+	if cmd != wantCmd {
+		t.Fatalf("client sent command %v, want %v", cmd, wantCmd)
+	}
+
+	s.WriteString("* SORT 5 3 4 1 2\r\n")
+	s.WriteString(tag + " OK SORT completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Sort() = %v", err)
+	}
+
+	want := []uint32{5, 3, 4, 1, 2}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("c.Sort() = %v, want %v", results, want)
+	}
+}
+
 func TestClient_Fetch(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
@@ -240,6 +374,56 @@ func TestClient_Fetch(t *testing.T) {
 	}
 }
 
+func TestClient_Fetch_literalSpill(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SetLiteralSpill(8, "")
+	}()
+	if tag, cmd := s.ScanCmd(); cmd != "NOOP" {
+		t.Fatal("Bad command:", cmd)
+	} else {
+		s.WriteString(tag + " OK NOOP completed.\r\n")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("c.SetLiteralSpill() = %v", err)
+	}
+
+	setClientState(c, imap.SelectedState, nil)
+
+	seqset, _ := imap.ParseSeqSet("2")
+	messages := make(chan *imap.Message, 1)
+	go func() {
+		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchItem("BODY[]")}, messages)
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "FETCH 2 (BODY[])" {
+		t.Fatalf("client sent command %v, want %v", cmd, "FETCH 2 (BODY[])")
+	}
+
+	s.WriteString("* 2 FETCH (BODY[] {16}\r\n")
+	s.WriteString("I love potatoes.")
+	s.WriteString(")\r\n")
+	s.WriteString(tag + " OK FETCH completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Fetch() = %v", err)
+	}
+
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	msg := <-messages
+	body, ok := msg.GetBody(section).(*imap.BufferedLiteral)
+	if !ok {
+		t.Fatalf("Body is not a buffered literal: %T", msg.GetBody(section))
+	}
+	defer body.Close()
+	if b, _ := ioutil.ReadAll(body); string(b) != "I love potatoes." {
+		t.Errorf("Message has bad body: %q", b)
+	}
+}
 func TestClient_Fetch_ClosedState(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
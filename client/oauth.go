@@ -0,0 +1,121 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// ErrOAuthNotSupported is returned by Client.AuthenticateOAuth if the server
+// supports neither OAUTHBEARER nor XOAUTH2.
+var ErrOAuthNotSupported = errors.New("OAuth authentication not supported")
+
+// oauthClient implements the OAUTHBEARER and XOAUTH2 mechanisms. Contrary to
+// the implementations in go-sasl, it acknowledges error challenges as
+// required by RFC 7628 section 3.2.3 and records the error.
+type oauthClient struct {
+	mech string
+	ir   []byte
+	err  *sasl.OAuthBearerError
+}
+
+// NewOAuthBearerClient creates a SASL client for the OAUTHBEARER mechanism,
+// defined in RFC 7628.
+func NewOAuthBearerClient(opt *sasl.OAuthBearerOptions) sasl.Client {
+	var authzid string
+	if opt.Username != "" {
+		authzid = "a=" + strings.NewReplacer(",", "=2C", "=", "=3D").Replace(opt.Username)
+	}
+
+	ir := "n," + authzid + ",\x01"
+	if opt.Host != "" {
+		ir += "host=" + opt.Host + "\x01"
+	}
+	if opt.Port != 0 {
+		ir += "port=" + strconv.Itoa(opt.Port) + "\x01"
+	}
+	ir += "auth=Bearer " + opt.Token + "\x01\x01"
+
+	return &oauthClient{mech: sasl.OAuthBearer, ir: []byte(ir)}
+}
+
+// NewXoauth2Client creates a SASL client for the XOAUTH2 mechanism, defined
+// in https://developers.google.com/gmail/imap/xoauth2-protocol.
+func NewXoauth2Client(username, token string) sasl.Client {
+	ir := "user=" + username + "\x01auth=Bearer " + token + "\x01\x01"
+	return &oauthClient{mech: sasl.Xoauth2, ir: []byte(ir)}
+}
+
+func (a *oauthClient) Start() (mech string, ir []byte, err error) {
+	return a.mech, a.ir, nil
+}
+
+func (a *oauthClient) Next(challenge []byte) ([]byte, error) {
+	if a.err != nil {
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+
+	a.err = &sasl.OAuthBearerError{}
+	if err := json.Unmarshal(challenge, a.err); err != nil {
+		return nil, err
+	}
+
+	// Acknowledge the error, the server will then fail the exchange
+	if a.mech == sasl.Xoauth2 {
+		return []byte{}, nil
+	}
+	return []byte{0x01}, nil
+}
+
+// tokenExpired checks whether the server rejected the token as invalid or
+// expired.
+func (a *oauthClient) tokenExpired() bool {
+	return a.err != nil && (a.err.Status == "invalid_token" || a.err.Status == "401")
+}
+
+// OAuthTokenFunc returns an OAuth 2.0 bearer token. If refresh is set to true,
+// the previously returned token has been rejected by the server and a new one
+// must be obtained.
+type OAuthTokenFunc func(refresh bool) (string, error)
+
+// AuthenticateOAuth authenticates the client with an OAuth 2.0 bearer token.
+// OAUTHBEARER is used if the server supports it, XOAUTH2 otherwise. If the
+// server rejects the token as invalid or expired, a new token is requested via
+// token and authentication is attempted once more.
+func (c *Client) AuthenticateOAuth(username string, token OAuthTokenFunc) error {
+	newClient := func(t string) *oauthClient {
+		return NewXoauth2Client(username, t).(*oauthClient)
+	}
+
+	if ok, err := c.SupportAuth(sasl.OAuthBearer); err != nil {
+		return err
+	} else if ok {
+		newClient = func(t string) *oauthClient {
+			return NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+				Username: username,
+				Token:    t,
+			}).(*oauthClient)
+		}
+	} else if ok, err := c.SupportAuth(sasl.Xoauth2); err != nil {
+		return err
+	} else if !ok {
+		return ErrOAuthNotSupported
+	}
+
+	t, err := token(false)
+	if err != nil {
+		return err
+	}
+	auth := newClient(t)
+	if err := c.Authenticate(auth); err == nil || !auth.tokenExpired() {
+		return err
+	}
+
+	if t, err = token(true); err != nil {
+		return err
+	}
+	return c.Authenticate(newClient(t))
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/internal"
+	"github.com/emersion/go-sasl"
+)
+
+// scramClient implements the SCRAM-SHA-256 and SCRAM-SHA-256-PLUS mechanisms.
+type scramClient struct {
+	username, password string
+	plus               bool
+	state              *tls.ConnectionState
+	step               int
+
+	cbHeader        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewSCRAMSHA256Client creates a SASL client for the SCRAM-SHA-256 mechanism,
+// defined in RFC 7677.
+func NewSCRAMSHA256Client(username, password string) sasl.Client {
+	return &scramClient{username: username, password: password}
+}
+
+// NewSCRAMSHA256PlusClient creates a SASL client for the SCRAM-SHA-256-PLUS
+// mechanism, which binds the authentication to the TLS connection described
+// by state. The tls-exporter channel binding type is used with TLS 1.3,
+// tls-server-end-point otherwise. state can be obtained with Client.TLSState.
+func NewSCRAMSHA256PlusClient(username, password string, state *tls.ConnectionState) sasl.Client {
+	return &scramClient{username: username, password: password, plus: true, state: state}
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	mech = "SCRAM-SHA-256"
+	gs2Header := "n,,"
+	var cbData []byte
+	if a.plus {
+		mech = "SCRAM-SHA-256-PLUS"
+		if a.state == nil {
+			return "", nil, errors.New("SCRAM-SHA-256-PLUS requires TLS")
+		}
+
+		cbType := internal.SCRAMTLSServerEndPoint
+		var cert *x509.Certificate
+		if a.state.Version >= tls.VersionTLS13 {
+			cbType = internal.SCRAMTLSExporter
+		} else if len(a.state.PeerCertificates) > 0 {
+			cert = a.state.PeerCertificates[0]
+		}
+		if cbData, err = internal.SCRAMChannelBinding(cbType, a.state, cert); err != nil {
+			return "", nil, err
+		}
+		gs2Header = "p=" + cbType + ",,"
+	}
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+
+	a.cbHeader = base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...))
+	a.nonce = base64.StdEncoding.EncodeToString(b)
+	a.clientFirstBare = "n=" + internal.SCRAMEscape(a.username) + ",r=" + a.nonce
+	return mech, []byte(gs2Header + a.clientFirstBare), nil
+}
+
+func (a *scramClient) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.handleServerFirst(string(challenge))
+	case 2:
+		attrs := internal.SCRAMAttrs(string(challenge))
+		if e, ok := attrs['e']; ok {
+			return nil, errors.New("SCRAM authentication failed: " + e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil || !hmac.Equal(sig, a.serverSignature) {
+			return nil, errors.New("Invalid SCRAM server signature")
+		}
+		return []byte{}, nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+func (a *scramClient) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs := internal.SCRAMAttrs(serverFirst)
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("Unsupported SCRAM extension")
+	}
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("Invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("Invalid SCRAM salt")
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("Invalid SCRAM iteration count")
+	}
+
+	clientFinalWithoutProof := "c=" + a.cbHeader + ",r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	saltedPassword := internal.SCRAMSaltedPassword(a.password, salt, iterations)
+	clientKey, storedKey, serverKey := internal.SCRAMKeys(saltedPassword)
+	proof := internal.SCRAMHMAC(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = internal.SCRAMHMAC(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
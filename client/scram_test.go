@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+)
+
+// Test vector from RFC 7677 section 3.
+func TestSCRAMSHA256Client(t *testing.T) {
+	auth := NewSCRAMSHA256Client("user", "pencil").(*scramClient)
+
+	mech, _, err := auth.Start()
+	if err != nil {
+		t.Fatalf("auth.Start() = %v", err)
+	}
+	if mech != "SCRAM-SHA-256" {
+		t.Errorf("auth.Start() returned mechanism %v", mech)
+	}
+
+	auth.nonce = "rOprNGfwEbeRWgbNEkqO"
+	auth.clientFirstBare = "n=user,r=" + auth.nonce
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	clientFinal, err := auth.Next([]byte(serverFirst))
+	if err != nil {
+		t.Fatalf("auth.Next(server-first-message) = %v", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(clientFinal) != expected {
+		t.Errorf("Invalid client-final-message: got %q, want %q", clientFinal, expected)
+	}
+
+	if _, err := auth.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("auth.Next(server-final-message) = %v", err)
+	}
+}
+
+func TestSCRAMSHA256Client_InvalidServerSignature(t *testing.T) {
+	auth := NewSCRAMSHA256Client("user", "pencil").(*scramClient)
+	if _, _, err := auth.Start(); err != nil {
+		t.Fatalf("auth.Start() = %v", err)
+	}
+
+	serverFirst := "r=" + auth.nonce + "servernonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	if _, err := auth.Next([]byte(serverFirst)); err != nil {
+		t.Fatalf("auth.Next(server-first-message) = %v", err)
+	}
+
+	if _, err := auth.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("Expected an error for an invalid server signature")
+	}
+}
@@ -42,7 +42,15 @@ func (cmd *Fetch) Parse(fields []interface{}) error {
 		cmd.Items = imap.FetchItem(strings.ToUpper(items)).Expand()
 	case []interface{}: // A list of items
 		cmd.Items = make([]imap.FetchItem, 0, len(items))
-		for _, v := range items {
+		for i, v := range items {
+			if _, ok := v.([]interface{}); ok && i > 0 {
+				// PREVIEW modifiers (e.g. LAZY, RFC 8970 section 3) are
+				// optional and ignored
+				if prev, _ := items[i-1].(string); strings.EqualFold(prev, string(imap.FetchPreview)) {
+					continue
+				}
+			}
+
 			itemStr, _ := v.(string)
 			item := imap.FetchItem(strings.ToUpper(itemStr))
 			cmd.Items = append(cmd.Items, item.Expand()...)
@@ -12,10 +12,16 @@ import (
 type Search struct {
 	Charset  string
 	Criteria *imap.SearchCriteria
+	// Result options, as defined in RFC 4731. If nil, a regular SEARCH
+	// response is expected instead of an ESEARCH response.
+	Options *imap.SearchOptions
 }
 
 func (cmd *Search) Command() *imap.Command {
 	var args []interface{}
+	if cmd.Options != nil {
+		args = append(args, imap.RawString("RETURN"), cmd.Options.Format())
+	}
 	if cmd.Charset != "" {
 		args = append(args, imap.RawString("CHARSET"), imap.RawString(cmd.Charset))
 	}
@@ -32,6 +38,25 @@ func (cmd *Search) Parse(fields []interface{}) error {
 		return errors.New("Missing search criteria")
 	}
 
+	// Parse result options
+	if f, ok := fields[0].(string); ok && strings.EqualFold(f, "RETURN") {
+		if len(fields) < 2 {
+			return errors.New("Missing RETURN options")
+		}
+		opts, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("RETURN options must be a list")
+		}
+		cmd.Options = new(imap.SearchOptions)
+		if err := cmd.Options.Parse(opts); err != nil {
+			return err
+		}
+		fields = fields[2:]
+		if len(fields) == 0 {
+			return errors.New("Missing search criteria")
+		}
+	}
+
 	// Parse charset
 	if f, ok := fields[0].(string); ok && strings.EqualFold(f, "CHARSET") {
 		if len(fields) < 2 {
@@ -43,15 +68,19 @@ func (cmd *Search) Parse(fields []interface{}) error {
 		fields = fields[2:]
 	}
 
-	var charsetReader func(io.Reader) io.Reader
-	charset := strings.ToLower(cmd.Charset)
-	if charset != "utf-8" && charset != "us-ascii" && charset != "" {
-		charsetReader = func(r io.Reader) io.Reader {
-			r, _ = imap.CharsetReader(charset, r)
-			return r
-		}
-	}
-
 	cmd.Criteria = new(imap.SearchCriteria)
-	return cmd.Criteria.ParseWithCharset(fields, charsetReader)
+	return cmd.Criteria.ParseWithCharset(fields, searchCharsetReader(cmd.Charset))
+}
+
+// searchCharsetReader returns a function converting search criteria from the
+// provided charset to UTF-8.
+func searchCharsetReader(charset string) func(io.Reader) io.Reader {
+	charset = strings.ToLower(charset)
+	if charset == "utf-8" || charset == "us-ascii" || charset == "" {
+		return nil
+	}
+	return func(r io.Reader) io.Reader {
+		r, _ = imap.CharsetReader(charset, r)
+		return r
+	}
 }
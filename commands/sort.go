@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Sort is a SORT command, as defined in RFC 5256 section 3.
+type Sort struct {
+	SortCriteria   []imap.SortCriterion
+	Charset        string
+	SearchCriteria *imap.SearchCriteria
+	// Result options, as defined in RFC 5267 section 3. If nil, a regular SORT
+	// response is expected instead of an ESEARCH response.
+	Options *imap.SearchOptions
+}
+
+func (cmd *Sort) Command() *imap.Command {
+	var args []interface{}
+	if cmd.Options != nil {
+		args = append(args, imap.RawString("RETURN"), cmd.Options.Format())
+	}
+
+	charset := cmd.Charset
+	if charset == "" {
+		charset = "UTF-8"
+	}
+	args = append(args, imap.FormatSortCriteria(cmd.SortCriteria), imap.RawString(charset))
+	args = append(args, cmd.SearchCriteria.Format()...)
+
+	return &imap.Command{
+		Name:      "SORT",
+		Arguments: args,
+	}
+}
+
+func (cmd *Sort) Parse(fields []interface{}) error {
+	// Parse result options
+	if len(fields) > 0 {
+		if f, ok := fields[0].(string); ok && strings.EqualFold(f, "RETURN") {
+			if len(fields) < 2 {
+				return errors.New("Missing RETURN options")
+			}
+			opts, ok := fields[1].([]interface{})
+			if !ok {
+				return errors.New("RETURN options must be a list")
+			}
+			cmd.Options = new(imap.SearchOptions)
+			if err := cmd.Options.Parse(opts); err != nil {
+				return err
+			}
+			fields = fields[2:]
+		}
+	}
+
+	if len(fields) < 3 {
+		return errors.New("No enough arguments")
+	}
+
+	sortCriteria, ok := fields[0].([]interface{})
+	if !ok {
+		return errors.New("Sort criteria must be a list")
+	}
+	var err error
+	if cmd.SortCriteria, err = imap.ParseSortCriteria(sortCriteria); err != nil {
+		return err
+	}
+
+	if cmd.Charset, ok = fields[1].(string); !ok {
+		return errors.New("Charset must be a string")
+	}
+
+	cmd.SearchCriteria = new(imap.SearchCriteria)
+	return cmd.SearchCriteria.ParseWithCharset(fields[2:], searchCharsetReader(cmd.Charset))
+}
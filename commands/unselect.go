@@ -0,0 +1,19 @@
+package commands
+
+import (
+	"github.com/emersion/go-imap"
+)
+
+// Unselect is an UNSELECT command, as defined in RFC 3691. It closes the
+// selected mailbox without expunging it.
+type Unselect struct{}
+
+func (cmd *Unselect) Command() *imap.Command {
+	return &imap.Command{
+		Name: "UNSELECT",
+	}
+}
+
+func (cmd *Unselect) Parse(fields []interface{}) error {
+	return nil
+}
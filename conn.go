@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 // A connection state.
@@ -147,6 +148,10 @@ type ConnInfo struct {
 
 // An IMAP connection.
 type Conn struct {
+	// Accessed atomically, kept first for 64-bit alignment
+	bytesRead    int64
+	bytesWritten int64
+
 	net.Conn
 	*Reader
 	*Writer
@@ -176,8 +181,8 @@ func (c *Conn) createWaiter() *Waiter {
 }
 
 func (c *Conn) init() {
-	r := io.Reader(c.Conn)
-	w := io.Writer(c.Conn)
+	r := io.Reader(&countingReader{c.Conn, &c.bytesRead})
+	w := io.Writer(&countingWriter{c.Conn, &c.bytesWritten})
 
 	if c.debug != nil {
 		localDebug, remoteDebug := c.debug, c.debug
@@ -191,10 +196,12 @@ func (c *Conn) init() {
 		}
 
 		if localDebug != nil {
-			w = io.MultiWriter(c.Conn, localDebug)
+			// Log data before sending it, so that it's logged before the
+			// reply of the other side
+			w = io.MultiWriter(localDebug, w)
 		}
 		if remoteDebug != nil {
-			r = io.TeeReader(c.Conn, remoteDebug)
+			r = io.TeeReader(r, remoteDebug)
 		}
 	}
 
@@ -238,6 +245,22 @@ func (c *Conn) Info() *ConnInfo {
 	return info
 }
 
+// BytesRead returns the number of bytes read from the connection so far.
+func (c *Conn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written to the connection so far.
+func (c *Conn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.bytesWritten)
+}
+
+// Peek returns the next n bytes which will be read from the connection,
+// without consuming them. It blocks until they're available.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	return c.br.Peek(n)
+}
+
 // Write implements io.Writer.
 func (c *Conn) Write(b []byte) (n int, err error) {
 	return c.Writer.Write(b)
@@ -282,3 +305,25 @@ func (c *Conn) SetDebug(w io.Writer) {
 	c.debug = w
 	c.init()
 }
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
@@ -39,6 +39,9 @@ func TestNewConn(t *testing.T) {
 	if string(sent) != string(received) {
 		t.Errorf("Sent %v but received %v", sent, received)
 	}
+	if n := ic.BytesWritten(); n != int64(len(sent)) {
+		t.Errorf("BytesWritten() = %v, want %v", n, len(sent))
+	}
 }
 
 func transform(b []byte) []byte {
@@ -0,0 +1,341 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDebugLiteralSize is the default value of DebugLogger.MaxLiteralSize.
+const DefaultDebugLiteralSize = 1024
+
+// The maximum length of a line recorded by a DebugLogger. Longer lines are
+// truncated.
+const maxDebugLineSize = 64 * 1024
+
+// The text replacing credentials in debug logs.
+const debugRedacted = "[redacted]"
+
+// DebugDirection indicates which side of a connection sent data.
+type DebugDirection int
+
+const (
+	// Sent by the client.
+	DebugClient DebugDirection = iota
+	// Sent by the server.
+	DebugServer
+)
+
+func (d DebugDirection) String() string {
+	if d == DebugServer {
+		return "S"
+	}
+	return "C"
+}
+
+// DebugRecord is a line of network activity recorded by a DebugLogger.
+type DebugRecord struct {
+	// The identifier of the connection.
+	ConnID string
+	// The side of the connection which sent the line.
+	Direction DebugDirection
+	// The line, without the trailing CRLF. If Literal is true, the contents of
+	// a literal instead.
+	Line string
+	// True if Line contains the contents of a literal.
+	Literal bool
+}
+
+// DebugLogger logs network activity line by line. Unlike the raw streams
+// written to debug writers, arguments of LOGIN commands and SASL exchanges are
+// redacted and literals are truncated.
+//
+// A DebugLogger can be shared by many connections, each one must use its own
+// writer returned by ClientWriter or ServerWriter.
+type DebugLogger struct {
+	// Records are written to Output as text lines, in the form
+	// "<connection ID> <C|S>: <line>".
+	Output io.Writer
+	// If not nil, records are passed to Handler instead of being written to
+	// Output. Calls are serialized.
+	Handler func(rec *DebugRecord)
+	// Literals longer than this are truncated, in bytes. If zero,
+	// DefaultDebugLiteralSize is used. If negative, literals aren't
+	// truncated.
+	MaxLiteralSize int
+
+	locker sync.Mutex
+}
+
+// ClientWriter returns a debug writer for the client side of a connection,
+// suitable for Conn.SetDebug.
+func (l *DebugLogger) ClientWriter(connID string) io.Writer {
+	s := &debugSession{logger: l, id: connID}
+	return NewDebugWriter(s.stream(DebugClient), s.stream(DebugServer))
+}
+
+// ServerWriter returns a debug writer for the server side of a connection,
+// suitable for Conn.SetDebug.
+func (l *DebugLogger) ServerWriter(connID string) io.Writer {
+	s := &debugSession{logger: l, id: connID}
+	return NewDebugWriter(s.stream(DebugServer), s.stream(DebugClient))
+}
+
+func (l *DebugLogger) maxLiteralSize() int {
+	if l.MaxLiteralSize == 0 {
+		return DefaultDebugLiteralSize
+	}
+	return l.MaxLiteralSize
+}
+
+func (l *DebugLogger) emit(rec *DebugRecord) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if l.Handler != nil {
+		l.Handler(rec)
+	} else if l.Output != nil {
+		fmt.Fprintf(l.Output, "%v %v: %v\n", rec.ConnID, rec.Direction, rec.Line)
+	}
+}
+
+// debugSession holds the state shared by both directions of a connection.
+type debugSession struct {
+	logger *DebugLogger
+	id     string
+
+	locker sync.Mutex
+	// True while a SASL exchange is in progress
+	authenticating bool
+	// True if the server has sent a SASL challenge the client hasn't
+	// answered yet
+	challenged bool
+}
+
+func (s *debugSession) stream(dir DebugDirection) *debugStream {
+	return &debugStream{session: s, dir: dir}
+}
+
+func (s *debugSession) setAuthenticating(v bool) {
+	s.locker.Lock()
+	s.authenticating = v
+	s.challenged = false
+	s.locker.Unlock()
+}
+
+func (s *debugSession) isAuthenticating() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.authenticating
+}
+
+func (s *debugSession) challenge() {
+	s.locker.Lock()
+	s.challenged = true
+	s.locker.Unlock()
+}
+
+// answer returns true if a line sent by the client answers a SASL challenge.
+func (s *debugSession) answer() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	answer := s.challenged
+	s.challenged = false
+	return answer
+}
+
+// debugStream splits the data sent by one side of a connection into records.
+type debugStream struct {
+	session *debugSession
+	dir     DebugDirection
+
+	line          []byte
+	lineTruncated bool
+
+	// The number of bytes of the current literal left to read
+	literalLeft int64
+	literalSize int64
+	literal     []byte
+
+	// True if the current command or response continues after a literal
+	continued bool
+	// True if the rest of the current command is redacted
+	redact bool
+}
+
+// Write implements io.Writer. It never fails, so that logging can't interrupt
+// the connection.
+func (s *debugStream) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if s.literalLeft > 0 {
+			chunk := b
+			if int64(len(chunk)) > s.literalLeft {
+				chunk = chunk[:s.literalLeft]
+			}
+			s.appendLiteral(chunk)
+			s.literalLeft -= int64(len(chunk))
+			b = b[len(chunk):]
+
+			if s.literalLeft == 0 {
+				s.flushLiteral()
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			s.appendLine(b)
+			break
+		}
+		s.appendLine(b[:i])
+		b = b[i+1:]
+		s.flushLine()
+	}
+	return n, nil
+}
+
+func (s *debugStream) appendLine(b []byte) {
+	if len(s.line)+len(b) > maxDebugLineSize {
+		b = b[:maxDebugLineSize-len(s.line)]
+		s.lineTruncated = true
+	}
+	s.line = append(s.line, b...)
+}
+
+func (s *debugStream) appendLiteral(b []byte) {
+	if max := s.session.logger.maxLiteralSize(); max >= 0 && len(s.literal)+len(b) > max {
+		b = b[:max-len(s.literal)]
+	}
+	s.literal = append(s.literal, b...)
+}
+
+func (s *debugStream) flushLine() {
+	line := strings.TrimSuffix(string(s.line), "\r")
+	truncated := s.lineTruncated
+	s.line = s.line[:0]
+	s.lineTruncated = false
+
+	size := literalSuffix(line)
+	if truncated {
+		// The literal size may have been truncated
+		size = -1
+	}
+
+	line = s.filter(line)
+	if truncated && line != debugRedacted {
+		line += " [truncated]"
+	}
+	s.emit(line, false)
+
+	s.continued = size >= 0
+	if size > 0 {
+		s.literalLeft = size
+		s.literalSize = size
+	}
+}
+
+func (s *debugStream) flushLiteral() {
+	line := string(s.literal)
+	if s.redact {
+		line = debugRedacted
+	} else if int64(len(s.literal)) < s.literalSize {
+		line += fmt.Sprintf(" [truncated, %v bytes]", s.literalSize)
+	}
+	s.literal = s.literal[:0]
+
+	s.emit(line, true)
+}
+
+func (s *debugStream) emit(line string, literal bool) {
+	s.session.logger.emit(&DebugRecord{
+		ConnID:    s.session.id,
+		Direction: s.dir,
+		Line:      line,
+		Literal:   literal,
+	})
+}
+
+// filter redacts credentials from a line.
+func (s *debugStream) filter(line string) string {
+	if s.dir == DebugServer {
+		return s.filterResponse(line)
+	}
+	return s.filterCommand(line)
+}
+
+func (s *debugStream) filterCommand(line string) string {
+	if s.continued {
+		if s.redact && line != "" {
+			return debugRedacted
+		}
+		return line
+	}
+	s.redact = false
+
+	if s.session.answer() {
+		// A SASL response, or "*" to cancel the exchange
+		if line == "*" {
+			return line
+		}
+		return debugRedacted
+	}
+
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 2 {
+		return line
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		s.redact = true
+		return fields[0] + " " + fields[1] + " " + debugRedacted
+	case "AUTHENTICATE":
+		s.session.setAuthenticating(true)
+		if len(fields) > 3 {
+			// Initial response
+			return strings.Join(fields[:3], " ") + " " + debugRedacted
+		}
+	}
+	return line
+}
+
+func (s *debugStream) filterResponse(line string) string {
+	if s.continued || !s.session.isAuthenticating() {
+		return line
+	}
+
+	switch {
+	case strings.HasPrefix(line, "+"):
+		// A SASL challenge
+		s.session.challenge()
+		if strings.TrimSpace(strings.TrimPrefix(line, "+")) != "" {
+			return "+ " + debugRedacted
+		}
+	case !strings.HasPrefix(line, "*"):
+		// The tagged response ends the exchange
+		s.session.setAuthenticating(false)
+	}
+	return line
+}
+
+// literalSuffix returns the size of the literal announced at the end of a
+// line, or -1 if there is none.
+func literalSuffix(line string) int64 {
+	if !strings.HasSuffix(line, "}") {
+		return -1
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return -1
+	}
+
+	s := strings.TrimSuffix(line[i+1:len(line)-1], "+")
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
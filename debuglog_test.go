@@ -0,0 +1,195 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// debugExchange is a chunk of data sent by one side of a connection.
+type debugExchange struct {
+	dir  DebugDirection
+	data string
+}
+
+func runDebugLogger(l *DebugLogger, exchanges []debugExchange) {
+	w := l.ServerWriter("42").(*debugWriter)
+	for _, ex := range exchanges {
+		out := w.local
+		if ex.dir == DebugClient {
+			out = w.remote
+		}
+		// Write byte by byte to check that lines can be split across writes
+		for i := 0; i < len(ex.data); i++ {
+			io.WriteString(out, ex.data[i:i+1])
+		}
+	}
+}
+
+var debugLoggerTests = []struct {
+	name      string
+	exchanges []debugExchange
+	want      []DebugRecord
+}{
+	{
+		name: "login",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 LOGIN username password\r\n"},
+			{DebugServer, "a001 OK LOGIN completed\r\n"},
+			{DebugClient, "a002 NOOP\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 LOGIN [redacted]"},
+			{Direction: DebugServer, Line: "a001 OK LOGIN completed"},
+			{Direction: DebugClient, Line: "a002 NOOP"},
+		},
+	},
+	{
+		name: "login_literal",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 LOGIN username {8}\r\n"},
+			{DebugServer, "+ send literal\r\n"},
+			{DebugClient, "password\r\n"},
+			{DebugServer, "a001 OK LOGIN completed\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 LOGIN [redacted]"},
+			{Direction: DebugServer, Line: "+ send literal"},
+			{Direction: DebugClient, Line: "[redacted]", Literal: true},
+			{Direction: DebugClient, Line: ""},
+			{Direction: DebugServer, Line: "a001 OK LOGIN completed"},
+		},
+	},
+	{
+		name: "authenticate",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 AUTHENTICATE PLAIN\r\n"},
+			{DebugServer, "+ \r\n"},
+			{DebugClient, "AHVzZXJuYW1lAHBhc3N3b3Jk\r\n"},
+			{DebugServer, "a001 OK AUTHENTICATE completed\r\n"},
+			{DebugClient, "a002 NOOP\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 AUTHENTICATE PLAIN"},
+			{Direction: DebugServer, Line: "+ "},
+			{Direction: DebugClient, Line: "[redacted]"},
+			{Direction: DebugServer, Line: "a001 OK AUTHENTICATE completed"},
+			{Direction: DebugClient, Line: "a002 NOOP"},
+		},
+	},
+	{
+		name: "authenticate_initial_response",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 AUTHENTICATE SCRAM-SHA-256 biwsbj11c2VyLHI9bm9uY2U=\r\n"},
+			{DebugServer, "+ cj1ub25jZSxzPXNhbHQsaT00MDk2\r\n"},
+			{DebugClient, "*\r\n"},
+			{DebugServer, "a001 BAD AUTHENTICATE cancelled\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 AUTHENTICATE SCRAM-SHA-256 [redacted]"},
+			{Direction: DebugServer, Line: "+ [redacted]"},
+			{Direction: DebugClient, Line: "*"},
+			{Direction: DebugServer, Line: "a001 BAD AUTHENTICATE cancelled"},
+		},
+	},
+	{
+		name: "authenticate_pipelined",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\na002 NOOP\r\n"},
+			{DebugServer, "a001 OK AUTHENTICATE completed\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 AUTHENTICATE PLAIN [redacted]"},
+			{Direction: DebugClient, Line: "a002 NOOP"},
+			{Direction: DebugServer, Line: "a001 OK AUTHENTICATE completed"},
+		},
+	},
+	{
+		name: "literal_truncated",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 UID FETCH 1 BODY[]\r\n"},
+			{DebugServer, "* 1 FETCH (UID 1 BODY[] {10}\r\n0123456789)\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 UID FETCH 1 BODY[]"},
+			{Direction: DebugServer, Line: "* 1 FETCH (UID 1 BODY[] {10}"},
+			{Direction: DebugServer, Line: "0123 [truncated, 10 bytes]", Literal: true},
+			{Direction: DebugServer, Line: ")"},
+		},
+	},
+	{
+		name: "literal_crlf",
+		exchanges: []debugExchange{
+			{DebugClient, "a001 APPEND INBOX {4+}\r\na\r\nb\r\n"},
+		},
+		want: []DebugRecord{
+			{Direction: DebugClient, Line: "a001 APPEND INBOX {4+}"},
+			{Direction: DebugClient, Line: "a\r\nb", Literal: true},
+			{Direction: DebugClient, Line: ""},
+		},
+	},
+}
+
+func TestDebugLogger(t *testing.T) {
+	for _, test := range debugLoggerTests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []DebugRecord
+			l := &DebugLogger{
+				MaxLiteralSize: 4,
+				Handler: func(rec *DebugRecord) {
+					got = append(got, *rec)
+				},
+			}
+
+			runDebugLogger(l, test.exchanges)
+
+			for i := range test.want {
+				test.want[i].ConnID = "42"
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Invalid records:\ngot  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDebugLogger_output(t *testing.T) {
+	var b bytes.Buffer
+	l := &DebugLogger{Output: &b}
+
+	runDebugLogger(l, []debugExchange{
+		{DebugClient, "a001 LOGIN username password\r\n"},
+		{DebugServer, "a001 OK LOGIN completed\r\n"},
+	})
+
+	want := "42 C: a001 LOGIN [redacted]\n42 S: a001 OK LOGIN completed\n"
+	if b.String() != want {
+		t.Errorf("Invalid output: got %q, want %q", b.String(), want)
+	}
+}
+
+func TestDebugLogger_longLine(t *testing.T) {
+	var got []string
+	l := &DebugLogger{
+		Handler: func(rec *DebugRecord) {
+			got = append(got, rec.Line)
+		},
+	}
+
+	runDebugLogger(l, []debugExchange{
+		{DebugClient, "a001 NOOP " + strings.Repeat("a", maxDebugLineSize) + "\r\n"},
+		{DebugClient, "a002 NOOP\r\n"},
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("Got %v records, want 2", len(got))
+	}
+	if len(got[0]) != maxDebugLineSize+len(" [truncated]") || !strings.HasSuffix(got[0], " [truncated]") {
+		t.Errorf("Long line not truncated: %v bytes", len(got[0]))
+	}
+	if got[1] != "a002 NOOP" {
+		t.Errorf("Invalid record after a long line: %q", got[1])
+	}
+}
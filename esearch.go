@@ -0,0 +1,370 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A PartialRange is a range of search results, as defined in RFC 5267 section
+// 4.4. Positions are 1-based and inclusive.
+type PartialRange struct {
+	First uint32
+	Last  uint32
+}
+
+// ParsePartialRange parses a partial range, e.g. "1:50".
+func ParsePartialRange(s string) (*PartialRange, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("imap: invalid partial range %q", s)
+	}
+
+	first, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || first == 0 {
+		return nil, fmt.Errorf("imap: invalid partial range %q", s)
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || last == 0 {
+		return nil, fmt.Errorf("imap: invalid partial range %q", s)
+	}
+
+	if first > last {
+		first, last = last, first
+	}
+	return &PartialRange{First: uint32(first), Last: uint32(last)}, nil
+}
+
+func (r *PartialRange) String() string {
+	return formatNumber(r.First) + ":" + formatNumber(r.Last)
+}
+
+// SearchOptions contains the result options of a SEARCH or SORT command. They
+// are defined in RFC 4731 section 3.1 and RFC 5267 section 4.
+type SearchOptions struct {
+	// Return the lowest message number or UID.
+	ReturnMin bool
+	// Return the highest message number or UID.
+	ReturnMax bool
+	// Return all message numbers or UIDs.
+	ReturnAll bool
+	// Return the number of messages.
+	ReturnCount bool
+	// Keep the search results up-to-date with ADDTO and REMOVEFROM updates.
+	ReturnUpdate bool
+	// Hint that the client is likely to issue subsequent searches with
+	// PARTIAL.
+	ReturnContext bool
+	// Return a window of the results.
+	ReturnPartial *PartialRange
+}
+
+// Parse parses search options from the RETURN list.
+func (opts *SearchOptions) Parse(fields []interface{}) error {
+	*opts = SearchOptions{}
+
+	if len(fields) == 0 {
+		// RFC 4731 section 3.1: "RETURN ()" is equivalent to "RETURN (ALL)"
+		opts.ReturnAll = true
+		return nil
+	}
+
+	for i := 0; i < len(fields); i++ {
+		name, ok := fields[i].(string)
+		if !ok {
+			return errors.New("imap: search return option must be an atom")
+		}
+
+		switch strings.ToUpper(name) {
+		case "MIN":
+			opts.ReturnMin = true
+		case "MAX":
+			opts.ReturnMax = true
+		case "ALL":
+			opts.ReturnAll = true
+		case "COUNT":
+			opts.ReturnCount = true
+		case "UPDATE":
+			opts.ReturnUpdate = true
+		case "CONTEXT":
+			opts.ReturnContext = true
+		case "PARTIAL":
+			i++
+			if i >= len(fields) {
+				return errors.New("imap: missing PARTIAL range")
+			}
+			r, err := ParsePartialRange(maybeString(fields[i]))
+			if err != nil {
+				return err
+			}
+			opts.ReturnPartial = r
+		default:
+			return fmt.Errorf("imap: unsupported search return option %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Format formats search options to the RETURN list.
+func (opts *SearchOptions) Format() []interface{} {
+	fields := []interface{}{}
+	if opts.ReturnMin {
+		fields = append(fields, RawString("MIN"))
+	}
+	if opts.ReturnMax {
+		fields = append(fields, RawString("MAX"))
+	}
+	if opts.ReturnAll {
+		fields = append(fields, RawString("ALL"))
+	}
+	if opts.ReturnCount {
+		fields = append(fields, RawString("COUNT"))
+	}
+	if opts.ReturnUpdate {
+		fields = append(fields, RawString("UPDATE"))
+	}
+	if opts.ReturnContext {
+		fields = append(fields, RawString("CONTEXT"))
+	}
+	if opts.ReturnPartial != nil {
+		fields = append(fields, RawString("PARTIAL"), RawString(opts.ReturnPartial.String()))
+	}
+	return fields
+}
+
+// SearchPartialData is a window of search results, as defined in RFC 5267
+// section 4.4.
+type SearchPartialData struct {
+	Range PartialRange
+	Ids   []uint32
+}
+
+// A SearchContextUpdate describes messages added to or removed from search
+// results, as defined in RFC 5267 section 4.3.
+type SearchContextUpdate struct {
+	// The position of the first message in the results. It's always zero for
+	// unsorted results.
+	Position uint32
+	Ids      []uint32
+}
+
+// SearchData is the data contained in an ESEARCH response, as defined in RFC
+// 4731 section 3.1 and RFC 5267.
+type SearchData struct {
+	// The tag of the command which started the search.
+	Tag string
+	// True if results are UIDs, false if they are message sequence numbers.
+	Uid bool
+
+	Min     uint32
+	Max     uint32
+	All     []uint32
+	Count   uint32
+	Partial *SearchPartialData
+
+	AddTo      []SearchContextUpdate
+	RemoveFrom []SearchContextUpdate
+}
+
+// Parse parses search data from ESEARCH response fields.
+func (data *SearchData) Parse(fields []interface{}) error {
+	*data = SearchData{}
+
+	if len(fields) > 0 {
+		if correlator, ok := fields[0].([]interface{}); ok {
+			if len(correlator) != 2 || !strings.EqualFold(maybeString(correlator[0]), "TAG") {
+				return errors.New("imap: invalid ESEARCH correlator")
+			}
+			tag, err := ParseString(correlator[1])
+			if err != nil {
+				return err
+			}
+			data.Tag = tag
+			fields = fields[1:]
+		}
+	}
+	if len(fields) > 0 && strings.EqualFold(maybeString(fields[0]), "UID") {
+		data.Uid = true
+		fields = fields[1:]
+	}
+
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return errors.New("imap: missing ESEARCH return data value")
+		}
+		name, value := strings.ToUpper(maybeString(fields[0])), fields[1]
+		fields = fields[2:]
+
+		var err error
+		switch name {
+		case "MIN":
+			data.Min, err = ParseNumber(value)
+		case "MAX":
+			data.Max, err = ParseNumber(value)
+		case "ALL":
+			data.All, err = parseIdList(value)
+		case "COUNT":
+			data.Count, err = ParseNumber(value)
+		case "PARTIAL":
+			data.Partial, err = parseSearchPartialData(value)
+		case "ADDTO":
+			data.AddTo, err = parseSearchContextUpdates(value)
+		case "REMOVEFROM":
+			data.RemoveFrom, err = parseSearchContextUpdates(value)
+		default:
+			// Return data defined in an unsupported extension, skip it
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Format formats search data to ESEARCH response fields. Only the results
+// requested in opts are included. If opts is nil, only context updates are
+// included.
+func (data *SearchData) Format(opts *SearchOptions) []interface{} {
+	var fields []interface{}
+	if data.Tag != "" {
+		fields = append(fields, []interface{}{RawString("TAG"), data.Tag})
+	}
+	if data.Uid {
+		fields = append(fields, RawString("UID"))
+	}
+
+	if opts != nil {
+		// RFC 4731 section 3.1: MIN, MAX and ALL are omitted if there are no
+		// results
+		if opts.ReturnMin && data.Min > 0 {
+			fields = append(fields, RawString("MIN"), data.Min)
+		}
+		if opts.ReturnMax && data.Max > 0 {
+			fields = append(fields, RawString("MAX"), data.Max)
+		}
+		if opts.ReturnAll && len(data.All) > 0 {
+			fields = append(fields, RawString("ALL"), formatIdList(data.All))
+		}
+		if opts.ReturnCount {
+			fields = append(fields, RawString("COUNT"), data.Count)
+		}
+		if opts.ReturnPartial != nil && data.Partial != nil {
+			var ids interface{}
+			if len(data.Partial.Ids) > 0 {
+				ids = formatIdList(data.Partial.Ids)
+			}
+			fields = append(fields, RawString("PARTIAL"), []interface{}{
+				RawString(data.Partial.Range.String()),
+				ids,
+			})
+		}
+	}
+
+	if len(data.AddTo) > 0 {
+		fields = append(fields, RawString("ADDTO"), formatSearchContextUpdates(data.AddTo))
+	}
+	if len(data.RemoveFrom) > 0 {
+		fields = append(fields, RawString("REMOVEFROM"), formatSearchContextUpdates(data.RemoveFrom))
+	}
+
+	return fields
+}
+
+// formatIdList formats a list of message numbers or UIDs as a sequence set.
+// Unlike SeqSet, the order of the list is preserved.
+func formatIdList(ids []uint32) RawString {
+	var b strings.Builder
+	for i := 0; i < len(ids); i++ {
+		start := ids[i]
+		for i+1 < len(ids) && ids[i+1] == ids[i]+1 {
+			i++
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(formatNumber(start))
+		if ids[i] != start {
+			b.WriteByte(':')
+			b.WriteString(formatNumber(ids[i]))
+		}
+	}
+	return RawString(b.String())
+}
+
+// parseIdList parses a sequence set as an ordered list of message numbers or
+// UIDs.
+func parseIdList(f interface{}) ([]uint32, error) {
+	s, err := ParseString(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for _, part := range strings.Split(s, ",") {
+		seq, err := parseSeq(part)
+		if err != nil {
+			return nil, err
+		}
+		if seq.Start == 0 || seq.Stop == 0 {
+			return nil, ErrBadSeqSet(s)
+		}
+
+		for id := seq.Start; id <= seq.Stop; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func parseSearchPartialData(f interface{}) (*SearchPartialData, error) {
+	fields, ok := f.([]interface{})
+	if !ok || len(fields) != 2 {
+		return nil, errors.New("imap: PARTIAL return data must be a list of two items")
+	}
+
+	r, err := ParsePartialRange(maybeString(fields[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	partial := &SearchPartialData{Range: *r}
+	if fields[1] != nil {
+		if partial.Ids, err = parseIdList(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return partial, nil
+}
+
+func parseSearchContextUpdates(f interface{}) ([]SearchContextUpdate, error) {
+	fields, ok := f.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, errors.New("imap: context update must be a list of position and message pairs")
+	}
+
+	updates := make([]SearchContextUpdate, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		pos, err := ParseNumber(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		ids, err := parseIdList(fields[i+1])
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, SearchContextUpdate{Position: pos, Ids: ids})
+	}
+	return updates, nil
+}
+
+func formatSearchContextUpdates(updates []SearchContextUpdate) []interface{} {
+	fields := make([]interface{}, 0, 2*len(updates))
+	for _, update := range updates {
+		fields = append(fields, update.Position, formatIdList(update.Ids))
+	}
+	return fields
+}
@@ -0,0 +1,216 @@
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var searchOptionsTests = []struct {
+	expected string
+	options  *SearchOptions
+}{
+	{
+		expected: "(MIN MAX COUNT)",
+		options: &SearchOptions{
+			ReturnMin:   true,
+			ReturnMax:   true,
+			ReturnCount: true,
+		},
+	},
+	{
+		expected: "(ALL UPDATE CONTEXT PARTIAL 1:50)",
+		options: &SearchOptions{
+			ReturnAll:     true,
+			ReturnUpdate:  true,
+			ReturnContext: true,
+			ReturnPartial: &PartialRange{First: 1, Last: 50},
+		},
+	},
+}
+
+func TestSearchOptions_Format(t *testing.T) {
+	for i, test := range searchOptionsTests {
+		got, err := formatFields(test.options.Format())
+		if err != nil {
+			t.Fatal("Expected no error while formatting fields, got:", err)
+		}
+		if got != test.expected {
+			t.Errorf("Invalid search options for #%v: got %v instead of %v", i+1, got, test.expected)
+		}
+	}
+}
+
+func TestSearchOptions_Parse(t *testing.T) {
+	for i, test := range searchOptionsTests {
+		r := NewReader(bytes.NewBufferString(test.expected))
+		fields, _ := r.ReadFields()
+
+		options := new(SearchOptions)
+		if err := options.Parse(fields[0].([]interface{})); err != nil {
+			t.Errorf("Cannot parse search options for #%v: %v", i+1, err)
+		} else if !reflect.DeepEqual(options, test.options) {
+			t.Errorf("Invalid search options for #%v: got %+v instead of %+v", i+1, options, test.options)
+		}
+	}
+}
+
+func TestSearchOptions_Parse_empty(t *testing.T) {
+	options := new(SearchOptions)
+	if err := options.Parse(nil); err != nil {
+		t.Fatal("Expected no error while parsing empty search options, got:", err)
+	}
+	if !reflect.DeepEqual(options, &SearchOptions{ReturnAll: true}) {
+		t.Errorf("Empty search options should be equivalent to ALL, got %+v", options)
+	}
+}
+
+var searchDataTests = []struct {
+	expected string
+	data     *SearchData
+	options  *SearchOptions
+}{
+	{
+		expected: `(TAG "a001") UID MIN 2 MAX 42 ALL 2:5,7,42 COUNT 6`,
+		data: &SearchData{
+			Tag:   "a001",
+			Uid:   true,
+			Min:   2,
+			Max:   42,
+			All:   []uint32{2, 3, 4, 5, 7, 42},
+			Count: 6,
+		},
+		options: &SearchOptions{
+			ReturnMin:   true,
+			ReturnMax:   true,
+			ReturnAll:   true,
+			ReturnCount: true,
+		},
+	},
+	{
+		expected: `(TAG "a002") ALL 9,3:4,1 PARTIAL (1:3 9,3:4)`,
+		data: &SearchData{
+			Tag: "a002",
+			All: []uint32{9, 3, 4, 1},
+			Partial: &SearchPartialData{
+				Range: PartialRange{First: 1, Last: 3},
+				Ids:   []uint32{9, 3, 4},
+			},
+		},
+		options: &SearchOptions{
+			ReturnAll:     true,
+			ReturnPartial: &PartialRange{First: 1, Last: 3},
+		},
+	},
+	{
+		expected: `(TAG "a003") COUNT 0 PARTIAL (1:10 NIL)`,
+		data: &SearchData{
+			Tag:     "a003",
+			Partial: &SearchPartialData{Range: PartialRange{First: 1, Last: 10}},
+		},
+		options: &SearchOptions{
+			ReturnCount:   true,
+			ReturnPartial: &PartialRange{First: 1, Last: 10},
+		},
+	},
+	{
+		expected: `(TAG "a004") UID ADDTO (1 12 4 15:16) REMOVEFROM (0 3)`,
+		data: &SearchData{
+			Tag: "a004",
+			Uid: true,
+			AddTo: []SearchContextUpdate{
+				{Position: 1, Ids: []uint32{12}},
+				{Position: 4, Ids: []uint32{15, 16}},
+			},
+			RemoveFrom: []SearchContextUpdate{
+				{Position: 0, Ids: []uint32{3}},
+			},
+		},
+	},
+}
+
+func TestSearchData_Format(t *testing.T) {
+	for i, test := range searchDataTests {
+		fields := test.data.Format(test.options)
+
+		got, err := formatFields(fields)
+		if err != nil {
+			t.Fatal("Expected no error while formatting fields, got:", err)
+		}
+		if expected := "(" + test.expected + ")"; got != expected {
+			t.Errorf("Invalid search data for #%v: got \n%v\n instead of \n%v", i+1, got, expected)
+		}
+	}
+}
+
+func TestSearchData_Parse(t *testing.T) {
+	for i, test := range searchDataTests {
+		r := NewReader(bytes.NewBufferString(test.expected + "\r\n"))
+		fields, err := r.ReadLine()
+		if err != nil {
+			t.Fatal("Expected no error while reading fields, got:", err)
+		}
+
+		data := new(SearchData)
+		if err := data.Parse(fields); err != nil {
+			t.Errorf("Cannot parse search data for #%v: %v", i+1, err)
+		} else if !reflect.DeepEqual(data, test.data) {
+			t.Errorf("Invalid search data for #%v: got \n%+v\n instead of \n%+v", i+1, data, test.data)
+		}
+	}
+}
+
+func TestParsePartialRange(t *testing.T) {
+	tests := []struct {
+		s   string
+		r   *PartialRange
+		err bool
+	}{
+		{s: "1:50", r: &PartialRange{First: 1, Last: 50}},
+		{s: "100:51", r: &PartialRange{First: 51, Last: 100}},
+		{s: "0:10", err: true},
+		{s: "1:*", err: true},
+		{s: "42", err: true},
+	}
+
+	for _, test := range tests {
+		r, err := ParsePartialRange(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected an error while parsing %q", test.s)
+			}
+		} else if err != nil {
+			t.Errorf("Cannot parse partial range %q: %v", test.s, err)
+		} else if !reflect.DeepEqual(r, test.r) {
+			t.Errorf("Invalid partial range for %q: got %+v", test.s, r)
+		}
+	}
+}
+
+func TestParseSortCriteria(t *testing.T) {
+	fields := []interface{}{"REVERSE", "date", "SUBJECT"}
+	expected := []SortCriterion{
+		{Field: SortDate, Reverse: true},
+		{Field: SortSubject},
+	}
+
+	criteria, err := ParseSortCriteria(fields)
+	if err != nil {
+		t.Fatal("Expected no error while parsing sort criteria, got:", err)
+	}
+	if !reflect.DeepEqual(criteria, expected) {
+		t.Errorf("Invalid sort criteria: got %+v", criteria)
+	}
+
+	got, err := formatFields(FormatSortCriteria(criteria))
+	if err != nil {
+		t.Fatal("Expected no error while formatting fields, got:", err)
+	}
+	if got != "(REVERSE DATE SUBJECT)" {
+		t.Errorf("Invalid formatted sort criteria: got %v", got)
+	}
+
+	if _, err := ParseSortCriteria([]interface{}{"DATE", "REVERSE"}); err == nil {
+		t.Error("Expected an error while parsing a trailing REVERSE")
+	}
+}
@@ -5,5 +5,8 @@ go 1.13
 require (
 	github.com/emersion/go-message v0.11.1
 	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
-	golang.org/x/text v0.3.2
+	github.com/fsnotify/fsnotify v1.4.9
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
 )
@@ -17,6 +17,12 @@ const (
 	StatusUidNext     StatusItem = "UIDNEXT"
 	StatusUidValidity StatusItem = "UIDVALIDITY"
 	StatusUnseen      StatusItem = "UNSEEN"
+
+	// Defined in RFC 8474 section 4.
+	StatusMailboxId StatusItem = "MAILBOXID"
+
+	// Defined in RFC 8438 section 2.
+	StatusSize StatusItem = "SIZE"
 )
 
 // A FetchItem is a message data item that can be fetched.
@@ -40,6 +46,16 @@ const (
 	FetchRFC822Size    FetchItem = "RFC822.SIZE"
 	FetchRFC822Text    FetchItem = "RFC822.TEXT"
 	FetchUid           FetchItem = "UID"
+
+	// Defined in RFC 8474 section 5.
+	FetchEmailId  FetchItem = "EMAILID"
+	FetchThreadId FetchItem = "THREADID"
+
+	// Defined in RFC 8514 section 4.
+	FetchSaveDate FetchItem = "SAVEDATE"
+
+	// Defined in RFC 8970 section 3.
+	FetchPreview FetchItem = "PREVIEW"
 )
 
 // Expand expands the item if it's a macro.
@@ -0,0 +1,61 @@
+package imap
+
+import (
+	"errors"
+)
+
+// InProgress is the progress of a long-running command, sent in an INPROGRESS
+// response code. See RFC 9585.
+type InProgress struct {
+	// The tag of the command.
+	Tag string
+	// The number of items processed so far.
+	Count uint32
+	// The total number of items to process, or zero if unknown.
+	Total uint32
+}
+
+// ParseInProgress parses the arguments of an INPROGRESS response code.
+func ParseInProgress(args []interface{}) (*InProgress, error) {
+	p := new(InProgress)
+	if len(args) == 0 {
+		// RFC 9585 section 3: the progress data is optional
+		return p, nil
+	}
+
+	fields, ok := args[0].([]interface{})
+	if !ok || len(fields) != 3 {
+		return nil, errors.New("imap: INPROGRESS data must be a list of three items")
+	}
+
+	if fields[0] != nil {
+		tag, err := ParseString(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		p.Tag = tag
+	}
+
+	var err error
+	if fields[1] != nil {
+		if p.Count, err = ParseNumber(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	if fields[2] != nil {
+		if p.Total, err = ParseNumber(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Format formats the arguments of an INPROGRESS response code.
+func (p *InProgress) Format() []interface{} {
+	var total interface{}
+	if p.Total > 0 {
+		total = p.Total
+	}
+	return []interface{}{[]interface{}{p.Tag, p.Count, total}}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SCRAM channel binding types, defined in RFC 5929 and RFC 9266.
+const (
+	SCRAMTLSExporter       = "tls-exporter"
+	SCRAMTLSServerEndPoint = "tls-server-end-point"
+)
+
+// SCRAMHMAC computes HMAC-SHA-256, as used by SCRAM-SHA-256.
+func SCRAMHMAC(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// SCRAMSaltedPassword computes Hi(password, salt, iterations), as defined in
+// RFC 5802 section 2.2. This is PBKDF2 with a single output block.
+func SCRAMSaltedPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+// SCRAMKeys derives the client, stored and server keys from a salted
+// password.
+func SCRAMKeys(saltedPassword []byte) (clientKey, storedKey, serverKey []byte) {
+	clientKey = SCRAMHMAC(saltedPassword, "Client Key")
+	h := sha256.Sum256(clientKey)
+	serverKey = SCRAMHMAC(saltedPassword, "Server Key")
+	return clientKey, h[:], serverKey
+}
+
+// SCRAMEscape escapes a username for use in a SCRAM message.
+func SCRAMEscape(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// SCRAMUnescape reverses SCRAMEscape.
+func SCRAMUnescape(s string) (string, error) {
+	if strings.Contains(strings.NewReplacer("=3D", "", "=2C", "").Replace(s), "=") {
+		return "", errors.New("Invalid escape sequence in SCRAM username")
+	}
+	return strings.NewReplacer("=3D", "=", "=2C", ",").Replace(s), nil
+}
+
+// SCRAMChannelBinding computes the channel binding data for a TLS
+// connection. cert is the server certificate, only used for
+// tls-server-end-point.
+func SCRAMChannelBinding(cbType string, state *tls.ConnectionState, cert *x509.Certificate) ([]byte, error) {
+	switch cbType {
+	case SCRAMTLSExporter:
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case SCRAMTLSServerEndPoint:
+		if cert == nil {
+			return nil, errors.New("Missing server certificate for channel binding")
+		}
+
+		// RFC 5929 section 4.1: use the certificate's signature hash, or
+		// SHA-256 if it's MD5 or SHA-1
+		var h crypto.Hash
+		switch cert.SignatureAlgorithm {
+		case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+			h = crypto.SHA384
+		case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+			h = crypto.SHA512
+		default:
+			h = crypto.SHA256
+		}
+		if !h.Available() {
+			return nil, errors.New("Unsupported certificate signature hash")
+		}
+
+		hash := h.New()
+		hash.Write(cert.Raw)
+		return hash.Sum(nil), nil
+	default:
+		return nil, errors.New("Unsupported channel binding type")
+	}
+}
+
+// SCRAMAttrs parses comma-separated SCRAM attributes.
+func SCRAMAttrs(s string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		if _, ok := attrs[attr[0]]; !ok {
+			attrs[attr[0]] = attr[2:]
+		}
+	}
+	return attrs
+}
@@ -1,7 +1,10 @@
 package imap
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
 )
 
 // A literal, as defined in RFC 3501 section 4.3.
@@ -11,3 +14,69 @@ type Literal interface {
 	// Len returns the number of bytes of the literal.
 	Len() int
 }
+
+// BufferedLiteral is a literal whose contents are stored in memory or in a
+// temporary file. It supports random access, and can be read multiple times
+// by seeking back to its start.
+//
+// A BufferedLiteral stored in a temporary file should be closed once it isn't
+// needed anymore.
+type BufferedLiteral struct {
+	*io.SectionReader
+
+	file *os.File
+	// The name of the temporary file if it couldn't be removed when created
+	name string
+}
+
+// BufferLiteral reads n bytes from r into a BufferedLiteral. If n is larger
+// than maxMemory, the contents are written to a temporary file in dir instead
+// of being kept in memory. If dir is empty, os.TempDir is used.
+func BufferLiteral(r io.Reader, n int64, maxMemory int64, dir string) (*BufferedLiteral, error) {
+	if n <= maxMemory {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return &BufferedLiteral{SectionReader: io.NewSectionReader(bytes.NewReader(b), 0, n)}, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "imap-literal-")
+	if err != nil {
+		return nil, err
+	}
+	lit := &BufferedLiteral{file: f}
+	// On most systems, the file can be read until it's closed even if it's
+	// removed, and its contents are released as soon as it's closed
+	if err := os.Remove(f.Name()); err != nil {
+		lit.name = f.Name()
+	}
+
+	if _, err := io.CopyN(f, r, n); err != nil {
+		lit.Close()
+		return nil, err
+	}
+	lit.SectionReader = io.NewSectionReader(f, 0, n)
+	return lit, nil
+}
+
+// Len returns the number of unread bytes of the literal.
+func (l *BufferedLiteral) Len() int {
+	offset, _ := l.Seek(0, io.SeekCurrent)
+	return int(l.Size() - offset)
+}
+
+// Close releases the temporary file storing the literal, if any.
+func (l *BufferedLiteral) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	if l.name != "" {
+		if removeErr := os.Remove(l.name); err == nil {
+			err = removeErr
+		}
+	}
+	l.file = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package imap_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestBufferLiteral(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, maxMemory := range []int64{0, 1024} {
+		const s = "Hello World"
+		lit, err := imap.BufferLiteral(strings.NewReader(s+"!"), int64(len(s)), maxMemory, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lit.Len() != len(s) {
+			t.Errorf("Invalid length: got %v, want %v", lit.Len(), len(s))
+		}
+		b, err := ioutil.ReadAll(lit)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b) != s {
+			t.Errorf("Invalid contents: got %q, want %q", string(b), s)
+		}
+		if lit.Len() != 0 {
+			t.Errorf("Invalid length after read: %v", lit.Len())
+		}
+
+		// Random access
+		b = make([]byte, 5)
+		if _, err := lit.ReadAt(b, 6); err != nil {
+			t.Fatal(err)
+		} else if string(b) != "World" {
+			t.Errorf("Invalid contents at offset 6: got %q", string(b))
+		}
+		if _, err := lit.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		} else if lit.Len() != len(s) {
+			t.Errorf("Invalid length after seeking: %v", lit.Len())
+		}
+
+		if err := lit.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Temporary files are removed once closed
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) > 0 {
+		t.Errorf("Temporary files left: %v", len(files))
+	}
+
+	if _, err := imap.BufferLiteral(strings.NewReader("Hello"), 11, 0, dir); err == nil {
+		t.Error("Buffering a short literal didn't fail")
+	}
+}
@@ -186,6 +186,10 @@ type MailboxStatus struct {
 	// Together with a UID, it is a unique identifier for a message.
 	// Must be greater than or equal to 1.
 	UidValidity uint32
+	// The mailbox object identifier, as defined in RFC 8474.
+	MailboxId string
+	// The total size of the mailbox in octets, as defined in RFC 8438.
+	Size uint64
 }
 
 // Create a new mailbox status that will contain the specified items.
@@ -228,6 +232,10 @@ func (status *MailboxStatus) Parse(fields []interface{}) error {
 				status.UidNext, err = ParseNumber(f)
 			case StatusUidValidity:
 				status.UidValidity, err = ParseNumber(f)
+			case StatusMailboxId:
+				status.MailboxId, err = ParseObjectId(f)
+			case StatusSize:
+				status.Size, err = ParseNumber64(f)
 			default:
 				status.Items[k] = f
 			}
@@ -255,6 +263,10 @@ func (status *MailboxStatus) Format() []interface{} {
 			v = status.UidNext
 		case StatusUidValidity:
 			v = status.UidValidity
+		case StatusMailboxId:
+			v = FormatObjectId(status.MailboxId)
+		case StatusSize:
+			v = status.Size
 		}
 
 		fields = append(fields, RawString(k), v)
@@ -189,3 +189,37 @@ func TestMailboxStatus_Format(t *testing.T) {
 		}
 	}
 }
+
+func TestMailboxStatus_MailboxId(t *testing.T) {
+	status := &imap.MailboxStatus{}
+	fields := []interface{}{"MAILBOXID", []interface{}{"F2212ea87-6097-4256-9d51-71338625"}}
+	if err := status.Parse(fields); err != nil {
+		t.Fatalf("Expected no error while parsing mailbox status, got: %v", err)
+	}
+	if status.MailboxId != "F2212ea87-6097-4256-9d51-71338625" {
+		t.Errorf("Invalid mailbox ID: got %q", status.MailboxId)
+	}
+
+	formatted := status.Format()
+	expected := []interface{}{imap.RawString("MAILBOXID"), []interface{}{imap.RawString(status.MailboxId)}}
+	if !reflect.DeepEqual(formatted, expected) {
+		t.Errorf("Invalid mailbox status fields: got \n%+v\n but expected \n%+v", formatted, expected)
+	}
+}
+
+func TestMailboxStatus_Size(t *testing.T) {
+	status := &imap.MailboxStatus{}
+	fields := []interface{}{"SIZE", "8589934592"}
+	if err := status.Parse(fields); err != nil {
+		t.Fatalf("Expected no error while parsing mailbox status, got: %v", err)
+	}
+	if status.Size != 8589934592 {
+		t.Errorf("Invalid mailbox size: got %v", status.Size)
+	}
+
+	formatted := status.Format()
+	expected := []interface{}{imap.RawString("SIZE"), uint64(8589934592)}
+	if !reflect.DeepEqual(formatted, expected) {
+		t.Errorf("Invalid mailbox status fields: got \n%+v\n but expected \n%+v", formatted, expected)
+	}
+}
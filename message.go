@@ -162,6 +162,16 @@ type Message struct {
 	Uid uint32
 	// The message body sections.
 	Body map[*BodySectionName]Literal
+	// The message object identifier, as defined in RFC 8474.
+	EmailId string
+	// The thread object identifier, as defined in RFC 8474. Empty if the
+	// server doesn't support threads.
+	ThreadId string
+	// The date the message was saved to its current mailbox, as defined in
+	// RFC 8514. Zero if the server doesn't support it for this mailbox.
+	SaveDate time.Time
+	// A short plain-text abstract of the message, as defined in RFC 8970.
+	Preview string
 
 	// The order in which items were requested. This order must be preserved
 	// because some bad IMAP clients (looking at you, Outlook!) refuse responses
@@ -245,6 +255,17 @@ func (m *Message) Parse(fields []interface{}) error {
 				m.Size, _ = ParseNumber(f)
 			case FetchUid:
 				m.Uid, _ = ParseNumber(f)
+			case FetchEmailId:
+				m.EmailId, _ = ParseObjectId(f)
+			case FetchThreadId:
+				m.ThreadId, _ = ParseObjectId(f)
+			case FetchSaveDate:
+				date, _ := f.(string)
+				m.SaveDate, _ = time.Parse(DateTimeLayout, date)
+			case FetchPreview:
+				if f != nil {
+					m.Preview, _ = ParseString(f)
+				}
 			default:
 				// Likely to be a section of the body
 				// First check that the section name is correct
@@ -284,6 +305,14 @@ func (m *Message) formatItem(k FetchItem) []interface{} {
 		v = m.Size
 	case FetchUid:
 		v = m.Uid
+	case FetchEmailId:
+		v = FormatObjectId(m.EmailId)
+	case FetchThreadId:
+		v = FormatObjectId(m.ThreadId)
+	case FetchSaveDate:
+		v = m.SaveDate
+	case FetchPreview:
+		v = m.Preview
 	default:
 		for section, literal := range m.Body {
 			if section.value == k {
@@ -73,6 +73,37 @@ var messageTests = []struct {
 			RawString("UID"), RawString("2424"),
 		},
 	},
+	{
+		message: &Message{
+			Items: map[FetchItem]interface{}{
+				FetchEmailId:  nil,
+				FetchThreadId: nil,
+			},
+			Body:       map[*BodySectionName]Literal{},
+			EmailId:    "M6d99ac3275bb4e",
+			itemsOrder: []FetchItem{FetchEmailId, FetchThreadId},
+		},
+		fields: []interface{}{
+			RawString("EMAILID"), []interface{}{RawString("M6d99ac3275bb4e")},
+			RawString("THREADID"), nil,
+		},
+	},
+	{
+		message: &Message{
+			Items: map[FetchItem]interface{}{
+				FetchSaveDate: nil,
+				FetchPreview:  nil,
+			},
+			Body:       map[*BodySectionName]Literal{},
+			SaveDate:   t,
+			Preview:    "Hi there :)",
+			itemsOrder: []FetchItem{FetchSaveDate, FetchPreview},
+		},
+		fields: []interface{}{
+			RawString("SAVEDATE"), "10-Nov-2009 23:00:00 -0600",
+			RawString("PREVIEW"), "Hi there :)",
+		},
+	},
 }
 
 func TestMessage_Parse(t *testing.T) {
@@ -0,0 +1,60 @@
+package imap
+
+import (
+	"errors"
+)
+
+// Object identifiers are defined in RFC 8474. They are used to identify
+// mailboxes (MAILBOXID), messages (EMAILID) and threads (THREADID).
+
+func isObjectIdChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+// IsValidObjectId checks whether a string is a valid object identifier, as
+// defined in RFC 8474 section 3.
+func IsValidObjectId(id string) bool {
+	if len(id) == 0 || len(id) > 255 {
+		return false
+	}
+	for _, c := range id {
+		if !isObjectIdChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseObjectId parses an object identifier wrapped in a list, e.g.
+// "(M6d99ac3275bb4e)". A NIL value is parsed as an empty string.
+func ParseObjectId(f interface{}) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+
+	fields, ok := f.([]interface{})
+	if !ok {
+		return "", errors.New("Object identifier must be a list")
+	}
+	if len(fields) != 1 {
+		return "", errors.New("Object identifier list must contain exactly one item")
+	}
+
+	id, err := ParseString(fields[0])
+	if err != nil {
+		return "", err
+	}
+	if !IsValidObjectId(id) {
+		return "", errors.New("Invalid object identifier")
+	}
+	return id, nil
+}
+
+// FormatObjectId formats an object identifier as a list. An empty identifier
+// is formatted as NIL.
+func FormatObjectId(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return []interface{}{RawString(id)}
+}
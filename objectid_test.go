@@ -0,0 +1,31 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestParseObjectId(t *testing.T) {
+	tests := []struct {
+		f     interface{}
+		id    string
+		valid bool
+	}{
+		{f: []interface{}{"M6d99ac3275bb4e"}, id: "M6d99ac3275bb4e", valid: true},
+		{f: nil, id: "", valid: true},
+		{f: "M6d99ac3275bb4e", valid: false},
+		{f: []interface{}{}, valid: false},
+		{f: []interface{}{"M6d99", "M6d99"}, valid: false},
+		{f: []interface{}{"M6d99ac3275bb4e!"}, valid: false},
+	}
+
+	for _, test := range tests {
+		id, err := ParseObjectId(test.f)
+		if test.valid && err != nil {
+			t.Errorf("ParseObjectId(%v) = %v", test.f, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("ParseObjectId(%v) didn't fail", test.f)
+		} else if id != test.id {
+			t.Errorf("ParseObjectId(%v) = %q, want %q", test.f, id, test.id)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 )
@@ -87,6 +88,31 @@ func ParseNumber(f interface{}) (uint32, error) {
 	return uint32(nbr), nil
 }
 
+// ParseNumber64 parses a 64-bit number.
+func ParseNumber64(f interface{}) (uint64, error) {
+	// Useful for tests
+	if n, ok := f.(uint64); ok {
+		return n, nil
+	}
+
+	var s string
+	switch f := f.(type) {
+	case RawString:
+		s = string(f)
+	case string:
+		s = f
+	default:
+		return 0, newParseError("expected a number, got a non-atom")
+	}
+
+	nbr, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, &parseError{err}
+	}
+
+	return nbr, nil
+}
+
 // ParseString parses a string, which is either a literal, a quoted string or an
 // atom.
 func ParseString(f interface{}) (string, error) {
@@ -135,10 +161,29 @@ func trimSuffix(str string, suffix rune) string {
 type Reader struct {
 	MaxLiteralSize uint32 // The maximum literal size.
 
+	// Literals larger than this are written to a temporary file instead of
+	// being kept in memory, in bytes. If zero, literals are always kept in
+	// memory (this is the default). See BufferLiteral.
+	MaxMemoryLiteralSize uint32
+	// The directory in which temporary files holding literals are created. If
+	// empty, os.TempDir is used.
+	LiteralTempDir string
+
+	// If not nil, StreamLiteral is called by ReadLine when a literal is found
+	// at the top level of a line, with the fields preceding it. If it returns
+	// true, the literal isn't read in memory: ReadLine returns right away, with
+	// a literal reading from the underlying reader as the last field. The
+	// literal must be read before any other read, and FinishLine must then be
+	// called to read the rest of the line.
+	StreamLiteral func(fields []interface{}) bool
+
 	reader
 
 	continues chan<- bool
 
+	// The literal returned by the last call to ReadLine, if it was streamed
+	streamed *streamedLiteral
+
 	brackets   int
 	inRespCode bool
 }
@@ -225,16 +270,40 @@ func (r *Reader) ReadAtom() (interface{}, error) {
 }
 
 func (r *Reader) ReadLiteral() (Literal, error) {
-	char, _, err := r.ReadRune()
+	n, err := r.readLiteralHeader()
 	if err != nil {
 		return nil, err
+	}
+
+	return r.readLiteralContents(n)
+}
+
+// readLiteralContents reads the n bytes of a literal.
+func (r *Reader) readLiteralContents(n uint32) (Literal, error) {
+	if r.MaxMemoryLiteralSize > 0 {
+		return BufferLiteral(r, int64(n), int64(r.MaxMemoryLiteralSize), r.LiteralTempDir)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+// readLiteralHeader reads the size of a literal and the following CRLF, and
+// sends a continuation request if necessary. The contents of the literal are
+// left unread.
+func (r *Reader) readLiteralHeader() (uint32, error) {
+	char, _, err := r.ReadRune()
+	if err != nil {
+		return 0, err
 	} else if char != literalStart {
-		return nil, newParseError("literal string doesn't start with an open brace")
+		return 0, newParseError("literal string doesn't start with an open brace")
 	}
 
 	lstr, err := r.ReadString(byte(literalEnd))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	lstr = trimSuffix(lstr, literalEnd)
 
@@ -245,14 +314,14 @@ func (r *Reader) ReadLiteral() (Literal, error) {
 
 	n, err := strconv.ParseUint(lstr, 10, 32)
 	if err != nil {
-		return nil, newParseError("cannot parse literal length: " + err.Error())
+		return 0, newParseError("cannot parse literal length: " + err.Error())
 	}
 	if r.MaxLiteralSize > 0 && uint32(n) > r.MaxLiteralSize {
-		return nil, newParseError("literal exceeding maximum size")
+		return 0, newParseError("literal exceeding maximum size")
 	}
 
 	if err := r.ReadCrlf(); err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	// Send continuation request if necessary
@@ -260,12 +329,50 @@ func (r *Reader) ReadLiteral() (Literal, error) {
 		r.continues <- true
 	}
 
-	// Read literal
-	b := make([]byte, n)
-	if _, err := io.ReadFull(r, b); err != nil {
-		return nil, err
+	return uint32(n), nil
+}
+
+// streamedLiteral is a literal read from the underlying reader as it's
+// consumed.
+type streamedLiteral struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *streamedLiteral) Read(b []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, io.EOF
 	}
-	return bytes.NewBuffer(b), nil
+	if int64(len(b)) > l.left {
+		b = b[:l.left]
+	}
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if err == io.EOF && l.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Len returns the number of unread bytes of the literal.
+func (l *streamedLiteral) Len() int {
+	return int(l.left)
+}
+
+// FinishLine discards the unread contents of the literal streamed by the last
+// call to ReadLine and reads the rest of the line, which must only contain a
+// CRLF. It does nothing if ReadLine hasn't streamed a literal.
+func (r *Reader) FinishLine() error {
+	lit := r.streamed
+	if lit == nil {
+		return nil
+	}
+	r.streamed = nil
+
+	if _, err := io.Copy(ioutil.Discard, lit); err != nil {
+		return err
+	}
+	return r.ReadCrlf()
 }
 
 func (r *Reader) ReadQuotedString() (string, error) {
@@ -307,6 +414,12 @@ func (r *Reader) ReadQuotedString() (string, error) {
 }
 
 func (r *Reader) ReadFields() (fields []interface{}, err error) {
+	return r.readFields(nil)
+}
+
+// readFields reads fields. If stream is not nil, it's called for each literal
+// to check whether it should be streamed, see Reader.StreamLiteral.
+func (r *Reader) readFields(stream func(fields []interface{}) bool) (fields []interface{}, err error) {
 	var char rune
 	for {
 		if char, _, err = r.ReadRune(); err != nil {
@@ -320,7 +433,21 @@ func (r *Reader) ReadFields() (fields []interface{}, err error) {
 		ok := true
 		switch char {
 		case literalStart:
-			field, err = r.ReadLiteral()
+			if stream == nil {
+				field, err = r.ReadLiteral()
+				break
+			}
+
+			var n uint32
+			if n, err = r.readLiteralHeader(); err != nil {
+				return
+			}
+			if stream(fields) {
+				r.streamed = &streamedLiteral{r: r, left: int64(n)}
+				fields = append(fields, r.streamed)
+				return
+			}
+			field, err = r.readLiteralContents(n)
 		case dquote:
 			field, err = r.ReadQuotedString()
 		case listStart:
@@ -386,8 +513,9 @@ func (r *Reader) ReadList() (fields []interface{}, err error) {
 }
 
 func (r *Reader) ReadLine() (fields []interface{}, err error) {
-	fields, err = r.ReadFields()
-	if err != nil {
+	r.streamed = nil
+	fields, err = r.readFields(r.StreamLiteral)
+	if err != nil || r.streamed != nil {
 		return
 	}
 
@@ -40,6 +40,34 @@ func TestParseNumber(t *testing.T) {
 	}
 }
 
+func TestParseNumber64(t *testing.T) {
+	tests := []struct {
+		f   interface{}
+		n   uint64
+		err bool
+	}{
+		{f: "42", n: 42},
+		{f: "8589934592", n: 8589934592},
+		{f: "-1", err: true},
+		{f: nil, err: true},
+	}
+
+	for _, test := range tests {
+		n, err := imap.ParseNumber64(test.f)
+		if err != nil {
+			if !test.err {
+				t.Errorf("Cannot parse number %v", test.f)
+			}
+		} else {
+			if test.err {
+				t.Errorf("Parsed invalid number %v", test.f)
+			} else if n != test.n {
+				t.Errorf("Invalid parsed number: got %v but expected %v", n, test.n)
+			}
+		}
+	}
+}
+
 func TestParseStringList(t *testing.T) {
 	tests := []struct {
 		field interface{}
@@ -457,6 +485,89 @@ func TestReader_ReadLine(t *testing.T) {
 	}
 }
 
+func TestReader_ReadLine_streamLiteral(t *testing.T) {
+	b, r := newReader("a001 APPEND INBOX {11}\r\nHello World\r\na002 NOOP\r\n")
+	r.StreamLiteral = func(fields []interface{}) bool {
+		return len(fields) == 3 && fields[1] == "APPEND"
+	}
+
+	fields, err := r.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 4 {
+		t.Fatal("Expected 4 fields, but got", len(fields))
+	}
+	lit, ok := fields[3].(imap.Literal)
+	if !ok {
+		t.Fatal("Last field is not a literal:", fields[3])
+	}
+	if lit.Len() != 11 {
+		t.Error("Invalid literal length:", lit.Len())
+	}
+	if b.Len() != len("Hello World\r\na002 NOOP\r\n") {
+		t.Error("Literal has been read before being consumed")
+	}
+
+	// Partially read the literal, the rest is discarded by FinishLine
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(lit, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "Hello" {
+		t.Error("Literal has not the expected value:", string(buf))
+	}
+	if err := r.FinishLine(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fields, err := r.ReadLine(); err != nil {
+		t.Error(err)
+	} else if len(fields) != 2 || fields[1] != "NOOP" {
+		t.Error("Invalid fields after streamed literal:", fields)
+	}
+	if err := r.FinishLine(); err != nil {
+		t.Error("FinishLine failed without streamed literal:", err)
+	}
+
+	_, r = newReader("a001 APPEND INBOX {5}\r\nHello World\r\n")
+	r.StreamLiteral = func(fields []interface{}) bool {
+		return true
+	}
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.FinishLine(); err == nil {
+		t.Error("Line with data after streamed literal didn't fail")
+	}
+}
+
+func TestReader_ReadLine_spillLiteral(t *testing.T) {
+	_, r := newReader("a001 LOGIN {8}\r\nusername {8}\r\npassword\r\n")
+	r.MaxMemoryLiteralSize = 4
+
+	fields, err := r.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 4 {
+		t.Fatal("Expected 4 fields, but got", len(fields))
+	}
+	for i, want := range []string{"username", "password"} {
+		lit, ok := fields[i+2].(*imap.BufferedLiteral)
+		if !ok {
+			t.Fatalf("Field %v is not a buffered literal: %T", i+2, fields[i+2])
+		}
+		if s, err := imap.ParseString(lit); err != nil {
+			t.Error(err)
+		} else if s != want {
+			t.Errorf("Invalid literal: got %q, want %q", s, want)
+		}
+		if err := lit.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestReader_ReadRespCode(t *testing.T) {
 	b, r := newReader("[CAPABILITY NOOP STARTTLS]")
 	if code, fields, err := r.ReadRespCode(); err != nil {
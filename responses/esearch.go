@@ -0,0 +1,44 @@
+package responses
+
+import (
+	"github.com/emersion/go-imap"
+)
+
+const esearchName = "ESEARCH"
+
+// An ESEARCH response.
+// See RFC 4731 section 3.1 and RFC 5267
+type ESearch struct {
+	Data *imap.SearchData
+	// The requested result options. Only used when writing the response. If
+	// nil, only context updates are written.
+	Options *imap.SearchOptions
+}
+
+func (r *ESearch) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != esearchName {
+		return ErrUnhandled
+	}
+
+	data := new(imap.SearchData)
+	if err := data.Parse(fields); err != nil {
+		return err
+	}
+
+	// Context updates are unilateral responses for a previous command
+	if len(data.AddTo) > 0 || len(data.RemoveFrom) > 0 {
+		return ErrUnhandled
+	}
+
+	r.Data = data
+	return nil
+}
+
+func (r *ESearch) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(esearchName)}
+	fields = append(fields, r.Data.Format(r.Options)...)
+
+	resp := imap.NewUntaggedResp(fields)
+	return resp.WriteTo(w)
+}
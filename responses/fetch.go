@@ -4,32 +4,42 @@ import (
 	"github.com/emersion/go-imap"
 )
 
-const fetchName = "FETCH"
+const (
+	fetchName    = "FETCH"
+	uidFetchName = "UIDFETCH"
+)
 
 // A FETCH response.
 // See RFC 3501 section 7.4.2
 type Fetch struct {
 	Messages chan *imap.Message
+	// If true, UIDFETCH responses are written instead of FETCH responses and
+	// messages are identified by their UID. See RFC 9586 section 3.3.
+	Uid bool
 }
 
 func (r *Fetch) Handle(resp imap.Resp) error {
 	name, fields, ok := imap.ParseNamedResp(resp)
-	if !ok || name != fetchName {
+	if !ok || (name != fetchName && name != uidFetchName) {
 		return ErrUnhandled
 	} else if len(fields) < 1 {
 		return errNotEnoughFields
 	}
 
-	seqNum, err := imap.ParseNumber(fields[0])
+	id, err := imap.ParseNumber(fields[0])
 	if err != nil {
 		return err
 	}
 
 	msgFields, _ := fields[1].([]interface{})
-	msg := &imap.Message{SeqNum: seqNum}
+	msg := &imap.Message{SeqNum: id}
 	if err := msg.Parse(msgFields); err != nil {
 		return err
 	}
+	if name == uidFetchName {
+		msg.SeqNum = 0
+		msg.Uid = id
+	}
 
 	r.Messages <- msg
 	return nil
@@ -37,7 +47,20 @@ func (r *Fetch) Handle(resp imap.Resp) error {
 
 func (r *Fetch) WriteTo(w *imap.Writer) error {
 	for msg := range r.Messages {
-		resp := imap.NewUntaggedResp([]interface{}{msg.SeqNum, imap.RawString(fetchName), msg.Format()})
+		var resp *imap.DataResp
+		if r.Uid {
+			// The UID already identifies the message, don't send it twice
+			m := *msg
+			m.Items = make(map[imap.FetchItem]interface{}, len(msg.Items))
+			for k, v := range msg.Items {
+				if k != imap.FetchUid {
+					m.Items[k] = v
+				}
+			}
+			resp = imap.NewUntaggedResp([]interface{}{msg.Uid, imap.RawString(uidFetchName), m.Format()})
+		} else {
+			resp = imap.NewUntaggedResp([]interface{}{msg.SeqNum, imap.RawString(fetchName), msg.Format()})
+		}
 		if err := resp.WriteTo(w); err != nil {
 			return err
 		}
@@ -46,6 +46,9 @@ func (r *Select) Handle(resp imap.Resp) error {
 		case "UIDVALIDITY":
 			mbox.UidValidity, _ = imap.ParseNumber(resp.Arguments[0])
 			item = imap.StatusUidValidity
+		case "MAILBOXID":
+			mbox.MailboxId, _ = imap.ParseObjectId(resp.Arguments[0])
+			item = imap.StatusMailboxId
 		default:
 			return ErrUnhandled
 		}
@@ -135,6 +138,19 @@ func (r *Select) WriteTo(w *imap.Writer) error {
 			if err := statusRes.WriteTo(w); err != nil {
 				return err
 			}
+		case imap.StatusMailboxId:
+			if mbox.MailboxId == "" {
+				break
+			}
+			statusRes := &imap.StatusResp{
+				Type:      imap.StatusRespOk,
+				Code:      imap.CodeMailboxId,
+				Arguments: []interface{}{imap.FormatObjectId(mbox.MailboxId)},
+				Info:      "Mailbox ID",
+			}
+			if err := statusRes.WriteTo(w); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,37 @@
+package responses
+
+import (
+	"github.com/emersion/go-imap"
+)
+
+const vanishedName = "VANISHED"
+
+// A VANISHED response, sent instead of EXPUNGE responses when UIDONLY is
+// enabled.
+// See RFC 9586 section 3.4
+type Vanished struct {
+	Uids *imap.SeqSet
+}
+
+func (r *Vanished) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != vanishedName {
+		return ErrUnhandled
+	}
+
+	if len(fields) == 0 {
+		return errNotEnoughFields
+	}
+
+	s, err := imap.ParseString(fields[len(fields)-1])
+	if err != nil {
+		return err
+	}
+	r.Uids, err = imap.ParseSeqSet(s)
+	return err
+}
+
+func (r *Vanished) WriteTo(w *imap.Writer) error {
+	resp := imap.NewUntaggedResp([]interface{}{imap.RawString(vanishedName), r.Uids})
+	return resp.WriteTo(w)
+}
@@ -68,6 +68,13 @@ type SearchCriteria struct {
 	SentSince  time.Time // Date header field is since this date
 	SentBefore time.Time // Date header field is before this date
 
+	SavedSince  time.Time // Save date is since this date (RFC 8514)
+	SavedBefore time.Time // Save date is before this date (RFC 8514)
+
+	// Time and timezone are taken into account, precision is one second
+	Younger time.Duration // Internal date is within this interval (RFC 5032)
+	Older   time.Duration // Internal date is older than this interval (RFC 5032)
+
 	Header textproto.MIMEHeader // Each header field value is present
 	Body   []string             // Each string is in the body
 	Text   []string             // Each string is in the text (header + body)
@@ -78,6 +85,9 @@ type SearchCriteria struct {
 	Larger  uint32 // Size is larger than this number
 	Smaller uint32 // Size is smaller than this number
 
+	EmailId  string // Message object identifier is equal to this one (RFC 8474)
+	ThreadId string // Thread object identifier is equal to this one (RFC 8474)
+
 	Not []*SearchCriteria    // Each criteria doesn't match
 	Or  [][2]*SearchCriteria // Each criteria pair has at least one match of two
 }
@@ -133,6 +143,14 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		} else {
 			c.Body = append(c.Body, convertField(f, charsetReader))
 		}
+	case "EMAILID":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if id := maybeString(f); !IsValidObjectId(id) {
+			return nil, errors.New("imap: invalid EMAILID search key")
+		} else {
+			c.EmailId = id
+		}
 	case "HEADER":
 		var f1, f2 interface{}
 		if f1, fields, err = popSearchField(fields); err != nil {
@@ -170,6 +188,14 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		c.Not = append(c.Not, not)
 	case "OLD":
 		c.WithoutFlags = append(c.WithoutFlags, RecentFlag)
+	case "OLDER":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if n, err := ParseNumber(f); err != nil {
+			return nil, err
+		} else if d := time.Duration(n) * time.Second; c.Older == 0 || d > c.Older {
+			c.Older = d
+		}
 	case "ON":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -187,6 +213,31 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 			return nil, err
 		}
 		c.Or = append(c.Or, [2]*SearchCriteria{c1, c2})
+	case "SAVEDBEFORE":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else if c.SavedBefore.IsZero() || t.Before(c.SavedBefore) {
+			c.SavedBefore = t
+		}
+	case "SAVEDON":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else {
+			c.SavedSince = t
+			c.SavedBefore = t.Add(24 * time.Hour)
+		}
+	case "SAVEDSINCE":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else if c.SavedSince.IsZero() || t.After(c.SavedSince) {
+			c.SavedSince = t
+		}
 	case "SENTBEFORE":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -234,6 +285,14 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		} else {
 			c.Text = append(c.Text, convertField(f, charsetReader))
 		}
+	case "THREADID":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if id := maybeString(f); !IsValidObjectId(id) {
+			return nil, errors.New("imap: invalid THREADID search key")
+		} else {
+			c.ThreadId = id
+		}
 	case "UID":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -249,6 +308,14 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		} else {
 			c.WithoutFlags = append(c.WithoutFlags, CanonicalFlag(maybeString(f)))
 		}
+	case "YOUNGER":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if n, err := ParseNumber(f); err != nil {
+			return nil, err
+		} else if d := time.Duration(n) * time.Second; c.Younger == 0 || d < c.Younger {
+			c.Younger = d
+		}
 	default: // Try to parse a sequence set
 		if c.SeqNum, err = ParseSeqSet(key); err != nil {
 			return nil, err
@@ -302,6 +369,16 @@ func (c *SearchCriteria) Format() []interface{} {
 			fields = append(fields, RawString("SENTBEFORE"), searchDate(c.SentBefore))
 		}
 	}
+	if !c.SavedSince.IsZero() && !c.SavedBefore.IsZero() && c.SavedBefore.Sub(c.SavedSince) == 24*time.Hour {
+		fields = append(fields, RawString("SAVEDON"), searchDate(c.SavedSince))
+	} else {
+		if !c.SavedSince.IsZero() {
+			fields = append(fields, RawString("SAVEDSINCE"), searchDate(c.SavedSince))
+		}
+		if !c.SavedBefore.IsZero() {
+			fields = append(fields, RawString("SAVEDBEFORE"), searchDate(c.SavedBefore))
+		}
+	}
 
 	for key, values := range c.Header {
 		var prefields []interface{}
@@ -354,6 +431,20 @@ func (c *SearchCriteria) Format() []interface{} {
 		fields = append(fields, RawString("SMALLER"), c.Smaller)
 	}
 
+	if c.Older > 0 {
+		fields = append(fields, RawString("OLDER"), uint32(c.Older/time.Second))
+	}
+	if c.Younger > 0 {
+		fields = append(fields, RawString("YOUNGER"), uint32(c.Younger/time.Second))
+	}
+
+	if c.EmailId != "" {
+		fields = append(fields, RawString("EMAILID"), RawString(c.EmailId))
+	}
+	if c.ThreadId != "" {
+		fields = append(fields, RawString("THREADID"), RawString(c.ThreadId))
+	}
+
 	for _, not := range c.Not {
 		fields = append(fields, RawString("NOT"), not.Format())
 	}
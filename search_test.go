@@ -69,6 +69,31 @@ var searchCriteriaTests = []struct {
 		expected: "(ALL)",
 		criteria: &SearchCriteria{},
 	},
+	{
+		expected: "(EMAILID M6d99ac3275bb4e THREADID T64b478a75b7ea9)",
+		criteria: &SearchCriteria{
+			EmailId:  "M6d99ac3275bb4e",
+			ThreadId: "T64b478a75b7ea9",
+		},
+	},
+	{
+		expected: `(SAVEDSINCE "5-Nov-1984" SAVEDBEFORE "21-Nov-1997" NOT (SAVEDON "21-Nov-1997"))`,
+		criteria: &SearchCriteria{
+			SavedSince:  searchDate2,
+			SavedBefore: searchDate1,
+			Not: []*SearchCriteria{{
+				SavedSince:  searchDate1,
+				SavedBefore: searchDate1.Add(24 * time.Hour),
+			}},
+		},
+	},
+	{
+		expected: `(OLDER 86400 YOUNGER 3600)`,
+		criteria: &SearchCriteria{
+			Older:   24 * time.Hour,
+			Younger: time.Hour,
+		},
+	},
 }
 
 func TestSearchCriteria_Format(t *testing.T) {
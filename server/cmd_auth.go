@@ -2,6 +2,7 @@ package server
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -14,6 +15,44 @@ var (
 	ErrNotAuthenticated = errors.New("Not authenticated")
 )
 
+// uidOnlyCap is the UIDONLY capability, defined in RFC 9586.
+const uidOnlyCap = "UIDONLY"
+
+// enableableCaps contains the capabilities which can be enabled with ENABLE.
+var enableableCaps = map[string]bool{
+	uidOnlyCap: true,
+}
+
+type Enable struct {
+	commands.Enable
+}
+
+func (cmd *Enable) Handle(conn Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return ErrNotAuthenticated
+	}
+	if ctx.Mailbox != nil {
+		return errors.New("ENABLE must be issued before selecting a mailbox")
+	}
+
+	var enabled []string
+	for _, c := range cmd.Caps {
+		c = strings.ToUpper(c)
+		if !enableableCaps[c] || ctx.Enabled[c] {
+			continue
+		}
+
+		if ctx.Enabled == nil {
+			ctx.Enabled = make(map[string]bool)
+		}
+		ctx.Enabled[c] = true
+		enabled = append(enabled, c)
+	}
+
+	return conn.WriteResp(&responses.Enabled{Caps: enabled})
+}
+
 type Select struct {
 	commands.Select
 }
@@ -28,28 +67,49 @@ func (cmd *Select) Handle(conn Conn) error {
 	// 		fails is attempted, no mailbox is selected.
 	// For example, some clients (e.g. Apple Mail) perform SELECT "" when the
 	// server doesn't announce the UNSELECT capability.
-	ctx.Mailbox = nil
-	ctx.MailboxReadOnly = false
+	if err := unselectMailbox(conn); err != nil {
+		return err
+	}
 
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	// The mailbox is kept until it's unselected, so it isn't bound to the
+	// context of this command
+	selected, err := ctx.User.GetMailbox(cmd.Mailbox)
 	if err != nil {
 		return err
 	}
+	mbox := commandMailbox(conn, selected)
 
 	items := []imap.StatusItem{
 		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
 		imap.StatusUidNext, imap.StatusUidValidity,
 	}
+	if conn.Server().backendSupports(backend.ExtObjectID) {
+		items = append(items, imap.StatusMailboxId)
+	}
 
-	status, err := mbox.Status(items)
+	var status *imap.MailboxStatus
+	if sessionMbox, ok := mbox.(backend.SessionMailbox); ok {
+		status, err = sessionMbox.Select(cmd.ReadOnly, items)
+	} else {
+		status, err = mbox.Status(items)
+	}
 	if err != nil {
 		return err
 	}
 
-	ctx.Mailbox = mbox
+	view, err := newView(conn, mbox)
+	if err != nil {
+		return err
+	}
+	if view != nil {
+		// Messages may have been added or removed in the meantime
+		status.Messages = uint32(len(view.entries))
+	}
+
+	selectMailbox(conn, selected, view)
 	ctx.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
 
 	res := &responses.Select{Mailbox: status}
@@ -77,7 +137,32 @@ func (cmd *Create) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.CreateMailbox(cmd.Mailbox)
+	if err := commandUser(conn).CreateMailbox(cmd.Mailbox); err != nil {
+		return err
+	}
+
+	if !conn.Server().backendSupports(backend.ExtObjectID) {
+		return nil
+	}
+
+	// Send the identifier of the newly created mailbox, as required by RFC 8474
+	mbox, err := getMailbox(conn, cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMailboxId})
+	if err != nil {
+		return err
+	}
+	if status.MailboxId == "" {
+		return nil
+	}
+	return ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      imap.CodeMailboxId,
+		Arguments: []interface{}{imap.FormatObjectId(status.MailboxId)},
+		Info:      "CREATE completed",
+	})
 }
 
 type Delete struct {
@@ -90,7 +175,7 @@ func (cmd *Delete) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.DeleteMailbox(cmd.Mailbox)
+	return commandUser(conn).DeleteMailbox(cmd.Mailbox)
 }
 
 type Rename struct {
@@ -103,7 +188,7 @@ func (cmd *Rename) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.RenameMailbox(cmd.Existing, cmd.New)
+	return commandUser(conn).RenameMailbox(cmd.Existing, cmd.New)
 }
 
 type Subscribe struct {
@@ -116,7 +201,7 @@ func (cmd *Subscribe) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := getMailbox(conn, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
@@ -134,7 +219,7 @@ func (cmd *Unsubscribe) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := getMailbox(conn, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
@@ -146,6 +231,11 @@ type List struct {
 	commands.List
 }
 
+// Concurrent implements ConcurrentHandler.
+func (cmd *List) Concurrent(conn Conn) bool {
+	return true
+}
+
 func (cmd *List) Handle(conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
@@ -163,7 +253,7 @@ func (cmd *List) Handle(conn Conn) error {
 		}
 	})()
 
-	mailboxes, err := ctx.User.ListMailboxes(cmd.Subscribed)
+	mailboxes, err := commandUser(conn).ListMailboxes(cmd.Subscribed)
 	if err != nil {
 		// Close channel to signal end of results
 		close(ch)
@@ -204,13 +294,18 @@ type Status struct {
 	commands.Status
 }
 
+// Concurrent implements ConcurrentHandler.
+func (cmd *Status) Concurrent(conn Conn) bool {
+	return true
+}
+
 func (cmd *Status) Handle(conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := getMailbox(conn, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
@@ -241,7 +336,7 @@ func (cmd *Append) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := getMailbox(conn, cmd.Mailbox)
 	if err == backend.ErrNoSuchMailbox {
 		return ErrStatusResp(&imap.StatusResp{
 			Type: imap.StatusRespNo,
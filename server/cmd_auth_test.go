@@ -18,6 +18,97 @@ func testServerAuthenticated(t *testing.T) (s *server.Server, c net.Conn, scanne
 	return
 }
 
+func TestCapability_Authenticated(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+
+	scanner.Scan()
+	if line := scanner.Text(); !strings.HasPrefix(line, "* CAPABILITY ") || !strings.Contains(line+" ", " WITHIN ") || !strings.Contains(line+" ", " CONTEXT=SORT ") {
+		t.Fatal("Bad capability:", line)
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestEnable_UidOnly(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 ENABLE UIDONLY X-UNKNOWN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* ENABLED UIDONLY" {
+		t.Fatal("Invalid ENABLED response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "a003 FETCH 1 (FLAGS)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 BAD [UIDREQUIRED] ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a004 UID SEARCH 1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 BAD [UIDREQUIRED] ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a005 UID FETCH 6 (FLAGS)\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* 6 UIDFETCH (FLAGS (\\Seen))" {
+		t.Fatal("Invalid UIDFETCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a005 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a006 UID STORE 6 +FLAGS.SILENT (\\Deleted)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a006 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a007 EXPUNGE\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* VANISHED 6" {
+		t.Fatal("Invalid VANISHED response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a007 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestEnable_Selected(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 ENABLE UIDONLY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestSelect_Ok(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -33,6 +124,7 @@ func TestSelect_Ok(t *testing.T) {
 		"PERMANENTFLAGS": false,
 		"UIDNEXT":        false,
 		"UIDVALIDITY":    false,
+		"MAILBOXID":      false,
 	}
 
 	for scanner.Scan() {
@@ -50,6 +142,8 @@ func TestSelect_Ok(t *testing.T) {
 			got["UIDNEXT"] = true
 		} else if strings.HasPrefix(res, "* OK [UIDVALIDITY 1]") {
 			got["UIDVALIDITY"] = true
+		} else if strings.HasPrefix(res, "* OK [MAILBOXID (F") {
+			got["MAILBOXID"] = true
 		} else if strings.HasPrefix(res, "a001 OK [READ-WRITE] ") {
 			got["OK"] = true
 			break
@@ -121,7 +215,7 @@ func TestCreate(t *testing.T) {
 	io.WriteString(c, "a001 CREATE test\r\n")
 	scanner.Scan()
 
-	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+	if !strings.HasPrefix(scanner.Text(), "a001 OK [MAILBOXID (F") {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 }
@@ -464,6 +558,42 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+func TestStatus_MailboxId(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 STATUS INBOX (MAILBOXID)\r\n")
+
+	scanner.Scan()
+	if line := scanner.Text(); !strings.HasPrefix(line, "* STATUS INBOX (MAILBOXID (F") {
+		t.Fatal("Invalid STATUS response:", line)
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestStatus_Size(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 STATUS INBOX (SIZE)\r\n")
+
+	scanner.Scan()
+	if line := scanner.Text(); line != "* STATUS INBOX (SIZE 205)" {
+		t.Fatal("Invalid STATUS response:", line)
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestStatus_InvalidMailbox(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -572,6 +702,19 @@ func TestAppend_Selected(t *testing.T) {
 	}
 }
 
+func TestAppend_literalMailbox(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 APPEND {5+}\r\nINBOX {11+}\r\nHello World\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestAppend_InvalidMailbox(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -591,6 +734,26 @@ func TestAppend_InvalidMailbox(t *testing.T) {
 	}
 }
 
+func TestAppend_literalNotConsumed(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	// The message isn't read by the backend, the connection must skip it
+	io.WriteString(c, "a001 APPEND idontexist {11+}\r\n")
+	io.WriteString(c, "a002 NOOP\r\n\r\n")
+	io.WriteString(c, "a003 NOOP\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestAppend_NotAuthenticated(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer s.Close()
@@ -44,9 +44,10 @@ func (cmd *StartTLS) Upgrade(conn Conn) error {
 	tlsConfig := conn.Server().TLSConfig
 
 	var tlsConn *tls.Conn
+	served := new(servedCert)
 	err := conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
 		conn.WaitReady()
-		tlsConn = tls.Server(sock, tlsConfig)
+		tlsConn = tls.Server(sock, served.wrap(tlsConfig))
 		err := tlsConn.Handshake()
 		return tlsConn, err
 	})
@@ -54,7 +55,7 @@ func (cmd *StartTLS) Upgrade(conn Conn) error {
 		return err
 	}
 
-	conn.setTLSConn(tlsConn)
+	conn.setTLSConn(tlsConn, served)
 
 	return nil
 }
@@ -95,13 +96,21 @@ func (cmd *Login) Handle(conn Conn) error {
 		return ErrAuthDisabled
 	}
 
-	user, err := conn.Server().Backend.Login(conn.Info(), cmd.Username, cmd.Password)
-	if err != nil {
+	s := conn.Server()
+	if err := s.checkAuth(conn); err != nil {
 		return err
 	}
 
+	user, err := s.login(conn, "", cmd.Username, cmd.Password)
+	if err != nil {
+		return s.authFailed(conn, "LOGIN", cmd.Username, err)
+	}
+
 	ctx.State = imap.AuthenticatedState
 	ctx.User = user
+	if err := s.authSucceeded(conn, "LOGIN"); err != nil {
+		return err
+	}
 	return afterAuthStatus(conn)
 }
 
@@ -118,15 +127,27 @@ func (cmd *Authenticate) Handle(conn Conn) error {
 		return ErrAuthDisabled
 	}
 
+	s := conn.Server()
+	if err := s.checkAuth(conn); err != nil {
+		return err
+	}
+
 	mechanisms := map[string]sasl.Server{}
-	for name, newSasl := range conn.Server().auths {
+	for name, newSasl := range s.auths {
 		mechanisms[name] = newSasl(conn)
 	}
 
 	err := cmd.Authenticate.Handle(mechanisms, conn)
 	if err != nil {
-		return err
+		mech := cmd.Mechanism
+		if _, ok := mechanisms[mech]; !ok {
+			mech = ""
+		}
+		return s.authFailed(conn, mech, "", err)
 	}
 
+	if err := s.authSucceeded(conn, cmd.Mechanism); err != nil {
+		return err
+	}
 	return afterAuthStatus(conn)
 }
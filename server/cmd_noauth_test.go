@@ -2,14 +2,31 @@ package server_test
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
 	"io"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-imap/internal"
 	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func testServerTLS(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
@@ -223,3 +240,504 @@ func TestAuthenticate_No(t *testing.T) {
 		t.Fatal("Bad status response:", scanner.Text())
 	}
 }
+
+type oauthBackend struct {
+	backend.Backend
+}
+
+func (be *oauthBackend) LoginOAuth(connInfo *imap.ConnInfo, username, token string) (backend.User, error) {
+	if username != "username" || token != "token" {
+		return nil, errors.New("Invalid token")
+	}
+	return be.Login(connInfo, "username", "password")
+}
+
+func testServerOAuth(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	s, c, scanner = testServerGreeted(t)
+	s.Backend = &oauthBackend{memory.New()}
+	s.EnableAuth(sasl.OAuthBearer, server.NewOAuthBearerServer)
+	s.EnableAuth(sasl.Xoauth2, server.NewXoauth2Server)
+	return
+}
+
+var authenticateOAuthTests = []struct {
+	mech     string
+	ir       string
+	ok       bool
+	errResp  string
+	errReply string
+}{
+	{
+		mech: "OAUTHBEARER",
+		ir:   "n,a=username,\x01host=localhost\x01port=143\x01auth=Bearer token\x01\x01",
+		ok:   true,
+	},
+	{
+		mech:     "OAUTHBEARER",
+		ir:       "n,a=username,\x01auth=Bearer expired\x01\x01",
+		errResp:  `{"status":"invalid_token","schemes":"bearer"}`,
+		errReply: "\x01",
+	},
+	{
+		mech: "XOAUTH2",
+		ir:   "user=username\x01auth=Bearer token\x01\x01",
+		ok:   true,
+	},
+	{
+		mech:     "XOAUTH2",
+		ir:       "user=username\x01auth=Bearer expired\x01\x01",
+		errResp:  `{"status":"401","schemes":"bearer"}`,
+		errReply: "",
+	},
+}
+
+func TestAuthenticate_OAuth(t *testing.T) {
+	for _, test := range authenticateOAuthTests {
+		s, c, scanner := testServerOAuth(t)
+
+		ir := base64.StdEncoding.EncodeToString([]byte(test.ir))
+		io.WriteString(c, "a001 AUTHENTICATE "+test.mech+" "+ir+"\r\n")
+
+		if !test.ok {
+			scanner.Scan()
+			want := "+ " + base64.StdEncoding.EncodeToString([]byte(test.errResp))
+			if scanner.Text() != want {
+				t.Errorf("%v: bad error challenge: got %q, want %q", test.mech, scanner.Text(), want)
+			}
+			io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(test.errReply))+"\r\n")
+		}
+
+		scanner.Scan()
+		if test.ok && !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+			t.Errorf("%v: bad status response: %v", test.mech, scanner.Text())
+		} else if !test.ok && !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+			t.Errorf("%v: bad status response: %v", test.mech, scanner.Text())
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestAuthenticate_OAuthBearer_NoInitialResponse(t *testing.T) {
+	s, c, scanner := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 AUTHENTICATE OAUTHBEARER\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "+" {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	ir := "n,a=username,\x01auth=Bearer token\x01\x01"
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(ir))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_SCRAMSHA256(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.EnableAuth(server.SCRAMSHA256, server.NewSCRAMSHA256Server)
+
+	readChallenge := func() string {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "+ ") {
+			t.Fatal("Bad continuation request:", scanner.Text())
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+		if err != nil {
+			t.Fatal("Invalid challenge:", err)
+		}
+		return string(b)
+	}
+
+	clientFirstBare := "n=username,r=clientnonce"
+	ir := base64.StdEncoding.EncodeToString([]byte("n,," + clientFirstBare))
+	io.WriteString(c, "a001 AUTHENTICATE SCRAM-SHA-256 "+ir+"\r\n")
+
+	serverFirst := readChallenge()
+	attrs := internal.SCRAMAttrs(serverFirst)
+	if !strings.HasPrefix(attrs['r'], "clientnonce") {
+		t.Fatal("Invalid server nonce:", attrs['r'])
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs['s'])
+	iterations, _ := strconv.Atoi(attrs['i'])
+
+	clientFinalWithoutProof := "c=biws,r=" + attrs['r']
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientKey, storedKey, serverKey := internal.SCRAMKeys(internal.SCRAMSaltedPassword("password", salt, iterations))
+	proof := internal.SCRAMHMAC(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(clientFinal))+"\r\n")
+
+	serverFinal := readChallenge()
+	expected := "v=" + base64.StdEncoding.EncodeToString(internal.SCRAMHMAC(serverKey, authMessage))
+	if serverFinal != expected {
+		t.Fatalf("Invalid server-final-message: got %q, want %q", serverFinal, expected)
+	}
+	io.WriteString(c, "\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_SCRAMSHA256_InvalidProof(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.EnableAuth(server.SCRAMSHA256, server.NewSCRAMSHA256Server)
+
+	ir := base64.StdEncoding.EncodeToString([]byte("n,,n=username,r=clientnonce"))
+	io.WriteString(c, "a001 AUTHENTICATE SCRAM-SHA-256 "+ir+"\r\n")
+
+	scanner.Scan()
+	serverFirst, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+	nonce := internal.SCRAMAttrs(string(serverFirst))['r']
+
+	proof := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	clientFinal := "c=biws,r=" + nonce + ",p=" + proof
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(clientFinal))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_SCRAMSHA256_UnknownUser(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.EnableAuth(server.SCRAMSHA256, server.NewSCRAMSHA256Server)
+
+	// The server must behave as for an existing user until the
+	// client-final-message, and announce the same salt on every attempt
+	var salts []string
+	for _, tag := range []string{"a001", "a002"} {
+		ir := base64.StdEncoding.EncodeToString([]byte("n,,n=unknown,r=clientnonce"))
+		io.WriteString(c, tag+" AUTHENTICATE SCRAM-SHA-256 "+ir+"\r\n")
+
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "+ ") {
+			t.Fatal("Bad continuation request:", scanner.Text())
+		}
+		serverFirst, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+		attrs := internal.SCRAMAttrs(string(serverFirst))
+		if attrs['s'] == "" || attrs['i'] != "4096" {
+			t.Fatalf("Invalid server-first-message: %q", serverFirst)
+		}
+		salts = append(salts, attrs['s'])
+
+		proof := base64.StdEncoding.EncodeToString(make([]byte, 32))
+		clientFinal := "c=biws,r=" + attrs['r'] + ",p=" + proof
+		io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(clientFinal))+"\r\n")
+
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tag+" NO ") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+
+	if salts[0] != salts[1] {
+		t.Errorf("Salt changed between attempts: %q != %q", salts[0], salts[1])
+	}
+}
+
+// scramExporterClient starts a SCRAM-SHA-256-PLUS exchange with the
+// tls-exporter channel binding type, whatever the TLS version.
+type scramExporterClient struct{}
+
+func (scramExporterClient) Start() (string, []byte, error) {
+	return server.SCRAMSHA256Plus, []byte("p=tls-exporter,,n=username,r=clientnonce"), nil
+}
+
+func (scramExporterClient) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected challenge")
+}
+
+func TestAuthenticate_SCRAMSHA256Plus(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := server.New(memory.New())
+		s.TLSConfig = &tls.Config{
+			// The certificate presented must be recorded for the
+			// tls-server-end-point channel binding type
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+			MaxVersion: version,
+		}
+		s.EnableAuth(server.SCRAMSHA256Plus, server.NewSCRAMSHA256PlusServer)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Cannot listen:", err)
+		}
+		go s.ServeTLS(l)
+
+		c, err := client.DialTLS(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+
+		if ok, err := c.SupportAuth(server.SCRAMSHA256Plus); err != nil || !ok {
+			t.Errorf("TLS %x: server doesn't advertise %v", version, server.SCRAMSHA256Plus)
+		}
+
+		// RFC 9266 section 3: tls-exporter requires TLS 1.3, unless the
+		// extended master secret extension is used
+		err = c.Authenticate(scramExporterClient{})
+		if version == tls.VersionTLS12 && err == nil {
+			t.Errorf("TLS %x: tls-exporter channel binding accepted", version)
+		}
+
+		auth := client.NewSCRAMSHA256PlusClient("username", "password", c.TLSState())
+		if err := c.Authenticate(auth); err != nil {
+			t.Errorf("TLS %x: c.Authenticate() = %v", version, err)
+		}
+
+		c.Logout()
+		s.Close()
+	}
+}
+
+func TestAuthenticate_SCRAMSHA256Plus_UnknownCertificate(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(memory.New())
+	defer s.Close()
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+	}
+	s.EnableAuth(server.SCRAMSHA256Plus, server.NewSCRAMSHA256PlusServer)
+
+	// The server doesn't perform the TLS handshakes, so it can't know which
+	// certificate is presented
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig)
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+
+	c, err := client.DialTLS(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Logout()
+
+	if ok, err := c.SupportAuth(server.SCRAMSHA256Plus); err != nil || ok {
+		t.Errorf("Server advertises %v without channel binding", server.SCRAMSHA256Plus)
+	}
+
+	auth := client.NewSCRAMSHA256PlusClient("username", "password", c.TLSState())
+	if err := c.Authenticate(auth); err == nil {
+		t.Error("tls-server-end-point channel binding accepted")
+	}
+}
+
+type externalBackend struct {
+	backend.Backend
+}
+
+func (be *externalBackend) LoginExternal(connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	cert := connInfo.TLS.PeerCertificates[0]
+	if cert.Subject.CommonName != "username" || (identity != "" && identity != "username") {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.Login(connInfo, "username", "password")
+}
+
+func testClientCert(t *testing.T, commonName string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestAuthenticate_External(t *testing.T) {
+	serverCert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, leaf := testClientCert(t, "username")
+	otherCert, _ := testClientCert(t, "someone-else")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	s := server.New(&externalBackend{memory.New()})
+	defer s.Close()
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	}
+	s.EnableAuth(sasl.External, server.NewExternalServer)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig)
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+
+	dial := func(certs ...tls.Certificate) *client.Client {
+		c, err := client.DialTLS(l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		})
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		return c
+	}
+
+	c := dial(clientCert)
+	if err := c.AuthenticateExternal(""); err != nil {
+		t.Errorf("c.AuthenticateExternal() = %v", err)
+	}
+	c.Logout()
+
+	c = dial(clientCert)
+	if err := c.AuthenticateExternal("someone-else"); err == nil {
+		t.Error("Expected an error for an unauthorized identity")
+	}
+	c.Logout()
+
+	// Not signed by a trusted CA
+	if c, err := client.DialTLS(l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{otherCert},
+	}); err == nil {
+		if err := c.AuthenticateExternal(""); err == nil {
+			t.Error("Expected an error for an untrusted certificate")
+		}
+		c.Logout()
+	}
+
+	// No certificate at all, EXTERNAL isn't advertised
+	c = dial()
+	if err := c.AuthenticateExternal(""); err != client.ErrExternalNotSupported {
+		t.Errorf("c.AuthenticateExternal() = %v, want ErrExternalNotSupported", err)
+	}
+	c.Logout()
+}
+
+func testServerAuthenticator(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	s, c, scanner = testServerGreeted(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("admin-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := backendutil.ReadHtpasswd(strings.NewReader("admin:" + string(hash) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.MasterUsers = map[string]bool{"admin": true}
+	s.Authenticator = auth
+	return
+}
+
+func TestLogin_Authenticator(t *testing.T) {
+	s, c, scanner := testServerAuthenticator(t)
+	defer s.Close()
+	defer c.Close()
+
+	// The backend's own credentials aren't used anymore
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// The user doesn't exist in the backend
+	io.WriteString(c, "a002 LOGIN admin admin-password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_Plain_Impersonation(t *testing.T) {
+	s, c, scanner := testServerAuthenticator(t)
+	defer s.Close()
+	defer c.Close()
+
+	ir := base64.StdEncoding.EncodeToString([]byte("username\x00admin\x00admin-password"))
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN "+ir+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// The mailboxes of the impersonated user are available
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_Plain_IdentitiesNotSupported(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	ir := base64.StdEncoding.EncodeToString([]byte("someone\x00username\x00password"))
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN "+ir+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
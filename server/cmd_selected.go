@@ -2,8 +2,11 @@ package server
 
 import (
 	"errors"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/responses"
 )
@@ -14,6 +17,80 @@ var (
 	ErrMailboxReadOnly   = errors.New("Mailbox opened in read-only mode")
 )
 
+// uidRequiredResp returns the response sent when a client which has enabled
+// UIDONLY uses message sequence numbers.
+func uidRequiredResp() *imap.StatusResp {
+	return &imap.StatusResp{
+		Type: imap.StatusRespBad,
+		Code: imap.CodeUidRequired,
+		Info: "Message sequence numbers are not allowed with UIDONLY",
+	}
+}
+
+// uidOnlyMailbox returns mbox if the client has enabled UIDONLY and the
+// backend supports it.
+func uidOnlyMailbox(ctx *Context, mbox backend.Mailbox) (backend.UidOnlyMailbox, bool) {
+	if !ctx.Enabled[uidOnlyCap] {
+		return nil, false
+	}
+	uidMbox, ok := mbox.(backend.UidOnlyMailbox)
+	return uidMbox, ok
+}
+
+// progressMailbox returns the selected mailbox. If the backend supports it,
+// the progress of long-running operations is sent to the client in INPROGRESS
+// responses, as defined in RFC 9585.
+func progressMailbox(conn Conn) backend.Mailbox {
+	ctx := conn.Context()
+	selected := commandMailbox(conn, ctx.Mailbox)
+	mbox, ok := selected.(backend.ProgressMailbox)
+	if !ok {
+		return selected
+	}
+
+	interval := conn.Server().ProgressInterval
+	if interval == 0 {
+		interval = DefaultProgressInterval
+	}
+
+	tag := commandTag(conn)
+	last := time.Now()
+	return mbox.WithProgress(func(count, total uint32) {
+		now := time.Now()
+		if now.Sub(last) < interval {
+			return
+		}
+		last = now
+
+		p := &imap.InProgress{Tag: tag, Count: count, Total: total}
+		conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      imap.CodeInProgress,
+			Arguments: p.Format(),
+			Info:      "Command in progress",
+		})
+	})
+}
+
+// hasSeqNumCriteria checks whether search criteria contain message sequence
+// numbers.
+func hasSeqNumCriteria(c *imap.SearchCriteria) bool {
+	if c.SeqNum != nil {
+		return true
+	}
+	for _, not := range c.Not {
+		if hasSeqNumCriteria(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if hasSeqNumCriteria(or[0]) || hasSeqNumCriteria(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
 // A command handler that supports UIDs.
 type UidHandler interface {
 	Handler
@@ -35,7 +112,7 @@ func (cmd *Check) Handle(conn Conn) error {
 		return ErrMailboxReadOnly
 	}
 
-	return ctx.Mailbox.Check()
+	return commandMailbox(conn, ctx.Mailbox).Check()
 }
 
 type Close struct {
@@ -48,14 +125,26 @@ func (cmd *Close) Handle(conn Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	mailbox := ctx.Mailbox
-	ctx.Mailbox = nil
-	ctx.MailboxReadOnly = false
+	mailbox := commandMailbox(conn, ctx.Mailbox)
+	if err := unselectMailbox(conn); err != nil {
+		return err
+	}
 
 	// No need to send expunge updates here, since the mailbox is already unselected
 	return mailbox.Expunge()
 }
 
+type Unselect struct {
+	commands.Unselect
+}
+
+func (cmd *Unselect) Handle(conn Conn) error {
+	if conn.Context().Mailbox == nil {
+		return ErrNoMailboxSelected
+	}
+	return unselectMailbox(conn)
+}
+
 type Expunge struct {
 	commands.Expunge
 }
@@ -71,23 +160,40 @@ func (cmd *Expunge) Handle(conn Conn) error {
 
 	// Get a list of messages that will be deleted
 	// That will allow us to send expunge updates if the backend doesn't support it
-	var seqnums []uint32
+	uidOnly := ctx.Enabled[uidOnlyCap]
+	var ids []uint32
 	if conn.Server().Updates == nil {
 		criteria := &imap.SearchCriteria{
 			WithFlags: []string{imap.DeletedFlag},
 		}
 
 		var err error
-		seqnums, err = ctx.Mailbox.SearchMessages(false, criteria)
+		mbox := commandMailbox(conn, ctx.Mailbox)
+		if uidMbox, ok := uidOnlyMailbox(ctx, mbox); ok {
+			ids, err = uidMbox.UidSearchMessages(criteria)
+		} else {
+			ids, err = mbox.SearchMessages(uidOnly, criteria)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	if err := ctx.Mailbox.Expunge(); err != nil {
+	if err := progressMailbox(conn).Expunge(); err != nil {
 		return err
 	}
 
+	// Clients which have enabled UIDONLY get a VANISHED response instead
+	if conn.Server().Updates == nil && uidOnly {
+		if len(ids) == 0 {
+			return nil
+		}
+
+		uids := new(imap.SeqSet)
+		uids.AddNum(ids...)
+		return conn.WriteResp(&responses.Vanished{Uids: uids})
+	}
+
 	// If the backend doesn't support expunge updates, let's do it ourselves
 	if conn.Server().Updates == nil {
 		done := make(chan error, 1)
@@ -102,10 +208,10 @@ func (cmd *Expunge) Handle(conn Conn) error {
 
 		// Iterate sequence numbers from the last one to the first one, as deleting
 		// messages changes their respective numbers
-		for i := len(seqnums) - 1; i >= 0; i-- {
+		for i := len(ids) - 1; i >= 0; i-- {
 			// Send sequence numbers to channel, and check if conn.WriteResp() finished early.
 			select {
-			case ch <- seqnums[i]: // Send next seq. number
+			case ch <- ids[i]: // Send next seq. number
 			case err := <-done: // Check for errors
 				close(ch)
 				return err
@@ -130,14 +236,42 @@ func (cmd *Search) handle(uid bool, conn Conn) error {
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
 	}
+	if cmd.Options != nil && cmd.Options.ReturnUpdate {
+		end, err := beginSearchContext(conn)
+		if err != nil {
+			return err
+		}
+		defer end()
+	}
 
-	ids, err := ctx.Mailbox.SearchMessages(uid, cmd.Criteria)
+	mbox := progressMailbox(conn)
+
+	var ids []uint32
+	var err error
+	if uidMbox, ok := uidOnlyMailbox(ctx, mbox); ok {
+		ids, err = uidMbox.UidSearchMessages(cmd.Criteria)
+	} else {
+		ids, err = mbox.SearchMessages(uid, cmd.Criteria)
+	}
 	if err != nil {
 		return err
 	}
 
-	res := &responses.Search{Ids: ids}
-	return conn.WriteResp(res)
+	if cmd.Options == nil {
+		res := &responses.Search{Ids: ids}
+		return conn.WriteResp(res)
+	}
+
+	criteria := cmd.Criteria
+	return writeSearchResults(conn, uid, false, ids, cmd.Options, func(mbox backend.Mailbox, uids *imap.SeqSet) ([]uint32, error) {
+		return mbox.SearchMessages(true, restrictCriteria(criteria, uids))
+	})
+}
+
+// Concurrent implements ConcurrentHandler. Search contexts can't be created
+// concurrently.
+func (cmd *Search) Concurrent(conn Conn) bool {
+	return cmd.Options == nil || !cmd.Options.ReturnUpdate
 }
 
 func (cmd *Search) Handle(conn Conn) error {
@@ -145,9 +279,122 @@ func (cmd *Search) Handle(conn Conn) error {
 }
 
 func (cmd *Search) UidHandle(conn Conn) error {
+	if conn.Context().Enabled[uidOnlyCap] && hasSeqNumCriteria(cmd.Criteria) {
+		return ErrStatusResp(uidRequiredResp())
+	}
+	return cmd.handle(true, conn)
+}
+
+type Sort struct {
+	commands.Sort
+}
+
+func (cmd *Sort) handle(uid bool, conn Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return ErrNoMailboxSelected
+	}
+
+	mbox, ok := commandMailbox(conn, ctx.Mailbox).(backend.SortMailbox)
+	if !ok || !conn.Server().backendSupports(backend.ExtSort) {
+		return errors.New("SORT not supported")
+	}
+	if cmd.Options != nil && cmd.Options.ReturnUpdate {
+		end, err := beginSearchContext(conn)
+		if err != nil {
+			return err
+		}
+		defer end()
+	}
+
+	ids, err := mbox.SortMessages(uid, cmd.SortCriteria, cmd.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Options == nil {
+		res := &responses.Sort{Ids: ids}
+		return conn.WriteResp(res)
+	}
+
+	sortCriteria, searchCriteria := cmd.SortCriteria, cmd.SearchCriteria
+	return writeSearchResults(conn, uid, true, ids, cmd.Options, func(mbox backend.Mailbox, uids *imap.SeqSet) ([]uint32, error) {
+		return mbox.(backend.SortMailbox).SortMessages(true, sortCriteria, restrictCriteria(searchCriteria, uids))
+	})
+}
+
+// Concurrent implements ConcurrentHandler. Search contexts can't be created
+// concurrently.
+func (cmd *Sort) Concurrent(conn Conn) bool {
+	return cmd.Options == nil || !cmd.Options.ReturnUpdate
+}
+
+func (cmd *Sort) Handle(conn Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *Sort) UidHandle(conn Conn) error {
+	if conn.Context().Enabled[uidOnlyCap] && hasSeqNumCriteria(cmd.SearchCriteria) {
+		return ErrStatusResp(uidRequiredResp())
+	}
 	return cmd.handle(true, conn)
 }
 
+// writeSearchResults writes an ESEARCH response for the results of a SEARCH or
+// SORT command. If the client requested updates, a search context is created.
+func writeSearchResults(conn Conn, uid, sorted bool, ids []uint32, opts *imap.SearchOptions, search func(mbox backend.Mailbox, uids *imap.SeqSet) ([]uint32, error)) error {
+	ctx := conn.Context()
+
+	data := backendutil.NewSearchData(ids, opts)
+	data.Tag = commandTag(conn)
+	data.Uid = uid
+	res := &responses.ESearch{Data: data, Options: opts}
+	if err := conn.WriteResp(res); err != nil {
+		return err
+	}
+
+	if !opts.ReturnUpdate {
+		return nil
+	}
+
+	// Search contexts keep track of UIDs, since sequence numbers change
+	uids := ids
+	if !uid {
+		var err error
+		if uids, err = search(commandMailbox(conn, ctx.Mailbox), nil); err != nil {
+			return err
+		}
+	}
+
+	ctx.searches.add(&searchUpdate{
+		tag:     commandTag(conn),
+		uid:     uid,
+		sorted:  sorted,
+		search:  search,
+		results: backendutil.NewSearchContext(uids, sorted),
+	})
+	return nil
+}
+
+type CancelUpdate struct {
+	commands.CancelUpdate
+}
+
+func (cmd *CancelUpdate) Handle(conn Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return ErrNoMailboxSelected
+	}
+
+	for _, tag := range cmd.Tags {
+		if !ctx.searches.cancel(tag) {
+			return errors.New("No search context for tag " + tag)
+		}
+	}
+
+	return nil
+}
+
 type Fetch struct {
 	commands.Fetch
 }
@@ -159,7 +406,7 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 	}
 
 	ch := make(chan *imap.Message)
-	res := &responses.Fetch{Messages: ch}
+	res := &responses.Fetch{Messages: ch, Uid: ctx.Enabled[uidOnlyCap]}
 
 	done := make(chan error, 1)
 	go (func() {
@@ -169,7 +416,13 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 		}
 	})()
 
-	err := ctx.Mailbox.ListMessages(uid, cmd.SeqSet, cmd.Items, ch)
+	var err error
+	mbox := commandMailbox(conn, ctx.Mailbox)
+	if uidMbox, ok := uidOnlyMailbox(ctx, mbox); ok {
+		err = uidMbox.UidListMessages(cmd.SeqSet, cmd.Items, ch)
+	} else {
+		err = mbox.ListMessages(uid, cmd.SeqSet, cmd.Items, ch)
+	}
 	if err != nil {
 		return err
 	}
@@ -177,6 +430,13 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 	return <-done
 }
 
+// Concurrent implements ConcurrentHandler. Fetching a body section without
+// BODY.PEEK sets the \Seen flag, which can affect the results of other
+// commands.
+func (cmd *Fetch) Concurrent(conn Conn) bool {
+	return conn.Context().MailboxReadOnly || !backendutil.SetsSeen(cmd.Items)
+}
+
 func (cmd *Fetch) Handle(conn Conn) error {
 	return cmd.handle(false, conn)
 }
@@ -241,7 +501,12 @@ func (cmd *Store) handle(uid bool, conn Conn) error {
 	// from receiving them
 	// TODO: find a better way to do this, without conn.silent
 	*conn.silent() = silent
-	err = ctx.Mailbox.UpdateMessagesFlags(uid, cmd.SeqSet, op, flags)
+	mbox := commandMailbox(conn, ctx.Mailbox)
+	if uidMbox, ok := uidOnlyMailbox(ctx, mbox); ok {
+		err = uidMbox.UidUpdateMessagesFlags(cmd.SeqSet, op, flags)
+	} else {
+		err = mbox.UpdateMessagesFlags(uid, cmd.SeqSet, op, flags)
+	}
 	*conn.silent() = false
 	if err != nil {
 		return err
@@ -283,7 +548,11 @@ func (cmd *Copy) handle(uid bool, conn Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	return ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	mbox := progressMailbox(conn)
+	if uidMbox, ok := uidOnlyMailbox(ctx, mbox); ok {
+		return uidMbox.UidCopyMessages(cmd.SeqSet, cmd.Mailbox)
+	}
+	return mbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
 }
 
 func (cmd *Copy) Handle(conn Conn) error {
@@ -298,6 +567,19 @@ type Uid struct {
 	commands.Uid
 }
 
+// Concurrent implements ConcurrentHandler.
+func (cmd *Uid) Concurrent(conn Conn) bool {
+	hdlr, err := conn.commandHandler(cmd.Cmd.Command())
+	if err != nil {
+		return false
+	}
+	if _, ok := hdlr.(UidHandler); !ok {
+		return false
+	}
+	concurrent, ok := hdlr.(ConcurrentHandler)
+	return ok && concurrent.Concurrent(conn)
+}
+
 func (cmd *Uid) Handle(conn Conn) error {
 	inner := cmd.Cmd.Command()
 	hdlr, err := conn.commandHandler(inner)
@@ -6,6 +6,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-imap/server"
 )
@@ -105,6 +106,56 @@ func TestClose_NotSelected(t *testing.T) {
 	}
 }
 
+func TestClose_recent(t *testing.T) {
+	for _, cmd := range []string{"CLOSE", "UNSELECT"} {
+		s, c, scanner, addr := testServerConfig(t, func(s *server.Server) {})
+
+		io.WriteString(c, "a001 LOGIN username password\r\n")
+		io.WriteString(c, "a002 SELECT INBOX\r\n")
+		io.WriteString(c, "a003 "+cmd+"\r\n")
+		io.WriteString(c, "a004 APPEND INBOX {11+}\r\nHello World\r\n")
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "a004 ") {
+				break
+			}
+		}
+
+		// The message isn't recent for the session which has closed INBOX
+		c2, scanner2, _ := dialGreeted(t, addr)
+		io.WriteString(c2, "b001 LOGIN username password\r\n")
+		io.WriteString(c2, "b002 SELECT INBOX\r\n")
+		var recent string
+		for scanner2.Scan() {
+			if strings.HasSuffix(scanner2.Text(), " RECENT") {
+				recent = scanner2.Text()
+			}
+			if strings.HasPrefix(scanner2.Text(), "b002 ") {
+				break
+			}
+		}
+		if recent != "* 1 RECENT" {
+			t.Errorf("Invalid RECENT response after %v: %q", cmd, recent)
+		}
+
+		c2.Close()
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestUnselect_NotSelected(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 UNSELECT\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestExpunge(t *testing.T) {
 	s, c, scanner := testServerSelected(t, false)
 	defer s.Close()
@@ -247,6 +298,246 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestFetch_ObjectId(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 FETCH 1 (EMAILID THREADID)\r\n")
+	scanner.Scan()
+	res := scanner.Text()
+	if !strings.HasPrefix(res, "* 1 FETCH (EMAILID (M") || !strings.Contains(res, " THREADID (T") {
+		t.Fatal("Invalid FETCH response:", res)
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestFetch_SaveDatePreview(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 FETCH 1 (SAVEDATE PREVIEW (LAZY))\r\n")
+	scanner.Scan()
+	res := scanner.Text()
+	if !strings.HasPrefix(res, "* 1 FETCH (SAVEDATE \"") || !strings.HasSuffix(res, " PREVIEW \"Hi there :)\")") {
+		t.Fatal("Invalid FETCH response:", res)
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_SaveDate(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SEARCH SAVEDBEFORE 1-Jan-2000\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 SEARCH SAVEDSINCE 1-Jan-2000\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_Within(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SEARCH YOUNGER 3600\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 SEARCH OLDER 3600\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_Return(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SEARCH RETURN (MIN COUNT PARTIAL 1:10) ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") MIN 1 COUNT 1 PARTIAL (1:10 1)` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 UID SEARCH RETURN () ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a002") UID ALL 6` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_ReturnUpdate(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SEARCH RETURN (COUNT UPDATE) UNSEEN\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") COUNT 0` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 APPEND INBOX {26}\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Invalid continuation request:", scanner.Text())
+	}
+	io.WriteString(c, "Subject: Hi\r\n\r\nHello World\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* 2 EXISTS" {
+		t.Fatal("Invalid untagged response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") ADDTO (0 2)` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 CANCELUPDATE \"a001\"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a004 CANCELUPDATE \"a001\"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 NO ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_ReturnUpdate_store(t *testing.T) {
+	s, c, scanner := testServerSelected(t, false)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 UID SEARCH RETURN (UPDATE) FLAGGED\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") UID` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	// Updates are sent once expunges aren't deferred anymore
+	io.WriteString(c, "a002 STORE 1 +FLAGS.SILENT (\\Flagged)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") UID ADDTO (0 6)` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSearch_InProgress(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	s.ProgressInterval = time.Nanosecond
+
+	io.WriteString(c, "a001 SEARCH ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* OK [INPROGRESS ("a001" 1 1)] Command in progress` {
+		t.Fatal("Invalid INPROGRESS response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestSort(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SORT (REVERSE DATE) UTF-8 ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* SORT 1" {
+		t.Fatal("Invalid SORT response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 UID SORT RETURN (MAX COUNT) (SUBJECT) UTF-8 SEEN\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a002") UID MAX 6 COUNT 1` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestFetch_NotSelected(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -442,11 +733,11 @@ func TestStore_RecentFlag(t *testing.T) {
 	defer c.Close()
 	defer s.Close()
 
-	// Add Recent flag
+	// \Recent can't be altered by clients
 	io.WriteString(c, "a001 STORE 1 FLAGS \\Recent\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent))" {
+	if scanner.Text() != "* 1 FETCH (FLAGS ())" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
 
@@ -455,12 +746,10 @@ func TestStore_RecentFlag(t *testing.T) {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 
-	// Set flags to: something
-	// Should still get Recent flag back
-	io.WriteString(c, "a001 STORE 1 FLAGS something\r\n")
+	io.WriteString(c, "a001 STORE 1 FLAGS \\Recent anotherflag\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent something))" {
+	if scanner.Text() != "* 1 FETCH (FLAGS (anotherflag))" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
 
@@ -469,16 +758,29 @@ func TestStore_RecentFlag(t *testing.T) {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 
-	// Try adding Recent flag again
-	io.WriteString(c, "a001 STORE 1 FLAGS \\Recent anotherflag\r\n")
+	// Messages appended while the mailbox is selected are recent
+	io.WriteString(c, "a002 APPEND INBOX {26}\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Invalid continuation request:", scanner.Text())
+	}
+	io.WriteString(c, "Subject: Hi\r\n\r\nHello World\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* 2 EXISTS" {
+		t.Fatal("Invalid untagged response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
 
+	io.WriteString(c, "a003 STORE 2 +FLAGS (\\Seen)\r\n")
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent anotherflag))" {
+	if scanner.Text() != "* 2 FETCH (FLAGS (\\Seen \\Recent))" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
-
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 }
@@ -1,16 +1,23 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-sasl"
 )
 
 // Conn is a connection to a client.
@@ -38,14 +45,21 @@ type Conn interface {
 
 	Info() *imap.ConnInfo
 
-	setTLSConn(*tls.Conn)
+	setTLSConn(*tls.Conn, *servedCert)
+	// serverCertificate returns the certificate presented by the server, or
+	// nil if it's unknown.
+	serverCertificate() *x509.Certificate
 	silent() *bool // TODO: remove this
+	shutdown()
+	reject(info string) error
 	serve(Conn) error
 	commandHandler(cmd *imap.Command) (hdlr Handler, err error)
 }
 
 // Context stores a connection's metadata.
 type Context struct {
+	// A unique identifier for this connection, used in debug logs.
+	ID string
 	// This connection's current state.
 	State imap.ConnState
 	// If the client is logged in, the user.
@@ -58,6 +72,22 @@ type Context struct {
 	Responses chan<- imap.WriterTo
 	// Closed when the client is logged out.
 	LoggedOut <-chan struct{}
+	// Capabilities enabled by the client with the ENABLE command, as defined
+	// in RFC 5161.
+	Enabled map[string]bool
+
+	// The context of the command being handled.
+	cmdCtx context.Context
+	// The username this connection is counted for by Server.MaxConnsPerUser.
+	countedUser string
+	// Set when the backend rejects a login attempt, until the failure is
+	// recorded by Server.AuthThrottle.
+	loginRejected bool
+	// Search contexts of the currently selected mailbox.
+	searches *searchContexts
+	// The client's view of the currently selected mailbox, nil if the backend
+	// doesn't send updates.
+	view *mailboxView
 }
 
 type conn struct {
@@ -67,11 +97,30 @@ type conn struct {
 	s         *Server
 	ctx       *Context
 	tlsConn   *tls.Conn
+	served    *servedCert
 	continues chan bool
 	upgrade   chan bool
 	responses chan imap.WriterTo
 	loggedOut chan struct{}
 	silentVal bool
+	// Set if the connection comes from a trusted proxy
+	proxy *proxyConn
+	// Executes pipelined commands, nil if disabled
+	pipeline *pipeline
+	// Set if the literal ending the last command read is streamed
+	literalStreamed bool
+
+	// Cancelled when the connection is closed or times out
+	context context.Context
+	cancel  context.CancelFunc
+
+	timerLocker sync.Mutex
+	logoutTimer *time.Timer
+
+	// Closed when the server shuts down
+	shuttingDown chan struct{}
+	shutdownOnce sync.Once
+	closeOnce    sync.Once
 }
 
 func newConn(s *Server, c net.Conn) *conn {
@@ -84,29 +133,44 @@ func newConn(s *Server, c net.Conn) *conn {
 	loggedOut := make(chan struct{})
 
 	tlsConn, _ := c.(*tls.Conn)
+	proxy, _ := c.(*proxyConn)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	conn := &conn{
 		Conn: imap.NewConn(c, r, w),
 
 		s: s,
 		ctx: &Context{
+			ID:        strconv.FormatUint(atomic.AddUint64(&s.connCount, 1), 10),
 			State:     imap.ConnectingState,
 			Responses: responses,
 			LoggedOut: loggedOut,
 		},
 		tlsConn:   tlsConn,
+		served:    s.takeServedCert(tlsConn),
+		proxy:     proxy,
 		continues: continues,
 		upgrade:   make(chan bool),
 		responses: responses,
 		loggedOut: loggedOut,
+		context:   ctx,
+		cancel:    cancel,
+
+		shuttingDown: make(chan struct{}),
 	}
 
-	if s.Debug != nil {
+	if s.DebugLog != nil {
+		conn.Conn.SetDebug(s.DebugLog.ServerWriter(conn.ctx.ID))
+	} else if s.Debug != nil {
 		conn.Conn.SetDebug(s.Debug)
 	}
 	if s.MaxLiteralSize > 0 {
 		conn.Conn.MaxLiteralSize = s.MaxLiteralSize
 	}
+	conn.Conn.MaxMemoryLiteralSize = s.MaxMemoryLiteralSize
+	conn.Conn.LiteralTempDir = s.LiteralTempDir
+	conn.Conn.StreamLiteral = conn.streamLiteral
 
 	go conn.send()
 
@@ -133,7 +197,7 @@ func (r *response) WriteTo(w *imap.Writer) error {
 }
 
 func (c *conn) setDeadline() {
-	if c.s.AutoLogout == 0 {
+	if c.s.AutoLogout == 0 || c.isShuttingDown() {
 		return
 	}
 
@@ -144,6 +208,15 @@ func (c *conn) setDeadline() {
 	t := time.Now().Add(dur)
 
 	c.Conn.SetDeadline(t)
+
+	// Cancel pending backend operations when the connection times out
+	c.timerLocker.Lock()
+	if c.logoutTimer == nil {
+		c.logoutTimer = time.AfterFunc(dur, c.cancel)
+	} else {
+		c.logoutTimer.Reset(dur)
+	}
+	c.timerLocker.Unlock()
 }
 
 func (c *conn) WriteResp(r imap.WriterTo) error {
@@ -155,18 +228,109 @@ func (c *conn) WriteResp(r imap.WriterTo) error {
 }
 
 func (c *conn) Close() error {
-	if c.ctx.User != nil {
-		c.ctx.User.Logout()
+	// The connection is closed by the server when it's done serving it, and
+	// can also be closed when the server is closed
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.timerLocker.Lock()
+		if c.logoutTimer != nil {
+			c.logoutTimer.Stop()
+		}
+		c.timerLocker.Unlock()
+
+		if c.ctx.User != nil {
+			c.ctx.User.Logout()
+		}
+
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// shutdown requests the connection to be closed once the command being
+// handled, if any, is completed.
+func (c *conn) shutdown() {
+	c.shutdownOnce.Do(func() {
+		close(c.shuttingDown)
+		// Interrupt the connection if it's waiting for a command
+		c.Conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *conn) isShuttingDown() bool {
+	select {
+	case <-c.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchDisconnect cancels pending backend operations if the client closes the
+// connection while hdlr is being handled. Only commands which don't read from
+// the connection are watched. The returned function stops watching, it must be
+// called before the next command is read.
+func (c *conn) watchDisconnect(hdlr Handler) (stop func()) {
+	concurrent, ok := hdlr.(ConcurrentHandler)
+	if !ok || c.literalStreamed || !concurrent.Concurrent(c.conn) {
+		return func() {}
 	}
 
-	return c.Conn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Data sent by the client, such as the next command, is left in the
+		// buffer
+		_, err := c.Conn.Peek(1)
+		if netErr, ok := err.(net.Error); err != nil && !(ok && netErr.Timeout()) {
+			c.cancel()
+		}
+	}()
+
+	return func() {
+		// Interrupt the read, then restore the deadline unless the server is
+		// shutting down
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		if c.isShuttingDown() {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Time{})
+		c.setDeadline()
+	}
+}
+
+// reject refuses to serve the connection, with a BYE response as greeting.
+func (c *conn) reject(info string) error {
+	defer close(c.loggedOut)
+
+	c.ctx.State = imap.LogoutState
+	return c.WriteResp(&imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Code: imap.CodeUnavailable,
+		Info: info,
+	})
+}
+
+// bye sends a BYE response before the connection is closed because the
+// server shuts down.
+func (c *conn) bye() error {
+	info := c.s.ShutdownMessage
+	if info == "" {
+		info = DefaultShutdownMessage
+	}
+	return c.WriteResp(&imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: info,
+	})
 }
 
 func (c *conn) Capabilities() []string {
 	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR"}
 
 	if c.ctx.State == imap.NotAuthenticatedState {
-		if !c.IsTLS() && c.s.TLSConfig != nil {
+		if !c.IsTLS() && !c.isProxiedTLS() && c.s.TLSConfig != nil {
 			caps = append(caps, "STARTTLS")
 		}
 
@@ -174,11 +338,31 @@ func (c *conn) Capabilities() []string {
 			caps = append(caps, "LOGINDISABLED")
 		} else {
 			for name := range c.s.auths {
+				if strings.HasSuffix(name, "-PLUS") && !channelBindingAvailable(c) {
+					// Channel binding mechanisms require TLS
+					continue
+				}
+				if name == sasl.External && !hasVerifiedClientCert(c) {
+					continue
+				}
 				caps = append(caps, "AUTH="+name)
 			}
 		}
 	}
 
+	if c.ctx.State&imap.AuthenticatedState != 0 {
+		if be, ok := c.s.Backend.(backend.ExtensionBackend); ok {
+			for _, ext := range be.SupportedExtensions() {
+				caps = append(caps, string(ext))
+			}
+		}
+
+		caps = append(caps, "ENABLE", uidOnlyCap, "UNSELECT", "ESEARCH", "CONTEXT=SEARCH")
+		if c.s.backendSupports(backend.ExtSort) {
+			caps = append(caps, "ESORT", "CONTEXT=SORT")
+		}
+	}
+
 	for _, ext := range c.s.extensions {
 		caps = append(caps, ext.Capabilities(c)...)
 	}
@@ -213,6 +397,8 @@ func (c *conn) send() {
 			// Request to send the response
 			if err := c.writeAndFlush(res); err != nil {
 				c.Server().ErrorLog.Println("cannot send response: ", err)
+				// The client is gone, stop pending backend operations
+				c.cancel()
 			}
 		case <-c.loggedOut:
 			return
@@ -239,8 +425,16 @@ func (c *conn) greet() error {
 	return c.WriteResp(greeting)
 }
 
-func (c *conn) setTLSConn(tlsConn *tls.Conn) {
+func (c *conn) setTLSConn(tlsConn *tls.Conn, served *servedCert) {
 	c.tlsConn = tlsConn
+	c.served = served
+}
+
+func (c *conn) serverCertificate() *x509.Certificate {
+	if c.served == nil {
+		return nil
+	}
+	return c.served.leaf()
 }
 
 func (c *conn) IsTLS() bool {
@@ -255,9 +449,25 @@ func (c *conn) TLSState() *tls.ConnectionState {
 	return nil
 }
 
+// Info returns information about the connection. If a trusted proxy has
+// terminated TLS, the state of the TLS connection between the client and the
+// proxy is reported.
+func (c *conn) Info() *imap.ConnInfo {
+	info := c.Conn.Info()
+	if info.TLS == nil && c.proxy != nil {
+		info.TLS = c.proxy.tlsState()
+	}
+	return info
+}
+
+// isProxiedTLS checks whether a trusted proxy has terminated TLS.
+func (c *conn) isProxiedTLS() bool {
+	return c.proxy != nil && c.proxy.tlsState() != nil
+}
+
 // canAuth checks if the client can use plain text authentication.
 func (c *conn) canAuth() bool {
-	return c.IsTLS() || c.s.AllowInsecureAuth
+	return c.IsTLS() || c.isProxiedTLS() || c.s.AllowInsecureAuth
 }
 
 func (c *conn) silent() *bool {
@@ -286,23 +496,52 @@ func (c *conn) serve(conn Conn) (err error) {
 		}
 	}()
 
+	// Complete the TLS handshake first, capabilities depend on its outcome
+	if c.tlsConn != nil {
+		if err := c.tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+
 	// Send greeting
 	if err := c.greet(); err != nil {
 		return err
 	}
 
+	if c.s.MaxPipelined > 1 {
+		c.pipeline = newPipeline(c, c.s.MaxPipelined)
+		defer c.pipeline.close()
+	}
+
 	for {
 		if c.ctx.State == imap.LogoutState {
 			return nil
 		}
+		if c.isShuttingDown() {
+			c.pipeline.wait()
+			return c.bye()
+		}
 
 		var res *imap.StatusResp
 		var up Upgrader
+		var obs *observedCommand
+		var deferred *mailboxView
 
+		bytesIn := c.BytesRead()
+		c.literalStreamed = false
 		fields, err := c.ReadLine()
-		if err == io.EOF || c.ctx.State == imap.LogoutState {
+		if err == io.EOF {
+			// The client is gone, stop pipelined commands in progress
+			c.cancel()
+			return nil
+		}
+		if c.ctx.State == imap.LogoutState {
 			return nil
 		}
+		if err != nil && c.isShuttingDown() {
+			c.pipeline.wait()
+			return c.bye()
+		}
 		c.setDeadline()
 
 		if err != nil {
@@ -324,21 +563,42 @@ func (c *conn) serve(conn Conn) (err error) {
 					Info: err.Error(),
 				}
 			} else {
-				var err error
-				res, up, err = c.handleCommand(cmd)
-				if err != nil {
+				var parent context.Context
+				parent, obs = c.startCommand(cmd, bytesIn)
+
+				if hdlr, err := c.commandHandler(cmd); err != nil {
 					res = &imap.StatusResp{
 						Tag:  cmd.Tag,
 						Type: imap.StatusRespBad,
 						Info: err.Error(),
 					}
+				} else if !c.literalStreamed && c.pipeline.canRun(hdlr) {
+					c.pipeline.run(parent, cmd, hdlr, obs)
+					continue
+				} else {
+					c.pipeline.wait()
+					stop := c.watchDisconnect(hdlr)
+					res, up, deferred = c.handleCommand(parent, cmd, hdlr)
+					stop()
 				}
 			}
+			closeLiterals(fields)
+		}
+
+		// The streamed literal may not have been read entirely by the handler
+		if err := c.FinishLine(); err != nil {
+			c.s.ErrorLog.Println("cannot read command:", err)
+			return err
 		}
 
 		if res != nil {
+			// Responses to pipelined commands are sent first
+			c.pipeline.wait()
 
-			if err := c.WriteResp(res); err != nil {
+			err := c.WriteResp(res)
+			c.finishCommand(obs, res)
+			c.endCommand(deferred)
+			if err != nil {
 				c.s.ErrorLog.Println("cannot write response:", err)
 				continue
 			}
@@ -353,6 +613,31 @@ func (c *conn) serve(conn Conn) (err error) {
 	}
 }
 
+// streamLiteral checks whether a literal should be streamed instead of being
+// read in memory. This is the case for messages appended with APPEND, which
+// are passed as is to the backend. The message follows the mailbox name,
+// which can be a literal too.
+func (c *conn) streamLiteral(fields []interface{}) bool {
+	if len(fields) < 3 {
+		return false
+	}
+	name, ok := fields[1].(string)
+	c.literalStreamed = ok && strings.EqualFold(name, "APPEND")
+	return c.literalStreamed
+}
+
+// closeLiterals releases the temporary files storing the literals of a command.
+func closeLiterals(fields []interface{}) {
+	for _, f := range fields {
+		switch f := f.(type) {
+		case *imap.BufferedLiteral:
+			f.Close()
+		case []interface{}:
+			closeLiterals(f)
+		}
+	}
+}
+
 func (c *conn) WaitReady() {
 	c.upgrade <- true
 	c.Conn.WaitReady()
@@ -370,13 +655,37 @@ func (c *conn) commandHandler(cmd *imap.Command) (hdlr Handler, err error) {
 	return
 }
 
-func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrader, err error) {
-	hdlr, err := c.commandHandler(cmd)
-	if err != nil {
+func (c *conn) handleCommand(parent context.Context, cmd *imap.Command, hdlr Handler) (res *imap.StatusResp, up Upgrader, deferred *mailboxView) {
+	// Commands supporting UIDs use sequence numbers when not prefixed by UID
+	if _, ok := hdlr.(UidHandler); ok && c.ctx.Enabled[uidOnlyCap] {
+		res = uidRequiredResp()
+		res.Tag = cmd.Tag
 		return
 	}
 
+	cmdCtx, cancel := context.WithCancel(parent)
+	defer cancel()
+	cmdCtx = backend.ContextWithConnInfo(cmdCtx, c.conn.Info())
+	c.ctx.cmdCtx = backend.ContextWithTag(cmdCtx, cmd.Tag)
+	defer func() {
+		c.ctx.cmdCtx = nil
+	}()
+
+	deferred = c.beginCommand(cmd, false)
 	hdlrErr := hdlr.Handle(c.conn)
+	if err := sendSearchUpdates(c.conn); err != nil {
+		c.s.ErrorLog.Println("cannot send search updates:", err)
+	}
+	res = statusResp(cmd, hdlrErr)
+
+	up, _ = hdlr.(Upgrader)
+	return
+}
+
+// statusResp returns the status response of a command, given the error
+// returned by its handler.
+func statusResp(cmd *imap.Command, hdlrErr error) *imap.StatusResp {
+	var res *imap.StatusResp
 	if statusErr, ok := hdlrErr.(*imap.ErrStatusResp); ok {
 		res = statusErr.Resp
 	} else if hdlrErr != nil {
@@ -397,7 +706,5 @@ func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrad
 			res.Info = cmd.Name + " completed"
 		}
 	}
-
-	up, _ = hdlr.(Upgrader)
-	return
+	return res
 }
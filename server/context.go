@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// CommandContext returns the context of the command being handled by conn. It
+// is cancelled when the connection is closed or times out, and carries the
+// connection info and the command tag. Extensions should bind the backend
+// operations they perform to it.
+func CommandContext(conn Conn) context.Context {
+	if pc, ok := conn.(*pipelinedCommand); ok {
+		return pc.ctx
+	}
+	if ctx := conn.Context().cmdCtx; ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// commandTag returns the tag of the command being handled by conn.
+func commandTag(conn Conn) string {
+	return backend.TagFromContext(CommandContext(conn))
+}
+
+// commandUser returns the logged in user, with its operations bound to the
+// context of the current command.
+func commandUser(conn Conn) backend.User {
+	return backend.UserWithContext(CommandContext(conn), conn.Context().User)
+}
+
+// commandMailbox returns mbox, with its operations bound to the context of the
+// current command.
+func commandMailbox(conn Conn, mbox backend.Mailbox) backend.Mailbox {
+	return backend.MailboxWithContext(CommandContext(conn), mbox)
+}
+
+// getMailbox returns a mailbox of the logged in user, with its operations
+// bound to the context of the current command.
+func getMailbox(conn Conn, name string) (backend.Mailbox, error) {
+	mbox, err := commandUser(conn).GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return commandMailbox(conn, mbox), nil
+}
@@ -0,0 +1,167 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// contextBackend is a backend whose SearchMessages waits until its context
+// is cancelled.
+type contextBackend struct {
+	*memory.Backend
+	contexts chan context.Context
+}
+
+func (be *contextBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &contextUser{u, be}, nil
+}
+
+type contextUser struct {
+	backend.User
+	be *contextBackend
+}
+
+func (u *contextUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &contextMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type contextMailbox struct {
+	backend.Mailbox
+	be  *contextBackend
+	ctx context.Context
+}
+
+func (mbox *contextMailbox) WithContext(ctx context.Context) backend.Mailbox {
+	return &contextMailbox{Mailbox: mbox.Mailbox, be: mbox.be, ctx: ctx}
+}
+
+func (mbox *contextMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if mbox.ctx == nil || uid {
+		return mbox.Mailbox.SearchMessages(uid, criteria)
+	}
+
+	mbox.be.contexts <- mbox.ctx
+	<-mbox.ctx.Done()
+	return nil, mbox.ctx.Err()
+}
+
+func TestCommandContext(t *testing.T) {
+	be := &contextBackend{
+		Backend:  memory.New(),
+		contexts: make(chan context.Context, 1),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	ctx := startSearch(t, c, be)
+	if tag := backend.TagFromContext(ctx); tag != "a002" {
+		t.Errorf("Context has tag %q, want a002", tag)
+	}
+	connInfo := backend.ConnInfoFromContext(ctx)
+	if connInfo == nil || connInfo.RemoteAddr.String() != c.LocalAddr().String() {
+		t.Errorf("Context has connection info %v, want remote address %v", connInfo, c.LocalAddr())
+	}
+
+	s.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Context not cancelled after the server is closed")
+	}
+}
+
+func TestCommandContext_disconnect(t *testing.T) {
+	for _, maxPipelined := range []int{0, 4} {
+		be := &contextBackend{
+			Backend:  memory.New(),
+			contexts: make(chan context.Context, 1),
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Cannot listen:", err)
+		}
+
+		s := server.New(be)
+		s.AllowInsecureAuth = true
+		s.MaxPipelined = maxPipelined
+		go s.Serve(l)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+
+		ctx := startSearch(t, c, be)
+		c.Close()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("Context not cancelled after the client disconnected with MaxPipelined = %v", maxPipelined)
+		}
+
+		s.Close()
+	}
+}
+
+// startSearch logs in and starts a SEARCH command with the tag a002, and
+// returns its context once the backend is waiting for it to be cancelled.
+func startSearch(t *testing.T, c net.Conn, be *contextBackend) context.Context {
+	scanner := bufio.NewScanner(c)
+
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+
+	var ctx context.Context
+	select {
+	case ctx = <-be.contexts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for SEARCH")
+	}
+
+	if err := ctx.Err(); err != nil {
+		t.Fatal("Context cancelled before the connection is closed:", err)
+	}
+	return ctx
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-sasl"
+)
+
+// externalServer implements the EXTERNAL mechanism with TLS client
+// certificates.
+type externalServer struct {
+	conn  Conn
+	asked bool
+	done  bool
+}
+
+// NewExternalServer creates a SASL server for the EXTERNAL mechanism, defined
+// in RFC 4422 appendix A. The client is authenticated with its TLS client
+// certificate, which must have been verified by crypto/tls (see
+// tls.Config.ClientAuth). The certificate is mapped to a user by the backend,
+// which must implement backend.ExternalBackend. It can be passed to
+// Server.EnableAuth:
+//
+//	s.EnableAuth(sasl.External, server.NewExternalServer)
+//
+// The mechanism is only advertised to clients which presented a certificate.
+func NewExternalServer(conn Conn) sasl.Server {
+	return &externalServer{conn: conn}
+}
+
+func (a *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if response == nil && !a.asked {
+		// No initial response, ask for one
+		a.asked = true
+		return []byte{}, false, nil
+	}
+	a.done = true
+
+	if !hasVerifiedClientCert(a.conn) {
+		return nil, true, errors.New("No verified TLS client certificate")
+	}
+
+	be, ok := a.conn.Server().Backend.(backend.ExternalBackend)
+	if !ok {
+		return nil, true, errors.New("EXTERNAL authentication not supported")
+	}
+
+	user, err := be.LoginExternal(a.conn.Info(), string(response))
+	if err != nil {
+		return nil, true, err
+	}
+
+	ctx := a.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
+
+// hasVerifiedClientCert checks whether the client presented a TLS certificate
+// which has been verified.
+func hasVerifiedClientCert(conn Conn) bool {
+	state := conn.TLSState()
+	return state != nil && len(state.PeerCertificates) > 0 && len(state.VerifiedChains) > 0
+}
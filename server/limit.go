@@ -0,0 +1,302 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// DefaultAuthBlock is the default value of AuthThrottle.Block.
+const DefaultAuthBlock = time.Second
+
+// DefaultAuthMaxBlock is the default value of AuthThrottle.MaxBlock.
+const DefaultAuthMaxBlock = time.Hour
+
+// How often expired entries are removed from an AuthThrottle.
+const authThrottlePruneInterval = time.Minute
+
+// AuthThrottle slows down password guessing by blocking the IP addresses from
+// which authentication attempts fail. While an address is blocked, LOGIN and
+// AUTHENTICATE commands are rejected with an UNAVAILABLE response code, as
+// defined in RFC 5530. Only attempts whose credentials are rejected count as
+// failures: cancelled or malformed attempts don't.
+//
+// The zero value blocks addresses after each failed attempt, for a duration
+// which doubles with each failure. Setting MaxFailures and Block to larger
+// values locks addresses out after a number of failures instead.
+type AuthThrottle struct {
+	// The number of failed attempts allowed before an address is blocked.
+	MaxFailures int
+	// How long an address is blocked the first time. The duration doubles
+	// with each further failure. If zero, DefaultAuthBlock is used.
+	Block time.Duration
+	// The maximum duration an address is blocked. Failures older than this
+	// duration are forgotten. If zero, DefaultAuthMaxBlock is used.
+	MaxBlock time.Duration
+	// If not nil, called when an address is blocked. It can be used to export
+	// the block list, for instance to a firewall.
+	OnBlock func(addr string, until time.Time)
+
+	locker    sync.Mutex
+	entries   map[string]*authThrottleEntry
+	lastPrune time.Time
+}
+
+type authThrottleEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+func (t *AuthThrottle) block() time.Duration {
+	if t.Block == 0 {
+		return DefaultAuthBlock
+	}
+	return t.Block
+}
+
+func (t *AuthThrottle) maxBlock() time.Duration {
+	if t.MaxBlock == 0 {
+		return DefaultAuthMaxBlock
+	}
+	return t.MaxBlock
+}
+
+// Blocked returns the addresses which are currently blocked, with the time
+// until which they're blocked.
+func (t *AuthThrottle) Blocked() map[string]time.Time {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	now := time.Now()
+	blocked := make(map[string]time.Time)
+	for addr, e := range t.entries {
+		if e.until.After(now) {
+			blocked[addr] = e.until
+		}
+	}
+	return blocked
+}
+
+// Unblock forgets the failed attempts from an address.
+func (t *AuthThrottle) Unblock(addr string) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	delete(t.entries, addr)
+}
+
+// blockedUntil checks whether an address is blocked.
+func (t *AuthThrottle) blockedUntil(addr string) (time.Time, bool) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	e, ok := t.entries[addr]
+	if !ok || !e.until.After(time.Now()) {
+		return time.Time{}, false
+	}
+	return e.until, true
+}
+
+// fail records a failed attempt from an address.
+func (t *AuthThrottle) fail(addr string) {
+	t.locker.Lock()
+
+	now := time.Now()
+	t.prune(now)
+
+	if t.entries == nil {
+		t.entries = make(map[string]*authThrottleEntry)
+	}
+	e, ok := t.entries[addr]
+	if !ok {
+		e = &authThrottleEntry{}
+		t.entries[addr] = e
+	}
+	e.failures++
+	e.last = now
+
+	n := e.failures - t.MaxFailures
+	if n <= 0 {
+		t.locker.Unlock()
+		return
+	}
+
+	d := t.block()
+	for i := 1; i < n && d < t.maxBlock(); i++ {
+		d *= 2
+	}
+	if d > t.maxBlock() {
+		d = t.maxBlock()
+	}
+	e.until = now.Add(d)
+	until := e.until
+	t.locker.Unlock()
+
+	if t.OnBlock != nil {
+		t.OnBlock(addr, until)
+	}
+}
+
+// succeed records a successful attempt from an address.
+func (t *AuthThrottle) succeed(addr string) {
+	t.Unblock(addr)
+}
+
+// prune removes the entries which have expired. The throttle must be locked.
+func (t *AuthThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < authThrottlePruneInterval {
+		return
+	}
+	t.lastPrune = now
+
+	for addr, e := range t.entries {
+		if now.Sub(e.last) > t.maxBlock() && !e.until.After(now) {
+			delete(t.entries, addr)
+		}
+	}
+}
+
+// remoteHost returns the IP address of the client.
+func remoteHost(conn Conn) string {
+	addr := conn.Info().RemoteAddr
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitedHost returns the host used to apply per-IP limits to a connection,
+// or an empty string if it isn't subject to them. The address of a trusted
+// proxy is only kept if its PROXY protocol header is invalid, or if the
+// connection is established by the proxy itself: limiting it would affect all
+// of the proxy's clients.
+func (s *Server) limitedHost(conn Conn) string {
+	addr := conn.Info().RemoteAddr
+	if addr != nil && len(s.TrustedProxies) > 0 && s.isTrustedProxy(addr) {
+		return ""
+	}
+	return remoteHost(conn)
+}
+
+// acquireConn checks that a new connection doesn't exceed the connection
+// limits and counts it. It returns the text of the BYE response to send if it
+// does. The server must be locked.
+func (s *Server) acquireConn(conn Conn) string {
+	host := s.limitedHost(conn)
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return "Too many connections"
+	}
+	if host != "" && s.MaxConnsPerIP > 0 && s.hostConns[host] >= s.MaxConnsPerIP {
+		return "Too many connections from your address"
+	}
+
+	s.conns[conn] = struct{}{}
+	if host != "" {
+		s.hostConns[host]++
+	}
+	return ""
+}
+
+// releaseConn stops counting a connection. The server must be locked.
+func (s *Server) releaseConn(conn Conn) {
+	delete(s.conns, conn)
+
+	if host := s.limitedHost(conn); host != "" {
+		if s.hostConns[host]--; s.hostConns[host] <= 0 {
+			delete(s.hostConns, host)
+		}
+	}
+
+	ctx := conn.Context()
+	if ctx.countedUser != "" {
+		if s.userConns[ctx.countedUser]--; s.userConns[ctx.countedUser] <= 0 {
+			delete(s.userConns, ctx.countedUser)
+		}
+		ctx.countedUser = ""
+	}
+}
+
+// checkAuth returns an error if the client isn't allowed to authenticate.
+func (s *Server) checkAuth(conn Conn) error {
+	host := s.limitedHost(conn)
+	if s.AuthThrottle == nil || host == "" {
+		return nil
+	}
+	if _, ok := s.AuthThrottle.blockedUntil(host); ok {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeUnavailable,
+			Info: "Too many failed authentication attempts, try again later",
+		})
+	}
+	return nil
+}
+
+// authFailed records a failed authentication attempt and returns the error to
+// send to the client. Only attempts whose credentials have been rejected are
+// counted by AuthThrottle, not cancelled or malformed ones.
+func (s *Server) authFailed(conn Conn, mech, username string, err error) error {
+	ctx := conn.Context()
+	rejected := ctx.loginRejected
+	ctx.loginRejected = false
+
+	var res error
+	switch err {
+	case backend.ErrInvalidCredentials, errSCRAMInvalidProof, errOAuthFailed:
+		rejected = true
+		res = ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeAuthenticationFailed,
+			Info: err.Error(),
+		})
+	default:
+		res = err
+	}
+
+	if host := s.limitedHost(conn); rejected && s.AuthThrottle != nil && host != "" {
+		s.AuthThrottle.fail(host)
+	}
+	s.observeAuth(conn, mech, username, err)
+	return res
+}
+
+// authSucceeded records a successful authentication attempt. If the user has
+// too many connections, the user is logged out and an error is returned.
+func (s *Server) authSucceeded(conn Conn, mech string) error {
+	if host := s.limitedHost(conn); s.AuthThrottle != nil && host != "" {
+		s.AuthThrottle.succeed(host)
+	}
+
+	ctx := conn.Context()
+	username := ctx.User.Username()
+
+	s.locker.Lock()
+	if s.MaxConnsPerUser > 0 && s.userConns[username] >= s.MaxConnsPerUser {
+		s.locker.Unlock()
+
+		ctx.User.Logout()
+		ctx.User = nil
+		ctx.State = imap.NotAuthenticatedState
+		err := ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeUnavailable,
+			Info: "Too many connections for this user",
+		})
+		s.observeAuth(conn, mech, username, err)
+		return err
+	}
+	s.userConns[username]++
+	ctx.countedUser = username
+	s.locker.Unlock()
+
+	s.observeAuth(conn, mech, username, nil)
+	return nil
+}
@@ -0,0 +1,245 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// testServerConfig starts a server configured by f, and opens a connection.
+func testServerConfig(t *testing.T, f func(s *server.Server)) (s *server.Server, c net.Conn, scanner *bufio.Scanner, addr net.Addr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(memory.New())
+	s.AllowInsecureAuth = true
+	f(s)
+
+	go s.Serve(l)
+
+	c, scanner, _ = dialGreeted(t, l.Addr())
+	return s, c, scanner, l.Addr()
+}
+
+func dialGreeted(t *testing.T, addr net.Addr) (c net.Conn, scanner *bufio.Scanner, greeting string) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	scanner = bufio.NewScanner(c)
+	scanner.Scan()
+	return c, scanner, scanner.Text()
+}
+
+func TestServer_MaxConnsPerIP(t *testing.T) {
+	s, c, _, addr := testServerConfig(t, func(s *server.Server) {
+		s.MaxConnsPerIP = 1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	c2, scanner2, greeting := dialGreeted(t, addr)
+	defer c2.Close()
+	if greeting != "* BYE [UNAVAILABLE] Too many connections from your address" {
+		t.Fatal("Invalid greeting:", greeting)
+	}
+	if scanner2.Scan() {
+		t.Fatal("Connection not closed, got:", scanner2.Text())
+	}
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	s, c, scanner, addr := testServerConfig(t, func(s *server.Server) {
+		s.MaxConns = 1
+	})
+	defer s.Close()
+
+	c2, _, greeting := dialGreeted(t, addr)
+	c2.Close()
+	if greeting != "* BYE [UNAVAILABLE] Too many connections" {
+		t.Fatal("Invalid greeting:", greeting)
+	}
+
+	// Connections can be opened again once another one is closed
+	io.WriteString(c, "a001 LOGOUT\r\n")
+	for scanner.Scan() {
+	}
+	c.Close()
+
+	var c3 net.Conn
+	for i := 0; i < 50; i++ {
+		c3, _, greeting = dialGreeted(t, addr)
+		if strings.HasPrefix(greeting, "* OK ") {
+			break
+		}
+		c3.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer c3.Close()
+	if !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatal("Invalid greeting after a connection has been closed:", greeting)
+	}
+}
+
+func TestServer_MaxConnsPerUser(t *testing.T) {
+	s, c, scanner, addr := testServerConfig(t, func(s *server.Server) {
+		s.MaxConnsPerUser = 1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	c2, scanner2, _ := dialGreeted(t, addr)
+	defer c2.Close()
+	io.WriteString(c2, "a001 LOGIN username password\r\n")
+	scanner2.Scan()
+	if scanner2.Text() != "a001 NO [UNAVAILABLE] Too many connections for this user" {
+		t.Fatal("Invalid status response:", scanner2.Text())
+	}
+
+	// The connection is still usable
+	io.WriteString(c2, "a002 CAPABILITY\r\n")
+	scanner2.Scan()
+	if !strings.Contains(scanner2.Text(), "AUTH=PLAIN") {
+		t.Fatal("Invalid capability response:", scanner2.Text())
+	}
+}
+
+func TestServer_AuthThrottle(t *testing.T) {
+	blocked := make(chan string, 1)
+	s, c, scanner, _ := testServerConfig(t, func(s *server.Server) {
+		s.AuthThrottle = &server.AuthThrottle{
+			MaxFailures: 1,
+			Block:       time.Hour,
+			OnBlock: func(addr string, until time.Time) {
+				blocked <- addr
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for i, want := range []string{
+		"a001 NO [AUTHENTICATIONFAILED] Invalid credentials",
+		"a002 NO [AUTHENTICATIONFAILED] Invalid credentials",
+		"a003 NO [UNAVAILABLE] Too many failed authentication attempts, try again later",
+	} {
+		tag := want[:4]
+		password := "wrong"
+		if i == 2 {
+			password = "password"
+		}
+		io.WriteString(c, tag+" LOGIN username "+password+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid status response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	select {
+	case addr := <-blocked:
+		if addr != "127.0.0.1" {
+			t.Errorf("Blocked address %q, want 127.0.0.1", addr)
+		}
+	default:
+		t.Error("OnBlock not called")
+	}
+	if until, ok := s.AuthThrottle.Blocked()["127.0.0.1"]; !ok || until.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Blocked() = %v, want 127.0.0.1 blocked for an hour", s.AuthThrottle.Blocked())
+	}
+
+	s.AuthThrottle.Unblock("127.0.0.1")
+	io.WriteString(c, "a004 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestServer_AuthThrottle_rejectedOnly(t *testing.T) {
+	s, c, scanner, _ := testServerConfig(t, func(s *server.Server) {
+		s.AuthThrottle = &server.AuthThrottle{
+			MaxFailures: 1,
+			Block:       time.Hour,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Cancelled and malformed attempts aren't counted
+	for i := 0; i < 3; i++ {
+		for _, resp := range []string{"*", "not base64"} {
+			io.WriteString(c, "a001 AUTHENTICATE PLAIN\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "+") {
+				t.Fatal("Invalid continuation request:", scanner.Text())
+			}
+			io.WriteString(c, resp+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "a001 BAD ") && !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+				t.Fatal("Invalid status response:", scanner.Text())
+			}
+		}
+	}
+	if blocked := s.AuthThrottle.Blocked(); len(blocked) != 0 {
+		t.Fatalf("Blocked() = %v, want no blocked address", blocked)
+	}
+
+	// Credentials rejected by the backend are
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00username\x00wrong"))
+	for i, want := range []string{
+		"a002 NO [AUTHENTICATIONFAILED] Invalid credentials",
+		"a003 NO [AUTHENTICATIONFAILED] Invalid credentials",
+		"a004 NO [UNAVAILABLE] Too many failed authentication attempts, try again later",
+	} {
+		io.WriteString(c, want[:4]+" AUTHENTICATE PLAIN "+wrong+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid status response #%v: got %q, want %q", i, scanner.Text(), want)
+		}
+	}
+}
+
+func TestServer_AuthThrottle_backoff(t *testing.T) {
+	durations := make(chan time.Duration, 3)
+	s, c, scanner, _ := testServerConfig(t, func(s *server.Server) {
+		s.AuthThrottle = &server.AuthThrottle{
+			Block:    20 * time.Millisecond,
+			MaxBlock: 50 * time.Millisecond,
+			OnBlock: func(addr string, until time.Time) {
+				durations <- time.Until(until)
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// The block duration doubles after each failure, up to MaxBlock
+	for _, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+		io.WriteString(c, "a001 LOGIN username wrong\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "a001 NO [AUTHENTICATIONFAILED] ") {
+			t.Fatal("Invalid status response:", scanner.Text())
+		}
+
+		d := <-durations
+		if d > want || d < want-10*time.Millisecond {
+			t.Errorf("Address blocked for %v, want %v", d, want)
+		}
+		time.Sleep(d + 10*time.Millisecond)
+	}
+}
@@ -0,0 +1,246 @@
+// Package metrics collects IMAP server metrics and exports them in the
+// Prometheus text exposition format.
+//
+// A Collector is both a server.Observer and an http.Handler:
+//
+//	c := metrics.New()
+//	s.Observer = c
+//	mux.Handle("/metrics", c)
+//
+// To keep the number of time series bounded, metrics are labelled by command
+// name and status, but not by user or mailbox.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/server"
+)
+
+// DefaultBuckets are the default upper bounds of the command duration
+// histogram buckets, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// The label of commands which aren't known by the server.
+const otherCommand = "other"
+
+// Collector collects metrics about a server. It must be created with New.
+type Collector struct {
+	locker     sync.Mutex
+	buckets    []float64
+	connsOpen  int64
+	connsTotal uint64
+	commands   map[string]*commandStats
+	auths      map[authKey]uint64
+}
+
+type commandStats struct {
+	statuses map[string]uint64
+	// Non-cumulative counts of each bucket, the last one is +Inf
+	buckets           []uint64
+	sum               float64
+	count             uint64
+	bytesIn, bytesOut int64
+}
+
+type authKey struct {
+	mechanism, result string
+}
+
+var _ server.Observer = (*Collector)(nil)
+var _ http.Handler = (*Collector)(nil)
+
+// New creates a new collector. If buckets is nil, DefaultBuckets is used for
+// the command duration histogram. Otherwise, buckets must be sorted in
+// increasing order.
+func New(buckets ...float64) *Collector {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Collector{
+		buckets:  buckets,
+		commands: make(map[string]*commandStats),
+		auths:    make(map[authKey]uint64),
+	}
+}
+
+// ConnOpened implements server.Observer.
+func (c *Collector) ConnOpened(conn server.Conn) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.connsOpen++
+	c.connsTotal++
+}
+
+// ConnClosed implements server.Observer.
+func (c *Collector) ConnClosed(conn server.Conn) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.connsOpen--
+}
+
+// CommandStarted implements server.Observer.
+func (c *Collector) CommandStarted(ctx context.Context, conn server.Conn, cmd *server.CommandInfo) context.Context {
+	return ctx
+}
+
+// CommandFinished implements server.Observer.
+func (c *Collector) CommandFinished(ctx context.Context, conn server.Conn, cmd *server.CommandInfo) {
+	name := commandLabel(conn.Server(), cmd.Name)
+	d := cmd.Duration.Seconds()
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	stats, ok := c.commands[name]
+	if !ok {
+		stats = &commandStats{
+			statuses: make(map[string]uint64),
+			buckets:  make([]uint64, len(c.buckets)+1),
+		}
+		c.commands[name] = stats
+	}
+
+	stats.statuses[strings.ToLower(string(cmd.Status))]++
+	stats.buckets[sort.SearchFloat64s(c.buckets, d)]++
+	stats.sum += d
+	stats.count++
+	stats.bytesIn += cmd.BytesIn
+	stats.bytesOut += cmd.BytesOut
+}
+
+// Authenticated implements server.Observer.
+func (c *Collector) Authenticated(conn server.Conn, auth *server.AuthInfo) {
+	k := authKey{mechanism: auth.Mechanism, result: "success"}
+	if k.mechanism == "" {
+		k.mechanism = "unsupported"
+	}
+	if auth.Err != nil {
+		k.result = "failure"
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.auths[k]++
+}
+
+// commandLabel returns the label of a command. Commands unknown to the
+// server share the same label, so that clients can't create new time series.
+func commandLabel(s *server.Server, name string) string {
+	for _, word := range strings.SplitN(name, " ", 2) {
+		if s.Command(word) == nil {
+			return otherCommand
+		}
+	}
+	return name
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	c.write(&b)
+	return b.WriteTo(w)
+}
+
+// ServeHTTP implements http.Handler.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+func (c *Collector) write(b *bytes.Buffer) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	header(b, "imap_connections", "gauge", "Number of open connections.")
+	fmt.Fprintf(b, "imap_connections %v\n", c.connsOpen)
+	header(b, "imap_connections_total", "counter", "Number of accepted connections.")
+	fmt.Fprintf(b, "imap_connections_total %v\n", c.connsTotal)
+
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(b, "imap_commands_total", "counter", "Number of handled commands, by status response type.")
+	for _, name := range names {
+		statuses := c.commands[name].statuses
+		keys := make([]string, 0, len(statuses))
+		for status := range statuses {
+			keys = append(keys, status)
+		}
+		sort.Strings(keys)
+
+		for _, status := range keys {
+			fmt.Fprintf(b, "imap_commands_total{command=%v,status=%v} %v\n", quote(name), quote(status), statuses[status])
+		}
+	}
+
+	header(b, "imap_command_duration_seconds", "histogram", "Time spent handling commands.")
+	for _, name := range names {
+		stats := c.commands[name]
+		var n uint64
+		for i, count := range stats.buckets {
+			n += count
+			le := "+Inf"
+			if i < len(c.buckets) {
+				le = formatFloat(c.buckets[i])
+			}
+			fmt.Fprintf(b, "imap_command_duration_seconds_bucket{command=%v,le=%v} %v\n", quote(name), quote(le), n)
+		}
+		fmt.Fprintf(b, "imap_command_duration_seconds_sum{command=%v} %v\n", quote(name), formatFloat(stats.sum))
+		fmt.Fprintf(b, "imap_command_duration_seconds_count{command=%v} %v\n", quote(name), stats.count)
+	}
+
+	header(b, "imap_command_received_bytes_total", "counter", "Number of bytes received while handling commands.")
+	for _, name := range names {
+		fmt.Fprintf(b, "imap_command_received_bytes_total{command=%v} %v\n", quote(name), c.commands[name].bytesIn)
+	}
+	header(b, "imap_command_sent_bytes_total", "counter", "Number of bytes sent while handling commands.")
+	for _, name := range names {
+		fmt.Fprintf(b, "imap_command_sent_bytes_total{command=%v} %v\n", quote(name), c.commands[name].bytesOut)
+	}
+
+	auths := make([]authKey, 0, len(c.auths))
+	for k := range c.auths {
+		auths = append(auths, k)
+	}
+	sort.Slice(auths, func(i, j int) bool {
+		if auths[i].mechanism != auths[j].mechanism {
+			return auths[i].mechanism < auths[j].mechanism
+		}
+		return auths[i].result < auths[j].result
+	})
+
+	header(b, "imap_auth_attempts_total", "counter", "Number of authentication attempts, by result.")
+	for _, k := range auths {
+		fmt.Fprintf(b, "imap_auth_attempts_total{mechanism=%v,result=%v} %v\n", quote(k.mechanism), quote(k.result), c.auths[k])
+	}
+}
+
+func header(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote formats a label value.
+func quote(v string) string {
+	return `"` + labelReplacer.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
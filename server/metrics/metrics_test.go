@@ -0,0 +1,89 @@
+package metrics_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/server/metrics"
+)
+
+func TestCollector(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	collector := metrics.New(0.5, 60)
+
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Observer = collector
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username wrong\r\n")
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	io.WriteString(c, "a003 SELECT INBOX\r\n")
+	io.WriteString(c, "a004 XUNKNOWN\r\n")
+	io.WriteString(c, "a005 NOOP\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a005 ") {
+			break
+		}
+	}
+
+	// The last command is reported right after its response is sent
+	var body string
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		collector.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatal("Invalid Content-Type:", ct)
+		}
+		b, _ := ioutil.ReadAll(w.Body)
+		body = string(b)
+		if strings.Contains(body, `command="NOOP"`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, want := range []string{
+		"# TYPE imap_connections gauge\nimap_connections 1\n",
+		"imap_connections_total 1\n",
+		"# TYPE imap_commands_total counter\n" +
+			`imap_commands_total{command="LOGIN",status="no"} 1` + "\n" +
+			`imap_commands_total{command="LOGIN",status="ok"} 1` + "\n" +
+			`imap_commands_total{command="NOOP",status="ok"} 1` + "\n" +
+			`imap_commands_total{command="SELECT",status="ok"} 1` + "\n" +
+			`imap_commands_total{command="other",status="bad"} 1` + "\n",
+		`imap_command_duration_seconds_bucket{command="LOGIN",le="60"} 2` + "\n" +
+			`imap_command_duration_seconds_bucket{command="LOGIN",le="+Inf"} 2` + "\n",
+		`imap_command_duration_seconds_count{command="SELECT"} 1` + "\n",
+		`imap_auth_attempts_total{mechanism="LOGIN",result="failure"} 1` + "\n" +
+			`imap_auth_attempts_total{mechanism="LOGIN",result="success"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics don't contain %q:\n%v", want, body)
+		}
+	}
+	if strings.Contains(body, "XUNKNOWN") {
+		t.Error("Unknown command exported as a label")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-sasl"
+)
+
+// errOAuthFailed is returned when the client acknowledges an OAuth error
+// challenge.
+var errOAuthFailed = errors.New("OAuth authentication failed")
+
+// oauthServer implements the OAUTHBEARER and XOAUTH2 mechanisms.
+type oauthServer struct {
+	conn     Conn
+	xoauth2  bool
+	failed   bool
+	finished bool
+}
+
+// NewOAuthBearerServer creates a SASL server for the OAUTHBEARER mechanism,
+// defined in RFC 7628. Tokens are checked by the backend, which must implement
+// backend.OAuthBackend. It can be passed to Server.EnableAuth:
+//
+//	s.EnableAuth(sasl.OAuthBearer, server.NewOAuthBearerServer)
+func NewOAuthBearerServer(conn Conn) sasl.Server {
+	return &oauthServer{conn: conn}
+}
+
+// NewXoauth2Server creates a SASL server for the XOAUTH2 mechanism, defined in
+// https://developers.google.com/gmail/imap/xoauth2-protocol. Tokens are
+// checked by the backend, which must implement backend.OAuthBackend.
+func NewXoauth2Server(conn Conn) sasl.Server {
+	return &oauthServer{conn: conn, xoauth2: true}
+}
+
+func (a *oauthServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.finished {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if a.failed {
+		// The client acknowledged the error challenge with a dummy response
+		a.finished = true
+		return nil, true, errOAuthFailed
+	}
+
+	if response == nil {
+		// No initial response, ask for one
+		return []byte{}, false, nil
+	}
+
+	var username, token string
+	if a.xoauth2 {
+		username, token, err = parseXoauth2Response(response)
+	} else {
+		username, token, err = parseOAuthBearerResponse(response)
+	}
+	if err != nil {
+		a.finished = true
+		return nil, true, err
+	}
+
+	be, ok := a.conn.Server().Backend.(backend.OAuthBackend)
+	if !ok {
+		a.finished = true
+		return nil, true, errors.New("OAuth authentication not supported")
+	}
+
+	user, err := be.LoginOAuth(a.conn.Info(), username, token)
+	if err != nil {
+		// Send an error challenge, the client will reply with a dummy response
+		oauthErr, ok := err.(*sasl.OAuthBearerError)
+		if !ok {
+			oauthErr = &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			if a.xoauth2 {
+				oauthErr.Status = "401"
+			}
+		}
+
+		challenge, err := json.Marshal(struct {
+			Status  string `json:"status"`
+			Schemes string `json:"schemes"`
+			Scope   string `json:"scope,omitempty"`
+		}{oauthErr.Status, oauthErr.Schemes, oauthErr.Scope})
+		if err != nil {
+			return nil, true, err
+		}
+		a.failed = true
+		return challenge, false, nil
+	}
+
+	ctx := a.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	a.finished = true
+	return nil, true, nil
+}
+
+// parseOAuthBearerResponse parses an OAUTHBEARER client response, as defined in
+// RFC 7628 section 3.1.
+func parseOAuthBearerResponse(response []byte) (username, token string, err error) {
+	// gs2-header: channel binding flag, authzid and an empty field
+	parts := strings.SplitN(string(response), ",", 3)
+	if len(parts) != 3 {
+		return "", "", errors.New("Invalid OAUTHBEARER response")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return "", "", errors.New("Channel binding not supported")
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return "", "", errors.New("Invalid OAUTHBEARER authorization identity")
+		}
+		username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(parts[1][2:])
+	}
+
+	token, err = parseOAuthKVPairs(parts[2])
+	return username, token, err
+}
+
+// parseXoauth2Response parses an XOAUTH2 client response.
+func parseXoauth2Response(response []byte) (username, token string, err error) {
+	s := string(response)
+	if !strings.HasPrefix(s, "user=") {
+		return "", "", errors.New("Invalid XOAUTH2 response")
+	}
+
+	i := strings.IndexByte(s, '\x01')
+	if i < 0 {
+		return "", "", errors.New("Invalid XOAUTH2 response")
+	}
+
+	username = s[len("user="):i]
+	token, err = parseOAuthKVPairs(s[i:])
+	return username, token, err
+}
+
+// parseOAuthKVPairs extracts the bearer token from a list of key-value pairs
+// separated by ^A.
+func parseOAuthKVPairs(s string) (token string, err error) {
+	if !strings.HasSuffix(s, "\x01\x01") {
+		return "", errors.New("Invalid OAuth key-value pairs")
+	}
+
+	for _, kv := range strings.Split(strings.TrimSuffix(s, "\x01\x01"), "\x01") {
+		if !strings.HasPrefix(kv, "auth=") {
+			// Other pairs (host, port) are informative
+			continue
+		}
+
+		auth := strings.TrimPrefix(kv, "auth=")
+		if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			return "", errors.New("Unsupported OAuth authorization scheme")
+		}
+		token = auth[len("Bearer "):]
+	}
+
+	if token == "" {
+		return "", errors.New("Missing OAuth bearer token")
+	}
+	return token, nil
+}
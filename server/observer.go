@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// CommandInfo describes a command handled by a connection.
+type CommandInfo struct {
+	// The command name, in upper case. Commands prefixed with UID are named
+	// after both words, e.g. "UID FETCH".
+	Name string
+	// The command tag.
+	Tag string
+	// The username of the logged in user, empty if the client isn't
+	// authenticated.
+	Username string
+	// The name of the selected mailbox, empty if no mailbox is selected.
+	Mailbox string
+	// The time at which the command was received.
+	Start time.Time
+
+	// The following fields are set once the command is finished.
+
+	// The time elapsed until the status response was sent.
+	Duration time.Duration
+	// The type of the status response.
+	Status imap.StatusRespType
+	// The number of bytes read from and written to the connection while the
+	// command was handled. When commands are pipelined, the bytes received
+	// ahead of time are attributed to the command being read.
+	BytesIn, BytesOut int64
+}
+
+// AuthInfo describes an authentication attempt.
+type AuthInfo struct {
+	// The SASL mechanism, or "LOGIN" for the LOGIN command. Empty if the
+	// client requested an unsupported mechanism.
+	Mechanism string
+	// The username, if known.
+	Username string
+	// Nil if the client has been authenticated.
+	Err error
+}
+
+// Observer is notified of the activity of a server, e.g. to collect metrics
+// or traces. Its methods are called concurrently by the goroutines serving
+// connections and should return quickly.
+type Observer interface {
+	// ConnOpened is called when a connection is accepted, before the greeting
+	// is sent. Connections rejected because of the connection limits aren't
+	// reported.
+	ConnOpened(conn Conn)
+	// ConnClosed is called once a connection is closed.
+	ConnClosed(conn Conn)
+	// CommandStarted is called before a command is handled. The returned
+	// context, which must be derived from ctx, becomes the parent of the
+	// command context and is passed to CommandFinished. It can carry a trace
+	// span.
+	CommandStarted(ctx context.Context, conn Conn, cmd *CommandInfo) context.Context
+	// CommandFinished is called once the status response of a command has
+	// been sent.
+	CommandFinished(ctx context.Context, conn Conn, cmd *CommandInfo)
+	// Authenticated is called after each LOGIN or AUTHENTICATE attempt.
+	// Attempts rejected by Server.AuthThrottle aren't reported.
+	Authenticated(conn Conn, auth *AuthInfo)
+}
+
+type multiObserver []Observer
+
+// MultiObserver returns an Observer which notifies all the provided
+// observers, in order.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+func (mo multiObserver) ConnOpened(conn Conn) {
+	for _, o := range mo {
+		o.ConnOpened(conn)
+	}
+}
+
+func (mo multiObserver) ConnClosed(conn Conn) {
+	for _, o := range mo {
+		o.ConnClosed(conn)
+	}
+}
+
+func (mo multiObserver) CommandStarted(ctx context.Context, conn Conn, cmd *CommandInfo) context.Context {
+	for _, o := range mo {
+		ctx = o.CommandStarted(ctx, conn, cmd)
+	}
+	return ctx
+}
+
+func (mo multiObserver) CommandFinished(ctx context.Context, conn Conn, cmd *CommandInfo) {
+	for _, o := range mo {
+		o.CommandFinished(ctx, conn, cmd)
+	}
+}
+
+func (mo multiObserver) Authenticated(conn Conn, auth *AuthInfo) {
+	for _, o := range mo {
+		o.Authenticated(conn, auth)
+	}
+}
+
+// observedCommand is a command reported to Server.Observer.
+type observedCommand struct {
+	ctx  context.Context
+	info *CommandInfo
+	// The byte counters of the connection when the command started
+	bytesIn, bytesOut int64
+}
+
+// commandName returns the name of cmd, as reported in CommandInfo.
+func commandName(cmd *imap.Command) string {
+	name := strings.ToUpper(cmd.Name)
+	if name == "UID" && len(cmd.Arguments) > 0 {
+		if inner, ok := cmd.Arguments[0].(string); ok {
+			name += " " + strings.ToUpper(inner)
+		}
+	}
+	return name
+}
+
+// setState fills the fields of info describing the connection state.
+func (info *CommandInfo) setState(ctx *Context) {
+	info.Username = ""
+	if ctx.User != nil {
+		info.Username = ctx.User.Username()
+	}
+	info.Mailbox = ""
+	if ctx.Mailbox != nil {
+		info.Mailbox = ctx.Mailbox.Name()
+	}
+}
+
+// startCommand reports a command to the observer, if any. bytesIn is the
+// number of bytes read before the command. It returns the parent of the
+// command context.
+func (c *conn) startCommand(cmd *imap.Command, bytesIn int64) (context.Context, *observedCommand) {
+	if c.s.Observer == nil {
+		return c.context, nil
+	}
+
+	info := &CommandInfo{
+		Name:  commandName(cmd),
+		Tag:   cmd.Tag,
+		Start: time.Now(),
+	}
+	info.setState(c.ctx)
+
+	ctx := c.s.Observer.CommandStarted(c.context, c.conn, info)
+	return ctx, &observedCommand{ctx, info, bytesIn, c.BytesWritten()}
+}
+
+// finishCommand reports the end of a command to the observer.
+func (c *conn) finishCommand(obs *observedCommand, res *imap.StatusResp) {
+	if obs == nil {
+		return
+	}
+
+	info := obs.info
+	info.setState(c.ctx)
+	info.Duration = time.Since(info.Start)
+	info.Status = res.Type
+	info.BytesIn = c.BytesRead() - obs.bytesIn
+	info.BytesOut = c.BytesWritten() - obs.bytesOut
+
+	c.s.Observer.CommandFinished(obs.ctx, c.conn, info)
+}
+
+// observeAuth reports an authentication attempt to the observer, if any.
+func (s *Server) observeAuth(conn Conn, mech, username string, err error) {
+	if s.Observer != nil {
+		s.Observer.Authenticated(conn, &AuthInfo{
+			Mechanism: mech,
+			Username:  username,
+			Err:       err,
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+type observerContextKey struct{}
+
+type recordingObserver struct {
+	locker   sync.Mutex
+	opened   int
+	commands []*server.CommandInfo
+	auths    []*server.AuthInfo
+	closed   chan struct{}
+}
+
+func (o *recordingObserver) ConnOpened(conn server.Conn) {
+	o.locker.Lock()
+	o.opened++
+	o.locker.Unlock()
+}
+
+func (o *recordingObserver) ConnClosed(conn server.Conn) {
+	close(o.closed)
+}
+
+func (o *recordingObserver) CommandStarted(ctx context.Context, conn server.Conn, cmd *server.CommandInfo) context.Context {
+	return context.WithValue(ctx, observerContextKey{}, cmd.Tag)
+}
+
+func (o *recordingObserver) CommandFinished(ctx context.Context, conn server.Conn, cmd *server.CommandInfo) {
+	if tag, _ := ctx.Value(observerContextKey{}).(string); tag != cmd.Tag {
+		panic("CommandFinished called with a context not returned by CommandStarted")
+	}
+
+	o.locker.Lock()
+	o.commands = append(o.commands, cmd)
+	o.locker.Unlock()
+}
+
+func (o *recordingObserver) Authenticated(conn server.Conn, auth *server.AuthInfo) {
+	o.locker.Lock()
+	o.auths = append(o.auths, auth)
+	o.locker.Unlock()
+}
+
+func TestServer_Observer(t *testing.T) {
+	o := &recordingObserver{closed: make(chan struct{})}
+	s, c, scanner, _ := testServerConfig(t, func(s *server.Server) {
+		s.Observer = o
+	})
+	defer s.Close()
+	defer c.Close()
+
+	cmds := []string{
+		"a001 LOGIN username wrong",
+		"a002 LOGIN username password",
+		"a003 SELECT INBOX",
+		"a004 UID FETCH 1:* FLAGS",
+		"a005 LOGOUT",
+	}
+	for _, cmd := range cmds {
+		io.WriteString(c, cmd+"\r\n")
+	}
+	for scanner.Scan() {
+	}
+
+	select {
+	case <-o.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnClosed not called")
+	}
+
+	o.locker.Lock()
+	defer o.locker.Unlock()
+
+	if o.opened != 1 {
+		t.Errorf("ConnOpened called %v times, want 1", o.opened)
+	}
+
+	want := []struct {
+		name, tag, username, mailbox string
+		status                       imap.StatusRespType
+	}{
+		{"LOGIN", "a001", "", "", imap.StatusRespNo},
+		{"LOGIN", "a002", "username", "", imap.StatusRespOk},
+		{"SELECT", "a003", "username", "INBOX", imap.StatusRespOk},
+		{"UID FETCH", "a004", "username", "INBOX", imap.StatusRespOk},
+		{"LOGOUT", "a005", "username", "INBOX", imap.StatusRespOk},
+	}
+	if len(o.commands) != len(want) {
+		t.Fatalf("Got %v commands, want %v", len(o.commands), len(want))
+	}
+	var bytesIn, wantBytesIn int64
+	for i, w := range want {
+		cmd := o.commands[i]
+		if cmd.Name != w.name || cmd.Tag != w.tag || cmd.Username != w.username || cmd.Mailbox != w.mailbox || cmd.Status != w.status {
+			t.Errorf("Command #%v: got %+v, want %+v", i, cmd, w)
+		}
+		bytesIn += cmd.BytesIn
+		wantBytesIn += int64(len(cmds[i]) + 2)
+		if cmd.BytesOut == 0 {
+			t.Errorf("Command #%v: no bytes out", i)
+		}
+		if cmd.Duration <= 0 {
+			t.Errorf("Command #%v: invalid duration %v", i, cmd.Duration)
+		}
+	}
+
+	// Pipelined commands are read at once, only the total is known
+	if bytesIn != wantBytesIn {
+		t.Errorf("Got %v bytes in, want %v", bytesIn, wantBytesIn)
+	}
+
+	if len(o.auths) != 2 {
+		t.Fatalf("Got %v authentication attempts, want 2", len(o.auths))
+	}
+	if auth := o.auths[0]; auth.Mechanism != "LOGIN" || auth.Username != "username" || auth.Err == nil {
+		t.Errorf("Invalid failed authentication attempt: %+v", auth)
+	}
+	if auth := o.auths[1]; auth.Mechanism != "LOGIN" || auth.Username != "username" || auth.Err != nil {
+		t.Errorf("Invalid successful authentication attempt: %+v", auth)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+)
+
+// The number of messages of a FETCH response buffered while a pipelined
+// command waits for the responses to previous commands to be sent.
+const pipelineFetchBuffer = 256
+
+// A ConcurrentHandler is a Handler which can be executed concurrently with
+// other pipelined commands, if Server.MaxPipelined allows it.
+type ConcurrentHandler interface {
+	Handler
+
+	// Concurrent checks whether the command can be executed concurrently.
+	// As defined in RFC 3501 section 5.5, this is only the case if it can't
+	// affect the results of other commands, e.g. because it doesn't modify
+	// anything. Commands which aren't concurrent wait for all previous
+	// commands to complete.
+	Concurrent(conn Conn) bool
+}
+
+// pipeline executes pipelined commands concurrently. Their responses are sent
+// in the order in which the commands have been received.
+type pipeline struct {
+	c *conn
+	// Commands whose responses haven't been sent yet, in order
+	queue chan *pipelinedCommand
+	// Limits the number of commands in progress
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newPipeline(c *conn, max int) *pipeline {
+	p := &pipeline{
+		c:     c,
+		queue: make(chan *pipelinedCommand, max),
+		slots: make(chan struct{}, max),
+	}
+	go p.send()
+	return p
+}
+
+// send forwards the responses of pipelined commands to the connection, one
+// command after the other.
+func (p *pipeline) send() {
+	for cmd := range p.queue {
+		for res := range cmd.responses {
+			select {
+			case p.c.responses <- res:
+			case <-p.c.loggedOut:
+				return
+			}
+		}
+	}
+}
+
+// canRun checks whether a command can be executed concurrently with the
+// commands in progress.
+func (p *pipeline) canRun(hdlr Handler) bool {
+	if p == nil {
+		return false
+	}
+
+	ctx := p.c.ctx
+	// Commands supporting UIDs are rejected when not prefixed by UID
+	if _, ok := hdlr.(UidHandler); ok && ctx.Enabled[uidOnlyCap] {
+		return false
+	}
+	// Without backend updates, search contexts are updated after each command
+	if p.c.s.Updates == nil && ctx.searches != nil && !ctx.searches.empty() {
+		return false
+	}
+
+	concurrent, ok := hdlr.(ConcurrentHandler)
+	return ok && concurrent.Concurrent(p.c.conn)
+}
+
+// run executes a command in the background. It blocks while too many commands
+// are in progress.
+func (p *pipeline) run(parent context.Context, cmd *imap.Command, hdlr Handler, obs *observedCommand) {
+	c := p.c
+
+	ctx, cancel := context.WithCancel(parent)
+	ctx = backend.ContextWithConnInfo(ctx, c.conn.Info())
+	pc := &pipelinedCommand{
+		Conn:      c.conn,
+		c:         c,
+		ctx:       backend.ContextWithTag(ctx, cmd.Tag),
+		responses: make(chan *response),
+	}
+
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	p.queue <- pc
+
+	deferred := c.beginCommand(cmd, true)
+
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			<-p.slots
+		}()
+		defer cancel()
+
+		res, ok := handlePipelined(pc, cmd, hdlr)
+		closeLiterals(cmd.Arguments)
+		pc.WriteResp(res)
+		close(pc.responses)
+
+		c.endCommand(deferred)
+		c.finishCommand(obs, res)
+		if !ok {
+			c.Close()
+		}
+	}()
+}
+
+// handlePipelined executes the handler of a pipelined command and returns its
+// status response. If the handler panics, a BYE response is returned and ok is
+// false.
+func handlePipelined(pc *pipelinedCommand, cmd *imap.Command, hdlr Handler) (res *imap.StatusResp, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			pc.c.s.ErrorLog.Printf("panic serving %v: %v\n%s", pc.c.Info().RemoteAddr, r, debug.Stack())
+			res = &imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: "Internal server error, closing connection.",
+			}
+			ok = false
+		}
+	}()
+
+	return statusResp(cmd, hdlr.Handle(pc)), true
+}
+
+// wait waits for all pipelined commands to complete.
+func (p *pipeline) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
+
+// close waits for all pipelined commands to complete and releases the
+// pipeline.
+func (p *pipeline) close() {
+	if p != nil {
+		p.wg.Wait()
+		close(p.queue)
+	}
+}
+
+// pipelinedCommand is the connection passed to the handler of a pipelined
+// command.
+type pipelinedCommand struct {
+	Conn
+
+	c         *conn
+	ctx       context.Context
+	responses chan *response
+}
+
+// WriteResp writes a response once the responses to the previous commands
+// have been sent.
+func (pc *pipelinedCommand) WriteResp(res imap.WriterTo) error {
+	var buffered chan *imap.Message
+	if fetch, ok := res.(*responses.Fetch); ok {
+		// Keep fetching messages while waiting
+		buffered = make(chan *imap.Message, pipelineFetchBuffer)
+		go func(messages <-chan *imap.Message) {
+			for msg := range messages {
+				buffered <- msg
+			}
+			close(buffered)
+		}(fetch.Messages)
+
+		bufferedFetch := *fetch
+		bufferedFetch.Messages = buffered
+		res = &bufferedFetch
+	}
+
+	done := make(chan struct{})
+	pc.responses <- &response{res, done}
+	<-done
+
+	if buffered != nil {
+		// The response may not have been written entirely
+		for range buffered {
+		}
+	}
+
+	pc.c.setDeadline()
+	return nil
+}
@@ -0,0 +1,221 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// pipelineBackend is a backend which reports the STATUS and CREATE operations
+// it performs. STATUS on the "Slow" mailbox blocks until release receives a
+// value.
+type pipelineBackend struct {
+	*memory.Backend
+	calls   chan string
+	release chan struct{}
+}
+
+func (be *pipelineBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &pipelineUser{u, be}, nil
+}
+
+type pipelineUser struct {
+	backend.User
+	be *pipelineBackend
+}
+
+func (u *pipelineUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pipelineMailbox{mbox, u.be}, nil
+}
+
+func (u *pipelineUser) CreateMailbox(name string) error {
+	u.be.calls <- "CREATE " + name
+	return u.User.CreateMailbox(name)
+}
+
+type pipelineMailbox struct {
+	backend.Mailbox
+	be *pipelineBackend
+}
+
+func (mbox *pipelineMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.be.calls <- "STATUS " + mbox.Name()
+	if mbox.Name() == "Slow" {
+		<-mbox.be.release
+	}
+	return mbox.Mailbox.Status(items)
+}
+
+func testServerPipeline(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner, be *pipelineBackend) {
+	be = &pipelineBackend{
+		Backend: memory.New(),
+		calls:   make(chan string, 10),
+		release: make(chan struct{}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(be)
+	s.AllowInsecureAuth = true
+	s.MaxPipelined = 4
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a001 CREATE Slow\r\n")
+	expectCall(t, be, "CREATE Slow")
+	// The status of created mailboxes is fetched for their ID
+	expectCall(t, be, "STATUS Slow")
+	be.release <- struct{}{}
+	scanner.Scan()
+	return
+}
+
+func expectCall(t *testing.T, be *pipelineBackend, want string) {
+	select {
+	case call := <-be.calls:
+		if call != want {
+			t.Fatalf("Backend called with %q, want %q", call, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %q", want)
+	}
+}
+
+func expectLines(t *testing.T, scanner *bufio.Scanner, want []string) {
+	for _, line := range want {
+		scanner.Scan()
+		if scanner.Text() != line {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), line)
+		}
+	}
+}
+
+func TestServer_pipeline(t *testing.T) {
+	s, c, scanner, be := testServerPipeline(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a002 STATUS Slow (MESSAGES)\r\n")
+	io.WriteString(c, "a003 STATUS INBOX (MESSAGES)\r\n")
+	io.WriteString(c, "a004 LIST \"\" INBOX\r\n")
+
+	// The second STATUS is executed while the first one is in progress, both
+	// calls are received before the first one is released
+	calls := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case call := <-be.calls:
+			calls[call] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for STATUS")
+		}
+	}
+	if !calls["STATUS Slow"] || !calls["STATUS INBOX"] {
+		t.Fatalf("Invalid backend calls: %v", calls)
+	}
+	be.release <- struct{}{}
+
+	// Responses are sent in order
+	expectLines(t, scanner, []string{
+		"* STATUS \"Slow\" (MESSAGES 0)",
+		"a002 OK STATUS completed",
+		"* STATUS INBOX (MESSAGES 1)",
+		"a003 OK STATUS completed",
+		"* LIST () \"/\" INBOX",
+		"a004 OK LIST completed",
+	})
+}
+
+func TestServer_pipeline_serialized(t *testing.T) {
+	s, c, scanner, be := testServerPipeline(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a002 STATUS Slow (MESSAGES)\r\n")
+	io.WriteString(c, "a003 CREATE Other\r\n")
+	io.WriteString(c, "a004 STATUS INBOX (MESSAGES)\r\n")
+
+	expectCall(t, be, "STATUS Slow")
+
+	// CREATE waits for the previous commands to complete
+	select {
+	case call := <-be.calls:
+		t.Fatalf("Backend called with %q while STATUS is in progress", call)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	be.release <- struct{}{}
+	expectCall(t, be, "CREATE Other")
+	expectCall(t, be, "STATUS Other")
+	expectCall(t, be, "STATUS INBOX")
+
+	expectLines(t, scanner, []string{
+		"* STATUS \"Slow\" (MESSAGES 0)",
+		"a002 OK STATUS completed",
+	})
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatalf("Invalid CREATE response: %q", scanner.Text())
+	}
+	expectLines(t, scanner, []string{
+		"* STATUS INBOX (MESSAGES 1)",
+		"a004 OK STATUS completed",
+	})
+}
+
+func TestServer_pipeline_fetch(t *testing.T) {
+	s, c, scanner, be := testServerPipeline(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if scanner.Text() == "a002 OK [READ-WRITE] SELECT completed" {
+			break
+		}
+	}
+	expectCall(t, be, "STATUS INBOX")
+
+	io.WriteString(c, "a003 STATUS Slow (MESSAGES)\r\n")
+	io.WriteString(c, "a004 UID FETCH 1:* (FLAGS)\r\n")
+	io.WriteString(c, "a005 SEARCH ALL\r\n")
+
+	expectCall(t, be, "STATUS Slow")
+	be.release <- struct{}{}
+
+	expectLines(t, scanner, []string{
+		"* STATUS \"Slow\" (MESSAGES 0)",
+		"a003 OK STATUS completed",
+		"* 1 FETCH (FLAGS (\\Seen) UID 6)",
+		"a004 OK UID FETCH completed",
+		"* SEARCH 1",
+		"a005 OK SEARCH completed",
+	})
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum duration to wait for a PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// The maximum length of a version 1 PROXY protocol header, as defined in the
+// specification.
+const proxyV1MaxLen = 107
+
+// The signature of version 2 PROXY protocol headers.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Types of version 2 PROXY protocol TLVs.
+const (
+	proxyTLVAuthority  = 0x02
+	proxyTLVSSL        = 0x20
+	proxyTLVSSLVersion = 0x21
+)
+
+// Set in the client field of a PROXY protocol SSL TLV if the client connected
+// over TLS.
+const proxyClientSSL = 0x01
+
+var proxyTLSVersions = map[string]uint16{
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// isTrustedProxy checks whether a connection comes from a trusted proxy.
+func (s *Server) isTrustedProxy(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn wraps a connection from a trusted proxy if necessary.
+func (s *Server) proxyConn(c net.Conn) net.Conn {
+	switch c.(type) {
+	case *tls.Conn, *proxyConn:
+		// The header is read before the TLS handshake, see ProxyListener
+		return c
+	}
+	if len(s.TrustedProxies) == 0 || !s.isTrustedProxy(c.RemoteAddr()) {
+		return c
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+// ProxyListener returns a listener which reads the PROXY protocol headers of
+// connections from TrustedProxies.
+//
+// Serve, ServeTLS and ListenAndServeTLS already do it. This is only needed to serve TLS
+// connections from another listener: since the header is sent before the TLS
+// handshake, the TLS listener must wrap the returned listener.
+func (s *Server) ProxyListener(l net.Listener) net.Listener {
+	return &proxyListener{l, s}
+}
+
+type proxyListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.s.proxyConn(c), nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header, version 1
+// or 2. The header is read before any other operation.
+type proxyConn struct {
+	net.Conn
+
+	r    *bufio.Reader
+	once sync.Once
+	err  error
+
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// Set if the proxy has terminated TLS
+	tls *tls.ConnectionState
+}
+
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.err = c.parseHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyConn) parseHeader() error {
+	// Fail early if the client doesn't send a header, rather than waiting for
+	// a whole signature
+	if b, err := c.r.Peek(1); err != nil {
+		return err
+	} else if b[0] != proxyV2Sig[0] && b[0] != 'P' {
+		return errors.New("Missing PROXY protocol header")
+	}
+
+	sig, err := c.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return c.parseV2()
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return c.parseV1()
+	}
+	return errors.New("Missing PROXY protocol header")
+}
+
+func (c *proxyConn) parseV1() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return errors.New("PROXY protocol header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("PROXY protocol header doesn't end with a CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The proxy doesn't know the addresses, use the connection ones
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("Invalid PROXY protocol header")
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("Invalid address in PROXY protocol header")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("Invalid port in PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func (c *proxyConn) parseV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return errors.New("Unsupported PROXY protocol version")
+	}
+	cmd := hdr[12] & 0x0F
+	family, transport := hdr[13]>>4, hdr[13]&0x0F
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case 0x0:
+		// LOCAL: the connection was established by the proxy itself, e.g.
+		// for a health check
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return errors.New("Invalid PROXY protocol command")
+	}
+
+	switch transport {
+	case 0x0, 0x1: // UNSPEC, STREAM
+	default:
+		// IMAP clients can't use datagrams
+		return errors.New("Unsupported PROXY protocol transport")
+	}
+
+	var ipLen int
+	switch family {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	case 0x3: // AF_UNIX
+		if len(payload) < 216 {
+			return errors.New("PROXY protocol header too short")
+		}
+		// Keep the connection addresses
+		return c.parseV2TLVs(payload[216:])
+	default:
+		// AF_UNSPEC, keep the connection addresses
+		return nil
+	}
+
+	addrLen := 2*ipLen + 4
+	if len(payload) < addrLen {
+		return errors.New("PROXY protocol header too short")
+	}
+	c.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	c.localAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return c.parseV2TLVs(payload[addrLen:])
+}
+
+// parseV2TLVs parses the TLVs following the addresses of a version 2 header.
+func (c *proxyConn) parseV2TLVs(b []byte) error {
+	var serverName string
+	var state *tls.ConnectionState
+	err := parseProxyTLVs(b, func(typ byte, value []byte) error {
+		switch typ {
+		case proxyTLVAuthority:
+			serverName = string(value)
+		case proxyTLVSSL:
+			if len(value) < 5 {
+				return errors.New("Invalid PROXY protocol SSL TLV")
+			}
+			if value[0]&proxyClientSSL == 0 {
+				return nil
+			}
+			state = &tls.ConnectionState{HandshakeComplete: true}
+			return parseProxyTLVs(value[5:], func(typ byte, value []byte) error {
+				if typ == proxyTLVSSLVersion {
+					state.Version = proxyTLSVersions[string(value)]
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if state != nil {
+		state.ServerName = serverName
+		c.tls = state
+	}
+	return nil
+}
+
+func parseProxyTLVs(b []byte, f func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("Invalid PROXY protocol TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return errors.New("Invalid PROXY protocol TLV")
+		}
+		if err := f(b[0], b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// tlsState returns the state of the TLS connection between the client and the
+// proxy, or nil if the proxy hasn't terminated TLS.
+func (c *proxyConn) tlsState() *tls.ConnectionState {
+	if c.readHeader() != nil || c.tls == nil {
+		return nil
+	}
+	state := *c.tls
+	return &state
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,215 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// proxyBackend is a backend which reports the connection information of
+// logins.
+type proxyBackend struct {
+	*memory.Backend
+	infos chan *imap.ConnInfo
+}
+
+func (be *proxyBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	be.infos <- connInfo
+	return be.Backend.Login(connInfo, username, password)
+}
+
+func testServerProxy(t *testing.T, trusted string, allowInsecureAuth bool) (s *server.Server, c net.Conn, be *proxyBackend) {
+	be = &proxyBackend{
+		Backend: memory.New(),
+		infos:   make(chan *imap.ConnInfo, 1),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	_, n, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = server.New(be)
+	s.TrustedProxies = []*net.IPNet{n}
+	s.AllowInsecureAuth = allowInsecureAuth
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	return
+}
+
+func proxyLogin(t *testing.T, c net.Conn, be *proxyBackend) *imap.ConnInfo {
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid LOGIN response:", scanner.Text())
+	}
+	return <-be.infos
+}
+
+func TestServer_proxyV1(t *testing.T) {
+	s, c, be := testServerProxy(t, "127.0.0.0/8", true)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n")
+
+	info := proxyLogin(t, c, be)
+	if got := info.RemoteAddr.String(); got != "192.0.2.1:56324" {
+		t.Errorf("Invalid remote address: got %v, want %v", got, "192.0.2.1:56324")
+	}
+	if got := info.LocalAddr.String(); got != "198.51.100.1:143" {
+		t.Errorf("Invalid local address: got %v, want %v", got, "198.51.100.1:143")
+	}
+	if info.TLS != nil {
+		t.Error("Connection reported as using TLS")
+	}
+}
+
+func TestServer_proxyV2(t *testing.T) {
+	s, c, be := testServerProxy(t, "127.0.0.0/8", false)
+	defer s.Close()
+	defer c.Close()
+
+	var payload []byte
+	payload = append(payload, net.ParseIP("2001:db8::1")...)
+	payload = append(payload, net.ParseIP("2001:db8::2")...)
+	payload = append(payload, 0xDC, 0x04, 0x03, 0xE1) // Ports 56324 and 993
+
+	authority := "imap.example.org"
+	payload = append(payload, 0x02, 0, byte(len(authority)))
+	payload = append(payload, authority...)
+
+	version := "TLSv1.3"
+	ssl := []byte{0x01, 0, 0, 0, 0, 0x21, 0, byte(len(version))}
+	ssl = append(ssl, version...)
+	payload = append(payload, 0x20, 0, byte(len(ssl)))
+	payload = append(payload, ssl...)
+
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x00")
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(payload)))
+	c.Write(append(hdr, payload...))
+
+	// LOGIN is allowed since the proxy has terminated TLS
+	info := proxyLogin(t, c, be)
+	if got := info.RemoteAddr.String(); got != "[2001:db8::1]:56324" {
+		t.Errorf("Invalid remote address: got %v, want %v", got, "[2001:db8::1]:56324")
+	}
+	if got := info.LocalAddr.String(); got != "[2001:db8::2]:993" {
+		t.Errorf("Invalid local address: got %v, want %v", got, "[2001:db8::2]:993")
+	}
+	if info.TLS == nil {
+		t.Fatal("Connection not reported as using TLS")
+	}
+	if info.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("Invalid TLS version: got %x, want %x", info.TLS.Version, tls.VersionTLS13)
+	}
+	if info.TLS.ServerName != authority {
+		t.Errorf("Invalid server name: got %q, want %q", info.TLS.ServerName, authority)
+	}
+}
+
+func TestServer_proxyInvalid(t *testing.T) {
+	s, c, _ := testServerProxy(t, "127.0.0.0/8", false)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 NOOP\r\n")
+
+	// The connection is closed without a greeting
+	if b, err := bufio.NewReader(c).ReadString('\n'); err != io.EOF {
+		t.Errorf("Connection not closed: read %q, %v", b, err)
+	}
+}
+
+func TestServer_proxyV2Datagram(t *testing.T) {
+	s, c, _ := testServerProxy(t, "127.0.0.0/8", false)
+	defer s.Close()
+	defer c.Close()
+
+	// UDP over IPv4
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0C")
+	hdr = append(hdr, 192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x00, 0x8F)
+	c.Write(hdr)
+
+	if b, err := bufio.NewReader(c).ReadString('\n'); err != io.EOF {
+		t.Errorf("Connection not closed: read %q, %v", b, err)
+	}
+}
+
+func TestServer_proxyMaxConnsPerIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s := server.New(memory.New())
+	s.TrustedProxies = []*net.IPNet{n}
+	s.MaxConnsPerIP = 1
+	go s.Serve(l)
+	defer s.Close()
+
+	local := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	for i, tc := range []struct {
+		header []byte
+		bye    bool
+	}{
+		// Connections keeping the proxy's address aren't limited
+		{[]byte("a001 NOOP\r\n"), false},
+		{local, false},
+		{local, false},
+		// Clients of the proxy are
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n"), false},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56325 143\r\n"), true},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		defer c.Close()
+		c.Write(tc.header)
+
+		greeting, err := bufio.NewReader(c).ReadString('\n')
+		if tc.header[0] == 'a' {
+			if err != io.EOF {
+				t.Errorf("Connection #%v not closed: read %q, %v", i, greeting, err)
+			}
+			continue
+		}
+		if bye := strings.HasPrefix(greeting, "* BYE "); bye != tc.bye {
+			t.Errorf("Invalid greeting for connection #%v: %q", i, greeting)
+		}
+	}
+}
+
+func TestServer_proxyUntrusted(t *testing.T) {
+	s, c, be := testServerProxy(t, "192.0.2.0/24", true)
+	defer s.Close()
+	defer c.Close()
+
+	info := proxyLogin(t, c, be)
+	if ip := info.RemoteAddr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("Invalid remote address: %v", info.RemoteAddr)
+	}
+}
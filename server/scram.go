@@ -0,0 +1,329 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/internal"
+	"github.com/emersion/go-sasl"
+)
+
+// SCRAM SASL mechanisms, defined in RFC 7677.
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+var errSCRAMInvalidProof = errors.New("Invalid SCRAM proof")
+
+// The number of iterations announced for users who don't exist.
+const scramFakeIterations = 4096
+
+// scramServer implements the SCRAM-SHA-256 and SCRAM-SHA-256-PLUS mechanisms.
+type scramServer struct {
+	conn Conn
+	plus bool
+	step int
+
+	username        string
+	creds           *backend.SCRAMCredentials
+	unknown         bool
+	user            backend.User
+	cbHeader        string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+// NewSCRAMSHA256Server creates a SASL server for the SCRAM-SHA-256 mechanism,
+// defined in RFC 7677. Credentials are looked up from the backend, which must
+// implement backend.SCRAMBackend. It can be passed to Server.EnableAuth:
+//
+//	s.EnableAuth(server.SCRAMSHA256, server.NewSCRAMSHA256Server)
+func NewSCRAMSHA256Server(conn Conn) sasl.Server {
+	return &scramServer{conn: conn}
+}
+
+// NewSCRAMSHA256PlusServer creates a SASL server for the SCRAM-SHA-256-PLUS
+// mechanism, which binds the authentication to the TLS connection. Both the
+// tls-exporter and tls-server-end-point channel binding types are supported,
+// tls-exporter only with TLS 1.3, tls-server-end-point only if the server knows
+// the certificate it presents, i.e. for connections accepted by ServeTLS or
+// upgraded with STARTTLS.
+// The mechanism is only advertised on TLS connections supporting one of them.
+func NewSCRAMSHA256PlusServer(conn Conn) sasl.Server {
+	return &scramServer{conn: conn, plus: true}
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		if response == nil {
+			// No initial response, ask for one
+			return []byte{}, false, nil
+		}
+		challenge, err = a.handleClientFirst(string(response))
+	case 1:
+		challenge, err = a.handleClientFinal(string(response))
+	case 2:
+		// The client acknowledged the server signature
+		ctx := a.conn.Context()
+		ctx.State = imap.AuthenticatedState
+		ctx.User = a.user
+		a.step++
+		return nil, true, nil
+	default:
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if err != nil {
+		a.step = -1
+		return nil, true, err
+	}
+	a.step++
+	return challenge, false, nil
+}
+
+func (a *scramServer) handleClientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid SCRAM client-first-message")
+	}
+	cbFlag, authzid, clientFirstBare := parts[0], parts[1], parts[2]
+
+	var cbData []byte
+	switch {
+	case cbFlag == "n":
+		if a.plus {
+			return nil, errors.New("Channel binding is required")
+		}
+	case cbFlag == "y":
+		// The client supports channel binding but thinks we don't
+		if a.plus || a.plusAvailable() {
+			return nil, errors.New("Channel binding downgrade detected")
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		if !a.plus {
+			return nil, errors.New("Channel binding is only supported with " + SCRAMSHA256Plus)
+		}
+		var err error
+		if cbData, err = a.channelBinding(strings.TrimPrefix(cbFlag, "p=")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Invalid SCRAM channel binding flag")
+	}
+
+	if !strings.HasPrefix(clientFirstBare, "n=") {
+		return nil, errors.New("Invalid SCRAM client-first-message")
+	}
+	attrs := internal.SCRAMAttrs(clientFirstBare)
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("Unsupported SCRAM extension")
+	}
+	username, err := internal.SCRAMUnescape(attrs['n'])
+	if err != nil {
+		return nil, err
+	}
+	if authzid != "" {
+		if z, err := internal.SCRAMUnescape(strings.TrimPrefix(authzid, "a=")); err != nil || z != username {
+			return nil, errors.New("Authorization identity not supported")
+		}
+	}
+	clientNonce := attrs['r']
+	if username == "" || clientNonce == "" {
+		return nil, errors.New("Invalid SCRAM client-first-message")
+	}
+
+	be, ok := a.conn.Server().Backend.(backend.SCRAMBackend)
+	if !ok {
+		return nil, errors.New("SCRAM authentication not supported")
+	}
+	creds, err := be.SCRAMCredentials(a.conn.Info(), username)
+	if err == backend.ErrInvalidCredentials {
+		// RFC 5802 section 5.1: don't reveal that the user doesn't exist, fail
+		// on the client-final-message instead
+		creds = a.conn.Server().fakeSCRAMCredentials(username)
+		a.unknown = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	a.username = username
+	a.creds = creds
+	a.cbHeader = base64.StdEncoding.EncodeToString(append([]byte(cbFlag+","+authzid+","), cbData...))
+	a.nonce = clientNonce + base64.StdEncoding.EncodeToString(b)
+	a.clientFirstBare = clientFirstBare
+	a.serverFirst = "r=" + a.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.Iterations)
+	return []byte(a.serverFirst), nil
+}
+
+func (a *scramServer) handleClientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errors.New("Invalid SCRAM client-final-message")
+	}
+	clientFinalWithoutProof := msg[:i]
+
+	attrs := internal.SCRAMAttrs(clientFinalWithoutProof)
+	if attrs['c'] != a.cbHeader {
+		return nil, errors.New("SCRAM channel binding mismatch")
+	}
+	if attrs['r'] != a.nonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errSCRAMInvalidProof
+	}
+
+	authMessage := a.clientFirstBare + "," + a.serverFirst + "," + clientFinalWithoutProof
+	clientKey := internal.SCRAMHMAC(a.creds.StoredKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], a.creds.StoredKey) || a.unknown {
+		return nil, errSCRAMInvalidProof
+	}
+
+	be := a.conn.Server().Backend.(backend.SCRAMBackend)
+	if a.user, err = be.LoginSCRAM(a.conn.Info(), a.username); err != nil {
+		return nil, err
+	}
+
+	serverSignature := internal.SCRAMHMAC(a.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// plusAvailable checks whether SCRAM-SHA-256-PLUS is advertised on this
+// connection.
+func (a *scramServer) plusAvailable() bool {
+	_, ok := a.conn.Server().auths[SCRAMSHA256Plus]
+	return ok && channelBindingAvailable(a.conn)
+}
+
+func (a *scramServer) channelBinding(cbType string) ([]byte, error) {
+	state := a.conn.TLSState()
+	if state == nil {
+		return nil, errors.New("Channel binding requires TLS")
+	}
+
+	var cert *x509.Certificate
+	switch cbType {
+	case internal.SCRAMTLSExporter:
+		// RFC 9266 section 3: tls-exporter is only safe with TLS 1.2 if the
+		// extended master secret extension is used, which can't be checked
+		if state.Version < tls.VersionTLS13 {
+			return nil, errors.New("Channel binding type tls-exporter requires TLS 1.3")
+		}
+	case internal.SCRAMTLSServerEndPoint:
+		if cert = a.conn.serverCertificate(); cert == nil {
+			return nil, errors.New("Channel binding type tls-server-end-point not supported")
+		}
+	}
+	return internal.SCRAMChannelBinding(cbType, state, cert)
+}
+
+// fakeSCRAMCredentials returns credentials for a user who doesn't exist. The
+// salt is derived from the username and a secret of the server, so that
+// repeated attempts get the same one, as for an existing user.
+func (s *Server) fakeSCRAMCredentials(username string) *backend.SCRAMCredentials {
+	mac := hmac.New(sha256.New, s.scramSecret)
+	mac.Write([]byte(username))
+	return &backend.SCRAMCredentials{
+		Salt:       mac.Sum(nil)[:16],
+		Iterations: scramFakeIterations,
+		StoredKey:  make([]byte, sha256.Size),
+		ServerKey:  make([]byte, sha256.Size),
+	}
+}
+
+// channelBindingAvailable checks whether a channel binding type can be used on
+// a connection: tls-exporter requires TLS 1.3 and tls-server-end-point requires
+// the certificate presented by the server.
+func channelBindingAvailable(conn Conn) bool {
+	state := conn.TLSState()
+	if state == nil {
+		return false
+	}
+	return state.Version >= tls.VersionTLS13 || conn.serverCertificate() != nil
+}
+
+// servedCert records the certificate presented by the server during a TLS
+// handshake.
+type servedCert struct {
+	// The configuration used for the handshake
+	config *tls.Config
+	// The certificate returned by config.GetCertificate, if any
+	cert *tls.Certificate
+}
+
+// wrap returns a copy of config which records the certificate it presents.
+func (sc *servedCert) wrap(config *tls.Config) *tls.Config {
+	if config == nil {
+		return nil
+	}
+	config = config.Clone()
+	sc.config = config
+	sc.cert = nil
+
+	if getConfig := config.GetConfigForClient; getConfig != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := getConfig(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			return sc.wrap(c), nil
+		}
+	}
+	if getCert := config.GetCertificate; getCert != nil {
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCert(hello)
+			if err == nil && cert != nil {
+				sc.cert = cert
+			}
+			return cert, err
+		}
+	}
+	return config
+}
+
+// leaf returns the certificate presented by the server, or nil if it's unknown.
+func (sc *servedCert) leaf() *x509.Certificate {
+	cert := sc.cert
+	if cert == nil && len(sc.config.Certificates) == 1 {
+		// If GetCertificate doesn't return a certificate, crypto/tls falls
+		// back to Certificates. The choice is only known if there's a single
+		// one.
+		cert = &sc.config.Certificates[0]
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
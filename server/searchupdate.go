@@ -0,0 +1,447 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/responses"
+)
+
+// searchUpdate is a search context created with RETURN (UPDATE), as defined in
+// RFC 5267 section 4.
+type searchUpdate struct {
+	tag    string
+	uid    bool
+	sorted bool
+	// search runs the search again on the messages whose UID is in uids, or
+	// on all messages if uids is nil, and returns UIDs.
+	search  func(mbox backend.Mailbox, uids *imap.SeqSet) ([]uint32, error)
+	results *backendutil.SearchContext
+}
+
+// restrictCriteria returns search criteria which only match the messages
+// matching criteria whose UID is in uids. If uids is nil, criteria is returned.
+func restrictCriteria(criteria *imap.SearchCriteria, uids *imap.SeqSet) *imap.SearchCriteria {
+	if uids == nil {
+		return criteria
+	}
+
+	c := *criteria
+	if c.Uid != nil {
+		// Messages must be in both sets
+		not := &imap.SearchCriteria{Not: []*imap.SearchCriteria{{Uid: c.Uid}}}
+		c.Not = append(c.Not[:len(c.Not):len(c.Not)], not)
+	}
+	c.Uid = uids
+	return &c
+}
+
+// beginSearchContext is called before a search context is created. It returns a
+// function to call once it has been created.
+func beginSearchContext(conn Conn) (end func(), err error) {
+	ctx := conn.Context()
+	if conn.Server().Updates == nil {
+		// Search contexts are updated after each command
+		return func() {}, nil
+	}
+
+	if err := ctx.searches.begin(commandMailbox(conn, ctx.Mailbox)); err != nil {
+		return nil, err
+	}
+	return ctx.searches.end, nil
+}
+
+// searchContexts are the search contexts of the selected mailbox. They're kept
+// up-to-date with the updates sent by the backend: instead of running searches
+// again, only messages which have changed are evaluated.
+type searchContexts struct {
+	// Locked while search contexts are evaluated or created, so that no
+	// backend update is missed and responses are sent in order
+	evalMutex sync.Mutex
+
+	// Protects the fields below
+	mutex sync.Mutex
+	list  []*searchUpdate
+	// UIDs of messages whose flags have changed since the last evaluation
+	changed map[uint32]bool
+	// Set if messages may have been added since the last evaluation
+	added bool
+	// Messages whose UID is greater than or equal to uidNext haven't been
+	// evaluated yet
+	uidNext uint32
+	// UIDs of messages expunged since the last evaluation started
+	expunged map[uint32]bool
+}
+
+// empty checks whether there are no search contexts.
+func (s *searchContexts) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.list) == 0
+}
+
+// begin is called before a search context is created. It blocks evaluations
+// until end is called, so that the updates received while the search runs are
+// evaluated against the new context.
+func (s *searchContexts) begin(mbox backend.Mailbox) error {
+	s.evalMutex.Lock()
+	if !s.empty() {
+		return nil
+	}
+
+	// Pending changes are taken into account by the search
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidNext})
+	if err != nil {
+		s.evalMutex.Unlock()
+		return err
+	}
+
+	s.mutex.Lock()
+	s.uidNext = status.UidNext
+	s.changed = nil
+	s.added = false
+	s.mutex.Unlock()
+	return nil
+}
+
+// end is called once a search context has been created.
+func (s *searchContexts) end() {
+	s.evalMutex.Unlock()
+}
+
+func (s *searchContexts) add(su *searchUpdate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = append(s.list, su)
+}
+
+// cancel removes the search context created by the command tagged tag. It
+// returns false if there is no such context.
+func (s *searchContexts) cancel(tag string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, su := range s.list {
+		if su.tag == tag {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// update records a backend update. The messages it affects are evaluated the
+// next time send is called.
+func (s *searchContexts) update(update backend.Update, uid uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.list) == 0 {
+		return
+	}
+
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		if _, ok := update.Items[imap.StatusMessages]; ok {
+			s.added = true
+		}
+	case *backend.MessageUpdate:
+		if uid == 0 {
+			return
+		}
+		if s.changed == nil {
+			s.changed = make(map[uint32]bool)
+		}
+		s.changed[uid] = true
+	}
+}
+
+// forget removes expunged messages from the search contexts. It must be called
+// once the client has been notified, since EXPUNGE and VANISHED responses
+// remove messages from search results too.
+func (s *searchContexts) forget(uids ...uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.list) == 0 {
+		return
+	}
+	for _, su := range s.list {
+		su.results.Forget(uids)
+	}
+	if s.expunged == nil {
+		s.expunged = make(map[uint32]bool)
+	}
+	for _, uid := range uids {
+		delete(s.changed, uid)
+		s.expunged[uid] = true
+	}
+}
+
+// send evaluates the search contexts against the messages which have changed
+// since the last evaluation, and sends ADDTO and REMOVEFROM updates for the
+// contexts whose results have changed.
+//
+// Updates are sent with the sequence numbers of the client's view of the
+// mailbox. Nothing is done while expunges are deferred: as defined in RFC 5267
+// section 4.2, updates are subject to the same restrictions as EXPUNGE
+// responses. Contexts are evaluated once the command deferring expunges
+// completes.
+func (s *searchContexts) send(conn Conn, mbox backend.Mailbox, view *mailboxView) error {
+	s.evalMutex.Lock()
+	defer s.evalMutex.Unlock()
+
+	if view != nil {
+		view.mutex.Lock()
+		deferred := view.deferExpunges > 0
+		view.mutex.Unlock()
+		if deferred {
+			return nil
+		}
+	}
+
+	s.mutex.Lock()
+	list := append([]*searchUpdate(nil), s.list...)
+	candidates := new(imap.SeqSet)
+	for uid := range s.changed {
+		candidates.AddNum(uid)
+	}
+	added, uidNext := s.added, s.uidNext
+	s.changed = nil
+	s.added = false
+	s.expunged = nil
+	s.mutex.Unlock()
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	// The view can't be locked while the backend is called, since the
+	// backend may be waiting for an update to be delivered
+	var newUids []uint32
+	if added {
+		all := new(imap.SeqSet)
+		all.AddRange(uidNext, 0)
+		uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{Uid: all})
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			if uid >= uidNext {
+				newUids = append(newUids, uid)
+			}
+		}
+
+		if len(newUids) > 0 {
+			candidates.AddNum(newUids...)
+
+			s.mutex.Lock()
+			if next := newUids[len(newUids)-1] + 1; next > s.uidNext {
+				s.uidNext = next
+			}
+			s.mutex.Unlock()
+		}
+	}
+	if candidates.Empty() {
+		return nil
+	}
+
+	seqNums := false
+	matches := make([][]uint32, len(list))
+	for i, su := range list {
+		seqNums = seqNums || !su.uid
+
+		set := candidates
+		if su.sorted {
+			// Positions depend on the other results
+			set = new(imap.SeqSet)
+			set.AddSet(candidates)
+			s.mutex.Lock()
+			set.AddNum(su.results.Results()...)
+			s.mutex.Unlock()
+		}
+
+		var err error
+		if matches[i], err = su.search(mbox, set); err != nil {
+			return err
+		}
+	}
+
+	if view != nil {
+		view.mutex.Lock()
+		view.resolveNew(newUids)
+		unknown := view.unknown()
+		view.mutex.Unlock()
+
+		// Sequence numbers of messages whose UID is unknown are needed
+		if unknown && seqNums {
+			uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+			if err != nil {
+				return err
+			}
+			view.mutex.Lock()
+			view.resolve(uids)
+			view.mutex.Unlock()
+		}
+
+		view.mutex.Lock()
+	}
+
+	var resps []imap.WriterTo
+	s.mutex.Lock()
+	for i, su := range list {
+		results := matches[i]
+		if !su.sorted {
+			results = mergeResults(su.results.Results(), candidates, results)
+		}
+		// Messages may have been expunged while searching
+		results = withoutUids(results, s.expunged)
+
+		addTo, removeFrom := su.results.Update(results)
+		if len(addTo) == 0 && len(removeFrom) == 0 {
+			continue
+		}
+
+		if !su.uid {
+			for _, updates := range [][]imap.SearchContextUpdate{addTo, removeFrom} {
+				for i := range updates {
+					updates[i].Ids = view.seqNums(updates[i].Ids)
+				}
+			}
+		}
+
+		resps = append(resps, &responses.ESearch{Data: &imap.SearchData{
+			Tag:        su.tag,
+			Uid:        su.uid,
+			AddTo:      addTo,
+			RemoveFrom: removeFrom,
+		}})
+	}
+	s.mutex.Unlock()
+
+	// Keep the view locked until the responses are queued, so that they're
+	// sent before responses to later updates
+	ctx := conn.Context()
+	var done []chan struct{}
+	for _, res := range resps {
+		ch := make(chan struct{})
+		select {
+		case ctx.Responses <- &response{res, ch}:
+			done = append(done, ch)
+		case <-ctx.LoggedOut:
+		}
+	}
+	if view != nil {
+		view.mutex.Unlock()
+	}
+
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.LoggedOut:
+			return nil
+		}
+	}
+	return nil
+}
+
+// mergeResults returns the new results of an unsorted search context, given
+// the results matching among the candidates which have been evaluated.
+func mergeResults(results []uint32, candidates *imap.SeqSet, matches []uint32) []uint32 {
+	var merged []uint32
+	for _, uid := range results {
+		if !candidates.Contains(uid) {
+			merged = append(merged, uid)
+		}
+	}
+	merged = append(merged, matches...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	return merged
+}
+
+// withoutUids returns the UIDs which aren't in exclude.
+func withoutUids(uids []uint32, exclude map[uint32]bool) []uint32 {
+	if len(exclude) == 0 {
+		return uids
+	}
+
+	var l []uint32
+	for _, uid := range uids {
+		if !exclude[uid] {
+			l = append(l, uid)
+		}
+	}
+	return l
+}
+
+// sendSearchUpdates sends ADDTO and REMOVEFROM updates for the search contexts
+// of the currently selected mailbox, if the backend doesn't send updates. It's
+// called after each command: searches are run again to find out which results
+// have changed.
+func sendSearchUpdates(conn Conn) error {
+	ctx := conn.Context()
+	if conn.Server().Updates != nil || ctx.searches == nil || ctx.searches.empty() {
+		return nil
+	}
+
+	mbox := commandMailbox(conn, ctx.Mailbox)
+	all, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		return err
+	}
+	seqNums := make(map[uint32]uint32, len(all))
+	for i, uid := range all {
+		seqNums[uid] = uint32(i + 1)
+	}
+
+	s := ctx.searches
+	s.mutex.Lock()
+	list := append([]*searchUpdate(nil), s.list...)
+	s.mutex.Unlock()
+
+	for _, su := range list {
+		// Expunged messages have already been removed from the client's view
+		var expunged []uint32
+		for _, uid := range su.results.Results() {
+			if _, ok := seqNums[uid]; !ok {
+				expunged = append(expunged, uid)
+			}
+		}
+		su.results.Forget(expunged)
+
+		uids, err := su.search(mbox, nil)
+		if err != nil {
+			return err
+		}
+
+		addTo, removeFrom := su.results.Update(uids)
+		if len(addTo) == 0 && len(removeFrom) == 0 {
+			continue
+		}
+
+		if !su.uid {
+			for _, updates := range [][]imap.SearchContextUpdate{addTo, removeFrom} {
+				for _, update := range updates {
+					for i, uid := range update.Ids {
+						update.Ids[i] = seqNums[uid]
+					}
+				}
+			}
+		}
+
+		res := &responses.ESearch{Data: &imap.SearchData{
+			Tag:        su.tag,
+			Uid:        su.uid,
+			AddTo:      addTo,
+			RemoveFrom: removeFrom,
+		}}
+		if err := conn.WriteResp(res); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -20,6 +22,19 @@ import (
 // The minimum autologout duration defined in RFC 3501 section 5.4.
 const MinAutoLogout = 30 * time.Minute
 
+// DefaultProgressInterval is the default value of Server.ProgressInterval.
+const DefaultProgressInterval = 10 * time.Second
+
+// DefaultShutdownMessage is the default value of Server.ShutdownMessage.
+const DefaultShutdownMessage = "Server shutting down"
+
+// How often Shutdown checks whether all connections are closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// ErrServerClosed is returned by Serve after the server has been closed or
+// shut down.
+var ErrServerClosed = errors.New("imap: server closed")
+
 // A command handler.
 type Handler interface {
 	imap.Parser
@@ -85,13 +100,26 @@ func ErrNoStatusResp() error {
 
 // An IMAP server.
 type Server struct {
+	// The number of connections accepted so far, accessed atomically and kept
+	// first for 64-bit alignment
+	connCount uint64
+
 	locker    sync.Mutex
 	listeners map[net.Listener]struct{}
 	conns     map[Conn]struct{}
+	closed    bool
+	// The number of connections per IP address and per user
+	hostConns map[string]int
+	userConns map[string]int
+	// The certificates presented on TLS connections accepted by ServeTLS,
+	// until they're taken by newConn
+	servedCerts map[*tls.Conn]*servedCert
 
 	commands   map[string]HandlerFactory
 	auths      map[string]SASLServerFactory
 	extensions []Extension
+	// Used to derive the SCRAM salts of users who don't exist
+	scramSecret []byte
 
 	// TCP address to listen on.
 	Addr string
@@ -99,6 +127,9 @@ type Server struct {
 	TLSConfig *tls.Config
 	// This server's backend.
 	Backend backend.Backend
+	// If set, checks credentials for LOGIN and AUTHENTICATE PLAIN instead of
+	// Backend.Login. The backend must implement backend.UserBackend.
+	Authenticator backend.Authenticator
 	// Backend updates that will be sent to connected clients.
 	Updates <-chan backend.Update
 	// Automatically logout clients after a duration. To do not logout users
@@ -107,8 +138,13 @@ type Server struct {
 	AutoLogout time.Duration
 	// Allow authentication over unencrypted connections.
 	AllowInsecureAuth bool
-	// An io.Writer to which all network activity will be mirrored.
+	// An io.Writer to which all network activity will be mirrored, including
+	// credentials.
 	Debug io.Writer
+	// If not nil, network activity is logged to it line by line, with
+	// credentials redacted and literals truncated. It takes precedence over
+	// Debug.
+	DebugLog *imap.DebugLogger
 	// ErrorLog specifies an optional logger for errors accepting
 	// connections and unexpected behavior from handlers.
 	// If nil, logging goes to os.Stderr via the log package's
@@ -117,25 +153,78 @@ type Server struct {
 	// The maximum literal size, in bytes. Literals exceeding this size will be
 	// rejected. A value of zero disables the limit (this is the default).
 	MaxLiteralSize uint32
+	// Literals larger than this are written to a temporary file in
+	// LiteralTempDir instead of being kept in memory, in bytes. If zero,
+	// literals are kept in memory. Messages appended with APPEND are never
+	// kept in memory: they are read from the connection while the backend
+	// consumes them.
+	MaxMemoryLiteralSize uint32
+	// The directory in which temporary files holding literals are created. If
+	// empty, os.TempDir is used.
+	LiteralTempDir string
+	// The minimum duration between two INPROGRESS notifications sent while a
+	// long-running command is executed, as defined in RFC 9585. The first one
+	// is sent after the command has run for this duration. If zero,
+	// DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+	// The text of the BYE response sent to clients when the server shuts
+	// down. If empty, DefaultShutdownMessage is used.
+	ShutdownMessage string
+	// The maximum number of connections. If zero, the number of connections
+	// isn't limited. Clients connecting while the limit is reached get a BYE
+	// response with the UNAVAILABLE response code, as defined in RFC 5530.
+	MaxConns int
+	// The maximum number of connections from a single IP address. If zero,
+	// it isn't limited.
+	MaxConnsPerIP int
+	// The maximum number of connections authenticated as a single user. If
+	// zero, it isn't limited. Authentication fails with the UNAVAILABLE
+	// response code when the limit is reached.
+	MaxConnsPerUser int
+	// If not nil, throttles failed authentication attempts.
+	AuthThrottle *AuthThrottle
+	// If not nil, notified of connections, commands and authentication
+	// attempts.
+	Observer Observer
+	// The maximum number of pipelined commands a connection executes
+	// concurrently, as allowed by RFC 3501 section 5.5. Only commands which
+	// can't affect the results of other commands, such as FETCH, SEARCH,
+	// STATUS and LIST, are executed concurrently, see ConcurrentHandler.
+	// Responses are sent in the order of the commands. If zero or one,
+	// commands are executed one at a time. Otherwise, the backend must support
+	// concurrent calls on the users and mailboxes of a single connection.
+	MaxPipelined int
+	// Connections from these networks start with a PROXY protocol header,
+	// version 1 or 2, as sent by load balancers such as HAProxy. The client
+	// address and the TLS termination information of the header are used in
+	// place of the ones of the connection, e.g. in ConnInfo and for connection
+	// limits. Connections whose header is invalid are closed. Connections from
+	// other networks are handled as usual. Per-IP limits and AuthThrottle
+	// don't apply to the proxies' own addresses. See also ProxyListener.
+	TrustedProxies []*net.IPNet
 }
 
 // Create a new IMAP server from an existing listener.
 func New(bkd backend.Backend) *Server {
 	s := &Server{
-		listeners: make(map[net.Listener]struct{}),
-		conns:     make(map[Conn]struct{}),
-		Backend:   bkd,
-		ErrorLog:  log.New(os.Stderr, "imap/server: ", log.LstdFlags),
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[Conn]struct{}),
+		servedCerts: make(map[*tls.Conn]*servedCert),
+		hostConns:   make(map[string]int),
+		userConns:   make(map[string]int),
+		Backend:     bkd,
+		ErrorLog:    log.New(os.Stderr, "imap/server: ", log.LstdFlags),
+	}
+
+	s.scramSecret = make([]byte, 32)
+	if _, err := rand.Read(s.scramSecret); err != nil {
+		panic(err)
 	}
 
 	s.auths = map[string]SASLServerFactory{
 		sasl.Plain: func(conn Conn) sasl.Server {
 			return sasl.NewPlainServer(func(identity, username, password string) error {
-				if identity != "" && identity != username {
-					return errors.New("Identities not supported")
-				}
-
-				user, err := bkd.Login(conn.Info(), username, password)
+				user, err := s.login(conn, identity, username, password)
 				if err != nil {
 					return err
 				}
@@ -157,6 +246,8 @@ func New(bkd backend.Backend) *Server {
 		"LOGIN":        func() Handler { return &Login{} },
 		"AUTHENTICATE": func() Handler { return &Authenticate{} },
 
+		"ENABLE": func() Handler { return &Enable{} },
+
 		"SELECT": func() Handler { return &Select{} },
 		"EXAMINE": func() Handler {
 			hdlr := &Select{}
@@ -177,22 +268,64 @@ func New(bkd backend.Backend) *Server {
 		"STATUS": func() Handler { return &Status{} },
 		"APPEND": func() Handler { return &Append{} },
 
-		"CHECK":   func() Handler { return &Check{} },
-		"CLOSE":   func() Handler { return &Close{} },
-		"EXPUNGE": func() Handler { return &Expunge{} },
-		"SEARCH":  func() Handler { return &Search{} },
-		"FETCH":   func() Handler { return &Fetch{} },
-		"STORE":   func() Handler { return &Store{} },
-		"COPY":    func() Handler { return &Copy{} },
-		"UID":     func() Handler { return &Uid{} },
+		"CHECK":    func() Handler { return &Check{} },
+		"CLOSE":    func() Handler { return &Close{} },
+		"UNSELECT": func() Handler { return &Unselect{} },
+		"EXPUNGE":  func() Handler { return &Expunge{} },
+		"SEARCH":   func() Handler { return &Search{} },
+		"SORT":     func() Handler { return &Sort{} },
+		"FETCH":    func() Handler { return &Fetch{} },
+		"STORE":    func() Handler { return &Store{} },
+		"COPY":     func() Handler { return &Copy{} },
+		"UID":      func() Handler { return &Uid{} },
+
+		"CANCELUPDATE": func() Handler { return &CancelUpdate{} },
 	}
 
 	return s
 }
 
+// login authenticates a user with a password. authzid is the identity the
+// client wants to act as, empty to act as username.
+func (s *Server) login(conn Conn, authzid, username, password string) (backend.User, error) {
+	if s.Authenticator == nil {
+		if authzid != "" && authzid != username {
+			return nil, errors.New("Identities not supported")
+		}
+		user, err := s.Backend.Login(conn.Info(), username, password)
+		return user, loginRejected(conn, err)
+	}
+
+	be, ok := s.Backend.(backend.UserBackend)
+	if !ok {
+		return nil, errors.New("Backend doesn't support authenticators")
+	}
+
+	identity, err := s.Authenticator.Authenticate(conn.Info(), authzid, username, password)
+	if err != nil {
+		return nil, loginRejected(conn, err)
+	}
+	user, err := be.LookupUser(conn.Info(), identity)
+	return user, loginRejected(conn, err)
+}
+
+// loginRejected marks the login attempt of a connection as rejected by the
+// backend if err isn't nil, so that it's counted by AuthThrottle.
+func loginRejected(conn Conn, err error) error {
+	if err != nil {
+		conn.Context().loginRejected = true
+	}
+	return err
+}
+
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
 	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
 	s.listeners[l] = struct{}{}
 	s.locker.Unlock()
 
@@ -212,10 +345,16 @@ func (s *Server) Serve(l net.Listener) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			s.locker.Lock()
+			closed := s.closed
+			s.locker.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		var conn Conn = newConn(s, c)
+		var conn Conn = newConn(s, s.proxyConn(c))
 		for _, ext := range s.extensions {
 			if ext, ok := ext.(ConnExtension); ok {
 				conn = ext.NewConn(conn)
@@ -254,24 +393,88 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":imaps"
 	}
 
-	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.ServeTLS(l)
+}
+
+// ServeTLS accepts incoming connections on the Listener l and performs TLS
+// handshakes with s.TLSConfig.
+//
+// Unlike passing a TLS listener to Serve, this allows the server to know the
+// certificate it presents on each connection, which is needed by the
+// tls-server-end-point channel binding type of SCRAM-SHA-256-PLUS.
+func (s *Server) ServeTLS(l net.Listener) error {
+	return s.Serve(&tlsListener{s.ProxyListener(l), s})
+}
+
+type tlsListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	served := new(servedCert)
+	tlsConn := tls.Server(c, served.wrap(l.s.TLSConfig))
+
+	l.s.locker.Lock()
+	l.s.servedCerts[tlsConn] = served
+	l.s.locker.Unlock()
+	return tlsConn, nil
+}
+
+// takeServedCert returns the certificate recorded for a TLS connection
+// accepted by ServeTLS, if any.
+func (s *Server) takeServedCert(c *tls.Conn) *servedCert {
+	if c == nil {
+		return nil
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	served := s.servedCerts[c]
+	delete(s.servedCerts, c)
+	return served
 }
 
 func (s *Server) serveConn(conn Conn) error {
+	// Read the PROXY protocol header, if any, before the client address is
+	// used with the server locked
+	conn.Info()
+
 	s.locker.Lock()
-	s.conns[conn] = struct{}{}
+	if info := s.acquireConn(conn); info != "" {
+		s.locker.Unlock()
+		defer conn.Close()
+		return conn.reject(info)
+	}
+	if s.closed {
+		// The server has been shut down while the connection was accepted
+		conn.shutdown()
+	}
 	s.locker.Unlock()
 
+	if s.Observer != nil {
+		s.Observer.ConnOpened(conn)
+	}
+
 	defer func() {
 		s.locker.Lock()
-		defer s.locker.Unlock()
 		conn.Close()
-		delete(s.conns, conn)
+		s.releaseConn(conn)
+		s.locker.Unlock()
+
+		if s.Observer != nil {
+			s.Observer.ConnClosed(conn)
+		}
 	}()
 
 	return conn.serve(conn)
@@ -336,21 +539,67 @@ func (s *Server) listenUpdates() {
 			if update.Mailbox() != "" && (ctx.Mailbox == nil || ctx.Mailbox.Name() != update.Mailbox()) {
 				continue
 			}
-			if *conn.silent() {
-				// If silent is set, do not send message updates
-				if _, ok := res.(*responses.Fetch); ok {
-					continue
-				}
-			}
+			uidOnly := ctx.Enabled[uidOnlyCap]
+			silent := *conn.silent()
+			view := ctx.view
+			mbox, searches := ctx.Mailbox, ctx.searches
 
 			conn := conn // Copy conn to a local variable
 			go func() {
-				done := make(chan struct{})
-				conn.Context().Responses <- &response{
-					response: res,
-					done:     done,
+				res := res
+				uid := updateUid(update)
+				if view != nil {
+					// Translate sequence numbers, and keep the view locked
+					// until the response is queued so that responses are
+					// sent in order
+					view.mutex.Lock()
+					if uid == 0 {
+						uid = view.uid(update)
+					}
+					res = view.updateResp(update, res)
+				}
+				if res != nil && uidOnly {
+					res = uidOnlyUpdateResp(update, res)
+				}
+				if _, ok := res.(*responses.Fetch); ok && silent {
+					// If silent is set, do not send message updates
+					res = nil
+				}
+
+				// The connection may be closed meanwhile, don't wait for
+				// responses which won't be sent
+				loggedOut := conn.Context().LoggedOut
+				var done chan struct{}
+				if res != nil {
+					done = make(chan struct{})
+					select {
+					case conn.Context().Responses <- &response{
+						response: res,
+						done:     done,
+					}:
+					case <-loggedOut:
+						done = nil
+					}
+				}
+				if view != nil {
+					view.mutex.Unlock()
+				}
+				if done != nil {
+					select {
+					case <-done:
+					case <-loggedOut:
+					}
+				}
+
+				if searches != nil {
+					if _, ok := update.(*backend.ExpungeUpdate); ok && view == nil && uid != 0 {
+						searches.forget(uid)
+					}
+					searches.update(update, uid)
+					if err := searches.send(conn, mbox, view); err != nil {
+						s.ErrorLog.Println("cannot send search updates:", err)
+					}
 				}
-				<-done
 				sends <- struct{}{}
 			}()
 
@@ -372,6 +621,45 @@ func (s *Server) listenUpdates() {
 	}
 }
 
+// updateUid returns the UID of the message affected by a backend update, zero
+// if unknown.
+func updateUid(update backend.Update) uint32 {
+	switch update := update.(type) {
+	case *backend.MessageUpdate:
+		return update.Uid
+	case *backend.ExpungeUpdate:
+		return update.Uid
+	}
+	return 0
+}
+
+// uidOnlyUpdateResp returns the response to send for an update to a client
+// which has enabled UIDONLY. Message and expunge updates can't use sequence
+// numbers, nil is returned if they don't contain a UID.
+func uidOnlyUpdateResp(update backend.Update, res imap.WriterTo) imap.WriterTo {
+	switch update := update.(type) {
+	case *backend.MessageUpdate:
+		if update.Message.Uid == 0 {
+			return nil
+		}
+
+		ch := make(chan *imap.Message, 1)
+		ch <- update.Message
+		close(ch)
+
+		return &responses.Fetch{Messages: ch, Uid: true}
+	case *backend.ExpungeUpdate:
+		if update.Uid == 0 {
+			return nil
+		}
+
+		uids := new(imap.SeqSet)
+		uids.AddNum(update.Uid)
+		return &responses.Vanished{Uids: uids}
+	}
+	return res
+}
+
 // ForEachConn iterates through all opened connections.
 func (s *Server) ForEachConn(f func(Conn)) {
 	s.locker.Lock()
@@ -386,6 +674,8 @@ func (s *Server) Close() error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
+	s.closed = true
+
 	for l := range s.listeners {
 		l.Close()
 	}
@@ -397,6 +687,55 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting connections,
+// lets the commands being handled complete, then sends a BYE response to
+// clients and closes their connections. If ctx expires before all connections
+// are closed, the remaining ones are closed immediately and ctx.Err() is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.locker.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.shutdown()
+	}
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.locker.Lock()
+		n := len(s.conns)
+		s.locker.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// backendSupports checks whether the backend supports an extension.
+func (s *Server) backendSupports(ext backend.Extension) bool {
+	be, ok := s.Backend.(backend.ExtensionBackend)
+	if !ok {
+		return false
+	}
+	for _, e := range be.SupportedExtensions() {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
 // Enable some IMAP extensions on this server.
 // Wiki entry: https://github.com/emersion/go-imap/wiki/Using-extensions
 func (s *Server) Enable(extensions ...Extension) {
@@ -2,9 +2,18 @@ package server_test
 
 import (
 	"bufio"
+	"context"
+	"io"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/backend/memory"
 	"github.com/emersion/go-imap/server"
 )
@@ -44,3 +53,226 @@ func TestServer_greeting(t *testing.T) {
 		t.Fatal("Bad greeting:", greeting)
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	bkd := memory.New()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(bkd)
+	s.ShutdownMessage = "Be right back"
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Greeting
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal("Shutdown() =", err)
+	}
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE Be right back" {
+		t.Fatal("Invalid BYE response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+
+	if err := <-done; err != server.ErrServerClosed {
+		t.Errorf("Serve() = %v, want %v", err, server.ErrServerClosed)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Server accepts connections after Shutdown()")
+	}
+}
+
+func TestServer_Shutdown_inFlight(t *testing.T) {
+	s, c, scanner, be := testServerBlocking(t)
+	defer c.Close()
+
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	<-be.searching
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown() returned before the command completed:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(be.unblock)
+	for _, want := range []string{"* SEARCH 1 2 3", "a002 OK ", "* BYE "} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown() =", err)
+	}
+	if n := atomic.LoadInt32(&be.logouts); n != 1 {
+		t.Errorf("User.Logout() called %v times, want 1", n)
+	}
+}
+
+func TestServer_Shutdown_timeout(t *testing.T) {
+	s, c, _, be := testServerBlocking(t)
+	defer c.Close()
+	defer close(be.unblock)
+
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	<-be.searching
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if n := atomic.LoadInt32(&be.logouts); n != 1 {
+		t.Errorf("User.Logout() called %v times, want 1", n)
+	}
+}
+
+func TestServer_DebugLog(t *testing.T) {
+	var locker sync.Mutex
+	var records []imap.DebugRecord
+	s, c, scanner, addr := testServerConfig(t, func(s *server.Server) {
+		s.DebugLog = &imap.DebugLogger{
+			Handler: func(rec *imap.DebugRecord) {
+				locker.Lock()
+				records = append(records, *rec)
+				locker.Unlock()
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	c2, _, _ := dialGreeted(t, addr)
+	defer c2.Close()
+
+	// AHVzZXJuYW1lAHBhc3N3b3Jk is base64 for "\x00username\x00password"
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 LOGOUT\r\n")
+	for scanner.Scan() {
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	ids := make(map[string]bool)
+	var lines []string
+	for _, rec := range records {
+		ids[rec.ConnID] = true
+		if rec.ConnID == records[0].ConnID {
+			lines = append(lines, rec.Direction.String()+": "+rec.Line)
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("Got %v connection IDs, want 2", len(ids))
+	}
+
+	want := []string{
+		"C: a001 AUTHENTICATE PLAIN [redacted]",
+		"C: a002 LOGOUT",
+		"S: * BYE Closing connection",
+		"S: a002 OK LOGOUT completed",
+	}
+	if len(lines) < 2+len(want) {
+		t.Fatalf("Got %v records, want at least %v:\n%v", len(lines), 2+len(want), strings.Join(lines, "\n"))
+	}
+	lines = lines[1:] // Greeting
+	if lines[0] != want[0] || !strings.HasPrefix(lines[1], "S: a001 OK ") {
+		t.Errorf("Invalid authentication records:\n%v", strings.Join(lines[:2], "\n"))
+	}
+	if got := lines[2:]; !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("Invalid records: got %q, want %q", got, want[1:])
+	}
+}
+
+// updatesBackend is a backend whose updates are sent by tests.
+type updatesBackend struct {
+	*memory.Backend
+	updates chan backend.Update
+}
+
+func (be *updatesBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func TestServer_updatesDisconnected(t *testing.T) {
+	be := &updatesBackend{
+		Backend: memory.New(),
+		updates: make(chan backend.Update),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(be)
+	defer s.Close()
+	go s.Serve(l)
+
+	// Clients disconnecting while updates are delivered to them mustn't
+	// prevent the updates from completing
+	for i := 0; i < 20; i++ {
+		var conns []net.Conn
+		for j := 0; j < 10; j++ {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal("Cannot connect to server:", err)
+			}
+			bufio.NewReader(c).ReadString('\n') // Greeting
+			conns = append(conns, c)
+		}
+
+		var dones []chan struct{}
+		for j := 0; j < 50; j++ {
+			update := &backend.StatusUpdate{
+				Update: backend.NewUpdate("", ""),
+				StatusResp: &imap.StatusResp{
+					Type: imap.StatusRespOk,
+					Info: "Update",
+				},
+			}
+			dones = append(dones, update.Done())
+			be.updates <- update
+
+			if j == 0 {
+				for _, c := range conns {
+					c.Close()
+				}
+			}
+		}
+
+		for _, done := range dones {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Update not completed")
+			}
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+)
+
+// viewEntry is a message of a mailboxView.
+type viewEntry struct {
+	// The UID of the message, zero if unknown
+	uid uint32
+	// True if the message has been expunged, but the client hasn't been
+	// notified yet
+	expunged bool
+}
+
+// mailboxView is the client's view of the selected mailbox: the messages it
+// knows about, in the order of their sequence numbers.
+//
+// Backends send updates with the sequence numbers of their own view of the
+// mailbox, which can differ from the client's, for instance because the
+// server defers expunges while a FETCH, STORE or SEARCH command is in
+// progress. Updates are translated with the view, using UIDs.
+type mailboxView struct {
+	// Locked while updating the view and sending the responses resulting
+	// from the update, so that responses are sent in order
+	mutex   sync.Mutex
+	entries []viewEntry
+	// The number of entries at the start of entries whose UID is known.
+	// UIDs are ascending, so these are found with a binary search.
+	known int
+	// The number of entries whose expunge has been deferred
+	expunged int
+	// The number of commands in progress during which EXPUNGE responses
+	// can't be sent, as defined in RFC 3501 section 7.4.1
+	deferExpunges int
+	// The search contexts to remove expunged messages from
+	searches *searchContexts
+}
+
+func newMailboxView(uids []uint32) *mailboxView {
+	entries := make([]viewEntry, len(uids))
+	for i, uid := range uids {
+		entries[i] = viewEntry{uid: uid}
+	}
+	return &mailboxView{entries: entries, known: len(entries)}
+}
+
+// find returns the index of the message with the given UID, or -1 if its UID
+// is unknown. The view must be locked.
+func (v *mailboxView) find(uid uint32) int {
+	i := sort.Search(v.known, func(i int) bool {
+		return v.entries[i].uid >= uid
+	})
+	if i < v.known && v.entries[i].uid == uid {
+		return i
+	}
+
+	// Messages added since UIDs were last resolved
+	for i := v.known; i < len(v.entries); i++ {
+		if v.entries[i].uid == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// setUid sets the UID of the message at index i. The view must be locked.
+func (v *mailboxView) setUid(i int, uid uint32) {
+	v.entries[i].uid = uid
+	for v.known < len(v.entries) && v.entries[v.known].uid != 0 {
+		v.known++
+	}
+}
+
+// index returns the index of a message identified by a backend update, or -1
+// if the client doesn't know about it. The view must be locked.
+func (v *mailboxView) index(seqNum, uid uint32) int {
+	if uid != 0 {
+		if i := v.find(uid); i >= 0 && !v.entries[i].expunged {
+			return i
+		}
+	}
+
+	if v.expunged == 0 {
+		i := int(seqNum) - 1
+		if i < 0 || i >= len(v.entries) || (uid != 0 && v.entries[i].uid != 0) {
+			return -1
+		}
+		return i
+	}
+
+	// The sequence numbers of the backend don't take deferred expunges into
+	// account
+	var n uint32
+	for i, e := range v.entries {
+		if e.expunged {
+			continue
+		}
+		n++
+		if n == seqNum {
+			if uid != 0 && e.uid != 0 {
+				// Another message
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// uid returns the UID of the message affected by a backend update which
+// doesn't carry it, zero if unknown. The view must be locked.
+func (v *mailboxView) uid(update backend.Update) uint32 {
+	var seqNum uint32
+	switch update := update.(type) {
+	case *backend.MessageUpdate:
+		seqNum = update.SeqNum
+	case *backend.ExpungeUpdate:
+		seqNum = update.SeqNum
+	default:
+		return 0
+	}
+
+	if i := v.index(seqNum, 0); i >= 0 {
+		return v.entries[i].uid
+	}
+	return 0
+}
+
+// unknown checks whether the UID of some messages is unknown. The view must be
+// locked.
+func (v *mailboxView) unknown() bool {
+	return v.known < len(v.entries)
+}
+
+// resolve populates unknown UIDs with the UIDs of all messages in the
+// mailbox. Nothing is done if they don't match the client's view, for
+// instance because an update hasn't been delivered yet. The view must be
+// locked.
+func (v *mailboxView) resolve(uids []uint32) {
+	var entries []int
+	for i := range v.entries {
+		if !v.entries[i].expunged {
+			entries = append(entries, i)
+		}
+	}
+	if len(entries) != len(uids) {
+		return
+	}
+
+	for i, j := range entries {
+		if uid := v.entries[j].uid; uid != 0 && uid != uids[i] {
+			return
+		}
+	}
+	for i, j := range entries {
+		v.setUid(j, uids[i])
+	}
+}
+
+// resolveNew populates the unknown UIDs of the last messages with the UIDs of
+// messages which have been added to the mailbox, in ascending order. The view
+// must be locked.
+func (v *mailboxView) resolveNew(uids []uint32) {
+	i := len(v.entries)
+	for i > 0 && v.entries[i-1].uid == 0 {
+		i--
+	}
+	unknown := v.entries[i:]
+	if len(unknown) == 0 {
+		return
+	}
+
+	var last uint32
+	if i > 0 {
+		last = v.entries[i-1].uid
+	}
+	var added []uint32
+	for _, uid := range uids {
+		if uid > last {
+			added = append(added, uid)
+		}
+	}
+	// Messages may have been added after the last EXISTS response
+	if len(added) < len(unknown) {
+		return
+	}
+	for j := range unknown {
+		v.setUid(i+j, added[j])
+	}
+}
+
+// seqNums returns the sequence numbers of messages identified by their UIDs in
+// the client's view. Messages which aren't in the view are skipped. The view
+// must be locked.
+func (v *mailboxView) seqNums(uids []uint32) []uint32 {
+	var l []uint32
+	for _, uid := range uids {
+		if i := v.find(uid); i >= 0 {
+			l = append(l, uint32(i+1))
+		}
+	}
+	return l
+}
+
+// remove removes the message at index i from the view. The view must be
+// locked.
+func (v *mailboxView) remove(i int) {
+	if uid := v.entries[i].uid; uid != 0 && v.searches != nil {
+		v.searches.forget(uid)
+	}
+	if v.entries[i].expunged {
+		v.expunged--
+	}
+	if i < v.known {
+		v.known--
+	}
+	v.entries = append(v.entries[:i], v.entries[i+1:]...)
+}
+
+// updateResp updates the view and returns the response to send to the client
+// for a backend update, or nil if no response should be sent. The view must
+// be locked.
+func (v *mailboxView) updateResp(update backend.Update, res imap.WriterTo) imap.WriterTo {
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		if _, ok := update.Items[imap.StatusMessages]; !ok {
+			return res
+		}
+
+		// Backends don't count messages whose expunge has been deferred
+		n := update.Messages
+		for _, e := range v.entries {
+			if e.expunged {
+				n++
+			}
+		}
+		// EXISTS can't decrease the number of messages
+		for uint32(len(v.entries)) < n {
+			v.entries = append(v.entries, viewEntry{})
+		}
+		n = uint32(len(v.entries))
+
+		if n == update.Messages {
+			return res
+		}
+		return &responses.Select{Mailbox: withMessages(update.MailboxStatus, n)}
+	case *backend.MessageUpdate:
+		i := v.index(update.SeqNum, update.Uid)
+		if i < 0 {
+			return nil
+		}
+		if update.Uid != 0 {
+			v.setUid(i, update.Uid)
+		}
+
+		seqNum := uint32(i + 1)
+		if seqNum == update.SeqNum {
+			return res
+		}
+		msg := *update.Message
+		msg.SeqNum = seqNum
+
+		ch := make(chan *imap.Message, 1)
+		ch <- &msg
+		close(ch)
+		return &responses.Fetch{Messages: ch}
+	case *backend.ExpungeUpdate:
+		i := v.index(update.SeqNum, update.Uid)
+		if i < 0 {
+			return nil
+		}
+		if update.Uid != 0 {
+			v.setUid(i, update.Uid)
+		}
+
+		if v.deferExpunges > 0 {
+			v.entries[i].expunged = true
+			v.expunged++
+			return nil
+		}
+		v.remove(i)
+
+		seqNum := uint32(i + 1)
+		if seqNum == update.SeqNum {
+			return res
+		}
+		ch := make(chan uint32, 1)
+		ch <- seqNum
+		close(ch)
+		return &responses.Expunge{SeqNums: ch}
+	}
+	return res
+}
+
+// flushExpunges removes the messages whose expunge has been deferred from the
+// view, and returns the response to send to the client. The view must be
+// locked.
+func (v *mailboxView) flushExpunges() imap.WriterTo {
+	if v.expunged == 0 {
+		return nil
+	}
+
+	var seqNums []uint32
+	for i := len(v.entries) - 1; i >= 0; i-- {
+		if !v.entries[i].expunged {
+			continue
+		}
+		// Sequence numbers are listed from the last to the first one, as
+		// expunging a message changes the sequence numbers of the next ones
+		seqNums = append(seqNums, uint32(i+1))
+		v.remove(i)
+	}
+
+	ch := make(chan uint32, len(seqNums))
+	for _, seqNum := range seqNums {
+		ch <- seqNum
+	}
+	close(ch)
+	return &responses.Expunge{SeqNums: ch}
+}
+
+// withMessages returns a copy of status with a different number of messages.
+func withMessages(status *imap.MailboxStatus, n uint32) *imap.MailboxStatus {
+	status.ItemsLocker.Lock()
+	items := make(map[imap.StatusItem]interface{}, len(status.Items))
+	for k, v := range status.Items {
+		items[k] = v
+	}
+	status.ItemsLocker.Unlock()
+
+	return &imap.MailboxStatus{
+		Name:           status.Name,
+		ReadOnly:       status.ReadOnly,
+		Items:          items,
+		Flags:          status.Flags,
+		PermanentFlags: status.PermanentFlags,
+		UnseenSeqNum:   status.UnseenSeqNum,
+		Messages:       n,
+		Recent:         status.Recent,
+		Unseen:         status.Unseen,
+		UidNext:        status.UidNext,
+		UidValidity:    status.UidValidity,
+		MailboxId:      status.MailboxId,
+		Size:           status.Size,
+	}
+}
+
+// defersExpunges checks whether EXPUNGE responses must be deferred while cmd
+// is in progress. As defined in RFC 3501 section 7.4.1, they can't be sent
+// while responding to FETCH, STORE or SEARCH, since clients use sequence
+// numbers to refer to messages in these commands.
+func defersExpunges(cmd *imap.Command) bool {
+	name := cmd.Name
+	if name == "UID" && len(cmd.Arguments) > 0 {
+		inner, _ := cmd.Arguments[0].(string)
+		name = strings.ToUpper(inner)
+	}
+
+	switch name {
+	case "FETCH", "STORE", "SEARCH", "SORT":
+		return true
+	}
+	return false
+}
+
+// selectMailbox sets the selected mailbox of a connection. view is the
+// client's view of the mailbox, if the backend sends updates.
+func selectMailbox(conn Conn, mbox backend.Mailbox, view *mailboxView) {
+	s := conn.Server()
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ctx := conn.Context()
+	ctx.Mailbox = mbox
+	ctx.view = view
+	ctx.searches = nil
+	if mbox != nil {
+		ctx.searches = new(searchContexts)
+	}
+	if view != nil {
+		view.searches = ctx.searches
+	}
+}
+
+// unselectMailbox unselects the selected mailbox of a connection, if any.
+// Backends implementing backend.SessionMailbox are notified.
+func unselectMailbox(conn Conn) error {
+	ctx := conn.Context()
+	mbox := ctx.Mailbox
+
+	selectMailbox(conn, nil, nil)
+	ctx.MailboxReadOnly = false
+
+	if sessionMbox, ok := mbox.(backend.SessionMailbox); ok {
+		return sessionMbox.Unselect()
+	}
+	return nil
+}
+
+// newView creates the client's view of a mailbox which has just been
+// selected. nil is returned if the backend doesn't send updates, or if the
+// client has enabled UIDONLY: it doesn't use sequence numbers, and expunges are
+// never deferred.
+func newView(conn Conn, mbox backend.Mailbox) (*mailboxView, error) {
+	if conn.Server().Updates == nil || conn.Context().Enabled[uidOnlyCap] {
+		return nil, nil
+	}
+
+	uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		return nil, err
+	}
+	return newMailboxView(uids), nil
+}
+
+// beginCommand prepares the view of the selected mailbox before a command is
+// handled. If pipelined is true, the command may be executed concurrently with
+// others, so expunges are deferred whatever the command. It returns the view
+// whose expunges are deferred until endCommand is called, if any.
+func (c *conn) beginCommand(cmd *imap.Command, pipelined bool) *mailboxView {
+	view := c.ctx.view
+	if view == nil || c.ctx.Mailbox == nil {
+		return nil
+	}
+
+	view.mutex.Lock()
+	unknown := view.unknown()
+	view.mutex.Unlock()
+
+	// The view can't be locked while the backend is called, since the
+	// backend may be waiting for an update to be delivered
+	if unknown {
+		mbox := commandMailbox(c.conn, c.ctx.Mailbox)
+		if uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{}); err == nil {
+			view.mutex.Lock()
+			view.resolve(uids)
+			view.mutex.Unlock()
+		}
+	}
+
+	if !pipelined && !defersExpunges(cmd) {
+		return nil
+	}
+
+	view.mutex.Lock()
+	view.deferExpunges++
+	view.mutex.Unlock()
+	return view
+}
+
+// endCommand sends the expunges deferred while a command was in progress, once
+// no other command requires them to be deferred. deferred is the view
+// returned by beginCommand.
+func (c *conn) endCommand(deferred *mailboxView) {
+	if deferred != nil {
+		deferred.mutex.Lock()
+		deferred.deferExpunges--
+		deferred.mutex.Unlock()
+	}
+
+	view := c.ctx.view
+	if view == nil {
+		return
+	}
+
+	view.mutex.Lock()
+	if view.deferExpunges > 0 {
+		view.mutex.Unlock()
+		return
+	}
+	res := view.flushExpunges()
+	if res != nil {
+		// Keep the view locked until the response is queued, so that it's
+		// sent before responses to later updates
+		done := make(chan struct{})
+		c.responses <- &response{res, done}
+		view.mutex.Unlock()
+		<-done
+	} else {
+		view.mutex.Unlock()
+	}
+
+	// Search contexts aren't evaluated while expunges are deferred
+	if searches := c.ctx.searches; searches != nil {
+		if err := searches.send(c.conn, c.ctx.Mailbox, view); err != nil {
+			c.s.ErrorLog.Println("cannot send search updates:", err)
+		}
+	}
+}
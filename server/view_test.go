@@ -0,0 +1,324 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// blockingBackend is a backend whose SearchMessages blocks until unblock is
+// closed when searching sequence numbers. It counts calls to User.Logout and
+// Mailbox.SearchMessages.
+type blockingBackend struct {
+	*memory.Backend
+	searching chan struct{}
+	unblock   chan struct{}
+	logouts   int32
+	searches  int32
+}
+
+func (be *blockingBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingUser{u, be}, nil
+}
+
+type blockingUser struct {
+	backend.User
+	be *blockingBackend
+}
+
+func (u *blockingUser) Logout() error {
+	atomic.AddInt32(&u.be.logouts, 1)
+	return u.User.Logout()
+}
+
+func (u *blockingUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingMailbox{mbox, u.be}, nil
+}
+
+type blockingMailbox struct {
+	backend.Mailbox
+	be *blockingBackend
+}
+
+func (mbox *blockingMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	atomic.AddInt32(&mbox.be.searches, 1)
+	ids, err := mbox.Mailbox.SearchMessages(uid, criteria)
+	if !uid {
+		close(mbox.be.searching)
+		<-mbox.be.unblock
+	}
+	return ids, err
+}
+
+func testServerBlocking(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner, be *blockingBackend) {
+	be = &blockingBackend{
+		Backend:   memory.New(),
+		searching: make(chan struct{}),
+		unblock:   make(chan struct{}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(be)
+	s.AllowInsecureAuth = true
+
+	go s.Serve(l)
+
+	// INBOX contains messages 6, 7 and 8, 7 is marked as deleted
+	u, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	for _, flags := range [][]string{{imap.DeletedFlag}, nil} {
+		body := bytes.NewBufferString("Subject: Hi\r\n\r\nHello World\r\n")
+		if err := mbox.CreateMessage(flags, time.Now(), body); err != nil {
+			t.Fatal("CreateMessage() =", err)
+		}
+	}
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+	return
+}
+
+func TestView(t *testing.T) {
+	s, c, scanner, be := testServerBlocking(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	<-be.searching
+
+	// Update the mailbox from another session while the search is in
+	// progress
+	u, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+
+	// The client still knows about the expunged message
+	seqset, _ := imap.ParseSeqSet("8")
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != `* 3 FETCH (FLAGS (\Flagged \Recent) UID 8)` {
+		t.Fatal("Invalid FETCH response:", scanner.Text())
+	}
+
+	body := bytes.NewBufferString("Subject: Hi\r\n\r\nHello World\r\n")
+	if err := mbox.CreateMessage(nil, time.Now(), body); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != "* 4 EXISTS" {
+		t.Fatal("Invalid EXISTS response:", scanner.Text())
+	}
+
+	close(be.unblock)
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1 2 3" {
+		t.Fatal("Invalid SEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	// The expunge is sent once the command is completed
+	scanner.Scan()
+	if scanner.Text() != "* 2 EXPUNGE" {
+		t.Fatal("Invalid EXPUNGE response:", scanner.Text())
+	}
+
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.RemoveFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != `* 2 FETCH (FLAGS (\Recent) UID 8)` {
+		t.Fatal("Invalid FETCH response:", scanner.Text())
+	}
+}
+
+func TestView_searchUpdates(t *testing.T) {
+	s, c, scanner, be := testServerBlocking(t)
+	defer s.Close()
+	defer c.Close()
+
+	close(be.unblock)
+
+	io.WriteString(c, "a002 SEARCH RETURN (UPDATE) FLAGGED\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a002")` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	// Update the mailbox from another session between commands
+	u, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+
+	seqset, _ := imap.ParseSeqSet("8")
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	for _, want := range []string{
+		`* 3 FETCH (FLAGS (\Flagged \Recent) UID 8)`,
+		`* ESEARCH (TAG "a002") ADDTO (0 3)`,
+	} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	body := bytes.NewBufferString("Subject: Hi\r\n\r\nHello World\r\n")
+	if err := mbox.CreateMessage([]string{imap.FlaggedFlag}, time.Now(), body); err != nil {
+		t.Fatal("CreateMessage() =", err)
+	}
+	for _, want := range []string{
+		"* 4 EXISTS",
+		`* ESEARCH (TAG "a002") ADDTO (0 4)`,
+	} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	// Expunged messages aren't removed from the results with REMOVEFROM
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != "* 2 EXPUNGE" {
+		t.Fatal("Invalid EXPUNGE response:", scanner.Text())
+	}
+
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.RemoveFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	for _, want := range []string{
+		`* 2 FETCH (FLAGS (\Recent) UID 8)`,
+		`* ESEARCH (TAG "a002") REMOVEFROM (0 2)`,
+	} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+}
+
+func TestView_uidOnly(t *testing.T) {
+	be := &blockingBackend{Backend: memory.New()}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	defer s.Close()
+
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	io.WriteString(c, "a001 ENABLE UIDONLY\r\n")
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+
+	// Clients which have enabled UIDONLY don't need a view of the mailbox
+	if n := atomic.LoadInt32(&be.searches); n != 0 {
+		t.Fatalf("SearchMessages() called %v times", n)
+	}
+
+	u, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Login() =", err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal("GetMailbox() =", err)
+	}
+	seqset, _ := imap.ParseSeqSet("6")
+	if err := mbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("UpdateMessagesFlags() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != `* 6 UIDFETCH (FLAGS (\Seen \Deleted))` {
+		t.Fatal("Invalid UIDFETCH response:", scanner.Text())
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != "* VANISHED 6" {
+		t.Fatal("Invalid VANISHED response:", scanner.Text())
+	}
+}
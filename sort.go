@@ -0,0 +1,74 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A SortField is a message attribute messages can be sorted by. See RFC 5256
+// section 3.
+type SortField string
+
+const (
+	SortArrival SortField = "ARRIVAL"
+	SortCc      SortField = "CC"
+	SortDate    SortField = "DATE"
+	SortFrom    SortField = "FROM"
+	SortSize    SortField = "SIZE"
+	SortSubject SortField = "SUBJECT"
+	SortTo      SortField = "TO"
+)
+
+// A SortCriterion is a sort key, optionally in reverse order.
+type SortCriterion struct {
+	Field   SortField
+	Reverse bool
+}
+
+// ParseSortCriteria parses a list of sort criteria.
+func ParseSortCriteria(fields []interface{}) ([]SortCriterion, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("imap: empty sort criteria")
+	}
+
+	var criteria []SortCriterion
+	reverse := false
+	for _, f := range fields {
+		name, ok := f.(string)
+		if !ok {
+			return nil, errors.New("imap: sort criterion must be an atom")
+		}
+		name = strings.ToUpper(name)
+
+		if name == "REVERSE" {
+			reverse = true
+			continue
+		}
+
+		switch field := SortField(name); field {
+		case SortArrival, SortCc, SortDate, SortFrom, SortSize, SortSubject, SortTo:
+			criteria = append(criteria, SortCriterion{Field: field, Reverse: reverse})
+		default:
+			return nil, fmt.Errorf("imap: unsupported sort criterion %q", name)
+		}
+		reverse = false
+	}
+
+	if reverse {
+		return nil, errors.New("imap: REVERSE must be followed by a sort criterion")
+	}
+	return criteria, nil
+}
+
+// FormatSortCriteria formats a list of sort criteria.
+func FormatSortCriteria(criteria []SortCriterion) []interface{} {
+	var fields []interface{}
+	for _, c := range criteria {
+		if c.Reverse {
+			fields = append(fields, RawString("REVERSE"))
+		}
+		fields = append(fields, RawString(c.Field))
+	}
+	return fields
+}
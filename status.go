@@ -56,6 +56,29 @@ const (
 	CodeUnseen         StatusRespCode = "UNSEEN"
 )
 
+// Status response codes defined in RFC 5530 section 3.
+const (
+	CodeUnavailable          StatusRespCode = "UNAVAILABLE"
+	CodeAuthenticationFailed StatusRespCode = "AUTHENTICATIONFAILED"
+	CodeAuthorizationFailed  StatusRespCode = "AUTHORIZATIONFAILED"
+	CodeLimit                StatusRespCode = "LIMIT"
+)
+
+// Status response codes defined in RFC 8474 section 4.
+const (
+	CodeMailboxId StatusRespCode = "MAILBOXID"
+)
+
+// Status response codes defined in RFC 9586 section 3.
+const (
+	CodeUidRequired StatusRespCode = "UIDREQUIRED"
+)
+
+// Status response codes defined in RFC 9585 section 3.
+const (
+	CodeInProgress StatusRespCode = "INPROGRESS"
+)
+
 // A status response.
 // See RFC 3501 section 7.1
 type StatusResp struct {
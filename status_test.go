@@ -54,6 +54,16 @@ func TestStatusResp_WriteTo(t *testing.T) {
 			},
 			expected: "* OK [CAPABILITY IMAP4rev1] IMAP4rev1 service ready\r\n",
 		},
+		{
+			input: &imap.StatusResp{
+				Tag:       "*",
+				Type:      imap.StatusRespOk,
+				Code:      imap.CodeInProgress,
+				Arguments: (&imap.InProgress{Tag: "a001", Count: 42}).Format(),
+				Info:      "Searching",
+			},
+			expected: "* OK [INPROGRESS (\"a001\" 42 NIL)] Searching\r\n",
+		},
 	}
 
 	for i, test := range tests {
@@ -92,3 +102,22 @@ func TestStatus_Err(t *testing.T) {
 		t.Error("NO status returned incorrect error message:", err)
 	}
 }
+
+func TestParseInProgress(t *testing.T) {
+	args := []interface{}{[]interface{}{"a001", "42", "1000"}}
+	p, err := imap.ParseInProgress(args)
+	if err != nil {
+		t.Fatal("Expected no error while parsing INPROGRESS data, got:", err)
+	}
+	if p.Tag != "a001" || p.Count != 42 || p.Total != 1000 {
+		t.Errorf("Invalid INPROGRESS data: got %+v", p)
+	}
+
+	p, err = imap.ParseInProgress([]interface{}{[]interface{}{"a002", nil, nil}})
+	if err != nil {
+		t.Fatal("Expected no error while parsing INPROGRESS data, got:", err)
+	}
+	if p.Tag != "a002" || p.Count != 0 || p.Total != 0 {
+		t.Errorf("Invalid INPROGRESS data: got %+v", p)
+	}
+}
@@ -46,6 +46,17 @@ func TestWriter_WriteField_Number(t *testing.T) {
 	}
 }
 
+func TestWriter_WriteField_Number64(t *testing.T) {
+	w, b := newWriter()
+
+	if err := w.writeField(uint64(8589934592)); err != nil {
+		t.Error(err)
+	}
+	if b.String() != "8589934592" {
+		t.Error("Not the expected number")
+	}
+}
+
 func TestWriter_WriteField_Atom(t *testing.T) {
 	w, b := newWriter()
 